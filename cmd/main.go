@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"os/exec"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -14,6 +18,7 @@ import (
 
 	"diskimage-installer/cmd/options"
 	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/hardware"
 	"diskimage-installer/pkg/installer"
 	"diskimage-installer/pkg/utils"
 )
@@ -45,8 +50,7 @@ func main() {
 				node.RootDevice = map[string]string{
 					"name": options.RootDisk,
 				}
-				installer := installer.NewInstaller(node, logger)
-				return installer.InstallOS()
+				return install(cmd, &options, node, logger)
 			} else {
 				// Do image install with raid config and generate configdrive
 				data, err := ioutil.ReadFile(options.NodeConfig)
@@ -54,23 +58,27 @@ func main() {
 					logger.Sugar().Errorf("read file: %v", err)
 					return err
 				}
-				var nodes []config.Node
-				if err := yaml.Unmarshal(data, &nodes); err != nil {
+				nodeConfig, err := config.ParseNodeConfig(data)
+				if err != nil {
 					logger.Sugar().Errorf("yaml unmarshal: %v", err)
 					return err
 				}
-				node, err := findLocalNode(nodes)
+				node, err := findLocalNode(cmd.Context(), nodeConfig.Nodes, options.MatchPrecedence(), logger)
 				if err != nil {
 					logger.Sugar().Error(err)
 					return err
 				}
-				installer := installer.NewInstaller(node, logger)
-				return installer.InstallOS()
+				node = nodeConfig.Global.Merge(node)
+				return install(cmd, &options, node, logger)
 			}
 		},
 	}
 	options.Addflags(cmd.Flags())
-	if err := cmd.Execute(); err != nil {
+	cmd.AddCommand(newInventoryCommand())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := cmd.ExecuteContext(ctx); err != nil {
+		stop()
 		log.Fatal(err)
 	}
 }
@@ -108,35 +116,82 @@ var allNeedCommand []string = []string{
 	"parted",
 	"blockdev",
 	"efibootmgr",
+	"partx",
 }
 
 func CheckAllNeedCommandInstalled() error {
 	for _, command := range allNeedCommand {
-		cmd := exec.Command("command", "-v", command)
-		if err := cmd.Run(); err != nil {
+		if _, err := (utils.ExecRunner{}).LookPath(command); err != nil {
 			return fmt.Errorf("%s is required", command)
 		}
 	}
 	return nil
 }
 
-func findLocalNode(nodes []config.Node) (config.Node, error) {
-	out, err := utils.RunCommand("lshw", "-quiet", "-json")
-	if err != nil {
-		return config.Node{}, fmt.Errorf("lshw: %v", err)
+// install installs node, or prints plan of it on dry run. The step install
+// is in is logged when it is interrupted.
+func install(cmd *cobra.Command, options *options.Installer, node config.Node, logger *zap.Logger) error {
+	i := options.NewInstaller(node, logger)
+	if options.DryRun {
+		plan, err := i.Plan(cmd.Context())
+		if err != nil {
+			return err
+		}
+		plan.Print(cmd.OutOrStdout())
+		return nil
 	}
-	data := map[string]interface{}{}
-	if err := json.Unmarshal([]byte(out), &data); err != nil {
-		return config.Node{}, fmt.Errorf("json.Unmarshal: %v", err)
+	err := i.InstallOS(cmd.Context())
+	var stepErr *installer.StepError
+	if errors.As(err, &stepErr) && stepErr.Interrupted {
+		logger.Sugar().Errorf("install interrupted at step %s: %v", stepErr.Step, stepErr.Err)
 	}
-	serial, ok := data["serial"]
-	if !ok {
-		return config.Node{}, fmt.Errorf("could not find serial from localhost")
+	return err
+}
+
+func findLocalNode(ctx context.Context, nodes []config.Node, precedence []config.MatchKey, logger *zap.Logger) (config.Node, error) {
+	identity, err := hardware.NewHardWareManager(logger).GetIdentity(ctx, precedence)
+	if err != nil {
+		return config.Node{}, err
 	}
-	for _, node := range nodes {
-		if node.SerialNumber == serial.(string) {
-			return node, nil
-		}
+	logger.Sugar().Infof("localhost is identified by %+v", identity)
+	return config.MatchNode(nodes, identity, precedence)
+}
+
+func newInventoryCommand() *cobra.Command {
+	options := options.Inventory{}
+	cmd := &cobra.Command{
+		Use:   "inventory",
+		Short: "Print hardware inventory of host",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			zapconfig := zap.NewProductionConfig()
+			zapconfig.Level = zap.NewAtomicLevelAt(convertToZapLevel(options.LogLevel))
+			logger, err := zapconfig.Build()
+			if err != nil {
+				return err
+			}
+			defer logger.Sync()
+
+			inventory, err := hardware.NewHardWareManager(logger).GetInventory(cmd.Context())
+			if err != nil {
+				return err
+			}
+			var data []byte
+			if options.Output == "yaml" {
+				data, err = yaml.Marshal(inventory)
+			} else {
+				data, err = json.MarshalIndent(inventory, "", "  ")
+				data = append(data, '\n')
+			}
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(data)
+			return err
+		},
 	}
-	return config.Node{}, fmt.Errorf("could not find node with match serial number with localhost from config")
+	options.Addflags(cmd.Flags())
+	return cmd
 }
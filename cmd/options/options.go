@@ -2,8 +2,13 @@ package options
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/installer"
 )
 
 type Installer struct {
@@ -11,18 +16,110 @@ type Installer struct {
 	NodeConfig string
 	Image      string
 	RootDisk   string
+	MatchBy    []string
+	// PowerAction overrides power action of nodeconfig when it is set.
+	PowerAction string
+	PowerDelay  int
+	StateFile   string
+	Steps       []string
+	SkipSteps   []string
+	// DryRun prints what install would do instead of doing it.
+	DryRun bool
+
+	// fs tells which flags are given on command line.
+	fs *pflag.FlagSet
 }
 
 func (i *Installer) Addflags(fs *pflag.FlagSet) {
+	i.fs = fs
 	fs.StringVar(&i.LogLevel, "log-level", "info", "available level: debug, info, warn, error, dpanic, panic, fatal")
 	fs.StringVar(&i.NodeConfig, "nodeconfig", "", "path of nodeconfig")
 	fs.StringVar(&i.Image, "image", "", "image file to write to disk")
 	fs.StringVar(&i.RootDisk, "root-disk", "/dev/sda", "root disk to written image")
+	fs.StringSliceVar(&i.MatchBy, "match-by", matchKeyNames(config.DefaultMatchPrecedence),
+		"identifiers to find node of localhost in nodeconfig by, in order of precedence")
+	fs.StringVar(&i.PowerAction, "power-action", "", "action once image is installed: none, reboot, poweroff or kexec, overrides nodeconfig")
+	fs.IntVar(&i.PowerDelay, "power-delay", 0, "seconds to wait before power action, overrides nodeconfig")
+	fs.StringVar(&i.StateFile, "state-file", installer.DefaultStateFile, "file to keep progress of install in, a failed install resumes from the failed step, empty disables resume")
+	fs.StringSliceVar(&i.Steps, "steps", nil, fmt.Sprintf("only run these steps, even if they are completed already, steps are %s", strings.Join(installer.Steps, ",")))
+	fs.StringSliceVar(&i.SkipSteps, "skip-steps", nil, "steps not to run")
+	fs.BoolVar(&i.DryRun, "dry-run", false, "print the plan of install, including disk to wipe, partitions to create and commands to run, without changing anything")
+}
+
+// MatchPrecedence returns match keys of MatchBy, which is validated already.
+func (i *Installer) MatchPrecedence() []config.MatchKey {
+	keys, _ := config.ParseMatchKeys(i.MatchBy)
+	return keys
+}
+
+// NewInstaller returns installer of node with power action, state file and
+// steps of flags.
+func (i *Installer) NewInstaller(node config.Node, logger *zap.Logger) *installer.ImgaeInstaller {
+	i.ApplyPowerAction(&node)
+	imageInstaller := installer.NewInstaller(node, logger)
+	imageInstaller.SetStateFile(i.StateFile)
+	imageInstaller.SetSteps(i.Steps, i.SkipSteps)
+	return imageInstaller
+}
+
+// ApplyPowerAction sets power action and delay of node from flags, each is
+// left as is in node unless its flag is given.
+func (i *Installer) ApplyPowerAction(node *config.Node) {
+	delaySet := i.fs != nil && i.fs.Changed("power-delay")
+	if i.PowerAction == "" && !delaySet {
+		return
+	}
+	if node.PowerAction == nil {
+		node.PowerAction = &config.PowerActionInfo{}
+	}
+	if i.PowerAction != "" {
+		node.PowerAction.Action = i.PowerAction
+	}
+	if delaySet {
+		node.PowerAction.Delay = i.PowerDelay
+	}
+}
+
+func matchKeyNames(keys []config.MatchKey) []string {
+	names := []string{}
+	for _, k := range keys {
+		names = append(names, string(k))
+	}
+	return names
 }
 
 func (i *Installer) Validate() error {
 	if i.Image == "" && i.NodeConfig == "" {
 		return fmt.Errorf("neither image or nodeconfig are not specified")
 	}
+	if _, err := config.ParseMatchKeys(i.MatchBy); err != nil {
+		return err
+	}
+	if err := installer.ValidateStepNames(i.Steps); err != nil {
+		return fmt.Errorf("--steps: %v", err)
+	}
+	if err := installer.ValidateStepNames(i.SkipSteps); err != nil {
+		return fmt.Errorf("--skip-steps: %v", err)
+	}
+	if err := (config.PowerActionInfo{Action: i.PowerAction, Delay: i.PowerDelay}).Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
+type Inventory struct {
+	LogLevel string
+	Output   string
+}
+
+func (i *Inventory) Addflags(fs *pflag.FlagSet) {
+	fs.StringVar(&i.LogLevel, "log-level", "warn", "available level: debug, info, warn, error, dpanic, panic, fatal")
+	fs.StringVarP(&i.Output, "output", "o", "json", "output format: json or yaml")
+}
+
+func (i *Inventory) Validate() error {
+	if i.Output != "json" && i.Output != "yaml" {
+		return fmt.Errorf("unknown output format %q", i.Output)
+	}
 	return nil
 }
@@ -0,0 +1,60 @@
+package options
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+
+	"diskimage-installer/pkg/config"
+)
+
+func TestApplyPowerAction(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		node *config.PowerActionInfo
+		want *config.PowerActionInfo
+	}{
+		{
+			name: "no flags",
+			node: &config.PowerActionInfo{Action: config.PowerActionReboot, Delay: 30},
+			want: &config.PowerActionInfo{Action: config.PowerActionReboot, Delay: 30},
+		},
+		{
+			name: "action keeps delay of nodeconfig",
+			args: []string{"--power-action=poweroff"},
+			node: &config.PowerActionInfo{Action: config.PowerActionReboot, Delay: 30, BootNext: true},
+			want: &config.PowerActionInfo{Action: config.PowerActionPowerOff, Delay: 30, BootNext: true},
+		},
+		{
+			name: "delay alone",
+			args: []string{"--power-delay=10"},
+			node: &config.PowerActionInfo{Action: config.PowerActionReboot, Delay: 30},
+			want: &config.PowerActionInfo{Action: config.PowerActionReboot, Delay: 10},
+		},
+		{
+			name: "delay of zero",
+			args: []string{"--power-delay=0"},
+			node: &config.PowerActionInfo{Action: config.PowerActionReboot, Delay: 30},
+			want: &config.PowerActionInfo{Action: config.PowerActionReboot, Delay: 0},
+		},
+		{
+			name: "no power action in nodeconfig",
+			args: []string{"--power-action=reboot", "--power-delay=5"},
+			want: &config.PowerActionInfo{Action: config.PowerActionReboot, Delay: 5},
+		},
+	}
+	for _, tt := range tests {
+		i := &Installer{}
+		fs := pflag.NewFlagSet("install", pflag.ContinueOnError)
+		i.Addflags(fs)
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		node := config.Node{PowerAction: tt.node}
+		i.ApplyPowerAction(&node)
+		if node.PowerAction == nil || *node.PowerAction != *tt.want {
+			t.Errorf("%s: power action = %+v, want %+v", tt.name, node.PowerAction, tt.want)
+		}
+	}
+}
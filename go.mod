@@ -3,8 +3,8 @@ module diskimage-installer
 go 1.16
 
 require (
-	github.com/google/uuid v1.2.0 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/google/uuid v1.2.0
+	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.1.3
 	github.com/spf13/pflag v1.0.5
 	go.uber.org/zap v1.16.0
@@ -0,0 +1,241 @@
+// Package bmc configures the local BMC in-band, so that a node is reachable
+// out-of-band once it is provisioned.
+package bmc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	IPSourceStatic = "static"
+	IPSourceDHCP   = "dhcp"
+
+	PrivilegeAdministrator = 4
+)
+
+// LANConfig is the network of a LAN channel.
+type LANConfig struct {
+	IPSource  string
+	IPAddress string
+	Netmask   string
+	Gateway   string
+	// CipherSuites are ids of RMCP+ cipher suites BMC supports.
+	CipherSuites []int
+	// CipherSuitePrivileges is the maximum privilege of every cipher suite
+	// by id, in the form of ipmitool, e.g. XaaaXXaaaXaaaXX.
+	CipherSuitePrivileges string
+}
+
+type User struct {
+	ID      int
+	Name    string
+	Enabled bool
+	// Privilege is the privilege limit of user on channel, 4 is
+	// administrator.
+	Privilege int
+}
+
+// BMC is the local BMC, every method operates on a LAN channel.
+type BMC interface {
+	GetLAN(ctx context.Context, channel int) (LANConfig, error)
+	// SetLAN sets static address of channel.
+	SetLAN(ctx context.Context, channel int, ipaddr, netmask, gateway string) error
+	// SetCipherSuitePrivileges sets maximum privileges of cipher suites, in
+	// the form of LANConfig.CipherSuitePrivileges.
+	SetCipherSuitePrivileges(ctx context.Context, channel int, privileges string) error
+	ListUsers(ctx context.Context, channel int) ([]User, error)
+	// SetUser sets name and password of user id, enables it and grants it
+	// privilege on channel.
+	SetUser(ctx context.Context, channel int, id int, name, password string, privilege int) error
+	// TestPassword reports whether password is the password of user id.
+	TestPassword(ctx context.Context, id int, password string) (bool, error)
+}
+
+// Config is what BMC is configured to.
+type Config struct {
+	Channel   int
+	IPAddress string
+	Netmask   string
+	Gateway   string
+	// UserID is the user slot used when no user is named Username.
+	UserID   int
+	Username string
+	Password string
+	// CipherSuite is granted administrator privilege, it is left as is when
+	// it is 0.
+	CipherSuite int
+}
+
+// Configure applies config to b and verifies it by reading it back, only
+// what differs from config is changed.
+func Configure(ctx context.Context, b BMC, config Config, logger *zap.Logger) error {
+	lan, err := b.GetLAN(ctx, config.Channel)
+	if err != nil {
+		return fmt.Errorf("get lan of channel %d: %v", config.Channel, err)
+	}
+	if !lanMatches(lan, config) {
+		logger.Sugar().Infof("set bmc address to %s/%s via %s", config.IPAddress, config.Netmask, config.Gateway)
+		if err := b.SetLAN(ctx, config.Channel, config.IPAddress, config.Netmask, config.Gateway); err != nil {
+			return fmt.Errorf("set lan of channel %d: %v", config.Channel, err)
+		}
+	}
+	if config.CipherSuite != 0 {
+		privileges, changed, err := grantCipherSuite(lan, config.CipherSuite)
+		if err != nil {
+			return err
+		}
+		if changed {
+			logger.Sugar().Infof("grant administrator to cipher suite %d", config.CipherSuite)
+			if err := b.SetCipherSuitePrivileges(ctx, config.Channel, privileges); err != nil {
+				return fmt.Errorf("set cipher suite privileges: %v", err)
+			}
+		}
+	}
+
+	if err := configureUser(ctx, b, config, logger); err != nil {
+		return err
+	}
+	return verify(ctx, b, config)
+}
+
+func configureUser(ctx context.Context, b BMC, config Config, logger *zap.Logger) error {
+	user, ok, err := findUser(ctx, b, config)
+	if err != nil || ok {
+		return err
+	}
+	logger.Sugar().Infof("set bmc user %d to %s", user.ID, config.Username)
+	if err := b.SetUser(ctx, config.Channel, user.ID, config.Username, config.Password, PrivilegeAdministrator); err != nil {
+		return fmt.Errorf("set user %d: %v", user.ID, err)
+	}
+	return nil
+}
+
+// findUser returns the user named Username of config, or the user slot of
+// config when there is none, and whether it is configured already.
+func findUser(ctx context.Context, b BMC, config Config) (User, bool, error) {
+	users, err := b.ListUsers(ctx, config.Channel)
+	if err != nil {
+		return User{}, false, fmt.Errorf("list users of channel %d: %v", config.Channel, err)
+	}
+	user := User{ID: config.UserID}
+	for _, u := range users {
+		if u.Name == config.Username {
+			user = u
+			break
+		}
+	}
+	if user.Name == config.Username && user.Enabled && user.Privilege == PrivilegeAdministrator {
+		ok, err := b.TestPassword(ctx, user.ID, config.Password)
+		if err != nil {
+			return User{}, false, fmt.Errorf("test password of user %d: %v", user.ID, err)
+		}
+		if ok {
+			return user, true, nil
+		}
+	}
+	return user, false, nil
+}
+
+// Plan returns what Configure would change on b, nothing is changed.
+func Plan(ctx context.Context, b BMC, config Config) ([]string, error) {
+	changes := []string{}
+	lan, err := b.GetLAN(ctx, config.Channel)
+	if err != nil {
+		return nil, fmt.Errorf("get lan of channel %d: %v", config.Channel, err)
+	}
+	if !lanMatches(lan, config) {
+		changes = append(changes, fmt.Sprintf("set lan of channel %d from %s %s/%s to static %s/%s via %s",
+			config.Channel, lan.IPSource, lan.IPAddress, lan.Netmask, config.IPAddress, config.Netmask, config.Gateway))
+	}
+	if config.CipherSuite != 0 {
+		privileges, changed, err := grantCipherSuite(lan, config.CipherSuite)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			changes = append(changes, fmt.Sprintf("set cipher suite privileges from %s to %s", lan.CipherSuitePrivileges, privileges))
+		}
+	}
+	user, ok, err := findUser(ctx, b, config)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		changes = append(changes, fmt.Sprintf("set user %d from %q to %q with password and administrator privilege", user.ID, user.Name, config.Username))
+	}
+	return changes, nil
+}
+
+// verify reads BMC back and reports what doesn't match config.
+func verify(ctx context.Context, b BMC, config Config) error {
+	problems := []string{}
+	lan, err := b.GetLAN(ctx, config.Channel)
+	if err != nil {
+		return fmt.Errorf("get lan of channel %d: %v", config.Channel, err)
+	}
+	if !lanMatches(lan, config) {
+		problems = append(problems, fmt.Sprintf("lan is %s %s/%s via %s", lan.IPSource, lan.IPAddress, lan.Netmask, lan.Gateway))
+	}
+	if config.CipherSuite != 0 {
+		if _, changed, err := grantCipherSuite(lan, config.CipherSuite); err != nil || changed {
+			problems = append(problems, fmt.Sprintf("cipher suite %d has no administrator privilege", config.CipherSuite))
+		}
+	}
+	users, err := b.ListUsers(ctx, config.Channel)
+	if err != nil {
+		return fmt.Errorf("list users of channel %d: %v", config.Channel, err)
+	}
+	found := false
+	for _, u := range users {
+		if u.Name != config.Username {
+			continue
+		}
+		found = true
+		if !u.Enabled || u.Privilege != PrivilegeAdministrator {
+			problems = append(problems, fmt.Sprintf("user %s is not an enabled administrator", u.Name))
+		}
+		if ok, err := b.TestPassword(ctx, u.ID, config.Password); err != nil || !ok {
+			problems = append(problems, fmt.Sprintf("password of user %s doesn't match", u.Name))
+		}
+	}
+	if !found {
+		problems = append(problems, fmt.Sprintf("user %s doesn't exist", config.Username))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("bmc doesn't match config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func lanMatches(lan LANConfig, config Config) bool {
+	return lan.IPSource == IPSourceStatic && lan.IPAddress == config.IPAddress &&
+		lan.Netmask == config.Netmask && (config.Gateway == "" || lan.Gateway == config.Gateway)
+}
+
+// grantCipherSuite returns cipher suite privileges of lan with id granted
+// administrator, and whether they differ from lan.
+func grantCipherSuite(lan LANConfig, id int) (string, bool, error) {
+	supported := false
+	for _, c := range lan.CipherSuites {
+		if c == id {
+			supported = true
+		}
+	}
+	if !supported {
+		return "", false, fmt.Errorf("bmc doesn't support cipher suite %d, supported cipher suites are %v", id, lan.CipherSuites)
+	}
+	// privileges of suites beyond the list can't be set, they follow BMC
+	if id >= len(lan.CipherSuitePrivileges) {
+		return lan.CipherSuitePrivileges, false, nil
+	}
+	privileges := []byte(lan.CipherSuitePrivileges)
+	if privileges[id] == 'a' {
+		return lan.CipherSuitePrivileges, false, nil
+	}
+	privileges[id] = 'a'
+	return string(privileges), true, nil
+}
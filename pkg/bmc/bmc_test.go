@@ -0,0 +1,230 @@
+package bmc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const testPassword = "s3cr3t-Passw0rd"
+
+func testConfig() Config {
+	return Config{
+		Channel:     1,
+		IPAddress:   "10.0.0.20",
+		Netmask:     "255.255.255.0",
+		Gateway:     "10.0.0.1",
+		UserID:      3,
+		Username:    "deploy",
+		Password:    testPassword,
+		CipherSuite: 3,
+	}
+}
+
+// newFakeWithoutSuite3 returns a fake BMC whose cipher suite 3 has no
+// administrator privilege.
+func newFakeWithoutSuite3() *Fake {
+	f := NewFake()
+	lan := f.LAN[1]
+	lan.CipherSuitePrivileges = "XaaXXXXXXXXXXXX"
+	f.LAN[1] = lan
+	return f
+}
+
+func TestConfigure(t *testing.T) {
+	f := newFakeWithoutSuite3()
+	if err := Configure(context.Background(), f, testConfig(), zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	wantCalls := []string{"SetLAN", "SetCipherSuitePrivileges", "SetUser"}
+	if !reflect.DeepEqual(f.Calls, wantCalls) {
+		t.Errorf("calls = %v, want %v", f.Calls, wantCalls)
+	}
+	wantLAN := LANConfig{
+		IPSource:              IPSourceStatic,
+		IPAddress:             "10.0.0.20",
+		Netmask:               "255.255.255.0",
+		Gateway:               "10.0.0.1",
+		CipherSuites:          []int{0, 1, 2, 3, 17},
+		CipherSuitePrivileges: "XaaaXXXXXXXXXXX",
+	}
+	if !reflect.DeepEqual(f.LAN[1], wantLAN) {
+		t.Errorf("lan = %+v, want %+v", f.LAN[1], wantLAN)
+	}
+	wantUser := User{ID: 3, Name: "deploy", Enabled: true, Privilege: PrivilegeAdministrator}
+	if f.Users[3] != wantUser || f.Passwords[3] != testPassword {
+		t.Errorf("user 3 = %+v, want %+v", f.Users[3], wantUser)
+	}
+	if f.Users[2].Name != "ADMIN" {
+		t.Errorf("user 2 is changed to %+v", f.Users[2])
+	}
+
+	// configured bmc is left alone
+	f.Calls = nil
+	if err := Configure(context.Background(), f, testConfig(), zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Calls) != 0 {
+		t.Errorf("calls = %v, want none", f.Calls)
+	}
+}
+
+func TestConfigureExistingUser(t *testing.T) {
+	f := NewFake()
+	config := testConfig()
+	config.Username = "ADMIN"
+	if err := Configure(context.Background(), f, config, zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	// ADMIN is updated in place rather than taking slot 3
+	if _, ok := f.Users[3]; ok {
+		t.Errorf("user 3 is created: %+v", f.Users[3])
+	}
+	if f.Passwords[2] != testPassword {
+		t.Errorf("password of ADMIN is not changed")
+	}
+	// cipher suite 3 has administrator already
+	wantCalls := []string{"SetLAN", "SetUser"}
+	if !reflect.DeepEqual(f.Calls, wantCalls) {
+		t.Errorf("calls = %v, want %v", f.Calls, wantCalls)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	f := newFakeWithoutSuite3()
+	changes, err := Plan(context.Background(), f, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"set lan of channel 1 from dhcp / to static 10.0.0.20/255.255.255.0 via 10.0.0.1",
+		"set cipher suite privileges from XaaXXXXXXXXXXXX to XaaaXXXXXXXXXXX",
+		`set user 3 from "" to "deploy" with password and administrator privilege`,
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("changes = %q, want %q", changes, want)
+	}
+	if len(f.Calls) != 0 {
+		t.Errorf("Plan changed bmc: %v", f.Calls)
+	}
+	for _, c := range changes {
+		if strings.Contains(c, testPassword) {
+			t.Errorf("change %q has password", c)
+		}
+	}
+
+	if err := Configure(context.Background(), f, testConfig(), zap.NewNop()); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := Plan(context.Background(), f, testConfig()); err != nil || len(changes) != 0 {
+		t.Errorf("changes of configured bmc = %q, %v, want none", changes, err)
+	}
+}
+
+// brokenBMC drops what it is told to set, or fails to set users.
+type brokenBMC struct {
+	*Fake
+	err error
+}
+
+func (b brokenBMC) SetLAN(ctx context.Context, channel int, ipaddr, netmask, gateway string) error {
+	return nil
+}
+
+func (b brokenBMC) SetUser(ctx context.Context, channel int, id int, name, password string, privilege int) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.Fake.SetUser(ctx, channel, id, name, "", privilege)
+}
+
+func TestVerify(t *testing.T) {
+	f := NewFake()
+	err := Configure(context.Background(), brokenBMC{Fake: f}, testConfig(), zap.NewNop())
+	if err == nil {
+		t.Fatal("Configure of broken bmc succeeds")
+	}
+	for _, want := range []string{"lan is dhcp", "password of user deploy doesn't match"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), testPassword) {
+		t.Errorf("err has password: %v", err)
+	}
+
+	f = NewFake()
+	f.Users[3] = User{ID: 3, Name: "deploy", Enabled: false, Privilege: 2}
+	f.LAN[1] = LANConfig{IPSource: IPSourceStatic, IPAddress: "10.0.0.20", Netmask: "255.255.255.0", Gateway: "10.0.0.1", CipherSuites: []int{3, 17}, CipherSuitePrivileges: "XXXXXXXXXXXXXXX"}
+	err = verify(context.Background(), f, testConfig())
+	for _, want := range []string{"cipher suite 3 has no administrator privilege", "user deploy is not an enabled administrator", "password of user deploy doesn't match"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("err = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestConfigureErrorHasNoPassword(t *testing.T) {
+	f := NewFake()
+	err := Configure(context.Background(), brokenBMC{Fake: f, err: errors.New("insufficient privilege")}, testConfig(), zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "insufficient privilege") {
+		t.Fatalf("err = %v, want insufficient privilege", err)
+	}
+	if strings.Contains(err.Error(), testPassword) {
+		t.Errorf("err has password: %v", err)
+	}
+}
+
+func TestGrantCipherSuite(t *testing.T) {
+	tests := []struct {
+		name        string
+		lan         LANConfig
+		id          int
+		want        string
+		wantChanged bool
+		wantErr     bool
+	}{
+		{
+			name:        "granted",
+			lan:         LANConfig{CipherSuites: []int{0, 1, 2, 3, 17}, CipherSuitePrivileges: "XaaaXXXXXXXXXXX"},
+			id:          1,
+			want:        "XaaaXXXXXXXXXXX",
+			wantChanged: false,
+		},
+		{
+			name:        "grant",
+			lan:         LANConfig{CipherSuites: []int{0, 1, 2, 3, 8}, CipherSuitePrivileges: "XaaaXXXXuXXXXXX"},
+			id:          8,
+			want:        "XaaaXXXXaXXXXXX",
+			wantChanged: true,
+		},
+		{
+			name: "beyond privileges",
+			lan:  LANConfig{CipherSuites: []int{3, 17}, CipherSuitePrivileges: "XXXaXXXXXXXXXXX"},
+			id:   17,
+			want: "XXXaXXXXXXXXXXX",
+		},
+		{
+			name:    "unsupported",
+			lan:     LANConfig{CipherSuites: []int{0, 1, 2, 3}, CipherSuitePrivileges: "XaaaXXXXXXXXXXX"},
+			id:      17,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, changed, err := grantCipherSuite(tt.lan, tt.id)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got %q, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || changed != tt.wantChanged {
+			t.Errorf("%s: got %q, %v, %v, want %q, %v", tt.name, got, changed, err, tt.want, tt.wantChanged)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package bmc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Fake is an in-memory BMC, it stands in for the local BMC on hosts without
+// one and in tests.
+type Fake struct {
+	LAN       map[int]LANConfig
+	Users     map[int]User
+	Passwords map[int]string
+	// Calls records names of methods which changed BMC, in order.
+	Calls []string
+}
+
+// NewFake returns a BMC whose channel 1 gets address by DHCP and supports
+// cipher suites 3 and 17, with user 2 named ADMIN.
+func NewFake() *Fake {
+	return &Fake{
+		LAN: map[int]LANConfig{
+			1: {
+				IPSource:              IPSourceDHCP,
+				CipherSuites:          []int{0, 1, 2, 3, 17},
+				CipherSuitePrivileges: "XaaaXXXXXXXXXXX",
+			},
+		},
+		Users: map[int]User{
+			1: {ID: 1},
+			2: {ID: 2, Name: "ADMIN", Enabled: true, Privilege: PrivilegeAdministrator},
+		},
+		Passwords: map[int]string{2: "ADMIN"},
+	}
+}
+
+func (f *Fake) GetLAN(ctx context.Context, channel int) (LANConfig, error) {
+	lan, ok := f.LAN[channel]
+	if !ok {
+		return LANConfig{}, fmt.Errorf("invalid channel %d", channel)
+	}
+	return lan, nil
+}
+
+func (f *Fake) SetLAN(ctx context.Context, channel int, ipaddr, netmask, gateway string) error {
+	lan, err := f.GetLAN(ctx, channel)
+	if err != nil {
+		return err
+	}
+	f.Calls = append(f.Calls, "SetLAN")
+	lan.IPSource, lan.IPAddress, lan.Netmask = IPSourceStatic, ipaddr, netmask
+	if gateway != "" {
+		lan.Gateway = gateway
+	}
+	f.LAN[channel] = lan
+	return nil
+}
+
+func (f *Fake) SetCipherSuitePrivileges(ctx context.Context, channel int, privileges string) error {
+	lan, err := f.GetLAN(ctx, channel)
+	if err != nil {
+		return err
+	}
+	f.Calls = append(f.Calls, "SetCipherSuitePrivileges")
+	lan.CipherSuitePrivileges = privileges
+	f.LAN[channel] = lan
+	return nil
+}
+
+func (f *Fake) ListUsers(ctx context.Context, channel int) ([]User, error) {
+	if _, err := f.GetLAN(ctx, channel); err != nil {
+		return nil, err
+	}
+	users := []User{}
+	for _, u := range f.Users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (f *Fake) SetUser(ctx context.Context, channel int, id int, name, password string, privilege int) error {
+	if _, err := f.GetLAN(ctx, channel); err != nil {
+		return err
+	}
+	f.Calls = append(f.Calls, "SetUser")
+	f.Users[id] = User{ID: id, Name: name, Enabled: true, Privilege: privilege}
+	f.Passwords[id] = password
+	return nil
+}
+
+func (f *Fake) TestPassword(ctx context.Context, id int, password string) (bool, error) {
+	if _, ok := f.Users[id]; !ok {
+		return false, fmt.Errorf("invalid user id %d", id)
+	}
+	return f.Passwords[id] == password, nil
+}
@@ -0,0 +1,182 @@
+package bmc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"diskimage-installer/pkg/utils"
+)
+
+// IPMITool is BMC of host accessed by ipmitool through /dev/ipmi0.
+type IPMITool struct {
+	runner utils.Runner
+}
+
+func NewIPMITool(runner utils.Runner) *IPMITool {
+	return &IPMITool{runner: runner}
+}
+
+func (t *IPMITool) ipmitool(ctx context.Context, args ...string) (string, error) {
+	out, err := t.runner.Run(ctx, "ipmitool", args...)
+	if err != nil {
+		return out, fmt.Errorf("ipmitool %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(out))
+	}
+	return out, nil
+}
+
+func (t *IPMITool) GetLAN(ctx context.Context, channel int) (LANConfig, error) {
+	out, err := t.ipmitool(ctx, "lan", "print", strconv.Itoa(channel))
+	if err != nil {
+		return LANConfig{}, err
+	}
+	return parseLANPrint(out), nil
+}
+
+func parseLANPrint(out string) LANConfig {
+	lan := LANConfig{}
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "IP Address Source":
+			switch {
+			case strings.HasPrefix(value, "Static"):
+				lan.IPSource = IPSourceStatic
+			case strings.HasPrefix(value, "DHCP"):
+				lan.IPSource = IPSourceDHCP
+			default:
+				lan.IPSource = value
+			}
+		case "IP Address":
+			lan.IPAddress = value
+		case "Subnet Mask":
+			lan.Netmask = value
+		case "Default Gateway IP":
+			lan.Gateway = value
+		case "RMCP+ Cipher Suites":
+			for _, c := range strings.Split(value, ",") {
+				if id, err := strconv.Atoi(strings.TrimSpace(c)); err == nil {
+					lan.CipherSuites = append(lan.CipherSuites, id)
+				}
+			}
+		case "Cipher Suite Priv Max":
+			lan.CipherSuitePrivileges = value
+		}
+	}
+	return lan
+}
+
+func (t *IPMITool) SetLAN(ctx context.Context, channel int, ipaddr, netmask, gateway string) error {
+	ch := strconv.Itoa(channel)
+	commands := [][]string{
+		{"lan", "set", ch, "ipsrc", "static"},
+		{"lan", "set", ch, "ipaddr", ipaddr},
+		{"lan", "set", ch, "netmask", netmask},
+	}
+	if gateway != "" {
+		commands = append(commands, []string{"lan", "set", ch, "defgw", "ipaddr", gateway})
+	}
+	for _, args := range commands {
+		if _, err := t.ipmitool(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *IPMITool) SetCipherSuitePrivileges(ctx context.Context, channel int, privileges string) error {
+	_, err := t.ipmitool(ctx, "lan", "set", strconv.Itoa(channel), "cipher_privs", privileges)
+	return err
+}
+
+func (t *IPMITool) ListUsers(ctx context.Context, channel int) ([]User, error) {
+	out, err := t.ipmitool(ctx, "user", "list", strconv.Itoa(channel))
+	if err != nil {
+		return nil, err
+	}
+	return parseUserList(out), nil
+}
+
+// parseUserList parses output of ipmitool user list, whose columns are
+// ID, Name, Callin, Link Auth, IPMI Msg and Channel Priv Limit. Name is 17
+// characters wide and may be empty.
+func parseUserList(out string) []User {
+	users := []User{}
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 21 {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(line[:4]))
+		if err != nil {
+			continue
+		}
+		user := User{
+			ID:   id,
+			Name: strings.TrimSpace(line[4:21]),
+		}
+		fields := strings.Fields(line[21:])
+		// IPMI Msg tells whether user is enabled on channel
+		if len(fields) >= 4 {
+			user.Enabled = fields[2] == "true"
+			switch strings.Join(fields[3:], " ") {
+			case "CALLBACK":
+				user.Privilege = 1
+			case "USER":
+				user.Privilege = 2
+			case "OPERATOR":
+				user.Privilege = 3
+			case "ADMINISTRATOR":
+				user.Privilege = 4
+			case "OEM":
+				user.Privilege = 5
+			}
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+func (t *IPMITool) SetUser(ctx context.Context, channel int, id int, name, password string, privilege int) error {
+	ch, uid := strconv.Itoa(channel), strconv.Itoa(id)
+	size := "16"
+	if len(password) > 16 {
+		size = "20"
+	}
+	if _, err := t.ipmitool(ctx, "user", "set", "name", uid, name); err != nil {
+		return err
+	}
+	// password is kept out of error
+	if out, err := t.runner.Run(ctx, "ipmitool", "user", "set", "password", uid, password, size); err != nil {
+		return fmt.Errorf("ipmitool user set password %s: %v: %s", uid, err, strings.TrimSpace(out))
+	}
+	commands := [][]string{
+		{"channel", "setaccess", ch, uid, "callin=on", "ipmi=on", "link=on", "privilege=" + strconv.Itoa(privilege)},
+		{"user", "enable", uid},
+	}
+	for _, args := range commands {
+		if _, err := t.ipmitool(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *IPMITool) TestPassword(ctx context.Context, id int, password string) (bool, error) {
+	size := "16"
+	if len(password) > 16 {
+		size = "20"
+	}
+	out, err := t.runner.Run(ctx, "ipmitool", "user", "test", strconv.Itoa(id), size, password)
+	if strings.Contains(out, "Success") {
+		return true, nil
+	}
+	if strings.Contains(out, "Failure") {
+		return false, nil
+	}
+	return false, fmt.Errorf("ipmitool user test %d: %v: %s", id, err, strings.TrimSpace(out))
+}
@@ -0,0 +1,100 @@
+package bmc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/utils"
+)
+
+func TestParseLANPrint(t *testing.T) {
+	out := `Set in Progress         : Set Complete
+IP Address Source       : Static Address
+IP Address              : 10.0.0.20
+Subnet Mask             : 255.255.255.0
+MAC Address             : aa:00:00:00:00:10
+Default Gateway IP      : 10.0.0.1
+RMCP+ Cipher Suites     : 0,1,2,3,17
+Cipher Suite Priv Max   : XaaaXXXXXXXXXXX
+`
+	want := LANConfig{
+		IPSource:              IPSourceStatic,
+		IPAddress:             "10.0.0.20",
+		Netmask:               "255.255.255.0",
+		Gateway:               "10.0.0.1",
+		CipherSuites:          []int{0, 1, 2, 3, 17},
+		CipherSuitePrivileges: "XaaaXXXXXXXXXXX",
+	}
+	if got := parseLANPrint(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLANPrint = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseUserList(t *testing.T) {
+	out := `ID  Name	     Callin  Link Auth	IPMI Msg   Channel Priv Limit
+1                    true    false      false      NO ACCESS
+2   ADMIN            true    false      true       ADMINISTRATOR
+3   deploy           true    true       true       OPERATOR
+`
+	want := []User{
+		{ID: 1},
+		{ID: 2, Name: "ADMIN", Enabled: true, Privilege: PrivilegeAdministrator},
+		{ID: 3, Name: "deploy", Enabled: true, Privilege: 3},
+	}
+	if got := parseUserList(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseUserList = %+v, want %+v", got, want)
+	}
+}
+
+func TestIPMIToolSetUser(t *testing.T) {
+	runner := utils.NewFakeRunner()
+	if err := NewIPMITool(runner).SetUser(context.Background(), 1, 3, "deploy", testPassword, PrivilegeAdministrator); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ipmitool user set name 3 deploy",
+		"ipmitool user set password 3 " + testPassword + " 16",
+		"ipmitool channel setaccess 1 3 callin=on ipmi=on link=on privilege=4",
+		"ipmitool user enable 3",
+	}
+	if calls := runner.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestIPMIToolErrorHasNoPassword(t *testing.T) {
+	failure := errors.New("exit status 1")
+	runner := utils.NewFakeRunner().
+		On("ipmitool user set password", "Set User Password command failed (user 3)\n", failure).
+		On("ipmitool user test", "Unable to establish IPMI v2 / RMCP+ session\n", failure)
+	tool := NewIPMITool(runner)
+
+	err := tool.SetUser(context.Background(), 1, 3, "deploy", testPassword, PrivilegeAdministrator)
+	if err == nil || !strings.Contains(err.Error(), "Set User Password command failed") {
+		t.Errorf("SetUser err = %v, want command failed", err)
+	}
+	if err != nil && strings.Contains(err.Error(), testPassword) {
+		t.Errorf("SetUser err has password: %v", err)
+	}
+
+	_, err = tool.TestPassword(context.Background(), 3, testPassword)
+	if err == nil {
+		t.Errorf("TestPassword succeeds")
+	}
+	if err != nil && strings.Contains(err.Error(), testPassword) {
+		t.Errorf("TestPassword err has password: %v", err)
+	}
+
+	err = Configure(context.Background(), tool, testConfig(), zap.NewNop())
+	if err == nil {
+		t.Errorf("Configure succeeds")
+	}
+	if err != nil && strings.Contains(err.Error(), testPassword) {
+		t.Errorf("Configure err has password: %v", err)
+	}
+}
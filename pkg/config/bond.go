@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	BondModeBalanceRR    = "balance-rr"
+	BondModeActiveBackup = "active-backup"
+	BondModeBalanceXOR   = "balance-xor"
+	BondModeBroadcast    = "broadcast"
+	BondMode8023AD       = "802.3ad"
+	BondModeBalanceTLB   = "balance-tlb"
+	BondModeBalanceALB   = "balance-alb"
+)
+
+// bondModes are modes of linux bonding driver ordered by their numbers.
+var bondModes = []string{
+	BondModeBalanceRR,
+	BondModeActiveBackup,
+	BondModeBalanceXOR,
+	BondModeBroadcast,
+	BondMode8023AD,
+	BondModeBalanceTLB,
+	BondModeBalanceALB,
+}
+
+var bondHashPolicies = []string{
+	"layer2",
+	"layer2+3",
+	"layer3+4",
+	"encap2+3",
+	"encap3+4",
+	"vlan+srcmac",
+}
+
+// modes xmit_hash_policy takes effect in
+var bondHashPolicyModes = []string{
+	BondModeBalanceXOR,
+	BondMode8023AD,
+	BondModeBalanceTLB,
+}
+
+const maxBondMiimon = 10000
+
+// ModeName returns mode name of bond, mode given by number (e.g. "4") is
+// converted to its name (e.g. "802.3ad"). An empty string is returned for
+// unknown mode.
+func (b BondInfo) ModeName() string {
+	if b.Mode == "" {
+		return ""
+	}
+	for idx, mode := range bondModes {
+		if b.Mode == mode || b.Mode == fmt.Sprint(idx) {
+			return mode
+		}
+	}
+	return ""
+}
+
+// BondModeNumber returns number of bonding mode name, false is returned for
+// unknown mode.
+func BondModeNumber(name string) (int, bool) {
+	for idx, mode := range bondModes {
+		if name == mode {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// MinLinkCount returns the least number of links of bond.
+func (b BondInfo) MinLinkCount() int {
+	if b.MinLinks > 0 {
+		return b.MinLinks
+	}
+	if b.ModeName() == BondMode8023AD {
+		return 2
+	}
+	return 1
+}
+
+func (b BondInfo) validate(field string, errs *ValidationError) {
+	mode := b.ModeName()
+	if b.Mode != "" && mode == "" {
+		errs.add("%s: unknown mode %q, available modes: %s", field, b.Mode, strings.Join(bondModes, ", "))
+	}
+	if b.HashPolicy != "" {
+		if !containsString(bondHashPolicies, b.HashPolicy) {
+			errs.add("%s: unknown hash policy %q, available policies: %s", field, b.HashPolicy, strings.Join(bondHashPolicies, ", "))
+		} else if mode != "" && !containsString(bondHashPolicyModes, mode) {
+			errs.add("%s: hash policy %q takes no effect in mode %s", field, b.HashPolicy, mode)
+		}
+	}
+	if b.Miimon < 0 || b.Miimon > maxBondMiimon {
+		errs.add("%s: miimon %d out of range 0-%d", field, b.Miimon, maxBondMiimon)
+	}
+	if b.MinLinks < 0 {
+		errs.add("%s: negative min_links %d", field, b.MinLinks)
+	}
+	if b.BondAll && (len(b.Links) > 0 || len(b.SwitchPorts) > 0) {
+		errs.add("%s: links and switch_ports must be empty when bond_all_interface is enabled", field)
+	}
+	if len(b.Links) > 0 && len(b.SwitchPorts) > 0 && len(b.Links) != len(b.SwitchPorts) {
+		errs.add("%s: %d links are given with %d switch_ports", field, len(b.Links), len(b.SwitchPorts))
+	}
+	for idx, sp := range b.SwitchPorts {
+		if sp.Switch == "" && sp.Port == "" {
+			errs.add("%s.switch_ports[%d]: switch or port is required", field, idx)
+		}
+	}
+	if !b.BondAll {
+		count := len(b.Links)
+		if count == 0 {
+			count = len(b.SwitchPorts)
+		}
+		if count < b.MinLinkCount() {
+			errs.add("%s: %d links given, mode %s needs at least %d", field, count, mode, b.MinLinkCount())
+		}
+		seen := map[string]bool{}
+		for _, l := range b.Links {
+			if seen[l] {
+				errs.add("%s: duplicate link %s", field, l)
+			}
+			seen[l] = true
+		}
+	}
+	if b.CarrierTimeout < 0 || b.CarrierPollInterval < 0 {
+		errs.add("%s: negative carrier_timeout or carrier_poll_interval", field)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
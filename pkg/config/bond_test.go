@@ -0,0 +1,104 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBondModeName(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", ""},
+		{"active-backup", BondModeActiveBackup},
+		{"802.3ad", BondMode8023AD},
+		{"0", BondModeBalanceRR},
+		{"4", BondMode8023AD},
+		{"6", BondModeBalanceALB},
+		{"7", ""},
+		{"-1", ""},
+		{"lacp", ""},
+		{"802.3AD", ""},
+	}
+	for _, tt := range tests {
+		if got := (BondInfo{Mode: tt.mode}).ModeName(); got != tt.want {
+			t.Errorf("ModeName(%q) = %q, want %q", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestBondMinLinkCount(t *testing.T) {
+	tests := []struct {
+		bond BondInfo
+		want int
+	}{
+		{BondInfo{Mode: "active-backup"}, 1},
+		{BondInfo{Mode: "802.3ad"}, 2},
+		{BondInfo{Mode: "4"}, 2},
+		{BondInfo{Mode: "802.3ad", MinLinks: 1}, 1},
+		{BondInfo{Mode: "balance-rr", MinLinks: 3}, 3},
+	}
+	for _, tt := range tests {
+		if got := tt.bond.MinLinkCount(); got != tt.want {
+			t.Errorf("%+v: MinLinkCount = %d, want %d", tt.bond, got, tt.want)
+		}
+	}
+}
+
+func TestBondValidate(t *testing.T) {
+	links := []string{"eno1", "eno2"}
+	tests := []struct {
+		name    string
+		bond    BondInfo
+		wantErr string
+	}{
+		{name: "active-backup", bond: BondInfo{Mode: "active-backup", Links: links}},
+		{name: "mode number", bond: BondInfo{Mode: "1", Links: links}},
+		{name: "no mode", bond: BondInfo{Links: links}},
+		{name: "unknown mode", bond: BondInfo{Mode: "lacp", Links: links}, wantErr: `unknown mode "lacp"`},
+		{name: "mode number out of range", bond: BondInfo{Mode: "7", Links: links}, wantErr: `unknown mode "7"`},
+		{name: "hash policy", bond: BondInfo{Mode: "802.3ad", HashPolicy: "layer3+4", Links: links}},
+		{name: "hash policy of balance-xor", bond: BondInfo{Mode: "balance-xor", HashPolicy: "layer2+3", Links: links}},
+		{name: "hash policy of mode number", bond: BondInfo{Mode: "5", HashPolicy: "encap3+4", Links: links}},
+		{name: "unknown hash policy", bond: BondInfo{Mode: "802.3ad", HashPolicy: "layer4", Links: links}, wantErr: `unknown hash policy "layer4"`},
+		{
+			name:    "hash policy of active-backup",
+			bond:    BondInfo{Mode: "active-backup", HashPolicy: "layer3+4", Links: links},
+			wantErr: `hash policy "layer3+4" takes no effect in mode active-backup`,
+		},
+		{name: "miimon", bond: BondInfo{Mode: "active-backup", Miimon: 100, Links: links}},
+		{name: "max miimon", bond: BondInfo{Mode: "active-backup", Miimon: 10000, Links: links}},
+		{name: "negative miimon", bond: BondInfo{Mode: "active-backup", Miimon: -1, Links: links}, wantErr: "miimon -1 out of range 0-10000"},
+		{name: "miimon too large", bond: BondInfo{Mode: "active-backup", Miimon: 10001, Links: links}, wantErr: "miimon 10001 out of range 0-10000"},
+		{name: "min links", bond: BondInfo{Mode: "802.3ad", MinLinks: 2, Links: links}},
+		{name: "one link of active-backup", bond: BondInfo{Mode: "active-backup", Links: links[:1]}},
+		{name: "one link of 802.3ad", bond: BondInfo{Mode: "802.3ad", Links: links[:1]}, wantErr: "1 links given, mode 802.3ad needs at least 2"},
+		{name: "one link of 802.3ad with min links", bond: BondInfo{Mode: "802.3ad", MinLinks: 1, Links: links[:1]}},
+		{name: "fewer links than min links", bond: BondInfo{Mode: "balance-rr", MinLinks: 3, Links: links}, wantErr: "2 links given, mode balance-rr needs at least 3"},
+		{name: "negative min links", bond: BondInfo{Mode: "active-backup", MinLinks: -1, Links: links}, wantErr: "negative min_links -1"},
+		{name: "min links of all interfaces", bond: BondInfo{Mode: "802.3ad", MinLinks: 4, BondAll: true}},
+		{name: "switch ports", bond: BondInfo{Mode: "802.3ad", SwitchPorts: []SwitchPortInfo{{Switch: "tor1", Port: "Ethernet1"}, {Switch: "tor2", Port: "Ethernet1"}}}},
+		{
+			name:    "empty switch port",
+			bond:    BondInfo{Mode: "active-backup", SwitchPorts: []SwitchPortInfo{{Switch: "tor1"}, {}}},
+			wantErr: "bond.switch_ports[1]: switch or port is required",
+		},
+		{name: "duplicate link", bond: BondInfo{Mode: "active-backup", Links: []string{"eno1", "eno1"}}, wantErr: "duplicate link eno1"},
+		{name: "links of all interfaces", bond: BondInfo{Mode: "active-backup", BondAll: true, Links: links}, wantErr: "links and switch_ports must be empty"},
+		{name: "negative carrier timeout", bond: BondInfo{Mode: "active-backup", Links: links, CarrierTimeout: -1}, wantErr: "negative carrier_timeout"},
+	}
+	for _, tt := range tests {
+		errs := ValidationError{}
+		tt.bond.validate("bond", &errs)
+		if tt.wantErr == "" {
+			if len(errs) > 0 {
+				t.Errorf("%s: %v", tt.name, errs)
+			}
+			continue
+		}
+		if len(errs) == 0 || !strings.Contains(errs.Error(), tt.wantErr) {
+			t.Errorf("%s: validate = %v, want error %q", tt.name, errs, tt.wantErr)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"reflect"
 )
 
@@ -8,10 +9,72 @@ type Node struct {
 	Name         string            `json:"name" yaml:"name"`
 	IPMI         IPMIInfo          `json:"ipmi" yaml:"ipmi"`
 	Network      NetworkInfo       `json:"network" yaml:"network"`
+	Networks     []NetworkInfo     `json:"networks" yaml:"networks"`
 	RootDevice   map[string]string `json:"root_device" yaml:"root_device"`
 	SerialNumber string            `json:"sn" yaml:"sn"`
-	ImageInfo    *ImageInfo        `json:"image_info" yaml:"image_info"`
-	RaidConfig   *RaidConfig       `json:"raid" yaml:"raid"`
+	// UUID is product uuid of SMBIOS.
+	UUID     string `json:"uuid" yaml:"uuid"`
+	AssetTag string `json:"asset_tag" yaml:"asset_tag"`
+	// MACAddressList identifies node by mac address of any NIC, besides mac
+	// addresses its networks refer to.
+	MACAddressList []string      `json:"mac_addresses" yaml:"mac_addresses"`
+	ImageInfo      *ImageInfo    `json:"image_info" yaml:"image_info"`
+	RaidConfig     *RaidConfig   `json:"raid" yaml:"raid"`
+	SSHKeys        []string      `json:"ssh_keys" yaml:"ssh_keys"`
+	Ignition       *IgnitionInfo `json:"ignition" yaml:"ignition"`
+	// NetworkPrecheck checks static IPv4 networks in ramdisk before image is
+	// written, it is skipped when it is nil.
+	NetworkPrecheck *NetworkPrecheckInfo `json:"network_precheck" yaml:"network_precheck"`
+	// LLDPTimeout is the seconds to listen for LLDP when interfaces are
+	// selected by switch port, 35 is used when it is 0.
+	LLDPTimeout int `json:"lldp_timeout" yaml:"lldp_timeout"`
+	// PowerAction is done once image is installed, host is left as is when
+	// it is nil.
+	PowerAction *PowerActionInfo `json:"power_action" yaml:"power_action"`
+	// StepTimeouts limits seconds of install steps by step name, e.g.
+	// write_image, steps not listed have no timeout.
+	StepTimeouts map[string]int `json:"step_timeouts" yaml:"step_timeouts"`
+	// Hooks are site specific actions run in phases of install.
+	Hooks []Hook `json:"hooks" yaml:"hooks"`
+	// Files are written into root filesystem of installed image.
+	Files []FileInfo `json:"files" yaml:"files"`
+	// GrowRoot grows the last partition of image and its filesystem to fill
+	// root disk, space of config drive at end of disk is kept.
+	GrowRoot bool `json:"grow_root" yaml:"grow_root"`
+	// PartitionLayout is layout of root disk for a partition image, default
+	// layout is used when it is nil.
+	PartitionLayout *PartitionLayoutInfo `json:"partition_layout" yaml:"partition_layout"`
+	// Storage partitions and formats disks other than root disk once image
+	// is written.
+	Storage []StorageInfo `json:"storage" yaml:"storage"`
+}
+
+// AllNetworks returns network followed by every entry of networks, network is
+// skipped when it is empty.
+func (n Node) AllNetworks() []NetworkInfo {
+	result := []NetworkInfo{}
+	if !n.Network.IsEmpty() {
+		result = append(result, n.Network)
+	}
+	for _, network := range n.Networks {
+		if !network.IsEmpty() {
+			result = append(result, network)
+		}
+	}
+	return result
+}
+
+// NeedsLLDP reports whether any network selects interfaces by switch port.
+func (n Node) NeedsLLDP() bool {
+	for _, network := range n.AllNetworks() {
+		if network.InterfaceHint.Switch != "" || network.InterfaceHint.SwitchPort != "" {
+			return true
+		}
+		if len(network.Bond.SwitchPorts) > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 type DiskType string
@@ -59,6 +122,16 @@ type IPMIInfo struct {
 	Password  string `json:"password" yaml:"password"`
 	Cipher    int32  `json:"cipher" yaml:"cipher"`
 	Interface string `json:"interface" yaml:"interface"`
+	// Configure makes installer apply address, user and cipher suite to the
+	// local BMC in-band.
+	Configure bool   `json:"configure" yaml:"configure"`
+	Netmask   string `json:"netmask" yaml:"netmask"`
+	Gateway   string `json:"gateway" yaml:"gateway"`
+	// Channel is the LAN channel of BMC, 1 is used when it is 0.
+	Channel int `json:"channel" yaml:"channel"`
+	// UserID is the user slot to configure when no user has Username, 2 is
+	// used when it is 0.
+	UserID int `json:"user_id" yaml:"user_id"`
 }
 
 type NetworkInfo struct {
@@ -68,26 +141,302 @@ type NetworkInfo struct {
 	DNS         []string `json:"dns" yaml:"dns"`
 	MTU         string   `json:"mtu" yaml:"mtu"`
 	Bond        BondInfo `json:"bond" yaml:"bond"`
+	IPv6        IPv6Info `json:"ipv6" yaml:"ipv6"`
+	// DHCP requests IPv4 address by DHCP, address, netmask and gateway must
+	// be empty.
+	DHCP   bool        `json:"dhcp" yaml:"dhcp"`
+	Routes []RouteInfo `json:"routes" yaml:"routes"`
+	// Interface is the link used when network is not bonded, referenced by
+	// mac address, name, biosdevname or PCI address like bond links. It is
+	// picked by InterfaceHint when it is empty.
+	Interface     string        `json:"interface" yaml:"interface"`
+	InterfaceHint InterfaceHint `json:"interface_hint" yaml:"interface_hint"`
+	// VlanID tags the address above, the underlying link is left without
+	// address. It is untagged (native) when VlanID is 0.
+	VlanID int        `json:"vlan_id" yaml:"vlan_id"`
+	Vlans  []VlanInfo `json:"vlans" yaml:"vlans"`
 }
 
 func (n NetworkInfo) IsEmpty() bool {
 	return reflect.DeepEqual(n, NetworkInfo{})
 }
 
+// VlanInfo is a tagged network on top of the physical link or bond of the
+// network it belongs to.
+type VlanInfo struct {
+	ID          int         `json:"id" yaml:"id"`
+	IPv4Address string      `json:"address" yaml:"address"`
+	NetMask     string      `json:"netmask" yaml:"netmask"`
+	Gateway     string      `json:"gateway" yaml:"gateway"`
+	MTU         string      `json:"mtu" yaml:"mtu"`
+	IPv6        IPv6Info    `json:"ipv6" yaml:"ipv6"`
+	DHCP        bool        `json:"dhcp" yaml:"dhcp"`
+	Routes      []RouteInfo `json:"routes" yaml:"routes"`
+}
+
+// RouteInfo is a static route, Network is either an address with Netmask or
+// a CIDR. Routes are added to the IPv4 or IPv6 network by their family.
+type RouteInfo struct {
+	Network string `json:"network" yaml:"network"`
+	Netmask string `json:"netmask" yaml:"netmask"`
+	Gateway string `json:"gateway" yaml:"gateway"`
+}
+
+type IPv6Mode string
+
+const (
+	IPv6ModeStatic         IPv6Mode = "static"
+	IPv6ModeSLAAC          IPv6Mode = "slaac"
+	IPv6ModeDHCPv6Stateful IPv6Mode = "dhcpv6-stateful"
+)
+
+// IPv6Info is the IPv6 part of a dual-stack network.
+type IPv6Info struct {
+	// Mode defaults to static when Address is set.
+	Mode IPv6Mode `json:"mode" yaml:"mode"`
+	// Address with prefix length, e.g. 2001:db8::10/64
+	Address string `json:"address" yaml:"address"`
+	Gateway string `json:"gateway" yaml:"gateway"`
+}
+
+func (i IPv6Info) IsEmpty() bool {
+	return reflect.DeepEqual(i, IPv6Info{})
+}
+
+// InterfaceHint selects the link of a network which is not bonded, every field
+// set must match. The interface booting the ramdisk is preferred when no hint
+// is given, the first interface with carrier is used otherwise.
+type InterfaceHint struct {
+	MACAddress  string `json:"mac_address" yaml:"mac_address"`
+	Name        string `json:"name" yaml:"name"`
+	BIOSDevName string `json:"biosdevname" yaml:"biosdevname"`
+	PCIAddress  string `json:"pci_address" yaml:"pci_address"`
+	// MinSpeed in Mb/s
+	MinSpeed int `json:"min_speed" yaml:"min_speed"`
+	// BootInterface matches the interface from BOOTIF= of kernel cmdline.
+	BootInterface bool `json:"boot_interface" yaml:"boot_interface"`
+	// Switch and SwitchPort match the LLDP neighbor of interface, by chassis
+	// id or system name and by port id or port description.
+	Switch     string `json:"switch" yaml:"switch"`
+	SwitchPort string `json:"switch_port" yaml:"switch_port"`
+}
+
+// SwitchPortInfo is a switch port expected to be seen by LLDP.
+type SwitchPortInfo struct {
+	// Switch is chassis id or system name
+	Switch string `json:"switch" yaml:"switch"`
+	// Port is port id or port description
+	Port string `json:"port" yaml:"port"`
+}
+
+func (h InterfaceHint) IsEmpty() bool {
+	return reflect.DeepEqual(h, InterfaceHint{})
+}
+
 type BondInfo struct {
-	Mode       string   `json:"mode" yaml:"mode"`
-	HashPolicy string   `json:"hash_policy" yaml:"hash_policy"`
-	Miimon     int      `json:"miimon" yaml:"miimon"`
-	Links      []string `json:"links" yaml:"links"`
-	BondAll    bool     `json:"bond_all_interface" yaml:"bond_all_interface"`
+	// Name of bond interface, bond%d is used when it is empty.
+	Name       string `json:"name" yaml:"name"`
+	Mode       string `json:"mode" yaml:"mode"`
+	HashPolicy string `json:"hash_policy" yaml:"hash_policy"`
+	Miimon     int    `json:"miimon" yaml:"miimon"`
+	// Links are referenced by mac address, name (eno1), biosdevname (em1)
+	// or PCI address (0000:3b:00.0).
+	Links   []string `json:"links" yaml:"links"`
+	BondAll bool     `json:"bond_all_interface" yaml:"bond_all_interface"`
+	// SwitchPorts select bond links by their LLDP neighbor. When links are
+	// given as well, links[i] must be connected to switch_ports[i].
+	SwitchPorts []SwitchPortInfo `json:"switch_ports" yaml:"switch_ports"`
+	// MinLinks is the least number of links the bond must have, it is 2 for
+	// 802.3ad and 1 for other modes when it is 0.
+	MinLinks int `json:"min_links" yaml:"min_links"`
+	// Filter limits interfaces bonded by bond_all_interface.
+	Filter BondFilter `json:"filter" yaml:"filter"`
+	// CarrierTimeout is the seconds to wait for bond links to get carrier,
+	// links still down after it are left out. It is not waited when it is 0.
+	CarrierTimeout int `json:"carrier_timeout" yaml:"carrier_timeout"`
+	// CarrierPollInterval in seconds, 1 is used when it is 0.
+	CarrierPollInterval int `json:"carrier_poll_interval" yaml:"carrier_poll_interval"`
+}
+
+// BondFilter selects bond links, every field set must match.
+type BondFilter struct {
+	// Speed in Mb/s
+	Speed int `json:"speed" yaml:"speed"`
+	// MinSpeed in Mb/s
+	MinSpeed int      `json:"min_speed" yaml:"min_speed"`
+	Drivers  []string `json:"drivers" yaml:"drivers"`
+	// PCISlots are prefixes of PCI address, e.g. 0000:3b:00
+	PCISlots []string `json:"pci_slots" yaml:"pci_slots"`
 }
 
 func (b BondInfo) IsEmpty() bool {
 	return reflect.DeepEqual(b, BondInfo{})
 }
 
+type NetworkPrecheckInfo struct {
+	// Timeout in seconds of every probe, 5 is used when it is 0.
+	Timeout int `json:"timeout" yaml:"timeout"`
+	// DNSName is resolved by every dns server, any answer including
+	// NXDOMAIN is taken as success. "precheck.invalid" is used when it is empty.
+	DNSName string `json:"dns_name" yaml:"dns_name"`
+	// IgnoreFailure only logs failed checks instead of aborting installation.
+	IgnoreFailure bool `json:"ignore_failure" yaml:"ignore_failure"`
+}
+
+const (
+	IgnitionPlacementConfigDrive = "config-drive"
+	IgnitionPlacementOEM         = "oem"
+)
+
+// IgnitionInfo selects an Ignition config instead of a cloud-init config
+// drive, for images such as Flatcar or Fedora CoreOS.
+type IgnitionInfo struct {
+	// Placement is config-drive or oem, config-drive is used when it is
+	// empty. config-drive appends a config drive partition carrying
+	// config.ign, oem writes config.ign into the OEM partition of image.
+	Placement string `json:"placement" yaml:"placement"`
+	// Label is the volume label of the config drive carrying the Ignition
+	// config, "ignition" is used when it is empty. The drive of label
+	// config-2 carries it as openstack user_data as well.
+	Label string `json:"label" yaml:"label"`
+	// OEMLabel is the filesystem label of the OEM partition, "OEM" is used
+	// when it is empty.
+	OEMLabel string `json:"oem_label" yaml:"oem_label"`
+	// User is the account ssh keys are added to, "core" is used when it is empty.
+	User string `json:"user" yaml:"user"`
+}
+
+const (
+	PowerActionNone     = "none"
+	PowerActionReboot   = "reboot"
+	PowerActionPowerOff = "poweroff"
+	PowerActionKexec    = "kexec"
+)
+
+// PowerActionInfo is what is done to host once every step of install has
+// succeeded.
+type PowerActionInfo struct {
+	// Action is none, reboot, poweroff or kexec into the installed kernel,
+	// none is used when it is empty.
+	Action string `json:"action" yaml:"action"`
+	// Delay is the seconds to wait before action.
+	Delay int `json:"delay" yaml:"delay"`
+	// BootNext sets UEFI BootNext to the boot entry on root disk, it is
+	// ignored on BIOS.
+	BootNext bool `json:"boot_next" yaml:"boot_next"`
+	// KexecCmdline is the kernel command line of kexec. When it is empty,
+	// the command line the installed OS boots its kernel with is used, with
+	// root and console of ramdisk added if it lacks them.
+	KexecCmdline string `json:"kexec_cmdline" yaml:"kexec_cmdline"`
+}
+
+// Validate checks action and delay, nil is returned when they are valid.
+func (p PowerActionInfo) Validate() error {
+	switch p.Action {
+	case "", PowerActionNone, PowerActionReboot, PowerActionPowerOff, PowerActionKexec:
+	default:
+		return fmt.Errorf("power_action: unknown action %q", p.Action)
+	}
+	if p.Delay < 0 {
+		return fmt.Errorf("power_action: negative delay %d", p.Delay)
+	}
+	return nil
+}
+
+const (
+	FileEncodingPlain  = "plain"
+	FileEncodingBase64 = "base64"
+)
+
+// FileInfo is a file written into root filesystem of installed image, an
+// existing file is replaced.
+type FileInfo struct {
+	Path    string `json:"path" yaml:"path"`
+	Content string `json:"content" yaml:"content"`
+	// Encoding of content is plain or base64, plain is used when it is empty.
+	Encoding string `json:"encoding" yaml:"encoding"`
+	// Mode is permission bits in octal, 0644 is used when it is empty.
+	Mode string `json:"mode" yaml:"mode"`
+	// Owner and Group are names or ids in installed OS, root is used when
+	// they are empty.
+	Owner string `json:"owner" yaml:"owner"`
+	Group string `json:"group" yaml:"group"`
+}
+
+const (
+	ImageTypeWholeDisk = "whole-disk"
+	ImageTypePartition = "partition"
+)
+
+const (
+	PartitionLabelGPT   = "gpt"
+	PartitionLabelMSDOS = "msdos"
+)
+
+// PartitionLayoutInfo is layout created on root disk for a partition image,
+// ESP is created on UEFI, BIOS boot partition on BIOS with GPT.
+type PartitionLayoutInfo struct {
+	// Label is gpt or msdos, gpt is used when it is empty.
+	Label string `json:"label" yaml:"label"`
+	// ESPSizeMB is 550 when it is 0.
+	ESPSizeMB int `json:"esp_size_mb" yaml:"esp_size_mb"`
+	// BIOSBootSizeMB is 1 when it is 0.
+	BIOSBootSizeMB int `json:"bios_boot_size_mb" yaml:"bios_boot_size_mb"`
+	// SwapSizeMB is size of swap partition, there is no swap when it is 0.
+	SwapSizeMB int `json:"swap_size_mb" yaml:"swap_size_mb"`
+	// RootSizeMB is size of root partition, root fills disk but space of
+	// config drive when it is 0.
+	RootSizeMB int `json:"root_size_mb" yaml:"root_size_mb"`
+}
+
+// Filesystems of storage partitions.
+const (
+	FilesystemXFS  = "xfs"
+	FilesystemExt4 = "ext4"
+	FilesystemVFAT = "vfat"
+	FilesystemSwap = "swap"
+)
+
+// StorageIndex in label and mountpoint of a storage partition is replaced
+// with index of its disk among disks all storages select, e.g. data{n}.
+// Disks are numbered in order of storage, then of name.
+const StorageIndex = "{n}"
+
+// StorageDeviceHints are keys of StorageInfo.Device, a disk is selected only
+// when it matches every hint given. Unlike root_device, where any hint
+// matching is enough, a storage wipes what it selects.
+var StorageDeviceHints = []string{"name", "hctl", "uuid", "size", "model", "serial", "wwn", "vendor", "tran"}
+
+// StorageInfo is layout of every disk but root disk that Device selects by
+// StorageDeviceHints.
+type StorageInfo struct {
+	Device map[string]string `json:"device" yaml:"device"`
+	// Label is gpt or msdos, gpt is used when it is empty.
+	Label      string             `json:"label" yaml:"label"`
+	Partitions []StoragePartition `json:"partitions" yaml:"partitions"`
+	// Fstab adds partitions with mountpoint and swap to fstab of installed
+	// image.
+	Fstab bool `json:"fstab" yaml:"fstab"`
+}
+
+type StoragePartition struct {
+	// SizeMB of 0 fills the rest of disk, only the last partition may.
+	SizeMB int `json:"size_mb" yaml:"size_mb"`
+	// Filesystem is xfs, ext4, vfat or swap, partition is left unformatted
+	// when it is empty.
+	Filesystem string `json:"filesystem" yaml:"filesystem"`
+	// Label is label of filesystem.
+	Label      string `json:"label" yaml:"label"`
+	Mountpoint string `json:"mountpoint" yaml:"mountpoint"`
+	// MountOptions is defaults when it is empty.
+	MountOptions string `json:"mount_options" yaml:"mount_options"`
+}
+
 type ImageInfo struct {
-	Image       string `json:"image" yaml:"image"`
+	Image string `json:"image" yaml:"image"`
+	// Type is whole-disk or partition, whole-disk is used when it is empty.
+	// Image of type partition is a filesystem written to root partition.
+	Type        string `json:"image_type" yaml:"image_type"`
 	ImageURL    string `json:"image_url" yaml:"image_url"`
 	DiskFormat  string `json:"disk_format" yaml:"disk_format"`
 	MD5Checksum string `json:"md5" yaml:"md5"`
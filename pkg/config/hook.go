@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+)
+
+// Phases of install hooks run in.
+const (
+	// HookPhasePreClean runs before the first step changing host, i.e.
+	// before network precheck, BMC and raid controllers are configured and
+	// anything is wiped. Only config drive may be generated before it.
+	HookPhasePreClean = "pre-clean"
+	// HookPhasePreWrite runs once root device is chosen, before image is
+	// written.
+	HookPhasePreWrite = "pre-write"
+	// HookPhasePostWrite runs once image is written.
+	HookPhasePostWrite = "post-write"
+	// HookPhasePostConfigDrive runs once config drive partition is written.
+	HookPhasePostConfigDrive = "post-configdrive"
+	// HookPhasePostInstall runs once every step but power action succeeded.
+	HookPhasePostInstall = "post-install"
+)
+
+// HookPhases are every hook phase in the order they run.
+var HookPhases = []string{
+	HookPhasePreClean,
+	HookPhasePreWrite,
+	HookPhasePostWrite,
+	HookPhasePostConfigDrive,
+	HookPhasePostInstall,
+}
+
+const (
+	HookFailureAbort    = "abort"
+	HookFailureContinue = "continue"
+)
+
+// Hook is a site specific executable or inline script run in a phase of
+// install.
+type Hook struct {
+	Name  string `json:"name" yaml:"name"`
+	Phase string `json:"phase" yaml:"phase"`
+	// Path is an executable run with Args, Script is run by /bin/sh, only
+	// one of them is set.
+	Path   string   `json:"path" yaml:"path"`
+	Args   []string `json:"args" yaml:"args"`
+	Script string   `json:"script" yaml:"script"`
+	// OnFailure is abort or continue, install is aborted by a failed hook
+	// when it is empty.
+	OnFailure string `json:"on_failure" yaml:"on_failure"`
+	// Timeout is the seconds hook may run, it isn't limited when it is 0.
+	Timeout int `json:"timeout" yaml:"timeout"`
+}
+
+// Validate checks phase, command and failure policy of hook, nil is
+// returned when they are valid.
+func (h Hook) Validate() error {
+	errs := ValidationError{}
+	field := fmt.Sprintf("hook %s", h.Name)
+	if h.Name == "" {
+		errs.add("hook: name is required")
+	}
+	known := false
+	for _, p := range HookPhases {
+		if h.Phase == p {
+			known = true
+		}
+	}
+	if !known {
+		errs.add("%s: unknown phase %q, phases are %v", field, h.Phase, HookPhases)
+	}
+	if (h.Path == "") == (h.Script == "") {
+		errs.add("%s: exactly one of path and script is required", field)
+	}
+	if h.Script != "" && len(h.Args) > 0 {
+		errs.add("%s: args are only for path", field)
+	}
+	switch h.OnFailure {
+	case "", HookFailureAbort, HookFailureContinue:
+	default:
+		errs.add("%s: unknown on_failure %q", field, h.OnFailure)
+	}
+	if h.Timeout < 0 {
+		errs.add("%s: negative timeout %d", field, h.Timeout)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateHooks validates every hook of node, names of hooks are unique.
+func (n Node) ValidateHooks() error {
+	names := map[string]bool{}
+	for _, h := range n.Hooks {
+		if err := h.Validate(); err != nil {
+			return err
+		}
+		if names[h.Name] {
+			return fmt.Errorf("duplicate hook name %s", h.Name)
+		}
+		names[h.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MatchKey is an identifier of host a node is matched by.
+type MatchKey string
+
+const (
+	MatchBySerial   MatchKey = "serial"
+	MatchByUUID     MatchKey = "uuid"
+	MatchByAssetTag MatchKey = "asset_tag"
+	MatchByMAC      MatchKey = "mac"
+	MatchByBMCIP    MatchKey = "bmc_ip"
+)
+
+// DefaultMatchPrecedence matches by identifiers of the system first, which
+// don't change when NICs or BMC are replaced.
+var DefaultMatchPrecedence = []MatchKey{MatchBySerial, MatchByUUID, MatchByAssetTag, MatchByMAC, MatchByBMCIP}
+
+// ParseMatchKeys parses names of match keys, e.g. serial or bmc_ip.
+func ParseMatchKeys(names []string) ([]MatchKey, error) {
+	keys := []MatchKey{}
+	for _, name := range names {
+		key := MatchKey(strings.ReplaceAll(strings.ToLower(name), "-", "_"))
+		found := false
+		for _, k := range DefaultMatchPrecedence {
+			if k == key {
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown match key %q, available keys are %v", name, DefaultMatchPrecedence)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Identity is what a host is identified by, empty fields are unknown.
+type Identity struct {
+	Serial       string
+	UUID         string
+	AssetTag     string
+	MACAddresses []string
+	BMCIP        string
+}
+
+// MACAddresses returns mac address of node and every mac address its
+// networks refer to.
+func (n Node) MACAddresses() []string {
+	macs := append([]string{}, n.MACAddressList...)
+	for _, network := range n.AllNetworks() {
+		refs := append([]string{network.Interface, network.InterfaceHint.MACAddress}, network.Bond.Links...)
+		for _, ref := range refs {
+			if _, err := net.ParseMAC(ref); err == nil {
+				macs = append(macs, ref)
+			}
+		}
+	}
+	return macs
+}
+
+// MatchNode returns the node identity matches, keys are tried by precedence
+// and the first key matching any node decides. It is an error if more than
+// one node matches the key.
+func MatchNode(nodes []Node, identity Identity, precedence []MatchKey) (Node, error) {
+	for _, key := range precedence {
+		matched := []Node{}
+		for _, node := range nodes {
+			if node.matches(key, identity) {
+				matched = append(matched, node)
+			}
+		}
+		switch len(matched) {
+		case 0:
+			continue
+		case 1:
+			return matched[0], nil
+		default:
+			names := []string{}
+			for _, node := range matched {
+				names = append(names, node.Name)
+			}
+			return Node{}, fmt.Errorf("nodes %v all match %s of localhost", names, key)
+		}
+	}
+	return Node{}, fmt.Errorf("could not find node matching localhost by %v", precedence)
+}
+
+func (n Node) matches(key MatchKey, identity Identity) bool {
+	equal := func(a, b string) bool {
+		return a != "" && b != "" && strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+	}
+	switch key {
+	case MatchBySerial:
+		return equal(n.SerialNumber, identity.Serial)
+	case MatchByUUID:
+		return equal(n.UUID, identity.UUID)
+	case MatchByAssetTag:
+		return equal(n.AssetTag, identity.AssetTag)
+	case MatchByMAC:
+		for _, mac := range n.MACAddresses() {
+			for _, local := range identity.MACAddresses {
+				if sameMAC(mac, local) {
+					return true
+				}
+			}
+		}
+	case MatchByBMCIP:
+		return equal(n.IPMI.Address, identity.BMCIP)
+	}
+	return false
+}
+
+// sameMAC reports whether a and b are the same mac address, which may be
+// written in any notation net.ParseMAC accepts, e.g. aa-bb-cc-dd-ee-ff.
+func sameMAC(a, b string) bool {
+	macA, err := net.ParseMAC(strings.TrimSpace(a))
+	if err != nil {
+		return false
+	}
+	macB, err := net.ParseMAC(strings.TrimSpace(b))
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(macA, macB)
+}
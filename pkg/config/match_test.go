@@ -0,0 +1,72 @@
+package config
+
+import "testing"
+
+func TestMatchNodeByMAC(t *testing.T) {
+	nodes := []Node{
+		{Name: "node1", MACAddressList: []string{"AA-00-00-00-00-01"}},
+		{Name: "node2", Network: NetworkInfo{Bond: BondInfo{Links: []string{"eno1", "aa:00:00:00:00:02"}}}},
+		{Name: "node3", Network: NetworkInfo{Interface: "aa00.0000.0003"}},
+		{Name: "node4", Network: NetworkInfo{InterfaceHint: InterfaceHint{MACAddress: "AA:00:00:00:00:04"}}},
+	}
+	tests := []struct {
+		local string
+		want  string
+	}{
+		{"aa:00:00:00:00:01", "node1"},
+		{"AA:00:00:00:00:02", "node2"},
+		{"aa:00:00:00:00:03", "node3"},
+		{"aa-00-00-00-00-04", "node4"},
+	}
+	for _, tt := range tests {
+		node, err := MatchNode(nodes, Identity{MACAddresses: []string{"bb:00:00:00:00:01", tt.local}}, []MatchKey{MatchByMAC})
+		if err != nil {
+			t.Errorf("%s: %v", tt.local, err)
+			continue
+		}
+		if node.Name != tt.want {
+			t.Errorf("%s matches %s, want %s", tt.local, node.Name, tt.want)
+		}
+	}
+
+	if node, err := MatchNode(nodes, Identity{MACAddresses: []string{"aa:00:00:00:00:05"}}, []MatchKey{MatchByMAC}); err == nil {
+		t.Errorf("unknown mac matches %s", node.Name)
+	}
+}
+
+func TestMatchNodePrecedence(t *testing.T) {
+	nodes := []Node{
+		{Name: "node1", SerialNumber: "SN1", MACAddressList: []string{"aa:00:00:00:00:01"}},
+		{Name: "node2", SerialNumber: "SN2", MACAddressList: []string{"aa:00:00:00:00:01"}},
+	}
+	identity := Identity{Serial: " sn2 ", MACAddresses: []string{"aa:00:00:00:00:01"}}
+	node, err := MatchNode(nodes, identity, DefaultMatchPrecedence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Name != "node2" {
+		t.Errorf("matches %s, want node2", node.Name)
+	}
+	if _, err := MatchNode(nodes, identity, []MatchKey{MatchByMAC}); err == nil {
+		t.Errorf("mac shared by two nodes matches")
+	}
+}
+
+func TestSameMAC(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"aa:bb:cc:dd:ee:ff", "AA-BB-CC-DD-EE-FF", true},
+		{"aabb.ccdd.eeff", "aa:bb:cc:dd:ee:ff", true},
+		{" aa:bb:cc:dd:ee:ff\n", "aa:bb:cc:dd:ee:ff", true},
+		{"aa:bb:cc:dd:ee:ff", "aa:bb:cc:dd:ee:00", false},
+		{"eno1", "eno1", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := sameMAC(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameMAC(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
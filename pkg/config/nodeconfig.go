@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NodeConfig is the content of nodeconfig, which is either a list of nodes
+// or a mapping of global and nodes.
+type NodeConfig struct {
+	Global Global `json:"global" yaml:"global"`
+	Nodes  []Node `json:"nodes" yaml:"nodes"`
+}
+
+// Global is config shared by every node.
+type Global struct {
+	// Hooks run before hooks of node in the same phase.
+	Hooks []Hook `json:"hooks" yaml:"hooks"`
+}
+
+// ParseNodeConfig parses nodeconfig in yaml.
+func ParseNodeConfig(data []byte) (NodeConfig, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return NodeConfig{}, err
+	}
+	config := NodeConfig{}
+	if len(doc.Content) == 0 {
+		return config, nil
+	}
+	switch doc.Content[0].Kind {
+	case yaml.SequenceNode:
+		err := doc.Content[0].Decode(&config.Nodes)
+		return config, err
+	case yaml.MappingNode:
+		err := doc.Content[0].Decode(&config)
+		return config, err
+	}
+	return NodeConfig{}, fmt.Errorf("nodeconfig is neither a list of nodes nor a mapping of global and nodes")
+}
+
+// Merge returns node with global config applied.
+func (g Global) Merge(node Node) Node {
+	node.Hooks = append(append([]Hook{}, g.Hooks...), node.Hooks...)
+	return node
+}
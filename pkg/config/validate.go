@@ -0,0 +1,478 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError lists every problem found in a config.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return strings.Join(e, "; ")
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// ValidateNetworks checks addresses, netmasks, gateways and routes of all
+// networks of node, nil is returned when they are valid.
+func (n Node) ValidateNetworks() error {
+	errs := ValidationError{}
+	bondNames := map[string]bool{}
+	for idx, network := range n.AllNetworks() {
+		field := fmt.Sprintf("network[%d]", idx)
+		network.validate(field, &errs)
+		if network.Bond.Name != "" {
+			if bondNames[network.Bond.Name] {
+				errs.add("%s.bond: duplicate bond name %s", field, network.Bond.Name)
+			}
+			bondNames[network.Bond.Name] = true
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks what is needed to configure BMC, nil is returned when it
+// is valid.
+func (i IPMIInfo) Validate() error {
+	errs := ValidationError{}
+	validateIPv4("ipmi", i.Address, i.Netmask, i.Gateway, false, &errs)
+	if i.Address == "" || i.Netmask == "" {
+		errs.add("ipmi: address and netmask are required")
+	}
+	if i.Username == "" || i.Password == "" {
+		errs.add("ipmi: username and password are required")
+	}
+	if len(i.Username) > 16 {
+		errs.add("ipmi: username %q is longer than 16 characters", i.Username)
+	}
+	if len(i.Password) > 20 {
+		errs.add("ipmi: password is longer than 20 characters")
+	}
+	// cipher suite 0 has no authentication, it is never enabled
+	if i.Cipher < 0 || i.Cipher > 17 {
+		errs.add("ipmi: invalid cipher suite %d", i.Cipher)
+	}
+	if i.Channel < 0 || i.Channel > 15 {
+		errs.add("ipmi: invalid channel %d", i.Channel)
+	}
+	if i.UserID < 0 || i.UserID > 63 || i.UserID == 1 {
+		errs.add("ipmi: invalid user id %d, user 1 is anonymous", i.UserID)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateFiles checks path, encoding and mode of files, nil is returned
+// when they are valid.
+func (n Node) ValidateFiles() error {
+	errs := ValidationError{}
+	paths := map[string]bool{}
+	for idx, f := range n.Files {
+		field := fmt.Sprintf("files[%d]", idx)
+		if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path || f.Path == "/" {
+			errs.add("%s: path %q must be an absolute clean path of a file", field, f.Path)
+		}
+		if paths[f.Path] {
+			errs.add("%s: duplicate path %s", field, f.Path)
+		}
+		paths[f.Path] = true
+		switch f.Encoding {
+		case "", FileEncodingPlain:
+		case FileEncodingBase64:
+			if _, err := base64.StdEncoding.DecodeString(f.Content); err != nil {
+				errs.add("%s: invalid base64 content: %v", field, err)
+			}
+		default:
+			errs.add("%s: unknown encoding %q", field, f.Encoding)
+		}
+		if _, err := f.FileMode(); err != nil {
+			errs.add("%s: %v", field, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// FileMode returns mode of file, 0644 when mode is empty.
+func (f FileInfo) FileMode() (os.FileMode, error) {
+	if f.Mode == "" {
+		return 0644, nil
+	}
+	mode, err := strconv.ParseUint(f.Mode, 8, 32)
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid mode %q", f.Mode)
+	}
+	perm := os.FileMode(mode).Perm()
+	if mode&04000 != 0 {
+		perm |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		perm |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		perm |= os.ModeSticky
+	}
+	return perm, nil
+}
+
+// Data returns content of file decoded.
+func (f FileInfo) Data() ([]byte, error) {
+	if f.Encoding == FileEncodingBase64 {
+		return base64.StdEncoding.DecodeString(f.Content)
+	}
+	return []byte(f.Content), nil
+}
+
+// Validate checks placement of Ignition config, nil is returned when it is
+// valid.
+func (i IgnitionInfo) Validate() error {
+	switch i.Placement {
+	case "", IgnitionPlacementConfigDrive, IgnitionPlacementOEM:
+		return nil
+	}
+	return fmt.Errorf("ignition: unknown placement %q", i.Placement)
+}
+
+// Validate checks type of image, nil is returned when it is valid.
+func (i ImageInfo) Validate() error {
+	switch i.Type {
+	case "", ImageTypeWholeDisk, ImageTypePartition:
+		return nil
+	}
+	return fmt.Errorf("image_info: unknown image_type %q", i.Type)
+}
+
+// Validate checks label and sizes of layout, nil is returned when they are
+// valid.
+func (l PartitionLayoutInfo) Validate() error {
+	errs := ValidationError{}
+	switch l.Label {
+	case "", PartitionLabelGPT, PartitionLabelMSDOS:
+	default:
+		errs.add("partition_layout: unknown label %q", l.Label)
+	}
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"esp_size_mb", l.ESPSizeMB},
+		{"bios_boot_size_mb", l.BIOSBootSizeMB},
+		{"swap_size_mb", l.SwapSizeMB},
+		{"root_size_mb", l.RootSizeMB},
+	}
+	for _, s := range sizes {
+		if s.size < 0 {
+			errs.add("partition_layout: negative %s %d", s.name, s.size)
+		}
+	}
+	if l.ESPSizeMB != 0 && l.ESPSizeMB < 33 {
+		errs.add("partition_layout: esp_size_mb %d is less than 33, the least size of FAT32", l.ESPSizeMB)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateStorage checks disk hints, labels and partitions of storage, nil
+// is returned when they are valid.
+func (n Node) ValidateStorage() error {
+	errs := ValidationError{}
+	for idx, storage := range n.Storage {
+		field := fmt.Sprintf("storage[%d]", idx)
+		if len(storage.Device) == 0 {
+			errs.add("%s: device hints are required", field)
+		}
+		keys := []string{}
+		for key := range storage.Device {
+			if !containsString(StorageDeviceHints, key) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			errs.add("%s: unknown device hint %q", field, key)
+		}
+		switch storage.Label {
+		case "", PartitionLabelGPT:
+		case PartitionLabelMSDOS:
+			if len(storage.Partitions) > 4 {
+				errs.add("%s: msdos label has at most 4 partitions", field)
+			}
+		default:
+			errs.add("%s: unknown label %q", field, storage.Label)
+		}
+		if len(storage.Partitions) == 0 {
+			errs.add("%s: partitions are required", field)
+		}
+		for pidx, p := range storage.Partitions {
+			pfield := fmt.Sprintf("%s.partitions[%d]", field, pidx)
+			if p.SizeMB < 0 {
+				errs.add("%s: negative size_mb %d", pfield, p.SizeMB)
+			}
+			if p.SizeMB == 0 && pidx != len(storage.Partitions)-1 {
+				errs.add("%s: only the last partition may fill the rest of disk", pfield)
+			}
+			switch p.Filesystem {
+			case "", FilesystemXFS, FilesystemExt4, FilesystemVFAT, FilesystemSwap:
+			default:
+				errs.add("%s: unknown filesystem %q", pfield, p.Filesystem)
+			}
+			if p.Mountpoint == "" {
+				continue
+			}
+			if p.Filesystem == "" || p.Filesystem == FilesystemSwap {
+				errs.add("%s: mountpoint needs a filesystem other than swap", pfield)
+			}
+			mountpoint := strings.Replace(p.Mountpoint, StorageIndex, "0", -1)
+			if !path.IsAbs(mountpoint) || path.Clean(mountpoint) != mountpoint || mountpoint == "/" {
+				errs.add("%s: mountpoint %q must be an absolute clean path other than /", pfield, p.Mountpoint)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// minPhysicalDisks is the least number of physical disks of raid levels.
+var minPhysicalDisks = map[RaidLevel]int{
+	RaidlevelJBOD: 1,
+	RaidLevel0:    1,
+	RaidLevel1:    2,
+	RaidLevel5:    3,
+	RaidLevel6:    4,
+	RaidLevel10:   4,
+	RaidLevel50:   6,
+	RaidLevel60:   8,
+}
+
+// Validate checks raid levels, sizes and disks of logical disks, nil is
+// returned when they are valid.
+func (r RaidConfig) Validate() error {
+	errs := ValidationError{}
+	roots := 0
+	for idx, disk := range r.LogicalDisks {
+		field := fmt.Sprintf("raid.logical_disks[%d]", idx)
+		min, ok := minPhysicalDisks[disk.RaidLevel]
+		if !ok {
+			errs.add("%s: unknown raid level %q", field, disk.RaidLevel)
+		}
+		if disk.SizeGB != nil && *disk.SizeGB <= 0 {
+			errs.add("%s: size_gb must be positive, omit it to use all space", field)
+		}
+		if disk.RootVolume {
+			roots++
+		}
+		switch disk.DiskType {
+		case "", DiskTypeHDD, DiskTypeSSD:
+		default:
+			errs.add("%s: unknown disk type %q", field, disk.DiskType)
+		}
+		switch disk.InterfaceType {
+		case "", InterfaceSAS, InterfaceSCSI, InterfaceSATA:
+		default:
+			errs.add("%s: unknown interface type %q", field, disk.InterfaceType)
+		}
+		count := disk.NumberOfPhysicalDisks
+		if len(disk.PhysicalDisks) > 0 {
+			if count != 0 && count != len(disk.PhysicalDisks) {
+				errs.add("%s: number_of_physical_disks %d doesn't match %d physical_disks", field, count, len(disk.PhysicalDisks))
+			}
+			count = len(disk.PhysicalDisks)
+		}
+		if ok && count != 0 && count < min {
+			errs.add("%s: raid %s needs at least %d physical disks", field, disk.RaidLevel, min)
+		}
+	}
+	if roots > 1 {
+		errs.add("raid: %d logical disks are root volume, at most one is allowed", roots)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (n NetworkInfo) validate(field string, errs *ValidationError) {
+	validateIPv4(field, n.IPv4Address, n.NetMask, n.Gateway, n.DHCP, errs)
+	validateIPv6(field+".ipv6", n.IPv6, errs)
+	validateRoutes(field, n.Routes, errs)
+	validateMTU(field, n.MTU, errs)
+	if !n.Bond.IsEmpty() {
+		n.Bond.validate(field+".bond", errs)
+	}
+	for _, dns := range n.DNS {
+		if net.ParseIP(dns) == nil {
+			errs.add("%s: invalid dns %q", field, dns)
+		}
+	}
+	ids := map[int]bool{}
+	if n.VlanID != 0 {
+		validateVlanID(field, n.VlanID, errs)
+		ids[n.VlanID] = true
+	}
+	for _, vlan := range n.Vlans {
+		vlanField := fmt.Sprintf("%s.vlan[%d]", field, vlan.ID)
+		validateVlanID(vlanField, vlan.ID, errs)
+		if ids[vlan.ID] {
+			errs.add("%s: duplicate vlan id", vlanField)
+		}
+		ids[vlan.ID] = true
+		validateIPv4(vlanField, vlan.IPv4Address, vlan.NetMask, vlan.Gateway, vlan.DHCP, errs)
+		validateIPv6(vlanField+".ipv6", vlan.IPv6, errs)
+		validateRoutes(vlanField, vlan.Routes, errs)
+		validateMTU(vlanField, vlan.MTU, errs)
+	}
+}
+
+func validateIPv4(field, address, netmask, gateway string, dhcp bool, errs *ValidationError) {
+	if dhcp && (address != "" || netmask != "") {
+		errs.add("%s: address and netmask must be empty when dhcp is enabled", field)
+	}
+	// default route is given by dhcp, a fixed one is a static route
+	if dhcp && gateway != "" {
+		errs.add("%s: gateway must be empty when dhcp is enabled, add it to routes instead", field)
+	}
+	if address != "" {
+		if !isIPv4(address) {
+			errs.add("%s: invalid ipv4 address %q", field, address)
+		}
+		if !isNetmask(netmask) {
+			errs.add("%s: invalid netmask %q", field, netmask)
+		}
+	} else if netmask != "" && !dhcp {
+		errs.add("%s: netmask is set without address", field)
+	}
+	if gateway != "" && !isIPv4(gateway) {
+		errs.add("%s: invalid gateway %q", field, gateway)
+	}
+}
+
+func validateIPv6(field string, ipv6 IPv6Info, errs *ValidationError) {
+	switch ipv6.Mode {
+	case IPv6ModeSLAAC, IPv6ModeDHCPv6Stateful:
+		if ipv6.Address != "" {
+			errs.add("%s: address must be empty in %s mode", field, ipv6.Mode)
+		}
+	case IPv6ModeStatic, "":
+		if ipv6.IsEmpty() {
+			return
+		}
+		if ip, _, err := net.ParseCIDR(ipv6.Address); err != nil || ip.To4() != nil {
+			errs.add("%s: invalid address %q, address/prefix is expected", field, ipv6.Address)
+		}
+	default:
+		errs.add("%s: unknown mode %q", field, ipv6.Mode)
+	}
+	if ipv6.Gateway != "" && !isIPv6(ipv6.Gateway) {
+		errs.add("%s: invalid gateway %q", field, ipv6.Gateway)
+	}
+}
+
+func validateRoutes(field string, routes []RouteInfo, errs *ValidationError) {
+	for idx, route := range routes {
+		routeField := fmt.Sprintf("%s.routes[%d]", field, idx)
+		if _, _, err := route.Parse(); err != nil {
+			errs.add("%s: %v", routeField, err)
+		}
+	}
+}
+
+func validateMTU(field, mtu string, errs *ValidationError) {
+	if mtu == "" {
+		return
+	}
+	if v, err := strconv.Atoi(mtu); err != nil || v < 68 || v > 65535 {
+		errs.add("%s: invalid mtu %q", field, mtu)
+	}
+}
+
+func validateVlanID(field string, id int, errs *ValidationError) {
+	if id < 1 || id > 4094 {
+		errs.add("%s: vlan id %d out of range 1-4094", field, id)
+	}
+}
+
+// Parse returns destination and gateway of route, Network is either a CIDR or
+// an address with Netmask.
+func (r RouteInfo) Parse() (*net.IPNet, net.IP, error) {
+	var dest *net.IPNet
+	if strings.Contains(r.Network, "/") {
+		if r.Netmask != "" {
+			return nil, nil, fmt.Errorf("netmask must be empty when network %q is a CIDR", r.Network)
+		}
+		ip, ipnet, err := net.ParseCIDR(r.Network)
+		if err != nil || !ip.Equal(ipnet.IP) {
+			return nil, nil, fmt.Errorf("invalid network %q", r.Network)
+		}
+		dest = ipnet
+	} else {
+		ip := net.ParseIP(r.Network)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid network %q", r.Network)
+		}
+		mask := net.ParseIP(r.Netmask)
+		if ip.To4() != nil {
+			if !isNetmask(r.Netmask) {
+				return nil, nil, fmt.Errorf("invalid netmask %q", r.Netmask)
+			}
+			dest = &net.IPNet{IP: ip.To4(), Mask: net.IPMask(mask.To4())}
+		} else {
+			if mask == nil || mask.To4() != nil {
+				return nil, nil, fmt.Errorf("invalid netmask %q", r.Netmask)
+			}
+			if ones, bits := net.IPMask(mask).Size(); ones == 0 && bits == 0 {
+				return nil, nil, fmt.Errorf("invalid netmask %q", r.Netmask)
+			}
+			dest = &net.IPNet{IP: ip, Mask: net.IPMask(mask)}
+		}
+		if !dest.IP.Equal(dest.IP.Mask(dest.Mask)) {
+			return nil, nil, fmt.Errorf("network %q has host bits set for netmask %q", r.Network, r.Netmask)
+		}
+	}
+	gateway := net.ParseIP(r.Gateway)
+	if gateway == nil {
+		return nil, nil, fmt.Errorf("invalid gateway %q", r.Gateway)
+	}
+	if (gateway.To4() != nil) != (dest.IP.To4() != nil) {
+		return nil, nil, fmt.Errorf("gateway %q and network %q are of different family", r.Gateway, r.Network)
+	}
+	return dest, gateway, nil
+}
+
+func isIPv4(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.To4() != nil
+}
+
+func isIPv6(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.To4() == nil
+}
+
+func isNetmask(netmask string) bool {
+	ip := net.ParseIP(netmask)
+	if ip == nil || ip.To4() == nil {
+		return false
+	}
+	_, bits := net.IPMask(ip.To4()).Size()
+	return bits != 0
+}
@@ -0,0 +1,156 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateStorageDeviceHints(t *testing.T) {
+	partitions := []StoragePartition{{Filesystem: FilesystemXFS}}
+	tests := []struct {
+		device  map[string]string
+		wantErr string
+	}{
+		{device: map[string]string{"model": "ST8000NM", "tran": "sas", "vendor": "SEAGATE"}},
+		{device: map[string]string{"name": "/dev/sdb"}},
+		{device: map[string]string{}, wantErr: "device hints are required"},
+		{device: map[string]string{"model": "ST8000NM", "rotational": "1"}, wantErr: `unknown device hint "rotational"`},
+	}
+	for _, tt := range tests {
+		n := Node{Storage: []StorageInfo{{Device: tt.device, Partitions: partitions}}}
+		err := n.ValidateStorage()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tt.device, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%v: ValidateStorage = %v, want error %q", tt.device, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRouteInfoParse(t *testing.T) {
+	tests := []struct {
+		route    RouteInfo
+		wantDest string
+		wantErr  string
+	}{
+		{route: RouteInfo{Network: "10.2.0.0/16", Gateway: "10.0.0.1"}, wantDest: "10.2.0.0/16"},
+		{route: RouteInfo{Network: "10.2.0.0", Netmask: "255.255.0.0", Gateway: "10.0.0.1"}, wantDest: "10.2.0.0/16"},
+		{route: RouteInfo{Network: "2001:db8:100::/48", Gateway: "2001:db8::1"}, wantDest: "2001:db8:100::/48"},
+		{route: RouteInfo{Network: "2001:db8:100::", Netmask: "ffff:ffff:ffff::", Gateway: "2001:db8::1"}, wantDest: "2001:db8:100::/48"},
+		{route: RouteInfo{Network: "10.2.0.0/16", Netmask: "255.255.0.0", Gateway: "10.0.0.1"}, wantErr: "netmask must be empty"},
+		{route: RouteInfo{Network: "10.2.0.1/16", Gateway: "10.0.0.1"}, wantErr: "invalid network"},
+		{route: RouteInfo{Network: "10.2.0.1", Netmask: "255.255.0.0", Gateway: "10.0.0.1"}, wantErr: "host bits set"},
+		{route: RouteInfo{Network: "10.2.0.0", Netmask: "255.0.255.0", Gateway: "10.0.0.1"}, wantErr: "invalid netmask"},
+		{route: RouteInfo{Network: "10.2.0.0", Gateway: "10.0.0.1"}, wantErr: "invalid netmask"},
+		{route: RouteInfo{Network: "2001:db8:100::", Netmask: "255.255.0.0", Gateway: "2001:db8::1"}, wantErr: "invalid netmask"},
+		{route: RouteInfo{Network: "example.com", Netmask: "255.255.0.0", Gateway: "10.0.0.1"}, wantErr: "invalid network"},
+		{route: RouteInfo{Network: "10.2.0.0/16"}, wantErr: "invalid gateway"},
+		{route: RouteInfo{Network: "10.2.0.0/16", Gateway: "2001:db8::1"}, wantErr: "different family"},
+	}
+	for _, tt := range tests {
+		dest, _, err := tt.route.Parse()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%+v: Parse = %v, want error %q", tt.route, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", tt.route, err)
+			continue
+		}
+		if dest.String() != tt.wantDest {
+			t.Errorf("%+v: destination = %s, want %s", tt.route, dest, tt.wantDest)
+		}
+	}
+}
+
+func TestValidateNetworks(t *testing.T) {
+	static := NetworkInfo{IPv4Address: "10.0.0.10", NetMask: "255.255.255.0", Gateway: "10.0.0.1"}
+	tests := []struct {
+		name    string
+		network NetworkInfo
+		wantErr string
+	}{
+		{name: "static", network: static},
+		{name: "dhcp", network: NetworkInfo{DHCP: true}},
+		{
+			name:    "dhcp with route",
+			network: NetworkInfo{DHCP: true, Routes: []RouteInfo{{Network: "10.2.0.0/16", Gateway: "10.0.0.1"}}},
+		},
+		{
+			name:    "dhcp with address",
+			network: NetworkInfo{DHCP: true, IPv4Address: "10.0.0.10", NetMask: "255.255.255.0"},
+			wantErr: "network[0]: address and netmask must be empty when dhcp is enabled",
+		},
+		{
+			name:    "dhcp with gateway",
+			network: NetworkInfo{DHCP: true, Gateway: "10.0.0.1"},
+			wantErr: "network[0]: gateway must be empty when dhcp is enabled",
+		},
+		{
+			name:    "vlan dhcp with gateway",
+			network: NetworkInfo{Vlans: []VlanInfo{{ID: 100, DHCP: true, Gateway: "10.1.0.1"}}},
+			wantErr: "network[0].vlan[100]: gateway must be empty when dhcp is enabled",
+		},
+		{
+			name:    "netmask without address",
+			network: NetworkInfo{NetMask: "255.255.255.0"},
+			wantErr: "netmask is set without address",
+		},
+		{
+			name:    "ipv6 gateway for ipv4",
+			network: NetworkInfo{IPv4Address: "10.0.0.10", NetMask: "255.255.255.0", Gateway: "2001:db8::1"},
+			wantErr: `invalid gateway "2001:db8::1"`,
+		},
+		{
+			name:    "invalid route",
+			network: NetworkInfo{IPv4Address: "10.0.0.10", NetMask: "255.255.255.0", Routes: []RouteInfo{{Network: "10.2.0.1/16", Gateway: "10.0.0.1"}}},
+			wantErr: "network[0].routes[0]: invalid network",
+		},
+		{
+			name:    "duplicate vlan",
+			network: NetworkInfo{VlanID: 100, Vlans: []VlanInfo{{ID: 100}}},
+			wantErr: "network[0].vlan[100]: duplicate vlan id",
+		},
+		{
+			name:    "vlan out of range",
+			network: NetworkInfo{Vlans: []VlanInfo{{ID: 4095}}},
+			wantErr: "vlan id 4095 out of range",
+		},
+		{
+			name:    "mtu",
+			network: NetworkInfo{IPv4Address: "10.0.0.10", NetMask: "255.255.255.0", MTU: "64"},
+			wantErr: `invalid mtu "64"`,
+		},
+		{
+			name:    "dns",
+			network: NetworkInfo{IPv4Address: "10.0.0.10", NetMask: "255.255.255.0", DNS: []string{"ns1"}},
+			wantErr: `invalid dns "ns1"`,
+		},
+	}
+	for _, tt := range tests {
+		err := Node{Network: tt.network}.ValidateNetworks()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: ValidateNetworks = %v, want error %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	n := Node{Networks: []NetworkInfo{
+		{Bond: BondInfo{Name: "bond0", Mode: "active-backup", Links: []string{"eno1", "eno2"}}},
+		{Bond: BondInfo{Name: "bond0", Mode: "active-backup", Links: []string{"eno3", "eno4"}}},
+	}}
+	if err := n.ValidateNetworks(); err == nil || !strings.Contains(err.Error(), "network[1].bond: duplicate bond name bond0") {
+		t.Errorf("ValidateNetworks = %v, want error of duplicate bond name", err)
+	}
+}
@@ -1,19 +1,21 @@
 package configdrive
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
 	"diskimage-installer/pkg/config"
 	"diskimage-installer/pkg/hardware"
+	"diskimage-installer/pkg/utils"
 )
 
 var metaDataVersions = []string{
@@ -64,18 +66,24 @@ type Link struct {
 type NetworkType string
 
 const (
-	NetworkTypeIPv4     NetworkType = "static"
-	NetworkTypeIPv4DHCP NetworkType = "dhcp4"
+	NetworkTypeIPv4               NetworkType = "static"
+	NetworkTypeIPv4DHCP           NetworkType = "dhcp4"
+	NetworkTypeIPv6               NetworkType = "ipv6"
+	NetworkTypeIPv6SLAAC          NetworkType = "ipv6_slaac"
+	NetworkTypeIPv6DHCPv6Stateful NetworkType = "ipv6_dhcpv6-stateful"
 )
 
 type Network struct {
 	ID        string      `json:"id"`
 	Link      string      `json:"link"`
 	Type      NetworkType `json:"type"`
-	IPAddress string      `json:"ip_address"`
-	Netmask   string      `json:"netmask"`
+	IPAddress string      `json:"ip_address,omitempty"`
+	Netmask   string      `json:"netmask,omitempty"`
 	DNS       []string    `json:"dns_nameservers,omitempty"`
 	Routes    []Route     `json:"routes"`
+	// NetworkIndex is index of the network of node in AllNetworks it is
+	// rendered from.
+	NetworkIndex int `json:"-"`
 }
 
 type Route struct {
@@ -94,13 +102,14 @@ type Service struct {
 }
 
 // Generate generate config drive and return the path of it.
-func Generate(networkInterfaces []hardware.NetworkInterface, nodeconfig config.Node, logger *zap.Logger) (string, error) {
+func Generate(ctx context.Context, networkInterfaces []hardware.NetworkInterface, nodeconfig config.Node, runner utils.Runner, logger *zap.Logger) (string, error) {
 	metadata := MetaData{
-		Hostname: nodeconfig.Name,
-		Name:     nodeconfig.Name,
-		UUID:     uuid.NewString(),
+		Hostname:    nodeconfig.Name,
+		Name:        nodeconfig.Name,
+		UUID:        uuid.NewString(),
+		PublickKeys: getPublicKeys(nodeconfig.SSHKeys),
 	}
-	networkData, err := getNetworkMetaData(networkInterfaces, nodeconfig)
+	networkData, err := GetNetworkMetaData(networkInterfaces, nodeconfig)
 	if err != nil {
 		return "", err
 	}
@@ -113,6 +122,29 @@ func Generate(networkInterfaces []hardware.NetworkInterface, nodeconfig config.N
 		return "", err
 	}
 
+	files := map[string][]byte{}
+	for _, version := range metaDataVersions {
+		files[path.Join("openstack", version, "meta_data.json")] = metadataByte
+		files[path.Join("openstack", version, "network_data.json")] = networkDataByte
+	}
+	dirs := []string{path.Join("openstack", "content")}
+	return makeISO(ctx, files, dirs, "config-2", metadata.UUID, runner, logger)
+}
+
+func getPublicKeys(keys []string) map[string]string {
+	if len(keys) == 0 {
+		return nil
+	}
+	result := make(map[string]string)
+	for i, key := range keys {
+		result[fmt.Sprintf("key-%d", i)] = key
+	}
+	return result
+}
+
+// makeISO writes files and empty dirs into a temporary directory and packs
+// it into an iso with volume label, the path of the iso is returned.
+func makeISO(ctx context.Context, files map[string][]byte, dirs []string, label, id string, runner utils.Runner, logger *zap.Logger) (string, error) {
 	dir, err := ioutil.TempDir("/tmp", "configdriver-")
 	if err != nil {
 		return "", err
@@ -123,41 +155,33 @@ func Generate(networkInterfaces []hardware.NetworkInterface, nodeconfig config.N
 		}
 	}()
 
-	contentDir := filepath.Join(dir, "openstack", "content")
-	if err := os.MkdirAll(contentDir, 0755); err != nil {
-		return "", err
-	}
-
-	for _, version := range metaDataVersions {
-		versiondir := filepath.Join(dir, "openstack", version)
-		if err := os.MkdirAll(versiondir, 0755); err != nil {
+	for _, d := range dirs {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
 			return "", err
 		}
+	}
 
-		metadataFile := path.Join(versiondir, "meta_data.json")
-		if err := ioutil.WriteFile(metadataFile, metadataByte, 0644); err != nil {
+	for name, data := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
 			return "", err
 		}
-
-		networkDataFile := path.Join(versiondir, "network_data.json")
-		if err := ioutil.WriteFile(networkDataFile, networkDataByte, 0644); err != nil {
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
 			return "", err
 		}
 	}
 
-	configdriverISO := path.Join("/tmp", fmt.Sprintf("%s%s.iso", "configdrive-", metadata.UUID))
+	configdriverISO := path.Join("/tmp", fmt.Sprintf("%s%s.iso", "configdrive-", id))
 	args := []string{
 		"-R",
 		"-V",
-		"config-2",
+		label,
 		"-o",
 		configdriverISO,
 		dir,
 	}
-	cmd := exec.Command("mkisofs", args...)
-	_, err = cmd.Output()
-	if err != nil {
-		return "", err
+	if out, err := runner.Run(ctx, "mkisofs", args...); err != nil {
+		return "", errors.Wrapf(err, "mkisofs: %s", out)
 	}
 	logger.Sugar().Infof("iso is writen to %s\n", configdriverISO)
 	return configdriverISO, nil
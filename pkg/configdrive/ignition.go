@@ -0,0 +1,271 @@
+package configdrive
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/hardware"
+	"diskimage-installer/pkg/utils"
+)
+
+const (
+	ignitionVersion      = "3.3.0"
+	defaultIgnitionLabel = "ignition"
+	defaultIgnitionUser  = "core"
+	networkdDir          = "/etc/systemd/network"
+)
+
+type Ignition struct {
+	Ignition IgnitionMeta    `json:"ignition"`
+	Passwd   IgnitionPasswd  `json:"passwd,omitempty"`
+	Storage  IgnitionStorage `json:"storage,omitempty"`
+}
+
+type IgnitionMeta struct {
+	Version string `json:"version"`
+}
+
+type IgnitionPasswd struct {
+	Users []IgnitionUser `json:"users,omitempty"`
+}
+
+type IgnitionUser struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+}
+
+type IgnitionStorage struct {
+	Files []IgnitionFile `json:"files,omitempty"`
+}
+
+type IgnitionFile struct {
+	Path      string           `json:"path"`
+	Mode      int              `json:"mode"`
+	Overwrite bool             `json:"overwrite"`
+	Contents  IgnitionContents `json:"contents"`
+}
+
+type IgnitionContents struct {
+	Source string `json:"source"`
+}
+
+// GenerateIgnition generate an Ignition config from node config, pack it into
+// a config drive and return the path of it.
+func GenerateIgnition(ctx context.Context, networkInterfaces []hardware.NetworkInterface, nodeconfig config.Node, runner utils.Runner, logger *zap.Logger) (string, error) {
+	data, err := IgnitionConfig(networkInterfaces, nodeconfig)
+	if err != nil {
+		return "", err
+	}
+	label := defaultIgnitionLabel
+	if nodeconfig.Ignition != nil && nodeconfig.Ignition.Label != "" {
+		label = nodeconfig.Ignition.Label
+	}
+	files := map[string][]byte{
+		"config.ign": data,
+	}
+	// Ignition of openstack platform looks for user_data on config-2
+	if label == "config-2" {
+		files[path.Join("openstack", "latest", "user_data")] = data
+	}
+	return makeISO(ctx, files, nil, label, uuid.NewString(), runner, logger)
+}
+
+// WriteIgnition writes Ignition config of node config to a file, which is
+// copied into the image, and returns the path of it.
+func WriteIgnition(networkInterfaces []hardware.NetworkInterface, nodeconfig config.Node, logger *zap.Logger) (string, error) {
+	data, err := IgnitionConfig(networkInterfaces, nodeconfig)
+	if err != nil {
+		return "", err
+	}
+	file := path.Join("/tmp", fmt.Sprintf("ignition-%s.ign", uuid.NewString()))
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		return "", err
+	}
+	logger.Sugar().Infof("ignition config is writen to %s", file)
+	return file, nil
+}
+
+// IgnitionConfig returns Ignition config of node config in JSON.
+func IgnitionConfig(networkInterfaces []hardware.NetworkInterface, nodeconfig config.Node) ([]byte, error) {
+	ign, err := getIgnition(networkInterfaces, nodeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(ign, "", "\t")
+}
+
+func getIgnition(networkInterfaces []hardware.NetworkInterface, nodeconfig config.Node) (Ignition, error) {
+	ign := Ignition{
+		Ignition: IgnitionMeta{Version: ignitionVersion},
+	}
+	if nodeconfig.Name != "" {
+		ign.Storage.Files = append(ign.Storage.Files, newIgnitionFile("/etc/hostname", nodeconfig.Name+"\n"))
+	}
+	if len(nodeconfig.SSHKeys) > 0 {
+		user := defaultIgnitionUser
+		if nodeconfig.Ignition != nil && nodeconfig.Ignition.User != "" {
+			user = nodeconfig.Ignition.User
+		}
+		ign.Passwd.Users = append(ign.Passwd.Users, IgnitionUser{
+			Name:              user,
+			SSHAuthorizedKeys: nodeconfig.SSHKeys,
+		})
+	}
+	if len(nodeconfig.AllNetworks()) == 0 {
+		return ign, nil
+	}
+	networkData, err := GetNetworkMetaData(networkInterfaces, nodeconfig)
+	if err != nil {
+		return Ignition{}, err
+	}
+	units := renderNetworkd(networkData)
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ign.Storage.Files = append(ign.Storage.Files, newIgnitionFile(path.Join(networkdDir, name), units[name]))
+	}
+	return ign, nil
+}
+
+func newIgnitionFile(filePath, content string) IgnitionFile {
+	return IgnitionFile{
+		Path:      filePath,
+		Mode:      0644,
+		Overwrite: true,
+		Contents: IgnitionContents{
+			Source: "data:;base64," + base64.StdEncoding.EncodeToString([]byte(content)),
+		},
+	}
+}
+
+// renderNetworkd converts network data into systemd-networkd units, keyed by
+// unit file name.
+func renderNetworkd(data NetworkMetaData) map[string]string {
+	units := map[string]string{}
+	var dns []string
+	for _, s := range data.Services {
+		if s.Type == ServiceTypeDNS {
+			dns = append(dns, s.Address)
+		}
+	}
+
+	for idx, link := range data.Links {
+		prefix := fmt.Sprintf("%02d-", 10+idx)
+		var b strings.Builder
+		switch link.Type {
+		case LinkTypePhy:
+			// bond and vlans take mac address of their first link, only
+			// the physical link is of type ether
+			fmt.Fprintf(&b, "[Match]\nMACAddress=%s\nType=ether\n\n", link.MacAddress)
+		case LinkTypeBond:
+			units[prefix+link.ID+".netdev"] = renderBondNetDev(link)
+			fmt.Fprintf(&b, "[Match]\nName=%s\n\n", link.ID)
+		case LinkTypeVlan:
+			units[prefix+link.ID+".netdev"] = fmt.Sprintf("[NetDev]\nName=%s\nKind=vlan\n\n[VLAN]\nId=%d\n", link.ID, link.VlanID)
+			fmt.Fprintf(&b, "[Match]\nName=%s\n\n", link.ID)
+		}
+		if link.MTU != "" {
+			fmt.Fprintf(&b, "[Link]\nMTUBytes=%s\n\n", link.MTU)
+		}
+		b.WriteString("[Network]\n")
+		if link.BondMaster != "" {
+			fmt.Fprintf(&b, "Bond=%s\n", link.BondMaster)
+		} else {
+			renderNetworkSection(&b, data, link.ID, dns)
+		}
+		name := link.ID
+		if link.Type == LinkTypePhy {
+			name = strings.ReplaceAll(link.MacAddress, ":", "")
+		}
+		units[prefix+name+".network"] = b.String()
+	}
+	return units
+}
+
+func renderBondNetDev(link Link) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[NetDev]\nName=%s\nKind=bond\n\n[Bond]\n", link.ID)
+	if link.BondMode != "" {
+		fmt.Fprintf(&b, "Mode=%s\n", link.BondMode)
+	}
+	if link.BondHashPolicy != "" {
+		fmt.Fprintf(&b, "TransmitHashPolicy=%s\n", link.BondHashPolicy)
+	}
+	if link.Bondmiimon > 0 {
+		fmt.Fprintf(&b, "MIIMonitorSec=%dms\n", link.Bondmiimon)
+	}
+	return b.String()
+}
+
+func renderNetworkSection(b *strings.Builder, data NetworkMetaData, linkID string, dns []string) {
+	for _, l := range data.Links {
+		if l.Type == LinkTypeVlan && l.VlanLink == linkID {
+			fmt.Fprintf(b, "VLAN=%s\n", l.ID)
+		}
+	}
+	var routes []Route
+	hasAddress, dhcp4, dhcp6 := false, false, false
+	for _, n := range data.Networks {
+		if n.Link != linkID {
+			continue
+		}
+		switch n.Type {
+		case NetworkTypeIPv4DHCP:
+			dhcp4 = true
+		case NetworkTypeIPv6DHCPv6Stateful:
+			dhcp6 = true
+		case NetworkTypeIPv6SLAAC:
+			b.WriteString("IPv6AcceptRA=yes\n")
+		default:
+			fmt.Fprintf(b, "Address=%s/%d\n", n.IPAddress, prefixLength(n.Netmask))
+		}
+		hasAddress = true
+		routes = append(routes, n.Routes...)
+	}
+	switch {
+	case dhcp4 && dhcp6:
+		b.WriteString("DHCP=yes\n")
+	case dhcp4:
+		b.WriteString("DHCP=ipv4\n")
+	case dhcp6:
+		b.WriteString("DHCP=ipv6\n")
+	}
+	if hasAddress {
+		for _, d := range dns {
+			fmt.Fprintf(b, "DNS=%s\n", d)
+		}
+	}
+	for _, r := range routes {
+		if r.Gateway == "" {
+			continue
+		}
+		fmt.Fprintf(b, "\n[Route]\nDestination=%s/%d\nGateway=%s\n", r.Network, prefixLength(r.Netmask), r.Gateway)
+	}
+}
+
+func prefixLength(netmask string) int {
+	ip := net.ParseIP(netmask)
+	if ip == nil {
+		return 0
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ones, _ := net.IPMask(v4).Size()
+		return ones
+	}
+	ones, _ := net.IPMask(ip).Size()
+	return ones
+}
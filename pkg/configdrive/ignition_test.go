@@ -0,0 +1,244 @@
+package configdrive
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/hardware"
+	"diskimage-installer/pkg/utils"
+)
+
+// isoRunner records files of the directory mkisofs packs, which is removed
+// once the iso is made.
+type isoRunner struct {
+	*utils.FakeRunner
+	files []string
+}
+
+func (r *isoRunner) Run(ctx context.Context, command string, args ...string) (string, error) {
+	if command == "mkisofs" {
+		dir := args[len(args)-1]
+		filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err == nil && p != dir {
+				rel, _ := filepath.Rel(dir, p)
+				if info.IsDir() {
+					rel += "/"
+				}
+				r.files = append(r.files, rel)
+			}
+			return nil
+		})
+		sort.Strings(r.files)
+	}
+	return r.FakeRunner.Run(ctx, command, args...)
+}
+
+func TestIgnitionConfig(t *testing.T) {
+	node := config.Node{
+		Name:     "node1",
+		SSHKeys:  []string{"ssh-ed25519 AAAA"},
+		Ignition: &config.IgnitionInfo{User: "admin"},
+	}
+	data, err := IgnitionConfig(nil, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ign := Ignition{}
+	if err := json.Unmarshal(data, &ign); err != nil {
+		t.Fatal(err)
+	}
+	if ign.Ignition.Version != ignitionVersion {
+		t.Errorf("version = %s, want %s", ign.Ignition.Version, ignitionVersion)
+	}
+	wantUsers := []IgnitionUser{{Name: "admin", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA"}}}
+	if !reflect.DeepEqual(ign.Passwd.Users, wantUsers) {
+		t.Errorf("users = %+v, want %+v", ign.Passwd.Users, wantUsers)
+	}
+	if len(ign.Storage.Files) != 1 || ign.Storage.Files[0].Path != "/etc/hostname" {
+		t.Fatalf("files = %+v, want /etc/hostname", ign.Storage.Files)
+	}
+	source := ign.Storage.Files[0].Contents.Source
+	hostname, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(source, "data:;base64,"))
+	if string(hostname) != "node1\n" {
+		t.Errorf("hostname = %q, want %q", hostname, "node1\n")
+	}
+}
+
+func TestIgnitionConfigNetworkd(t *testing.T) {
+	interfaces := []hardware.NetworkInterface{
+		{Name: "eno1", MACAddress: "aa:00:00:00:00:01", HasCarrier: true},
+	}
+	node := config.Node{
+		Network: config.NetworkInfo{
+			IPv4Address: "10.0.0.10",
+			NetMask:     "255.255.255.0",
+			Gateway:     "10.0.0.1",
+			DNS:         []string{"10.0.0.2"},
+		},
+		Ignition: &config.IgnitionInfo{},
+	}
+	data, err := IgnitionConfig(interfaces, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ign := Ignition{}
+	if err := json.Unmarshal(data, &ign); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, f := range ign.Storage.Files {
+		paths = append(paths, f.Path)
+	}
+	want := []string{"/etc/systemd/network/10-aa0000000001.network"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("paths = %v, want %v", paths, want)
+	}
+}
+
+func TestGenerateIgnitionLabel(t *testing.T) {
+	tests := []struct {
+		label     string
+		wantLabel string
+		wantFiles []string
+	}{
+		{
+			label:     "",
+			wantLabel: "ignition",
+			wantFiles: []string{"config.ign"},
+		},
+		{
+			label:     "config-2",
+			wantLabel: "config-2",
+			wantFiles: []string{"config.ign", "openstack/", "openstack/latest/", "openstack/latest/user_data"},
+		},
+	}
+	for _, tt := range tests {
+		runner := &isoRunner{FakeRunner: utils.NewFakeRunner()}
+		node := config.Node{Name: "node1", Ignition: &config.IgnitionInfo{Label: tt.label}}
+		iso, err := GenerateIgnition(context.Background(), nil, node, runner, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		calls := runner.Calls()
+		if len(calls) != 1 || !strings.HasPrefix(calls[0], "mkisofs -R -V "+tt.wantLabel+" -o "+iso+" ") {
+			t.Errorf("label %q: calls = %v, want mkisofs of label %s", tt.label, calls, tt.wantLabel)
+		}
+		if !reflect.DeepEqual(runner.files, tt.wantFiles) {
+			t.Errorf("label %q: files = %v, want %v", tt.label, runner.files, tt.wantFiles)
+		}
+	}
+}
+
+func TestWriteIgnition(t *testing.T) {
+	file, err := WriteIgnition(nil, config.Node{Name: "node1", Ignition: &config.IgnitionInfo{}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ign := Ignition{}
+	if err := json.Unmarshal(data, &ign); err != nil {
+		t.Fatalf("%s is not an ignition config: %v", file, err)
+	}
+}
+
+// networkdDevice is a link as networkd matches it.
+type networkdDevice struct {
+	name, mac, kind string
+}
+
+// firstNetworkUnit returns the .network unit networkd applies to d, the first
+// in lexical order whose every [Match] key matches.
+func firstNetworkUnit(units map[string]string, d networkdDevice) string {
+	names := []string{}
+	for name := range units {
+		if strings.HasSuffix(name, ".network") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		matched := true
+		section := ""
+		for _, line := range strings.Split(units[name], "\n") {
+			if strings.HasPrefix(line, "[") {
+				section = line
+				continue
+			}
+			kv := strings.SplitN(line, "=", 2)
+			if section != "[Match]" || len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "Name":
+				matched = matched && kv[1] == d.name
+			case "MACAddress":
+				matched = matched && kv[1] == d.mac
+			case "Type":
+				matched = matched && kv[1] == d.kind
+			}
+		}
+		if matched {
+			return name
+		}
+	}
+	return ""
+}
+
+func TestRenderNetworkdBondVlan(t *testing.T) {
+	node := config.Node{
+		Network: config.NetworkInfo{
+			IPv4Address: "10.0.0.10",
+			NetMask:     "255.255.255.0",
+			Gateway:     "10.0.0.1",
+			DNS:         []string{"10.0.0.2"},
+			Bond:        config.BondInfo{Mode: "802.3ad", Links: []string{"eno1", "eno2"}},
+			Vlans:       []config.VlanInfo{{ID: 100, IPv4Address: "10.1.0.10", NetMask: "255.255.255.0"}},
+		},
+	}
+	data, err := GetNetworkMetaData(testInterfaces(2), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units := renderNetworkd(data)
+	for _, name := range []string{"12-bond0.netdev", "13-bond0.100.netdev"} {
+		if _, ok := units[name]; !ok {
+			t.Errorf("no unit %s in %v", name, units)
+		}
+	}
+	// bond and its vlan have mac address of eno1
+	tests := []struct {
+		device networkdDevice
+		want   string
+		has    string
+	}{
+		{networkdDevice{"eno1", "aa:00:00:00:00:01", "ether"}, "10-aa0000000001.network", "Bond=bond0\n"},
+		{networkdDevice{"eno2", "aa:00:00:00:00:02", "ether"}, "11-aa0000000002.network", "Bond=bond0\n"},
+		{networkdDevice{"bond0", "aa:00:00:00:00:01", "bond"}, "12-bond0.network", "VLAN=bond0.100\nAddress=10.0.0.10/24\n"},
+		{networkdDevice{"bond0.100", "aa:00:00:00:00:01", "vlan"}, "13-bond0.100.network", "Address=10.1.0.10/24\n"},
+	}
+	for _, tt := range tests {
+		got := firstNetworkUnit(units, tt.device)
+		if got != tt.want {
+			t.Errorf("%s is configured by %s, want %s", tt.device.name, got, tt.want)
+			continue
+		}
+		if !strings.Contains(units[got], tt.has) {
+			t.Errorf("%s has no %q:\n%s", got, tt.has, units[got])
+		}
+	}
+}
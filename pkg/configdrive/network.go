@@ -2,6 +2,8 @@ package configdrive
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
 	"diskimage-installer/pkg/config"
 	"diskimage-installer/pkg/hardware"
@@ -9,158 +11,518 @@ import (
 	"github.com/pkg/errors"
 )
 
-func getNetworkMetaData(networkInterfaces []hardware.NetworkInterface, config config.Node) (NetworkMetaData, error) {
-	if config.Network.Bond.IsEmpty() {
-		data, err := processNoneBondNetwork(networkInterfaces, config)
-		if err != nil {
-			return NetworkMetaData{}, errors.Wrap(err, "ProcessNoneBondNetwork:")
+// GetNetworkMetaData renders networks of node config against network interfaces
+// of host.
+func GetNetworkMetaData(networkInterfaces []hardware.NetworkInterface, nodeConfig config.Node) (NetworkMetaData, error) {
+	if err := nodeConfig.ValidateNetworks(); err != nil {
+		return NetworkMetaData{}, errors.Wrap(err, "invalid network config")
+	}
+	networkdata := NetworkMetaData{
+		Links:    []Link{},
+		Networks: []Network{},
+		Services: []Service{},
+	}
+	// used records mac address of interfaces already taken by a network, so
+	// that an interface is never configured twice.
+	used := map[string]bool{}
+	bondNames := map[string]bool{}
+	for _, network := range nodeConfig.AllNetworks() {
+		if !network.Bond.IsEmpty() && network.Bond.Name != "" {
+			bondNames[network.Bond.Name] = true
 		}
-		return data, nil
 	}
-	data, err := processBondNetwork(networkInterfaces, config)
-	if err != nil {
-		return NetworkMetaData{}, errors.Wrap(err, "ProcessBondNetwork:")
+	bondIndex := 0
+	for idx, network := range nodeConfig.AllNetworks() {
+		first := len(networkdata.Networks)
+		if network.Bond.IsEmpty() {
+			if err := processNoneBondNetwork(&networkdata, networkInterfaces, network, used); err != nil {
+				return NetworkMetaData{}, errors.Wrap(err, "ProcessNoneBondNetwork:")
+			}
+		} else {
+			bondName := network.Bond.Name
+			if bondName == "" {
+				// cloud-init names bond interface with "bond%d", names taken
+				// explicitly by other bonds are skipped
+				for bondNames[fmt.Sprintf("bond%d", bondIndex)] {
+					bondIndex++
+				}
+				bondName = fmt.Sprintf("bond%d", bondIndex)
+				bondNames[bondName] = true
+			}
+			if err := processBondNetwork(&networkdata, networkInterfaces, network, bondName, used); err != nil {
+				return NetworkMetaData{}, errors.Wrap(err, "ProcessBondNetwork:")
+			}
+		}
+		for n := first; n < len(networkdata.Networks); n++ {
+			networkdata.Networks[n].NetworkIndex = idx
+		}
 	}
-	return data, nil
+
+	for _, network := range nodeConfig.AllNetworks() {
+		for _, dns := range network.DNS {
+			if hasDNSService(networkdata.Services, dns) {
+				continue
+			}
+			networkdata.Services = append(networkdata.Services, Service{
+				Type:    ServiceTypeDNS,
+				Address: dns,
+			})
+		}
+	}
+	return networkdata, nil
 }
 
-func processBondNetwork(networkInterfaces []hardware.NetworkInterface, nodeConfig config.Node) (NetworkMetaData, error) {
-	networkdata := NetworkMetaData{}
+func hasDNSService(services []Service, address string) bool {
+	for _, s := range services {
+		if s.Type == ServiceTypeDNS && s.Address == address {
+			return true
+		}
+	}
+	return false
+}
 
-	links := []Link{}
+func processBondNetwork(networkdata *NetworkMetaData, networkInterfaces []hardware.NetworkInterface, network config.NetworkInfo, bondName string, used map[string]bool) error {
 	bondLinks := []string{}
 	// add physical link
-	if nodeConfig.Network.Bond.BondAll {
+	if network.Bond.BondAll {
 		for _, n := range networkInterfaces {
-			if n.HasCarrier {
-				links = append(links, Link{
+			if n.HasCarrier && !used[n.MACAddress] && matchBondFilter(n, network.Bond.Filter) {
+				networkdata.Links = append(networkdata.Links, Link{
 					ID:         n.MACAddress,
 					Type:       LinkTypePhy,
 					MacAddress: n.MACAddress,
-					MTU:        nodeConfig.Network.MTU,
-					BondMaster: "bond0", // cloud-init names bond interface with "bond%d"
+					MTU:        network.MTU,
+					BondMaster: bondName,
 				})
 				bondLinks = append(bondLinks, n.MACAddress)
+				used[n.MACAddress] = true
 			}
 		}
 	} else {
-		interfaceMap := getNetworkInterfaceMap(networkInterfaces)
-		for _, l := range nodeConfig.Network.Bond.Links {
-			if i, ok := interfaceMap[l]; ok {
-				if !i.HasCarrier {
-					return networkdata, fmt.Errorf("interface %s has no carrier", i.Name)
-				}
-				links = append(links, Link{
-					ID:         i.MACAddress,
-					Type:       LinkTypePhy,
-					MacAddress: i.MACAddress,
-					MTU:        nodeConfig.Network.MTU,
-					BondMaster: "bond0", // cloud-init names bond interface with "bond%d"
-				})
-				bondLinks = append(bondLinks, i.MACAddress)
-			} else {
-				return networkdata, fmt.Errorf("host has no interface %s", l)
+		members, err := resolveBondLinks(networkInterfaces, network.Bond)
+		if err != nil {
+			return err
+		}
+		for _, i := range members {
+			if !i.HasCarrier {
+				return fmt.Errorf("interface %s has no carrier", i.Name)
+			}
+			if used[i.MACAddress] {
+				return fmt.Errorf("interface %s is already used", i.Name)
 			}
+			networkdata.Links = append(networkdata.Links, Link{
+				ID:         i.MACAddress,
+				Type:       LinkTypePhy,
+				MacAddress: i.MACAddress,
+				MTU:        network.MTU,
+				BondMaster: bondName,
+			})
+			bondLinks = append(bondLinks, i.MACAddress)
+			used[i.MACAddress] = true
 		}
 	}
+	if len(bondLinks) < network.Bond.MinLinkCount() {
+		return fmt.Errorf("bond %s has %d links with carrier, at least %d is needed", bondName, len(bondLinks), network.Bond.MinLinkCount())
+	}
 	// add bond link
-	links = append(links, Link{
-		ID:             "bond0",
+	networkdata.Links = append(networkdata.Links, Link{
+		ID:             bondName,
 		Type:           LinkTypeBond,
-		BondMode:       nodeConfig.Network.Bond.Mode,
-		BondHashPolicy: nodeConfig.Network.Bond.HashPolicy,
-		Bondmiimon:     nodeConfig.Network.Bond.Miimon,
+		BondMode:       network.Bond.ModeName(),
+		BondHashPolicy: network.Bond.HashPolicy,
+		Bondmiimon:     network.Bond.Miimon,
 		BondLinks:      bondLinks,
 	})
-	networkdata.Links = links
-
-	networks := []Network{
-		{
-			ID:        fmt.Sprintf("ipv4-%s", "bond0"),
-			Link:      "bond0",
-			Type:      NetworkTypeIPv4,
-			IPAddress: nodeConfig.Network.IPv4Address,
-			Netmask:   nodeConfig.Network.NetMask,
-			Routes: []Route{
-				{
-					Network: "0.0.0.0",
-					Netmask: "0.0.0.0",
-					Gateway: nodeConfig.Network.Gateway,
-				},
-			},
-		},
-	}
-	networkdata.Networks = networks
-
-	services := []Service{}
-	for _, dns := range nodeConfig.Network.DNS {
-		services = append(services, Service{
-			Type:    ServiceTypeDNS,
-			Address: dns,
-		})
+
+	return appendNetworks(networkdata, bondName, bondLinks[0], network)
+}
+
+func processNoneBondNetwork(networkdata *NetworkMetaData, networkInterfaces []hardware.NetworkInterface, network config.NetworkInfo, used map[string]bool) error {
+	bootInterface, err := selectBootInterface(networkInterfaces, network, used)
+	if err != nil {
+		return err
 	}
-	networkdata.Services = services
+	used[bootInterface.MACAddress] = true
 
-	return networkdata, nil
+	networkdata.Links = append(networkdata.Links, Link{
+		ID:         bootInterface.MACAddress,
+		Type:       LinkTypePhy,
+		MacAddress: bootInterface.MACAddress,
+		MTU:        network.MTU,
+	})
+	return appendNetworks(networkdata, bootInterface.MACAddress, bootInterface.MACAddress, network)
 }
 
-func processNoneBondNetwork(networkInterfaces []hardware.NetworkInterface, config config.Node) (NetworkMetaData, error) {
-	bootInterface := &hardware.NetworkInterface{}
+// resolveBondLinks looks up links of bond, by their references or by the
+// switch ports they are connected to. When both are given every link must be
+// connected to its switch port.
+func resolveBondLinks(networkInterfaces []hardware.NetworkInterface, bond config.BondInfo) ([]hardware.NetworkInterface, error) {
+	members := []hardware.NetworkInterface{}
+	for idx, l := range bond.Links {
+		i, ok := findNetworkInterface(networkInterfaces, l)
+		if !ok {
+			return nil, fmt.Errorf("host has no interface %s", l)
+		}
+		if idx < len(bond.SwitchPorts) {
+			sp := bond.SwitchPorts[idx]
+			if !matchSwitchPort(i, sp.Switch, sp.Port) {
+				return nil, fmt.Errorf("interface %s is connected to %s, expected %s/%s", i.Name, describeNeighbor(i), sp.Switch, sp.Port)
+			}
+		}
+		members = append(members, i)
+	}
+	if len(bond.Links) > 0 {
+		return members, nil
+	}
+	for _, sp := range bond.SwitchPorts {
+		found := false
+		for _, i := range networkInterfaces {
+			if matchSwitchPort(i, sp.Switch, sp.Port) {
+				members = append(members, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no interface is connected to %s/%s", sp.Switch, sp.Port)
+		}
+	}
+	return members, nil
+}
+
+func matchSwitchPort(n hardware.NetworkInterface, switchName, port string) bool {
+	if switchName == "" && port == "" {
+		return true
+	}
+	if n.LLDP == nil {
+		return false
+	}
+	if switchName != "" && !n.LLDP.MatchSwitch(switchName) {
+		return false
+	}
+	if port != "" && !n.LLDP.MatchPort(port) {
+		return false
+	}
+	return true
+}
+
+func describeNeighbor(n hardware.NetworkInterface) string {
+	if n.LLDP == nil {
+		return "no known switch"
+	}
+	return n.LLDP.String()
+}
+
+// IsBondMember reports whether n would be bonded by bond regardless of its
+// carrier.
+func IsBondMember(n hardware.NetworkInterface, bond config.BondInfo) bool {
+	if bond.BondAll {
+		return matchBondFilter(n, bond.Filter)
+	}
+	for _, l := range bond.Links {
+		if _, ok := findNetworkInterface([]hardware.NetworkInterface{n}, l); ok {
+			return true
+		}
+	}
+	for _, sp := range bond.SwitchPorts {
+		if matchSwitchPort(n, sp.Switch, sp.Port) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchBondFilter(n hardware.NetworkInterface, filter config.BondFilter) bool {
+	if filter.Speed > 0 && n.Speed != filter.Speed {
+		return false
+	}
+	if filter.MinSpeed > 0 && n.Speed < filter.MinSpeed {
+		return false
+	}
+	if len(filter.Drivers) > 0 && !containsString(filter.Drivers, n.Driver) {
+		return false
+	}
+	if len(filter.PCISlots) > 0 {
+		matched := false
+		for _, slot := range filter.PCISlots {
+			if n.PCIAddress != "" && strings.HasPrefix(n.PCIAddress, slot) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// selectBootInterface picks the link of a network which is not bonded by
+// interface or interface hint of network. Without any of them the interface
+// booting the ramdisk is used, or the first interface with carrier if BOOTIF
+// is unknown.
+func selectBootInterface(networkInterfaces []hardware.NetworkInterface, network config.NetworkInfo, used map[string]bool) (hardware.NetworkInterface, error) {
+	hint := network.InterfaceHint
+	if network.Interface != "" {
+		i, ok := findNetworkInterface(networkInterfaces, network.Interface)
+		if !ok {
+			return hardware.NetworkInterface{}, fmt.Errorf("host has no interface %s", network.Interface)
+		}
+		hint.MACAddress = i.MACAddress
+	}
+	if hint.IsEmpty() {
+		for _, n := range networkInterfaces {
+			if n.IsBootInterface && !used[n.MACAddress] {
+				hint.BootInterface = true
+				break
+			}
+		}
+	}
+
+	candidates := []hardware.NetworkInterface{}
 	for _, n := range networkInterfaces {
-		// FIXME(huabinhong) 没有DHCP的情况下，无法得知哪块网卡是应该配置的
-		// 这里选择第一块插了网线的网卡作为boot interface
+		if used[n.MACAddress] || !matchInterfaceHint(n, hint) {
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+	if len(candidates) == 0 {
+		if hint.Switch != "" || hint.SwitchPort != "" {
+			observed := []string{}
+			for _, n := range networkInterfaces {
+				observed = append(observed, fmt.Sprintf("%s=%s", n.Name, describeNeighbor(n)))
+			}
+			return hardware.NetworkInterface{}, fmt.Errorf("no unused interface is connected to %s/%s, observed %v", hint.Switch, hint.SwitchPort, observed)
+		}
+		return hardware.NetworkInterface{}, fmt.Errorf("there is no unused interface matching %+v", hint)
+	}
+	for _, n := range candidates {
 		if n.HasCarrier {
-			bootInterface = &n
-		}
-	}
-	if bootInterface == nil {
-		return NetworkMetaData{}, fmt.Errorf("there is no interface has carrier")
-	}
-
-	networkdata := NetworkMetaData{}
-	networks := []Network{
-		{
-			ID:        fmt.Sprintf("ipv4-%s", bootInterface.MACAddress),
-			Link:      bootInterface.MACAddress,
-			Type:      NetworkTypeIPv4,
-			IPAddress: config.Network.IPv4Address,
-			Netmask:   config.Network.NetMask,
-			Routes: []Route{
-				{
-					Network: "0.0.0.0",
-					Netmask: "0.0.0.0",
-					Gateway: config.Network.Gateway,
-				},
-			},
-		},
-	}
-	networkdata.Networks = networks
-
-	services := []Service{}
-	for _, dns := range config.Network.DNS {
-		services = append(services, Service{
-			Type:    ServiceTypeDNS,
-			Address: dns,
+			return n, nil
+		}
+	}
+	names := []string{}
+	for _, n := range candidates {
+		names = append(names, n.Name)
+	}
+	return hardware.NetworkInterface{}, fmt.Errorf("there is no interface has carrier in %v", names)
+}
+
+func matchInterfaceHint(n hardware.NetworkInterface, hint config.InterfaceHint) bool {
+	if hint.MACAddress != "" && !strings.EqualFold(hint.MACAddress, n.MACAddress) {
+		return false
+	}
+	if hint.Name != "" && hint.Name != n.Name {
+		return false
+	}
+	if hint.BIOSDevName != "" && hint.BIOSDevName != n.BIOSDevName {
+		return false
+	}
+	if hint.PCIAddress != "" && hint.PCIAddress != n.PCIAddress {
+		return false
+	}
+	if hint.MinSpeed > 0 && n.Speed < hint.MinSpeed {
+		return false
+	}
+	if hint.BootInterface && !n.IsBootInterface {
+		return false
+	}
+	return matchSwitchPort(n, hint.Switch, hint.SwitchPort)
+}
+
+// appendNetworks adds the addresses of network on link, they are put on a vlan
+// link when network is tagged. Every vlan of network is added on top of link
+// as well.
+func appendNetworks(networkdata *NetworkMetaData, linkID, mac string, network config.NetworkInfo) error {
+	addressLink := linkID
+	if network.VlanID > 0 {
+		addressLink = appendVlanLink(networkdata, linkID, mac, network.VlanID, network.MTU)
+	}
+	if err := appendAddresses(networkdata, addressLink, network.IPv4Address, network.NetMask, network.Gateway, network.DHCP, network.Routes, network.IPv6); err != nil {
+		return err
+	}
+	for _, vlan := range network.Vlans {
+		vlanLink := appendVlanLink(networkdata, linkID, mac, vlan.ID, vlan.MTU)
+		if err := appendAddresses(networkdata, vlanLink, vlan.IPv4Address, vlan.NetMask, vlan.Gateway, vlan.DHCP, vlan.Routes, vlan.IPv6); err != nil {
+			return errors.Wrapf(err, "vlan %d", vlan.ID)
+		}
+	}
+	return nil
+}
+
+// appendAddresses adds IPv4 and IPv6 networks on link, a link may only carry
+// vlans so both of them are optional. Static routes go to the network of
+// their family.
+func appendAddresses(networkdata *NetworkMetaData, linkID, address, netmask, gateway string, dhcp bool, routes []config.RouteInfo, ipv6 config.IPv6Info) error {
+	var ipv4Network, ipv6Network *Network
+	if dhcp {
+		ipv4Network = &Network{
+			ID:     fmt.Sprintf("ipv4-%s", linkID),
+			Link:   linkID,
+			Type:   NetworkTypeIPv4DHCP,
+			Routes: []Route{},
+		}
+	} else if address != "" {
+		network := newIPv4Network(linkID, address, netmask, gateway)
+		ipv4Network = &network
+	}
+	if !ipv6.IsEmpty() {
+		network, err := newIPv6Network(linkID, ipv6)
+		if err != nil {
+			return err
+		}
+		ipv6Network = &network
+	}
+
+	for _, r := range routes {
+		dest, gw, err := r.Parse()
+		if err != nil {
+			return err
+		}
+		route := Route{
+			Network: dest.IP.String(),
+			Netmask: net.IP(dest.Mask).String(),
+			Gateway: gw.String(),
+		}
+		target := ipv4Network
+		if gw.To4() == nil {
+			target = ipv6Network
+		}
+		if target == nil {
+			return fmt.Errorf("route to %s has no network of its family on %s", r.Network, linkID)
+		}
+		target.Routes = append(target.Routes, route)
+	}
+
+	if ipv4Network != nil {
+		networkdata.Networks = append(networkdata.Networks, *ipv4Network)
+	}
+	if ipv6Network != nil {
+		networkdata.Networks = append(networkdata.Networks, *ipv6Network)
+	}
+	return nil
+}
+
+func appendVlanLink(networkdata *NetworkMetaData, linkID, mac string, vlanID int, mtu string) string {
+	id := vlanLinkName(networkdata, linkID, vlanID)
+	networkdata.Links = append(networkdata.Links, Link{
+		ID:       id,
+		Type:     LinkTypeVlan,
+		VlanID:   vlanID,
+		VlanLink: linkID,
+		VlanMac:  mac,
+		MTU:      mtu,
+	})
+	return id
+}
+
+// vlanLinkName names vlan after its parent when the parent has a readable
+// name (e.g. bond0.100), physical links are identified by mac address so
+// vlan%d is used for them.
+func vlanLinkName(networkdata *NetworkMetaData, linkID string, vlanID int) string {
+	for _, l := range networkdata.Links {
+		if l.ID == linkID && l.Type == LinkTypeBond {
+			return fmt.Sprintf("%s.%d", linkID, vlanID)
+		}
+	}
+	name := fmt.Sprintf("vlan%d", vlanID)
+	// the same vlan may be tagged on more than one physical link
+	for n := 1; hasLink(networkdata.Links, name); n++ {
+		name = fmt.Sprintf("vlan%d-%d", vlanID, n)
+	}
+	return name
+}
+
+func hasLink(links []Link, id string) bool {
+	for _, l := range links {
+		if l.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func newIPv4Network(linkID, address, netmask, gateway string) Network {
+	network := Network{
+		ID:        fmt.Sprintf("ipv4-%s", linkID),
+		Link:      linkID,
+		Type:      NetworkTypeIPv4,
+		IPAddress: address,
+		Netmask:   netmask,
+		Routes:    []Route{},
+	}
+	if gateway != "" {
+		network.Routes = append(network.Routes, Route{
+			Network: "0.0.0.0",
+			Netmask: "0.0.0.0",
+			Gateway: gateway,
 		})
 	}
-	networkdata.Services = services
+	return network
+}
 
-	links := []Link{
-		{
-			ID:         bootInterface.MACAddress,
-			Type:       LinkTypePhy,
-			MacAddress: bootInterface.MACAddress,
-			MTU:        config.Network.MTU,
-		}}
-	networkdata.Links = links
+func newIPv6Network(linkID string, ipv6 config.IPv6Info) (Network, error) {
+	network := Network{
+		ID:     fmt.Sprintf("ipv6-%s", linkID),
+		Link:   linkID,
+		Routes: []Route{},
+	}
+	switch ipv6.Mode {
+	case config.IPv6ModeSLAAC:
+		network.Type = NetworkTypeIPv6SLAAC
+		return network, nil
+	case config.IPv6ModeDHCPv6Stateful:
+		network.Type = NetworkTypeIPv6DHCPv6Stateful
+		return network, nil
+	case config.IPv6ModeStatic, "":
+		network.Type = NetworkTypeIPv6
+	default:
+		return Network{}, fmt.Errorf("unknown ipv6 mode %s", ipv6.Mode)
+	}
 
-	return networkdata, nil
+	ip, ipnet, err := net.ParseCIDR(ipv6.Address)
+	if err != nil || ip.To4() != nil {
+		return Network{}, fmt.Errorf("invalid ipv6 address %q, address/prefix is expected", ipv6.Address)
+	}
+	network.IPAddress = ip.String()
+	network.Netmask = net.IP(ipnet.Mask).String()
+	if ipv6.Gateway != "" {
+		network.Routes = append(network.Routes, Route{
+			Network: "::",
+			Netmask: "::",
+			Gateway: ipv6.Gateway,
+		})
+	}
+	return network, nil
 }
 
-func getNetworkInterfaceMap(networkInterfaces []hardware.NetworkInterface) map[string]hardware.NetworkInterface {
-	interfaceMap := make(map[string]hardware.NetworkInterface)
-	for _, n := range networkInterfaces {
-		interfaceMap[n.MACAddress] = n
+// findNetworkInterface looks up interface referenced by mac address, kernel
+// name, biosdevname or PCI address, in that precedence.
+func findNetworkInterface(networkInterfaces []hardware.NetworkInterface, ref string) (hardware.NetworkInterface, bool) {
+	keys := []func(hardware.NetworkInterface) string{
+		func(n hardware.NetworkInterface) string { return strings.ToLower(n.MACAddress) },
+		func(n hardware.NetworkInterface) string { return n.Name },
+		func(n hardware.NetworkInterface) string { return n.BIOSDevName },
+		func(n hardware.NetworkInterface) string { return n.PCIAddress },
+	}
+	if _, err := net.ParseMAC(ref); err == nil {
+		ref = strings.ToLower(ref)
+	}
+	for _, key := range keys {
+		for _, n := range networkInterfaces {
+			if k := key(n); k != "" && k == ref {
+				return n, true
+			}
+		}
 	}
-	return interfaceMap
+	return hardware.NetworkInterface{}, false
 }
@@ -0,0 +1,522 @@
+package configdrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/hardware"
+)
+
+func testInterfaces(n int) []hardware.NetworkInterface {
+	interfaces := []hardware.NetworkInterface{}
+	for i := 1; i <= n; i++ {
+		interfaces = append(interfaces, hardware.NetworkInterface{
+			Name:       fmt.Sprintf("eno%d", i),
+			MACAddress: fmt.Sprintf("aa:00:00:00:00:%02x", i),
+			HasCarrier: true,
+		})
+	}
+	return interfaces
+}
+
+func bondIDs(data NetworkMetaData) []string {
+	ids := []string{}
+	for _, l := range data.Links {
+		if l.Type == LinkTypeBond {
+			ids = append(ids, l.ID)
+		}
+	}
+	return ids
+}
+
+func TestBondNames(t *testing.T) {
+	bond := func(name string, links ...string) config.NetworkInfo {
+		return config.NetworkInfo{Bond: config.BondInfo{Name: name, Mode: "active-backup", Links: links}}
+	}
+	tests := []struct {
+		name     string
+		networks []config.NetworkInfo
+		want     []string
+	}{
+		{
+			name:     "unnamed",
+			networks: []config.NetworkInfo{bond("", "eno1"), bond("", "eno2")},
+			want:     []string{"bond0", "bond1"},
+		},
+		{
+			name:     "unnamed after bond0 taken later",
+			networks: []config.NetworkInfo{bond("", "eno1"), bond("bond0", "eno2")},
+			want:     []string{"bond1", "bond0"},
+		},
+		{
+			name:     "unnamed skips every taken name",
+			networks: []config.NetworkInfo{bond("bond0", "eno1"), bond("", "eno2"), bond("bond1", "eno3"), bond("", "eno4")},
+			want:     []string{"bond0", "bond2", "bond1", "bond3"},
+		},
+	}
+	for _, tt := range tests {
+		data, err := GetNetworkMetaData(testInterfaces(4), config.Node{Networks: tt.networks})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := bondIDs(data); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: bonds = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func vlanLinks(data NetworkMetaData) []Link {
+	links := []Link{}
+	for _, l := range data.Links {
+		if l.Type == LinkTypeVlan {
+			links = append(links, l)
+		}
+	}
+	return links
+}
+
+func TestVlanLinks(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks []config.NetworkInfo
+		want     []Link
+	}{
+		{
+			name: "vlan of bond",
+			networks: []config.NetworkInfo{{
+				Bond:  config.BondInfo{Mode: "802.3ad", Links: []string{"eno1", "eno2"}},
+				Vlans: []config.VlanInfo{{ID: 100, IPv4Address: "10.1.0.10", NetMask: "255.255.255.0"}},
+			}},
+			want: []Link{{ID: "bond0.100", Type: LinkTypeVlan, VlanID: 100, VlanLink: "bond0", VlanMac: "aa:00:00:00:00:01"}},
+		},
+		{
+			name: "tagged address of physical link",
+			networks: []config.NetworkInfo{{
+				IPv4Address: "10.0.0.10",
+				NetMask:     "255.255.255.0",
+				Interface:   "eno2",
+				VlanID:      10,
+				MTU:         "9000",
+			}},
+			want: []Link{{ID: "vlan10", Type: LinkTypeVlan, VlanID: 10, VlanLink: "aa:00:00:00:00:02", VlanMac: "aa:00:00:00:00:02", MTU: "9000"}},
+		},
+		{
+			name: "same vlan on two physical links",
+			networks: []config.NetworkInfo{
+				{Interface: "eno1", Vlans: []config.VlanInfo{{ID: 100, IPv4Address: "10.1.0.10", NetMask: "255.255.255.0"}}},
+				{Interface: "eno2", Vlans: []config.VlanInfo{{ID: 100, IPv4Address: "10.1.0.11", NetMask: "255.255.255.0"}}},
+				{Interface: "eno3", Vlans: []config.VlanInfo{{ID: 100, IPv4Address: "10.1.0.12", NetMask: "255.255.255.0"}}},
+			},
+			want: []Link{
+				{ID: "vlan100", Type: LinkTypeVlan, VlanID: 100, VlanLink: "aa:00:00:00:00:01", VlanMac: "aa:00:00:00:00:01"},
+				{ID: "vlan100-1", Type: LinkTypeVlan, VlanID: 100, VlanLink: "aa:00:00:00:00:02", VlanMac: "aa:00:00:00:00:02"},
+				{ID: "vlan100-2", Type: LinkTypeVlan, VlanID: 100, VlanLink: "aa:00:00:00:00:03", VlanMac: "aa:00:00:00:00:03"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		data, err := GetNetworkMetaData(testInterfaces(3), config.Node{Networks: tt.networks})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := vlanLinks(data); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: vlans = %+v, want %+v", tt.name, got, tt.want)
+		}
+		// addresses are put on vlan, not on the link under it
+		for _, n := range data.Networks {
+			if !hasVlanLink(tt.want, n.Link) {
+				t.Errorf("%s: network %s is on %s, want a vlan", tt.name, n.IPAddress, n.Link)
+			}
+		}
+	}
+}
+
+func hasVlanLink(links []Link, id string) bool {
+	for _, l := range links {
+		if l.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVlanNetworkData(t *testing.T) {
+	node := config.Node{Network: config.NetworkInfo{
+		Interface: "eno1",
+		Vlans:     []config.VlanInfo{{ID: 100, IPv4Address: "10.1.0.10", NetMask: "255.255.255.0", Gateway: "10.1.0.1"}},
+	}}
+	data, err := GetNetworkMetaData(testInterfaces(1), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"id":"vlan100","type":"vlan","vlan_id":100,"vlan_link":"aa:00:00:00:00:01","vlan_mac_address":"aa:00:00:00:00:01"`, `"link":"vlan100","type":"static","ip_address":"10.1.0.10"`} {
+		if !strings.Contains(string(out), s) {
+			t.Errorf("network_data.json has no %s:\n%s", s, out)
+		}
+	}
+}
+
+func TestIPv6NetworkData(t *testing.T) {
+	route := config.RouteInfo{Network: "2001:db8:100::/48", Gateway: "2001:db8::fe"}
+	tests := []struct {
+		name    string
+		ipv6    config.IPv6Info
+		routes  []config.RouteInfo
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "static",
+			ipv6: config.IPv6Info{Mode: config.IPv6ModeStatic, Address: "2001:db8::10/64", Gateway: "2001:db8::1"},
+			want: `{"id":"ipv6-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"ipv6","ip_address":"2001:db8::10","netmask":"ffff:ffff:ffff:ffff::",` +
+				`"routes":[{"network":"::","netmask":"::","gateway":"2001:db8::1"}]}`,
+		},
+		{
+			name: "static is default mode",
+			ipv6: config.IPv6Info{Address: "2001:db8::10/64"},
+			want: `{"id":"ipv6-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"ipv6","ip_address":"2001:db8::10","netmask":"ffff:ffff:ffff:ffff::","routes":[]}`,
+		},
+		{
+			name:   "static with route",
+			ipv6:   config.IPv6Info{Address: "2001:db8::10/64", Gateway: "2001:db8::1"},
+			routes: []config.RouteInfo{route},
+			want: `{"id":"ipv6-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"ipv6","ip_address":"2001:db8::10","netmask":"ffff:ffff:ffff:ffff::",` +
+				`"routes":[{"network":"::","netmask":"::","gateway":"2001:db8::1"},{"network":"2001:db8:100::","netmask":"ffff:ffff:ffff::","gateway":"2001:db8::fe"}]}`,
+		},
+		{
+			name: "slaac",
+			ipv6: config.IPv6Info{Mode: config.IPv6ModeSLAAC},
+			want: `{"id":"ipv6-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"ipv6_slaac","routes":[]}`,
+		},
+		{
+			name:   "slaac with route",
+			ipv6:   config.IPv6Info{Mode: config.IPv6ModeSLAAC},
+			routes: []config.RouteInfo{route},
+			want: `{"id":"ipv6-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"ipv6_slaac",` +
+				`"routes":[{"network":"2001:db8:100::","netmask":"ffff:ffff:ffff::","gateway":"2001:db8::fe"}]}`,
+		},
+		{
+			name: "dhcpv6",
+			ipv6: config.IPv6Info{Mode: config.IPv6ModeDHCPv6Stateful},
+			want: `{"id":"ipv6-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"ipv6_dhcpv6-stateful","routes":[]}`,
+		},
+		{
+			name:    "static without prefix",
+			ipv6:    config.IPv6Info{Address: "2001:db8::10"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			ipv6:    config.IPv6Info{Mode: "dhcpv6-stateless"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		node := config.Node{Network: config.NetworkInfo{
+			Interface:   "eno1",
+			IPv4Address: "10.0.0.10",
+			NetMask:     "255.255.255.0",
+			IPv6:        tt.ipv6,
+			Routes:      tt.routes,
+		}}
+		data, err := GetNetworkMetaData(testInterfaces(1), node)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: GetNetworkMetaData succeeded, want error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// ipv4 network is kept, ipv6 follows it on the same link
+		if len(data.Networks) != 2 || data.Networks[0].Type != NetworkTypeIPv4 {
+			t.Fatalf("%s: networks = %+v, want ipv4 and ipv6", tt.name, data.Networks)
+		}
+		out, err := json.Marshal(data.Networks[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s: ipv6 network =\n%s\nwant\n%s", tt.name, out, tt.want)
+		}
+	}
+}
+
+func TestDHCPNetworkData(t *testing.T) {
+	tests := []struct {
+		name    string
+		network config.NetworkInfo
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "dhcp",
+			network: config.NetworkInfo{Interface: "eno1", DHCP: true, DNS: []string{"10.0.0.53"}},
+			want:    []string{`{"id":"ipv4-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"dhcp4","routes":[]}`},
+		},
+		{
+			name: "dhcp with route",
+			network: config.NetworkInfo{
+				Interface: "eno1",
+				DHCP:      true,
+				Routes:    []config.RouteInfo{{Network: "10.2.0.0/16", Gateway: "10.0.0.1"}},
+			},
+			want: []string{`{"id":"ipv4-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"dhcp4",` +
+				`"routes":[{"network":"10.2.0.0","netmask":"255.255.0.0","gateway":"10.0.0.1"}]}`},
+		},
+		{
+			name: "dhcp and slaac",
+			network: config.NetworkInfo{
+				Interface: "eno1",
+				DHCP:      true,
+				IPv6:      config.IPv6Info{Mode: config.IPv6ModeSLAAC},
+			},
+			want: []string{
+				`{"id":"ipv4-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"dhcp4","routes":[]}`,
+				`{"id":"ipv6-aa:00:00:00:00:01","link":"aa:00:00:00:00:01","type":"ipv6_slaac","routes":[]}`,
+			},
+		},
+		{
+			name:    "dhcp on vlan",
+			network: config.NetworkInfo{Interface: "eno1", Vlans: []config.VlanInfo{{ID: 100, DHCP: true}}},
+			want:    []string{`{"id":"ipv4-vlan100","link":"vlan100","type":"dhcp4","routes":[]}`},
+		},
+		{
+			// gateway used to be dropped silently
+			name:    "dhcp with gateway",
+			network: config.NetworkInfo{Interface: "eno1", DHCP: true, Gateway: "10.0.0.1"},
+			wantErr: "gateway must be empty when dhcp is enabled",
+		},
+	}
+	for _, tt := range tests {
+		data, err := GetNetworkMetaData(testInterfaces(1), config.Node{Network: tt.network})
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: GetNetworkMetaData = %v, want error %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := []string{}
+		for _, n := range data.Networks {
+			out, err := json.Marshal(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, string(out))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: networks =\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
+
+func TestSelectBootInterface(t *testing.T) {
+	interfaces := func(boot string, down ...string) []hardware.NetworkInterface {
+		interfaces := testInterfaces(4)
+		for i := range interfaces {
+			n := &interfaces[i]
+			n.Speed = 1000 * (i + 1)
+			n.IsBootInterface = n.Name == boot
+			for _, d := range down {
+				if n.Name == d {
+					n.HasCarrier = false
+				}
+			}
+		}
+		return interfaces
+	}
+	tests := []struct {
+		name       string
+		interfaces []hardware.NetworkInterface
+		network    config.NetworkInfo
+		used       []string
+		want       string
+		wantErr    string
+	}{
+		{
+			name:       "boot interface",
+			interfaces: interfaces("eno3"),
+			want:       "eno3",
+		},
+		{
+			name:       "hint over boot interface",
+			interfaces: interfaces("eno3"),
+			network:    config.NetworkInfo{InterfaceHint: config.InterfaceHint{Name: "eno2"}},
+			want:       "eno2",
+		},
+		{
+			name:       "min speed over boot interface",
+			interfaces: interfaces("eno1"),
+			network:    config.NetworkInfo{InterfaceHint: config.InterfaceHint{MinSpeed: 2500}},
+			want:       "eno3",
+		},
+		{
+			name:       "interface over boot interface",
+			interfaces: interfaces("eno3"),
+			network:    config.NetworkInfo{Interface: "aa:00:00:00:00:04"},
+			want:       "eno4",
+		},
+		{
+			name:       "hint of boot interface",
+			interfaces: interfaces("eno2"),
+			network:    config.NetworkInfo{InterfaceHint: config.InterfaceHint{BootInterface: true}},
+			want:       "eno2",
+		},
+		{
+			name:       "first interface with carrier without boot interface",
+			interfaces: interfaces("", "eno1", "eno2"),
+			want:       "eno3",
+		},
+		{
+			name:       "first interface with carrier when boot interface is used",
+			interfaces: interfaces("eno1", "eno2"),
+			used:       []string{"aa:00:00:00:00:01"},
+			want:       "eno3",
+		},
+		{
+			name:       "first matching interface with carrier",
+			interfaces: interfaces("", "eno3"),
+			network:    config.NetworkInfo{InterfaceHint: config.InterfaceHint{MinSpeed: 3000}},
+			want:       "eno4",
+		},
+		{
+			name:       "boot interface without carrier",
+			interfaces: interfaces("eno2", "eno2"),
+			wantErr:    "there is no interface has carrier in [eno2]",
+		},
+		{
+			name:       "no interface matches hint",
+			interfaces: interfaces("eno1"),
+			network:    config.NetworkInfo{InterfaceHint: config.InterfaceHint{MinSpeed: 10000}},
+			wantErr:    "there is no unused interface matching",
+		},
+		{
+			name:       "unknown interface",
+			interfaces: interfaces("eno1"),
+			network:    config.NetworkInfo{Interface: "eth0"},
+			wantErr:    "host has no interface eth0",
+		},
+	}
+	for _, tt := range tests {
+		used := map[string]bool{}
+		for _, mac := range tt.used {
+			used[mac] = true
+		}
+		n, err := selectBootInterface(tt.interfaces, tt.network, used)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: selectBootInterface = %v, want error %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if n.Name != tt.want {
+			t.Errorf("%s: interface = %s, want %s", tt.name, n.Name, tt.want)
+		}
+	}
+}
+
+func TestMatchBondFilter(t *testing.T) {
+	n := hardware.NetworkInterface{Name: "ens1f0", Speed: 25000, Driver: "mlx5_core", PCIAddress: "0000:3b:00.0"}
+	tests := []struct {
+		name   string
+		filter config.BondFilter
+		want   bool
+	}{
+		{name: "empty", filter: config.BondFilter{}, want: true},
+		{name: "speed", filter: config.BondFilter{Speed: 25000}, want: true},
+		{name: "other speed", filter: config.BondFilter{Speed: 10000}, want: false},
+		{name: "min speed", filter: config.BondFilter{MinSpeed: 25000}, want: true},
+		{name: "min speed above", filter: config.BondFilter{MinSpeed: 40000}, want: false},
+		{name: "driver", filter: config.BondFilter{Drivers: []string{"i40e", "mlx5_core"}}, want: true},
+		{name: "other driver", filter: config.BondFilter{Drivers: []string{"i40e"}}, want: false},
+		{name: "pci slot", filter: config.BondFilter{PCISlots: []string{"0000:af:00", "0000:3b:00"}}, want: true},
+		{name: "pci address", filter: config.BondFilter{PCISlots: []string{"0000:3b:00.0"}}, want: true},
+		{name: "other pci slot", filter: config.BondFilter{PCISlots: []string{"0000:af:00"}}, want: false},
+		{name: "every field", filter: config.BondFilter{MinSpeed: 10000, Drivers: []string{"mlx5_core"}, PCISlots: []string{"0000:3b"}}, want: true},
+		{name: "one field fails", filter: config.BondFilter{MinSpeed: 10000, Drivers: []string{"i40e"}, PCISlots: []string{"0000:3b"}}, want: false},
+	}
+	for _, tt := range tests {
+		if got := matchBondFilter(n, tt.filter); got != tt.want {
+			t.Errorf("%s: matchBondFilter = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// virtual interface has no PCI address
+	if matchBondFilter(hardware.NetworkInterface{Name: "veth0"}, config.BondFilter{PCISlots: []string{""}}) {
+		t.Errorf("interface without PCI address matches pci slot")
+	}
+}
+
+func TestFindNetworkInterface(t *testing.T) {
+	interfaces := []hardware.NetworkInterface{
+		{Name: "eno1", BIOSDevName: "em1", MACAddress: "aa:00:00:00:00:01", PCIAddress: "0000:3b:00.0"},
+		{Name: "eno2", BIOSDevName: "em2", MACAddress: "aa:00:00:00:00:02", PCIAddress: "0000:3b:00.1"},
+		{Name: "ens1f0", BIOSDevName: "p1p1", MACAddress: "aa:00:00:00:00:03", PCIAddress: "0000:af:00.0"},
+		{Name: "bond0", MACAddress: "aa:00:00:00:00:04"},
+	}
+	tests := []struct {
+		name       string
+		interfaces []hardware.NetworkInterface
+		ref        string
+		want       string
+	}{
+		{name: "mac address", interfaces: interfaces, ref: "aa:00:00:00:00:02", want: "eno2"},
+		{name: "mac address in upper case", interfaces: interfaces, ref: "AA:00:00:00:00:03", want: "ens1f0"},
+		{name: "name", interfaces: interfaces, ref: "eno2", want: "eno2"},
+		{name: "biosdevname", interfaces: interfaces, ref: "p1p1", want: "ens1f0"},
+		{name: "pci address", interfaces: interfaces, ref: "0000:3b:00.1", want: "eno2"},
+		{name: "pci slot is not an address", interfaces: interfaces, ref: "0000:3b:00", want: ""},
+		{name: "unknown", interfaces: interfaces, ref: "eth0", want: ""},
+		// empty attributes never match
+		{name: "empty", interfaces: interfaces, ref: "", want: ""},
+		{
+			name: "mac address over name",
+			interfaces: []hardware.NetworkInterface{
+				{Name: "aa:00:00:00:00:02", MACAddress: "aa:00:00:00:00:01"},
+				{Name: "eno2", MACAddress: "aa:00:00:00:00:02"},
+			},
+			ref:  "aa:00:00:00:00:02",
+			want: "eno2",
+		},
+		{
+			// biosdevname of one interface may be kernel name of another
+			name: "name over biosdevname",
+			interfaces: []hardware.NetworkInterface{
+				{Name: "eno1", BIOSDevName: "em2", MACAddress: "aa:00:00:00:00:01"},
+				{Name: "em2", MACAddress: "aa:00:00:00:00:02"},
+			},
+			ref:  "em2",
+			want: "em2",
+		},
+		{
+			name: "biosdevname over pci address",
+			interfaces: []hardware.NetworkInterface{
+				{Name: "eno1", MACAddress: "aa:00:00:00:00:01", PCIAddress: "0000:3b:00.0"},
+				{Name: "eno2", BIOSDevName: "0000:3b:00.0", MACAddress: "aa:00:00:00:00:02"},
+			},
+			ref:  "0000:3b:00.0",
+			want: "eno2",
+		},
+	}
+	for _, tt := range tests {
+		n, ok := findNetworkInterface(tt.interfaces, tt.ref)
+		if ok != (tt.want != "") || n.Name != tt.want {
+			t.Errorf("%s: findNetworkInterface(%q) = %s, %v, want %q", tt.name, tt.ref, n.Name, ok, tt.want)
+		}
+	}
+}
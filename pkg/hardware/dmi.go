@@ -0,0 +1,128 @@
+package hardware
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/config"
+)
+
+// DMIInfo is SMBIOS information exported by kernel under class/dmi/id.
+type DMIInfo struct {
+	System  DMISystem  `json:"system" yaml:"system"`
+	Board   DMIBoard   `json:"board" yaml:"board"`
+	Chassis DMIChassis `json:"chassis" yaml:"chassis"`
+	BIOS    DMIBIOS    `json:"bios" yaml:"bios"`
+}
+
+type DMISystem struct {
+	Vendor  string `json:"vendor" yaml:"vendor"`
+	Product string `json:"product" yaml:"product"`
+	Version string `json:"version" yaml:"version"`
+	Serial  string `json:"serial" yaml:"serial"`
+	UUID    string `json:"uuid" yaml:"uuid"`
+	SKU     string `json:"sku" yaml:"sku"`
+}
+
+type DMIBoard struct {
+	Vendor   string `json:"vendor" yaml:"vendor"`
+	Name     string `json:"name" yaml:"name"`
+	Version  string `json:"version" yaml:"version"`
+	Serial   string `json:"serial" yaml:"serial"`
+	AssetTag string `json:"asset_tag" yaml:"asset_tag"`
+}
+
+type DMIChassis struct {
+	Vendor   string `json:"vendor" yaml:"vendor"`
+	Type     string `json:"type" yaml:"type"`
+	Serial   string `json:"serial" yaml:"serial"`
+	AssetTag string `json:"asset_tag" yaml:"asset_tag"`
+}
+
+type DMIBIOS struct {
+	Vendor  string `json:"vendor" yaml:"vendor"`
+	Version string `json:"version" yaml:"version"`
+	Date    string `json:"date" yaml:"date"`
+}
+
+// GetDMIInfo reads DMI information from sysfs, attributes which can't be read
+// (serials and uuid need root) are left empty.
+func (m *HardWareManager) GetDMIInfo() DMIInfo {
+	read := func(attr string) string {
+		data, err := ioutil.ReadFile(filepath.Join(m.sysfs.Root, "class", "dmi", "id", attr))
+		if err != nil {
+			m.logger.Sugar().Debugf("read dmi %s: %v", attr, err)
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+	return DMIInfo{
+		System: DMISystem{
+			Vendor:  read("sys_vendor"),
+			Product: read("product_name"),
+			Version: read("product_version"),
+			Serial:  read("product_serial"),
+			UUID:    strings.ToLower(read("product_uuid")),
+			SKU:     read("product_sku"),
+		},
+		Board: DMIBoard{
+			Vendor:   read("board_vendor"),
+			Name:     read("board_name"),
+			Version:  read("board_version"),
+			Serial:   read("board_serial"),
+			AssetTag: read("board_asset_tag"),
+		},
+		Chassis: DMIChassis{
+			Vendor:   read("chassis_vendor"),
+			Type:     read("chassis_type"),
+			Serial:   read("chassis_serial"),
+			AssetTag: read("chassis_asset_tag"),
+		},
+		BIOS: DMIBIOS{
+			Vendor:  read("bios_vendor"),
+			Version: read("bios_version"),
+			Date:    read("bios_date"),
+		},
+	}
+}
+
+// GetIdentity returns identifiers of host for keys, NICs and BMC are only
+// queried when keys include them.
+func (m *HardWareManager) GetIdentity(ctx context.Context, keys []config.MatchKey) (config.Identity, error) {
+	dmi := m.GetDMIInfo()
+	identity := config.Identity{
+		Serial:   dmi.System.Serial,
+		UUID:     dmi.System.UUID,
+		AssetTag: dmi.Chassis.AssetTag,
+	}
+	if identity.AssetTag == "" {
+		identity.AssetTag = dmi.Board.AssetTag
+	}
+	for _, key := range keys {
+		switch key {
+		case config.MatchByMAC:
+			interfaces, err := m.ListNetworkInterface(ctx)
+			if err != nil {
+				return config.Identity{}, errors.Wrap(err, "ListNetworkInterface")
+			}
+			for _, n := range interfaces {
+				identity.MACAddresses = append(identity.MACAddresses, n.MACAddress)
+				if n.PermanentMACAddress != "" && n.PermanentMACAddress != n.MACAddress {
+					identity.MACAddresses = append(identity.MACAddresses, n.PermanentMACAddress)
+				}
+			}
+		case config.MatchByBMCIP:
+			bmc, err := m.GetBMCInfo(ctx)
+			if err != nil {
+				m.logger.Sugar().Warnf("GetBMCInfo: %v", err)
+			} else if bmc != nil {
+				identity.BMCIP = bmc.IPAddress
+			}
+		}
+	}
+	return identity, nil
+}
@@ -1,84 +1,263 @@
 package hardware
 
 import (
+	"context"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"diskimage-installer/pkg/utils"
+	"diskimage-installer/pkg/utils/netlink"
 	netutil "diskimage-installer/pkg/utils/network"
 )
 
 type NetworkInterface struct {
-	Name        string
-	BIOSDevName string
-	MACAddress  string
-	HasCarrier  bool
-	Speed       int
+	Name        string `json:"name" yaml:"name"`
+	BIOSDevName string `json:"bios_dev_name" yaml:"bios_dev_name"`
+	MACAddress  string `json:"mac_address" yaml:"mac_address"`
+	// PermanentMACAddress is the mac address burnt in device, which differs
+	// from MACAddress when interface is enslaved to a bond.
+	PermanentMACAddress string `json:"permanent_mac_address" yaml:"permanent_mac_address"`
+	PCIAddress          string `json:"pci_address" yaml:"pci_address"`
+	Driver              string `json:"driver" yaml:"driver"`
+	VendorID            string `json:"vendor_id" yaml:"vendor_id"`
+	DeviceID            string `json:"device_id" yaml:"device_id"`
+	HasCarrier          bool   `json:"has_carrier" yaml:"has_carrier"`
+	OperState           string `json:"oper_state" yaml:"oper_state"`
+	// Speed in Mb/s, -1 if unknown
+	Speed int `json:"speed" yaml:"speed"`
+	// Duplex is full, half or unknown
+	Duplex string `json:"duplex" yaml:"duplex"`
+	// SRIOVTotalVFs is the number of virtual functions device supports, 0
+	// if it is not SR-IOV capable.
+	SRIOVTotalVFs int `json:"sriov_total_vfs" yaml:"sriov_total_vfs"`
+	SRIOVNumVFs   int `json:"sriov_num_vfs" yaml:"sriov_num_vfs"`
+	// IsBootInterface is true when the ramdisk was booted from it.
+	IsBootInterface bool `json:"is_boot_interface" yaml:"is_boot_interface"`
+	// LLDP is the switch port of interface, it is nil until DiscoverLLDP
+	// hears from the switch.
+	LLDP *LLDPNeighbor `json:"lldp,omitempty" yaml:"lldp,omitempty"`
 }
 
 type HardWareManager struct {
 	logger *zap.Logger
+	sysfs  netutil.Sysfs
+	procfs string
+	// devfs is where device nodes are looked up, e.g. ipmi0 of BMC.
+	devfs  string
+	runner utils.Runner
+	// captureLLDP returns an LLDP frame received on interface, it can be
+	// replaced to feed captured frames.
+	captureLLDP func(ctx context.Context, adapter string, timeout time.Duration) ([]byte, error)
+	// listLinks returns links reported by kernel, which have permanent mac
+	// address that sysfs lacks.
+	listLinks func() ([]netlink.Link, error)
 }
 
 func NewHardWareManager(logger *zap.Logger) *HardWareManager {
 	return &HardWareManager{
-		logger: logger,
+		logger:      logger,
+		sysfs:       netutil.Sysfs{Root: netutil.DefaultSysfsRoot},
+		procfs:      "/proc",
+		devfs:       "/dev",
+		runner:      utils.ExecRunner{},
+		captureLLDP: netutil.CaptureLLDPFrame,
+		listLinks:   netlink.LinkList,
 	}
 }
 
+// SetSysfsRoot makes manager read sysfs under root instead of /sys, links
+// of kernel are no longer consulted since they don't belong to root.
+func (m *HardWareManager) SetSysfsRoot(root string) {
+	m.sysfs = netutil.Sysfs{Root: root}
+	if root != netutil.DefaultSysfsRoot {
+		m.listLinks = func() ([]netlink.Link, error) { return nil, nil }
+	}
+}
+
+// SetRunner makes manager run commands by runner.
+func (m *HardWareManager) SetRunner(runner utils.Runner) {
+	m.runner = runner
+}
+
+// SetProcfsRoot makes manager read procfs under root instead of /proc.
+func (m *HardWareManager) SetProcfsRoot(root string) {
+	m.procfs = root
+}
+
+// SetDevfsRoot makes manager look up device nodes under root instead of /dev.
+func (m *HardWareManager) SetDevfsRoot(root string) {
+	m.devfs = root
+}
+
 func (m *HardWareManager) GetBootMode() string {
-	if _, err := os.Stat("/sys/fireware/efi"); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(m.sysfs.Root, "firmware", "efi")); os.IsNotExist(err) {
 		return "bios"
 	}
 	return "efi"
 }
 
-func (m *HardWareManager) ListNetworkInterface() ([]NetworkInterface, error) {
-	interfaces, err := net.Interfaces()
+// ListNetworkInterface lists interfaces backed by a device. Interfaces whose
+// attributes can't be read are skipped with a warning rather than failing
+// the whole listing.
+func (m *HardWareManager) ListNetworkInterface(ctx context.Context) ([]NetworkInterface, error) {
+	names, err := m.sysfs.Interfaces()
 	if err != nil {
-		return nil, errors.Wrap(err, "net.Interfaces():")
+		return nil, errors.Wrap(err, "sysfs.Interfaces")
+	}
+	permanentMACs := map[string]string{}
+	links, err := m.listLinks()
+	if err != nil {
+		m.logger.Sugar().Warnf("netlink.LinkList: %v", err)
+	}
+	for _, l := range links {
+		if len(l.PermHardwareAddr) > 0 {
+			permanentMACs[l.Name] = l.PermHardwareAddr.String()
+		}
 	}
 
+	bootMAC, err := m.GetBootInterfaceMAC()
+	if err != nil {
+		m.logger.Sugar().Warnf("GetBootInterfaceMAC: %v", err)
+	}
 	devices := []NetworkInterface{}
-	for _, i := range interfaces {
-		if !netutil.IsDevice(i.Name) {
+	for _, name := range names {
+		if !m.sysfs.IsDevice(name) {
 			continue
 		}
-		n, err := m.GetNetworkInterfaceInfo(i.Name)
+		n, err := m.GetNetworkInterfaceInfo(ctx, name)
 		if err != nil {
-			return nil, err
+			m.logger.Sugar().Warnf("skip interface %s: %v", name, err)
+			continue
+		}
+		if mac, ok := permanentMACs[name]; ok {
+			n.PermanentMACAddress = mac
 		}
+		n.IsBootInterface = bootMAC != "" && (strings.EqualFold(n.MACAddress, bootMAC) || strings.EqualFold(n.PermanentMACAddress, bootMAC))
 		devices = append(devices, n)
 	}
 	return devices, nil
 
 }
 
-func (m *HardWareManager) GetNetworkInterfaceInfo(adapter string) (NetworkInterface, error) {
-	macaddr, err := netutil.GetMacAddr(adapter)
-	if err != nil {
-		return NetworkInterface{}, errors.Wrap(err, "netutil.GetMacAddr:")
+// WaitForCarrier polls network interfaces until every interface matched by
+// match has carrier or timeout expires, the last listed interfaces are
+// returned either way.
+func (m *HardWareManager) WaitForCarrier(ctx context.Context, match func(NetworkInterface) bool, timeout, interval time.Duration) ([]NetworkInterface, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		devices, err := m.ListNetworkInterface(ctx)
+		if err != nil {
+			return nil, err
+		}
+		down := []string{}
+		for _, n := range devices {
+			if match(n) && !n.HasCarrier {
+				down = append(down, n.Name)
+			}
+		}
+		if len(down) == 0 {
+			return devices, nil
+		}
+		if time.Now().After(deadline) {
+			m.logger.Sugar().Warnf("interfaces %v have no carrier after %v", down, timeout)
+			return devices, nil
+		}
+		m.logger.Sugar().Debugf("waiting for carrier of interfaces %v", down)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
 	}
-	biosdevname, err := netutil.GetBIOSDevName(adapter)
+}
+
+// GetBootInterfaceMAC returns mac address from BOOTIF= of kernel cmdline, which
+// is set by pxelinux (01-aa-bb-cc-dd-ee-ff) or ipxe (aa:bb:cc:dd:ee:ff). An
+// empty string is returned if there is no BOOTIF.
+func (m *HardWareManager) GetBootInterfaceMAC() (string, error) {
+	cmdline, err := m.GetKernelCmdline()
 	if err != nil {
-		m.logger.Sugar().Warnf("netutil.GetBIOSDevName: %v", err)
+		return "", err
 	}
-	speed, err := netutil.GetSpeed(adapter)
+	return parseBootIF(cmdline), nil
+}
+
+// GetKernelCmdline returns kernel cmdline the ramdisk was booted with.
+func (m *HardWareManager) GetKernelCmdline() (string, error) {
+	f := filepath.Join(m.procfs, "cmdline")
+	data, err := ioutil.ReadFile(f)
 	if err != nil {
-		return NetworkInterface{}, errors.Wrap(err, "netutil.GetSpeed")
+		return "", errors.Wrapf(err, "read %s", f)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func parseBootIF(cmdline string) string {
+	for _, arg := range strings.Fields(cmdline) {
+		if !strings.HasPrefix(arg, "BOOTIF=") {
+			continue
+		}
+		value := strings.ToLower(strings.TrimPrefix(arg, "BOOTIF="))
+		value = strings.ReplaceAll(value, "-", ":")
+		// strip ARP hardware type of pxelinux
+		if len(value) == 20 && strings.HasPrefix(value, "01:") {
+			value = value[3:]
+		}
+		if _, err := net.ParseMAC(value); err != nil {
+			return ""
+		}
+		return value
 	}
-	hascarrier, err := netutil.HasCarrier(adapter)
+	return ""
+}
+
+// GetNetworkInterfaceInfo reads attributes of adapter from sysfs and its
+// name from biosdevname, only an unreadable mac address is an error, other
+// attributes are left unknown.
+func (m *HardWareManager) GetNetworkInterfaceInfo(ctx context.Context, adapter string) (NetworkInterface, error) {
+	macaddr, err := m.sysfs.MACAddress(adapter)
 	if err != nil {
-		return NetworkInterface{}, errors.Wrap(err, "netutil.HasCarrier")
+		return NetworkInterface{}, errors.Wrap(err, "sysfs.MACAddress")
 	}
 	n := NetworkInterface{
-		Name:        adapter,
-		BIOSDevName: biosdevname,
-		MACAddress:  macaddr,
-		HasCarrier:  hascarrier,
-		Speed:       speed,
+		Name:       adapter,
+		MACAddress: macaddr,
+		Duplex:     m.sysfs.Duplex(adapter),
+	}
+	if n.BIOSDevName, err = netutil.BIOSDevName(ctx, m.runner, adapter); err != nil {
+		m.logger.Sugar().Debugf("netutil.BIOSDevName: %v", err)
+	}
+	if n.PermanentMACAddress, err = m.sysfs.PermanentMACAddress(adapter); err != nil {
+		n.PermanentMACAddress = macaddr
+	}
+	if n.Speed, err = m.sysfs.Speed(adapter); err != nil {
+		m.logger.Sugar().Warnf("sysfs.Speed: %v", err)
+	}
+	if n.HasCarrier, err = m.sysfs.HasCarrier(adapter); err != nil {
+		m.logger.Sugar().Warnf("sysfs.HasCarrier: %v", err)
+	}
+	if n.OperState, err = m.sysfs.OperState(adapter); err != nil {
+		m.logger.Sugar().Warnf("sysfs.OperState: %v", err)
+	}
+	if n.PCIAddress, err = m.sysfs.PCIAddress(adapter); err != nil {
+		m.logger.Sugar().Warnf("sysfs.PCIAddress: %v", err)
+	}
+	if n.Driver, err = m.sysfs.Driver(adapter); err != nil {
+		m.logger.Sugar().Warnf("sysfs.Driver: %v", err)
+	}
+	if n.VendorID, err = m.sysfs.VendorID(adapter); err != nil {
+		m.logger.Sugar().Debugf("sysfs.VendorID: %v", err)
+	}
+	if n.DeviceID, err = m.sysfs.DeviceID(adapter); err != nil {
+		m.logger.Sugar().Debugf("sysfs.DeviceID: %v", err)
 	}
+	n.SRIOVTotalVFs, n.SRIOVNumVFs = m.sysfs.SRIOV(adapter)
 	return n, nil
 }
@@ -0,0 +1,251 @@
+package hardware
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/utils"
+)
+
+// fixtureInterface is a network interface of a fixture sysfs tree.
+type fixtureInterface struct {
+	name string
+	// pci is PCI address of device, interface is virtual when it is empty.
+	pci   string
+	attrs map[string]string
+}
+
+// newFixtureRoots returns sysfs and procfs trees holding interfaces and
+// kernel cmdline.
+func newFixtureRoots(t *testing.T, cmdline string, interfaces ...fixtureInterface) (string, string) {
+	t.Helper()
+	sysfs := t.TempDir()
+	for _, n := range interfaces {
+		dir := filepath.Join(sysfs, "class", "net", n.name)
+		mustMkdir(t, dir)
+		if n.pci != "" {
+			device := filepath.Join(sysfs, "devices", "pci0000:00", n.pci)
+			mustMkdir(t, device)
+			if err := os.Symlink(device, filepath.Join(dir, "device")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for attr, value := range n.attrs {
+			mustWrite(t, filepath.Join(dir, attr), value+"\n")
+		}
+	}
+	procfs := t.TempDir()
+	mustWrite(t, filepath.Join(procfs, "cmdline"), cmdline+"\n")
+	return sysfs, procfs
+}
+
+func mustMkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustWrite(t *testing.T, file, content string) {
+	t.Helper()
+	mustMkdir(t, filepath.Dir(file))
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newFixtureManager(t *testing.T, cmdline string, interfaces ...fixtureInterface) *HardWareManager {
+	sysfs, procfs := newFixtureRoots(t, cmdline, interfaces...)
+	m := NewHardWareManager(zap.NewNop())
+	m.SetSysfsRoot(sysfs)
+	m.SetProcfsRoot(procfs)
+	m.SetDevfsRoot(t.TempDir())
+	m.SetRunner(utils.NewFakeRunner())
+	return m
+}
+
+func TestParseBootIF(t *testing.T) {
+	tests := []struct {
+		cmdline string
+		want    string
+	}{
+		{"ro quiet BOOTIF=01-AA-BB-CC-DD-EE-FF", "aa:bb:cc:dd:ee:ff"},
+		{"BOOTIF=aa:bb:cc:dd:ee:01 console=ttyS0", "aa:bb:cc:dd:ee:01"},
+		{"BOOTIF=not-a-mac", ""},
+		{"ro quiet", ""},
+	}
+	for _, tt := range tests {
+		if got := parseBootIF(tt.cmdline); got != tt.want {
+			t.Errorf("parseBootIF(%q) = %q, want %q", tt.cmdline, got, tt.want)
+		}
+	}
+}
+
+func TestBootInterfaceFromProcfs(t *testing.T) {
+	m := newFixtureManager(t, "initrd=initrd.img BOOTIF=01-aa-00-00-00-00-02",
+		fixtureInterface{name: "eno1", pci: "0000:3b:00.0", attrs: map[string]string{"address": "aa:00:00:00:00:01"}},
+		fixtureInterface{name: "eno2", pci: "0000:3b:00.1", attrs: map[string]string{"address": "aa:00:00:00:00:02"}},
+		fixtureInterface{name: "lo", attrs: map[string]string{"address": "00:00:00:00:00:00"}},
+	)
+	mac, err := m.GetBootInterfaceMAC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac != "aa:00:00:00:00:02" {
+		t.Errorf("GetBootInterfaceMAC() = %q, want aa:00:00:00:00:02", mac)
+	}
+	interfaces, err := m.ListNetworkInterface(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	boot := map[string]bool{}
+	for _, n := range interfaces {
+		boot[n.Name] = n.IsBootInterface
+	}
+	want := map[string]bool{"eno1": false, "eno2": true}
+	if len(boot) != len(want) || boot["eno1"] != want["eno1"] || boot["eno2"] != want["eno2"] {
+		t.Errorf("boot interfaces = %v, want %v", boot, want)
+	}
+}
+
+func TestNetworkInterfaceInfo(t *testing.T) {
+	m := newFixtureManager(t, "ro",
+		fixtureInterface{name: "eno1", pci: "0000:3b:00.0", attrs: map[string]string{
+			"address":       "aa:00:00:00:00:01",
+			"carrier":       "1",
+			"operstate":     "up",
+			"speed":         "10000",
+			"duplex":        "full",
+			"device/vendor": "0x8086",
+			"device/device": "0x1572",
+		}},
+		fixtureInterface{name: "ens3", pci: "0000:00:03.0", attrs: map[string]string{
+			"address":   "aa:00:00:00:00:02",
+			"carrier":   "0",
+			"operstate": "down",
+			"speed":     "-1",
+		}},
+	)
+	driver := filepath.Join(m.sysfs.Root, "bus", "pci", "drivers", "i40e")
+	mustMkdir(t, driver)
+	if err := os.Symlink(driver, filepath.Join(m.sysfs.Root, "devices", "pci0000:00", "0000:3b:00.0", "driver")); err != nil {
+		t.Fatal(err)
+	}
+	runner := utils.NewFakeRunner().
+		On("biosdevname -i eno1", "em1\n", nil).
+		On("biosdevname -i ens3", "", errors.New("exit status 1"))
+	m.SetRunner(runner)
+
+	got, err := m.ListNetworkInterface(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []NetworkInterface{
+		{
+			Name:                "eno1",
+			BIOSDevName:         "em1",
+			MACAddress:          "aa:00:00:00:00:01",
+			PermanentMACAddress: "aa:00:00:00:00:01",
+			PCIAddress:          "0000:3b:00.0",
+			Driver:              "i40e",
+			VendorID:            "0x8086",
+			DeviceID:            "0x1572",
+			HasCarrier:          true,
+			OperState:           "up",
+			Speed:               10000,
+			Duplex:              "full",
+		},
+		{
+			Name:                "ens3",
+			MACAddress:          "aa:00:00:00:00:02",
+			PermanentMACAddress: "aa:00:00:00:00:02",
+			PCIAddress:          "0000:00:03.0",
+			OperState:           "down",
+			Speed:               -1,
+			Duplex:              "unknown",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListNetworkInterface() = %+v, want %+v", got, want)
+	}
+	wantCalls := []string{"biosdevname -i eno1", "biosdevname -i ens3"}
+	if calls := runner.Calls(); !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("calls = %v, want %v", calls, wantCalls)
+	}
+}
+
+// carrierRunner brings carrier of eno2 up when it is listed for the up-th time.
+type carrierRunner struct {
+	*utils.FakeRunner
+	carrier string
+	up      int
+	polls   int
+}
+
+func (r *carrierRunner) Run(ctx context.Context, cmd string, args ...string) (string, error) {
+	if cmd == "biosdevname" && reflect.DeepEqual(args, []string{"-i", "eno2"}) {
+		r.polls++
+		if r.polls == r.up {
+			if err := ioutil.WriteFile(r.carrier, []byte("1\n"), 0644); err != nil {
+				return "", err
+			}
+		}
+	}
+	return r.FakeRunner.Run(ctx, cmd, args...)
+}
+
+func TestWaitForCarrier(t *testing.T) {
+	all := func(NetworkInterface) bool { return true }
+	tests := []struct {
+		name      string
+		match     func(NetworkInterface) bool
+		up        int
+		timeout   time.Duration
+		cancel    bool
+		wantPolls int
+		want      bool
+		wantErr   bool
+	}{
+		{name: "carrier comes up", match: all, up: 3, timeout: time.Minute, wantPolls: 3, want: true},
+		{name: "carrier never comes up", match: all, timeout: 20 * time.Millisecond, want: false},
+		{name: "interface is not waited for", match: func(n NetworkInterface) bool { return n.Name != "eno2" }, timeout: time.Minute, wantPolls: 1, want: false},
+		{name: "canceled", match: all, timeout: time.Minute, cancel: true, wantPolls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		m := newFixtureManager(t, "ro",
+			fixtureInterface{name: "eno1", pci: "0000:3b:00.0", attrs: map[string]string{"address": "aa:00:00:00:00:01", "carrier": "1"}},
+			fixtureInterface{name: "eno2", pci: "0000:3b:00.1", attrs: map[string]string{"address": "aa:00:00:00:00:02", "carrier": "0"}},
+		)
+		runner := &carrierRunner{FakeRunner: utils.NewFakeRunner(), carrier: filepath.Join(m.sysfs.Root, "class", "net", "eno2", "carrier"), up: tt.up}
+		m.SetRunner(runner)
+		ctx, cancel := context.WithCancel(context.Background())
+		if tt.cancel {
+			cancel()
+		}
+		devices, err := m.WaitForCarrier(ctx, tt.match, tt.timeout, time.Millisecond)
+		cancel()
+		if tt.wantErr {
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%s: WaitForCarrier = %v, want %v", tt.name, err, context.Canceled)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if tt.wantPolls > 0 && runner.polls != tt.wantPolls {
+			t.Errorf("%s: interfaces are listed %d times, want %d", tt.name, runner.polls, tt.wantPolls)
+		}
+		if len(devices) != 2 || devices[1].Name != "eno2" || devices[1].HasCarrier != tt.want {
+			t.Errorf("%s: interfaces = %+v, want carrier of eno2 %v", tt.name, devices, tt.want)
+		}
+	}
+}
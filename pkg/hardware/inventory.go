@@ -0,0 +1,304 @@
+package hardware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Inventory is the hardware of host.
+type Inventory struct {
+	BootMode          string             `json:"boot_mode" yaml:"boot_mode"`
+	DMI               DMIInfo            `json:"dmi" yaml:"dmi"`
+	CPU               CPUInfo            `json:"cpu" yaml:"cpu"`
+	Memory            MemoryInfo         `json:"memory" yaml:"memory"`
+	Disks             []DiskInfo         `json:"disks" yaml:"disks"`
+	NetworkInterfaces []NetworkInterface `json:"network_interfaces" yaml:"network_interfaces"`
+	// BMC is nil when host has no BMC or ipmitool is missing.
+	BMC *BMCInfo `json:"bmc,omitempty" yaml:"bmc,omitempty"`
+}
+
+type CPUInfo struct {
+	Model        string `json:"model" yaml:"model"`
+	Architecture string `json:"architecture" yaml:"architecture"`
+	Sockets      int    `json:"sockets" yaml:"sockets"`
+	Cores        int    `json:"cores" yaml:"cores"`
+	Threads      int    `json:"threads" yaml:"threads"`
+}
+
+type MemoryInfo struct {
+	// TotalBytes is memory usable by kernel.
+	TotalBytes uint64 `json:"total_bytes" yaml:"total_bytes"`
+	// PhysicalBytes is memory installed, counted by online memory blocks.
+	PhysicalBytes uint64 `json:"physical_bytes" yaml:"physical_bytes"`
+}
+
+type DiskInfo struct {
+	Name       string `json:"name" yaml:"name"`
+	Model      string `json:"model" yaml:"model"`
+	Vendor     string `json:"vendor" yaml:"vendor"`
+	Serial     string `json:"serial" yaml:"serial"`
+	WWN        string `json:"wwn" yaml:"wwn"`
+	SizeBytes  uint64 `json:"size_bytes" yaml:"size_bytes"`
+	Rotational bool   `json:"rotational" yaml:"rotational"`
+	Removable  bool   `json:"removable" yaml:"removable"`
+	// SMART is nil when smartctl is missing or disk doesn't support it.
+	SMART *SMARTSummary `json:"smart,omitempty" yaml:"smart,omitempty"`
+}
+
+type SMARTSummary struct {
+	Passed       bool `json:"passed" yaml:"passed"`
+	Temperature  int  `json:"temperature" yaml:"temperature"`
+	PowerOnHours int  `json:"power_on_hours" yaml:"power_on_hours"`
+	// PercentageUsed is the estimated endurance used of NVMe disk.
+	PercentageUsed int `json:"percentage_used,omitempty" yaml:"percentage_used,omitempty"`
+}
+
+type BMCInfo struct {
+	IPAddress  string `json:"ip_address" yaml:"ip_address"`
+	MACAddress string `json:"mac_address" yaml:"mac_address"`
+	// IPSource is how BMC gets its address, e.g. Static Address or DHCP
+	IPSource string `json:"ip_source" yaml:"ip_source"`
+}
+
+// GetInventory collects hardware of host, only failing to list network
+// interfaces or disks is an error, other parts are left empty.
+func (m *HardWareManager) GetInventory(ctx context.Context) (Inventory, error) {
+	inventory := Inventory{
+		BootMode: m.GetBootMode(),
+		DMI:      m.GetDMIInfo(),
+	}
+	var err error
+	if inventory.CPU, err = m.GetCPUInfo(); err != nil {
+		m.logger.Sugar().Warnf("GetCPUInfo: %v", err)
+	}
+	if inventory.Memory, err = m.GetMemoryInfo(); err != nil {
+		m.logger.Sugar().Warnf("GetMemoryInfo: %v", err)
+	}
+	if inventory.Disks, err = m.ListDisks(ctx); err != nil {
+		return Inventory{}, errors.Wrap(err, "ListDisks")
+	}
+	if inventory.NetworkInterfaces, err = m.ListNetworkInterface(ctx); err != nil {
+		return Inventory{}, errors.Wrap(err, "ListNetworkInterface")
+	}
+	if inventory.BMC, err = m.GetBMCInfo(ctx); err != nil {
+		m.logger.Sugar().Warnf("GetBMCInfo: %v", err)
+	}
+	return inventory, nil
+}
+
+func (m *HardWareManager) GetCPUInfo() (CPUInfo, error) {
+	f := filepath.Join(m.procfs, "cpuinfo")
+	file, err := os.Open(f)
+	if err != nil {
+		return CPUInfo{}, err
+	}
+	defer file.Close()
+
+	cpu := CPUInfo{Architecture: runtime.GOARCH}
+	sockets := map[string]bool{}
+	coresPerSocket := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "processor":
+			cpu.Threads++
+		case "model name":
+			if cpu.Model == "" {
+				cpu.Model = value
+			}
+		case "physical id":
+			sockets[value] = true
+		case "cpu cores":
+			coresPerSocket, _ = strconv.Atoi(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return CPUInfo{}, errors.Wrapf(err, "read %s", f)
+	}
+	cpu.Sockets = len(sockets)
+	if cpu.Sockets == 0 {
+		cpu.Sockets = 1
+	}
+	cpu.Cores = cpu.Sockets * coresPerSocket
+	if cpu.Cores == 0 {
+		cpu.Cores = cpu.Threads
+	}
+	return cpu, nil
+}
+
+func (m *HardWareManager) GetMemoryInfo() (MemoryInfo, error) {
+	f := filepath.Join(m.procfs, "meminfo")
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		return MemoryInfo{}, err
+	}
+	memory := MemoryInfo{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return MemoryInfo{}, errors.Wrapf(err, "parse MemTotal of %s", f)
+			}
+			memory.TotalBytes = kb * 1024
+		}
+	}
+
+	dir := filepath.Join(m.sysfs.Root, "devices", "system", "memory")
+	data, err = ioutil.ReadFile(filepath.Join(dir, "block_size_bytes"))
+	if err != nil {
+		m.logger.Sugar().Debugf("read memory block size: %v", err)
+		return memory, nil
+	}
+	blockSize, err := strconv.ParseUint(strings.TrimSpace(string(data)), 16, 64)
+	if err != nil {
+		return memory, errors.Wrap(err, "parse memory block size")
+	}
+	blocks, _ := filepath.Glob(filepath.Join(dir, "memory[0-9]*"))
+	for _, b := range blocks {
+		if online, err := ioutil.ReadFile(filepath.Join(b, "online")); err == nil && strings.TrimSpace(string(online)) == "1" {
+			memory.PhysicalBytes += blockSize
+		}
+	}
+	return memory, nil
+}
+
+// ListDisks lists block devices backed by a device, which excludes loop,
+// device mapper and md devices.
+func (m *HardWareManager) ListDisks(ctx context.Context) ([]DiskInfo, error) {
+	dir := filepath.Join(m.sysfs.Root, "block")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", dir)
+	}
+	_, lookErr := m.runner.LookPath("smartctl")
+	disks := []DiskInfo{}
+	for _, e := range entries {
+		read := func(elem ...string) string {
+			data, err := ioutil.ReadFile(filepath.Join(append([]string{dir, e.Name()}, elem...)...))
+			if err != nil {
+				return ""
+			}
+			return strings.TrimSpace(string(data))
+		}
+		if _, err := os.Stat(filepath.Join(dir, e.Name(), "device")); err != nil {
+			continue
+		}
+		disk := DiskInfo{
+			Name:       "/dev/" + e.Name(),
+			Model:      read("device", "model"),
+			Vendor:     read("device", "vendor"),
+			Serial:     read("device", "serial"),
+			WWN:        read("wwid"),
+			Rotational: read("queue", "rotational") == "1",
+			Removable:  read("removable") == "1",
+		}
+		if disk.Serial == "" {
+			disk.Serial = parseVPDSerial(read("device", "vpd_pg80"))
+		}
+		if disk.WWN == "" {
+			disk.WWN = read("device", "wwid")
+		}
+		if sectors, err := strconv.ParseUint(read("size"), 10, 64); err == nil {
+			disk.SizeBytes = sectors * 512
+		}
+		if lookErr == nil {
+			if disk.SMART, err = m.getSMARTSummary(ctx, disk.Name); err != nil {
+				m.logger.Sugar().Warnf("smart of %s: %v", disk.Name, err)
+			}
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// parseVPDSerial parses unit serial number page of SCSI VPD.
+func parseVPDSerial(page string) string {
+	if len(page) < 4 {
+		return ""
+	}
+	length := int(page[2])<<8 | int(page[3])
+	if 4+length > len(page) {
+		length = len(page) - 4
+	}
+	return strings.TrimSpace(page[4 : 4+length])
+}
+
+func (m *HardWareManager) getSMARTSummary(ctx context.Context, device string) (*SMARTSummary, error) {
+	// exit status of smartctl is a bit mask which is set on failing disks
+	// as well, json output is parsed regardless
+	out, _ := m.runner.Run(ctx, "smartctl", "--json", "-H", "-A", device)
+	data := struct {
+		SmartStatus *struct {
+			Passed bool `json:"passed"`
+		} `json:"smart_status"`
+		Temperature struct {
+			Current int `json:"current"`
+		} `json:"temperature"`
+		PowerOnTime struct {
+			Hours int `json:"hours"`
+		} `json:"power_on_time"`
+		NVMe struct {
+			PercentageUsed int `json:"percentage_used"`
+		} `json:"nvme_smart_health_information_log"`
+	}{}
+	if err := json.Unmarshal([]byte(out), &data); err != nil {
+		return nil, errors.Wrap(err, "parse smartctl output")
+	}
+	if data.SmartStatus == nil {
+		return nil, nil
+	}
+	return &SMARTSummary{
+		Passed:         data.SmartStatus.Passed,
+		Temperature:    data.Temperature.Current,
+		PowerOnHours:   data.PowerOnTime.Hours,
+		PercentageUsed: data.NVMe.PercentageUsed,
+	}, nil
+}
+
+// GetBMCInfo returns address of BMC by ipmitool, nil is returned when host
+// has no IPMI device.
+func (m *HardWareManager) GetBMCInfo(ctx context.Context) (*BMCInfo, error) {
+	if _, err := os.Stat(filepath.Join(m.devfs, "ipmi0")); err != nil {
+		return nil, nil
+	}
+	out, err := m.runner.Run(ctx, "ipmitool", "lan", "print")
+	if err != nil {
+		return nil, errors.Wrapf(err, "ipmitool lan print: %s", out)
+	}
+	return parseLanPrint(out), nil
+}
+
+func parseLanPrint(out string) *BMCInfo {
+	bmc := &BMCInfo{}
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "IP Address":
+			bmc.IPAddress = value
+		case "MAC Address":
+			bmc.MACAddress = value
+		case "IP Address Source":
+			bmc.IPSource = value
+		}
+	}
+	return bmc
+}
@@ -0,0 +1,299 @@
+package hardware
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"diskimage-installer/pkg/utils"
+)
+
+// cpuinfo has 2 sockets of 2 cores with hyper-threading.
+const cpuinfo = `processor	: 0
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+physical id	: 0
+cpu cores	: 2
+
+processor	: 1
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+physical id	: 0
+cpu cores	: 2
+
+processor	: 2
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+physical id	: 1
+cpu cores	: 2
+
+processor	: 3
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+physical id	: 1
+cpu cores	: 2
+
+processor	: 4
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+physical id	: 0
+cpu cores	: 2
+
+processor	: 5
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+physical id	: 0
+cpu cores	: 2
+
+processor	: 6
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+physical id	: 1
+cpu cores	: 2
+
+processor	: 7
+model name	: Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz
+physical id	: 1
+cpu cores	: 2
+`
+
+func TestGetCPUInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpuinfo string
+		want    CPUInfo
+	}{
+		{
+			name:    "two sockets",
+			cpuinfo: cpuinfo,
+			want:    CPUInfo{Model: "Intel(R) Xeon(R) Gold 6230 CPU @ 2.10GHz", Architecture: runtime.GOARCH, Sockets: 2, Cores: 4, Threads: 8},
+		},
+		{
+			// arm64 has neither model name nor physical id
+			name:    "no topology",
+			cpuinfo: "processor\t: 0\nBogoMIPS\t: 50.00\n\nprocessor\t: 1\nBogoMIPS\t: 50.00\n",
+			want:    CPUInfo{Architecture: runtime.GOARCH, Sockets: 1, Cores: 2, Threads: 2},
+		},
+	}
+	for _, tt := range tests {
+		m := newFixtureManager(t, "ro")
+		mustWrite(t, filepath.Join(m.procfs, "cpuinfo"), tt.cpuinfo)
+		got, err := m.GetCPUInfo()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: GetCPUInfo() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetMemoryInfo(t *testing.T) {
+	m := newFixtureManager(t, "ro")
+	mustWrite(t, filepath.Join(m.procfs, "meminfo"), "MemTotal:       16310696 kB\nMemFree:         8040220 kB\n")
+	dir := filepath.Join(m.sysfs.Root, "devices", "system", "memory")
+	mustWrite(t, filepath.Join(dir, "block_size_bytes"), "8000000\n")
+	mustWrite(t, filepath.Join(dir, "memory0", "online"), "1\n")
+	mustWrite(t, filepath.Join(dir, "memory1", "online"), "1\n")
+	mustWrite(t, filepath.Join(dir, "memory2", "online"), "0\n")
+	got, err := m.GetMemoryInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MemoryInfo{TotalBytes: 16310696 * 1024, PhysicalBytes: 2 * 0x8000000}
+	if got != want {
+		t.Errorf("GetMemoryInfo() = %+v, want %+v", got, want)
+	}
+
+	// physical memory is unknown without memory blocks
+	m = newFixtureManager(t, "ro")
+	mustWrite(t, filepath.Join(m.procfs, "meminfo"), "MemTotal:       16310696 kB\n")
+	if got, err := m.GetMemoryInfo(); err != nil || got != (MemoryInfo{TotalBytes: 16310696 * 1024}) {
+		t.Errorf("GetMemoryInfo() = %+v, %v, want total only", got, err)
+	}
+
+	m = newFixtureManager(t, "ro")
+	mustWrite(t, filepath.Join(m.procfs, "meminfo"), "MemTotal:       lots kB\n")
+	if _, err := m.GetMemoryInfo(); err == nil {
+		t.Errorf("GetMemoryInfo() of invalid MemTotal succeeded")
+	}
+}
+
+const (
+	smartSATA = `{"smart_status": {"passed": true}, "temperature": {"current": 31}, "power_on_time": {"hours": 12034}}`
+	smartNVMe = `{"smart_status": {"passed": false}, "temperature": {"current": 45},
+		"power_on_time": {"hours": 800}, "nvme_smart_health_information_log": {"percentage_used": 103}}`
+	// smartctl of a disk behind raid controller has no health
+	smartUnknown = `{"smartctl": {"exit_status": 2}}`
+)
+
+// newDiskFixture returns manager of sysfs holding sda (SATA SSD), sdb (SAS
+// HDD whose serial is in VPD), sdc (USB stick), nvme0n1 and loop0.
+func newDiskFixture(t *testing.T) *HardWareManager {
+	m := newFixtureManager(t, "ro")
+	block := filepath.Join(m.sysfs.Root, "block")
+	disks := map[string]map[string]string{
+		"sda": {
+			"device/model":     "MZ7LH480HAHQ",
+			"device/vendor":    "ATA",
+			"device/serial":    "S45NNE0M",
+			"device/wwid":      "naa.5002538e00000001",
+			"size":             "937703088",
+			"queue/rotational": "0",
+			"removable":        "0",
+		},
+		"sdb": {
+			"device/model":     "ST8000NM0075",
+			"device/vendor":    "SEAGATE",
+			"device/vpd_pg80":  "\x00\x80\x00\x08ZA1B2C3D",
+			"size":             "15628053168",
+			"queue/rotational": "1",
+			"removable":        "0",
+		},
+		"sdc": {
+			"device/model":     "Ultra Fit",
+			"device/vendor":    "SanDisk",
+			"size":             "60063744",
+			"queue/rotational": "1",
+			"removable":        "1",
+		},
+		"nvme0n1": {
+			"device/model":     "INTEL SSDPE2KX010T8",
+			"device/serial":    "PHLJ9150",
+			"wwid":             "eui.01000000010000005cd2e4e1",
+			"size":             "1953525168",
+			"queue/rotational": "0",
+			"removable":        "0",
+		},
+		// loop device isn't backed by a device
+		"loop0": {"size": "2048", "queue/rotational": "0"},
+	}
+	for name, attrs := range disks {
+		for attr, value := range attrs {
+			mustWrite(t, filepath.Join(block, name, attr), value+"\n")
+		}
+	}
+	return m
+}
+
+func TestListDisks(t *testing.T) {
+	m := newDiskFixture(t)
+	runner := utils.NewFakeRunner().
+		On("smartctl --json -H -A /dev/sda", smartSATA, nil).
+		// bit 3 of exit status is set on failing disk
+		On("smartctl --json -H -A /dev/nvme0n1", smartNVMe, errors.New("exit status 8")).
+		On("smartctl --json -H -A /dev/sdb", smartUnknown, errors.New("exit status 2")).
+		On("smartctl --json -H -A /dev/sdc", "", errors.New("exit status 1"))
+	m.SetRunner(runner)
+	got, err := m.ListDisks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DiskInfo{
+		{
+			Name:      "/dev/nvme0n1",
+			Model:     "INTEL SSDPE2KX010T8",
+			Serial:    "PHLJ9150",
+			WWN:       "eui.01000000010000005cd2e4e1",
+			SizeBytes: 1953525168 * 512,
+			SMART:     &SMARTSummary{Passed: false, Temperature: 45, PowerOnHours: 800, PercentageUsed: 103},
+		},
+		{
+			Name:      "/dev/sda",
+			Model:     "MZ7LH480HAHQ",
+			Vendor:    "ATA",
+			Serial:    "S45NNE0M",
+			WWN:       "naa.5002538e00000001",
+			SizeBytes: 937703088 * 512,
+			SMART:     &SMARTSummary{Passed: true, Temperature: 31, PowerOnHours: 12034},
+		},
+		{
+			Name:       "/dev/sdb",
+			Model:      "ST8000NM0075",
+			Vendor:     "SEAGATE",
+			Serial:     "ZA1B2C3D",
+			SizeBytes:  15628053168 * 512,
+			Rotational: true,
+		},
+		{
+			Name:       "/dev/sdc",
+			Model:      "Ultra Fit",
+			Vendor:     "SanDisk",
+			SizeBytes:  60063744 * 512,
+			Rotational: true,
+			Removable:  true,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListDisks() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	// smartctl is not run when it is missing
+	runner = utils.NewFakeRunner()
+	runner.Missing = []string{"smartctl"}
+	m.SetRunner(runner)
+	got, err = m.ListDisks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range got {
+		if d.SMART != nil {
+			t.Errorf("%s has smart without smartctl", d.Name)
+		}
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("calls = %v, want none", calls)
+	}
+}
+
+func TestParseVPDSerial(t *testing.T) {
+	tests := []struct {
+		page string
+		want string
+	}{
+		{"\x00\x80\x00\x08ZA1B2C3D", "ZA1B2C3D"},
+		{"\x00\x80\x00\x0a  ZA1B2C3D", "ZA1B2C3D"},
+		// length beyond page is truncated
+		{"\x00\x80\x00\x20ZA1B", "ZA1B"},
+		{"\x00\x80", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := parseVPDSerial(tt.page); got != tt.want {
+			t.Errorf("parseVPDSerial(%q) = %q, want %q", tt.page, got, tt.want)
+		}
+	}
+}
+
+func TestGetBMCInfo(t *testing.T) {
+	lanPrint := `Set in Progress         : Set Complete
+IP Address Source       : Static Address
+IP Address              : 10.10.0.21
+Subnet Mask             : 255.255.255.0
+MAC Address             : 3c:ec:ef:00:00:01
+Default Gateway IP      : 10.10.0.1
+`
+	m := newFixtureManager(t, "ro")
+	runner := utils.NewFakeRunner().On("ipmitool lan print", lanPrint, nil)
+	m.SetRunner(runner)
+
+	// no ipmi device
+	bmc, err := m.GetBMCInfo(context.Background())
+	if err != nil || bmc != nil {
+		t.Errorf("GetBMCInfo() without ipmi0 = %+v, %v, want nil", bmc, err)
+	}
+	if calls := runner.Calls(); len(calls) != 0 {
+		t.Errorf("calls without ipmi0 = %v, want none", calls)
+	}
+
+	mustWrite(t, filepath.Join(m.devfs, "ipmi0"), "")
+	bmc, err = m.GetBMCInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &BMCInfo{IPAddress: "10.10.0.21", MACAddress: "3c:ec:ef:00:00:01", IPSource: "Static Address"}
+	if !reflect.DeepEqual(bmc, want) {
+		t.Errorf("GetBMCInfo() = %+v, want %+v", bmc, want)
+	}
+
+	runner.On("ipmitool lan print", "Could not open device at /dev/ipmi0", errors.New("exit status 1"))
+	if _, err := m.GetBMCInfo(context.Background()); err == nil {
+		t.Errorf("GetBMCInfo() succeeded when ipmitool fails")
+	}
+}
@@ -0,0 +1,158 @@
+package hardware
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	netutil "diskimage-installer/pkg/utils/network"
+)
+
+const (
+	ethP8021Q = 0x8100
+
+	lldpTLVEnd             = 0
+	lldpTLVChassisID       = 1
+	lldpTLVPortID          = 2
+	lldpTLVPortDescription = 4
+	lldpTLVSystemName      = 5
+
+	lldpChassisIDMAC     = 4
+	lldpChassisIDAddress = 5
+	lldpPortIDMAC        = 3
+	lldpPortIDAddress    = 4
+)
+
+// LLDPNeighbor is the switch port an interface is connected to.
+type LLDPNeighbor struct {
+	ChassisID       string `json:"chassis_id" yaml:"chassis_id"`
+	PortID          string `json:"port_id" yaml:"port_id"`
+	PortDescription string `json:"port_description" yaml:"port_description"`
+	SystemName      string `json:"system_name" yaml:"system_name"`
+}
+
+// MatchSwitch reports whether neighbor is switch, given by chassis id or
+// system name.
+func (n LLDPNeighbor) MatchSwitch(name string) bool {
+	return strings.EqualFold(name, n.ChassisID) || (n.SystemName != "" && name == n.SystemName)
+}
+
+// MatchPort reports whether neighbor is port, given by port id or port
+// description.
+func (n LLDPNeighbor) MatchPort(port string) bool {
+	return strings.EqualFold(port, n.PortID) || (n.PortDescription != "" && port == n.PortDescription)
+}
+
+func (n LLDPNeighbor) String() string {
+	name := n.SystemName
+	if name == "" {
+		name = n.ChassisID
+	}
+	return fmt.Sprintf("%s/%s", name, n.PortID)
+}
+
+// DiscoverLLDP listens on every interface for an LLDP frame up to timeout and
+// sets LLDP of interfaces heard from their neighbor. Interfaces are brought up
+// while listening. Listening stops once ctx is done, ctx.Err() is returned
+// then.
+func (m *HardWareManager) DiscoverLLDP(ctx context.Context, networkInterfaces []NetworkInterface, timeout time.Duration) ([]NetworkInterface, error) {
+	result := make([]NetworkInterface, len(networkInterfaces))
+	copy(result, networkInterfaces)
+	var wg sync.WaitGroup
+	for idx := range result {
+		wg.Add(1)
+		go func(n *NetworkInterface) {
+			defer wg.Done()
+			frame, err := m.captureLLDP(ctx, n.Name, timeout)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				m.logger.Sugar().Warnf("capture lldp on %s: %v", n.Name, err)
+				return
+			}
+			neighbor, err := ParseLLDPFrame(frame)
+			if err != nil {
+				m.logger.Sugar().Warnf("parse lldp frame of %s: %v", n.Name, err)
+				return
+			}
+			m.logger.Sugar().Infof("interface %s is connected to %s", n.Name, neighbor)
+			n.LLDP = &neighbor
+		}(&result[idx])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ParseLLDPFrame parses an ethernet frame carrying LLDPDU, as captured on
+// the wire.
+func ParseLLDPFrame(frame []byte) (LLDPNeighbor, error) {
+	if len(frame) < 14 {
+		return LLDPNeighbor{}, fmt.Errorf("frame too short")
+	}
+	offset := 12
+	ethertype := binary.BigEndian.Uint16(frame[offset:])
+	if ethertype == ethP8021Q && len(frame) >= 18 {
+		offset += 4
+		ethertype = binary.BigEndian.Uint16(frame[offset:])
+	}
+	if ethertype != netutil.EthPLLDP {
+		return LLDPNeighbor{}, fmt.Errorf("ethertype %#04x is not lldp", ethertype)
+	}
+	return parseLLDPDU(frame[offset+2:])
+}
+
+func parseLLDPDU(data []byte) (LLDPNeighbor, error) {
+	neighbor := LLDPNeighbor{}
+	for len(data) >= 2 {
+		header := binary.BigEndian.Uint16(data)
+		typ, length := int(header>>9), int(header&0x1ff)
+		data = data[2:]
+		if length > len(data) {
+			return LLDPNeighbor{}, fmt.Errorf("tlv %d length %d exceeds frame", typ, length)
+		}
+		value := data[:length]
+		data = data[length:]
+		switch typ {
+		case lldpTLVEnd:
+			data = nil
+		case lldpTLVChassisID:
+			neighbor.ChassisID = formatLLDPID(value, lldpChassisIDMAC, lldpChassisIDAddress)
+		case lldpTLVPortID:
+			neighbor.PortID = formatLLDPID(value, lldpPortIDMAC, lldpPortIDAddress)
+		case lldpTLVPortDescription:
+			neighbor.PortDescription = string(value)
+		case lldpTLVSystemName:
+			neighbor.SystemName = string(value)
+		}
+	}
+	if neighbor.ChassisID == "" || neighbor.PortID == "" {
+		return LLDPNeighbor{}, fmt.Errorf("lldpdu has no chassis id or port id")
+	}
+	return neighbor, nil
+}
+
+// formatLLDPID formats chassis id or port id by its subtype, the first byte
+// of value.
+func formatLLDPID(value []byte, macSubtype, addressSubtype byte) string {
+	if len(value) < 2 {
+		return ""
+	}
+	subtype, id := value[0], value[1:]
+	switch {
+	case subtype == macSubtype && len(id) == 6:
+		return net.HardwareAddr(id).String()
+	case subtype == addressSubtype && len(id) == 5 && id[0] == 1:
+		return net.IP(id[1:]).String()
+	case subtype == addressSubtype && len(id) == 17 && id[0] == 2:
+		return net.IP(id[1:]).String()
+	}
+	return string(id)
+}
@@ -0,0 +1,159 @@
+package hardware
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Frames as captured on the wire, without FCS.
+var (
+	// Extreme Summit300-48, chassis id is mac address, port id is interface
+	// name
+	summitFrame = `
+		0180c200000e 000130f9ada0 88cc
+		0207 04 000130f9ada0
+		0404 05 312f31
+		0602 0078
+		0a0c 53756d6d69743330302d3438
+		0000`
+	// Juniper through 802.1Q tag of vlan 100, port id is locally assigned
+	// with port description
+	juniperFrame = `
+		0180c200000e 2c6bf5000001 8100 0064 88cc
+		0207 04 2c6bf5000000
+		0409 07 67652d302f302f31
+		0602 0078
+		0808 7365727665723031
+		0a07 71667835313030
+		0000`
+	// port id is the IPv4 address 192.0.2.1
+	addressFrame = `
+		0180c200000e 020000000001 88cc
+		0207 04 020000000001
+		0406 04 01 c0000201
+		0000`
+)
+
+func mustFrame(t *testing.T, s string) []byte {
+	t.Helper()
+	frame, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestParseLLDPFrame(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		want  LLDPNeighbor
+	}{
+		{
+			name:  "summit",
+			frame: summitFrame,
+			want:  LLDPNeighbor{ChassisID: "00:01:30:f9:ad:a0", PortID: "1/1", SystemName: "Summit300-48"},
+		},
+		{
+			name:  "juniper vlan tagged",
+			frame: juniperFrame,
+			want:  LLDPNeighbor{ChassisID: "2c:6b:f5:00:00:00", PortID: "ge-0/0/1", PortDescription: "server01", SystemName: "qfx5100"},
+		},
+		{
+			name:  "port address",
+			frame: addressFrame,
+			want:  LLDPNeighbor{ChassisID: "02:00:00:00:00:01", PortID: "192.0.2.1"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseLLDPFrame(mustFrame(t, tt.frame))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseLLDPFrameInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+	}{
+		{"short", "0180c200000e"},
+		{"ipv4", "ffffffffffff 020000000001 0800 4500"},
+		{"tlv exceeds frame", "0180c200000e 020000000001 88cc 0207 04 0200"},
+		{"no port id", "0180c200000e 020000000001 88cc 0207 04 020000000001 0000"},
+	}
+	for _, tt := range tests {
+		if n, err := ParseLLDPFrame(mustFrame(t, tt.frame)); err == nil {
+			t.Errorf("%s: got %+v, want error", tt.name, n)
+		}
+	}
+}
+
+func TestDiscoverLLDP(t *testing.T) {
+	frames := map[string]string{
+		"eno1": summitFrame,
+		"eno2": juniperFrame,
+		"eno3": "0180c200000e 020000000001 88cc 0000",
+	}
+	m := NewHardWareManager(zap.NewNop())
+	m.captureLLDP = func(ctx context.Context, adapter string, timeout time.Duration) ([]byte, error) {
+		if timeout != 5*time.Second {
+			t.Errorf("timeout of %s = %v, want 5s", adapter, timeout)
+		}
+		frame, ok := frames[adapter]
+		if !ok {
+			return nil, fmt.Errorf("no lldp frame in %v", timeout)
+		}
+		return mustFrame(t, frame), nil
+	}
+	interfaces := []NetworkInterface{{Name: "eno1"}, {Name: "eno2"}, {Name: "eno3"}, {Name: "eno4"}}
+	got, err := m.DiscoverLLDP(context.Background(), interfaces, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"eno1": "Summit300-48/1/1", "eno2": "qfx5100/ge-0/0/1"}
+	for _, n := range got {
+		switch {
+		case want[n.Name] == "" && n.LLDP != nil:
+			t.Errorf("%s has neighbor %s, want none", n.Name, n.LLDP)
+		case want[n.Name] != "" && (n.LLDP == nil || n.LLDP.String() != want[n.Name]):
+			t.Errorf("%s has neighbor %v, want %s", n.Name, n.LLDP, want[n.Name])
+		}
+	}
+	if interfaces[0].LLDP != nil {
+		t.Errorf("interfaces passed in are modified")
+	}
+}
+
+func TestDiscoverLLDPCanceled(t *testing.T) {
+	m := NewHardWareManager(zap.NewNop())
+	m.captureLLDP = func(ctx context.Context, adapter string, timeout time.Duration) ([]byte, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(timeout):
+			return nil, fmt.Errorf("no lldp frame in %v", timeout)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := m.DiscoverLLDP(ctx, []NetworkInterface{{Name: "eno1"}, {Name: "eno2"}}, time.Minute)
+	if err != context.Canceled {
+		t.Errorf("DiscoverLLDP = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("DiscoverLLDP returned after %v", elapsed)
+	}
+}
@@ -0,0 +1,232 @@
+package hardware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils/netlink"
+	netutil "diskimage-installer/pkg/utils/network"
+)
+
+const (
+	precheckBond       = "pcbond0"
+	precheckVlanFormat = "pcvlan%d"
+)
+
+// NetworkCheck is a network applied temporarily in ramdisk to verify its
+// address, gateway and dns servers.
+type NetworkCheck struct {
+	// Links are names of physical interfaces.
+	Links []string
+	// BondMode is the mode name of bond created on links, links are not
+	// bonded when it is empty.
+	BondMode string
+	VlanID   int
+	Address  *net.IPNet
+	Gateway  net.IP
+	DNS      []net.IP
+	DNSName  string
+	Timeout  time.Duration
+}
+
+type NetworkCheckResult struct {
+	Interface  string
+	Address    string
+	Gateway    string
+	GatewayMAC string
+	Errors     []string
+}
+
+func (r NetworkCheckResult) OK() bool {
+	return len(r.Errors) == 0
+}
+
+// CheckNetwork applies check on links, probes gateway by ARP (or ICMP if ARP
+// gets no reply) and queries every dns server, everything is torn down before
+// it returns. An error is returned only when the network can't be applied,
+// failed probes are reported in result.
+func (m *HardWareManager) CheckNetwork(ctx context.Context, check NetworkCheck) (NetworkCheckResult, error) {
+	result := NetworkCheckResult{
+		Address: check.Address.String(),
+	}
+	if check.Gateway != nil {
+		result.Gateway = check.Gateway.String()
+	}
+	var undo []func() error
+	defer func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				m.logger.Sugar().Warnf("teardown network check: %v", err)
+			}
+		}
+	}()
+
+	dev, err := m.setupCheckLinks(check, &undo)
+	if err != nil {
+		return result, err
+	}
+	result.Interface = dev
+
+	if err := netlink.AddrAdd(dev, check.Address); err != nil {
+		if !errors.Is(err, syscall.EEXIST) {
+			return result, err
+		}
+	} else {
+		undo = append(undo, func() error { return netlink.AddrDel(dev, check.Address) })
+	}
+
+	carrier, err := m.waitCarrier(ctx, dev, check.Timeout)
+	if err != nil {
+		return result, err
+	}
+	if !carrier {
+		result.Errors = append(result.Errors, fmt.Sprintf("%s has no carrier in %v", dev, check.Timeout))
+		return result, nil
+	}
+
+	if check.Gateway != nil {
+		mac, err := netutil.ARPProbe(ctx, dev, check.Address.IP, check.Gateway, check.Timeout)
+		if err == nil {
+			result.GatewayMAC = mac.String()
+		} else if ctx.Err() != nil {
+			return result, ctx.Err()
+		} else if pingErr := netutil.Ping(ctx, check.Address.IP, check.Gateway, check.Timeout); pingErr != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			result.Errors = append(result.Errors, fmt.Sprintf("gateway %s: %v; %v", check.Gateway, err, pingErr))
+		}
+	}
+
+	for _, server := range check.DNS {
+		if !check.Address.Contains(server) {
+			if check.Gateway == nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("dns %s is not reachable without gateway", server))
+				continue
+			}
+			dst := &net.IPNet{IP: server, Mask: net.CIDRMask(32, 32)}
+			if err := netlink.RouteAdd(dst, check.Gateway, dev); err != nil {
+				if !errors.Is(err, syscall.EEXIST) {
+					result.Errors = append(result.Errors, fmt.Sprintf("dns %s: %v", server, err))
+					continue
+				}
+			} else {
+				undo = append(undo, func() error { return netlink.RouteDel(dst, check.Gateway, dev) })
+			}
+		}
+		if err := queryDNS(ctx, server, check.Address.IP, check.DNSName, check.Timeout); err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			result.Errors = append(result.Errors, fmt.Sprintf("dns %s: %v", server, err))
+		}
+	}
+	return result, nil
+}
+
+// setupCheckLinks brings links up, bonds and tags them as check asks, the
+// interface to put address on is returned.
+func (m *HardWareManager) setupCheckLinks(check NetworkCheck, undo *[]func() error) (string, error) {
+	if len(check.Links) == 0 {
+		return "", fmt.Errorf("network check has no link")
+	}
+	for _, link := range check.Links {
+		link := link
+		up, err := netlink.LinkIsUp(link)
+		if err != nil {
+			return "", err
+		}
+		if !up {
+			*undo = append(*undo, func() error { return netlink.LinkSetDown(link) })
+		}
+	}
+
+	dev := check.Links[0]
+	if check.BondMode != "" {
+		mode, ok := config.BondModeNumber(check.BondMode)
+		if !ok {
+			return "", fmt.Errorf("unknown bond mode %s", check.BondMode)
+		}
+		if err := netlink.AddBond(precheckBond, uint8(mode)); err != nil {
+			return "", err
+		}
+		// deleting bond releases its slaves
+		*undo = append(*undo, func() error { return netlink.LinkDel(precheckBond) })
+		for _, link := range check.Links {
+			if err := netlink.LinkSetDown(link); err != nil {
+				return "", err
+			}
+			if err := netlink.LinkSetMaster(link, precheckBond); err != nil {
+				return "", err
+			}
+		}
+		dev = precheckBond
+	}
+	for _, link := range check.Links {
+		if err := netlink.LinkSetUp(link); err != nil {
+			return "", err
+		}
+	}
+	if err := netlink.LinkSetUp(dev); err != nil {
+		return "", err
+	}
+
+	if check.VlanID > 0 {
+		vlan := fmt.Sprintf(precheckVlanFormat, check.VlanID)
+		if err := netlink.AddVlan(vlan, dev, uint16(check.VlanID)); err != nil {
+			return "", err
+		}
+		*undo = append(*undo, func() error { return netlink.LinkDel(vlan) })
+		if err := netlink.LinkSetUp(vlan); err != nil {
+			return "", err
+		}
+		dev = vlan
+	}
+	return dev, nil
+}
+
+// waitCarrier polls carrier of dev until it is up or timeout expires.
+func (m *HardWareManager) waitCarrier(ctx context.Context, dev string, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if carrier, err := m.sysfs.HasCarrier(dev); err == nil && carrier {
+			return true, nil
+		}
+		if time.Now().After(deadline) {
+			return false, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// queryDNS resolves name by server from source, NXDOMAIN is taken as success
+// since the server did answer.
+func queryDNS(ctx context.Context, server, source net.IP, name string, timeout time.Duration) error {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			d := net.Dialer{
+				Timeout:   timeout,
+				LocalAddr: &net.UDPAddr{IP: source},
+			}
+			return d.DialContext(ctx, "udp", net.JoinHostPort(server.String(), "53"))
+		},
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_, err := resolver.LookupHost(ctx, name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+package hardware
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/utils/netlink"
+)
+
+const netnsEnv = "DISKIMAGE_TEST_NETNS"
+
+// inNetns runs test in new network and mount namespaces by running the test
+// binary again under unshare, test is skipped when that is not possible. It
+// reports whether the caller is in the namespaces and goes on testing.
+func inNetns(t *testing.T) bool {
+	t.Helper()
+	if os.Getenv(netnsEnv) != "" {
+		// sysfs shows interfaces of the namespace it is mounted in
+		if err := syscall.Mount("sysfs", "/sys", "sysfs", 0, ""); err != nil {
+			t.Fatalf("mount sysfs: %v", err)
+		}
+		return true
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("network namespace needs root")
+	}
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare is not installed")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip is not installed")
+	}
+	cmd := exec.Command("unshare", "-n", "-m", os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil && strings.Contains(string(out), "unshare failed") {
+		t.Skipf("unshare: %s", out)
+	}
+	t.Log(string(out))
+	if err != nil {
+		t.Fatalf("test in network namespace: %v", err)
+	}
+	return false
+}
+
+func mustIP(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+}
+
+// serveNXDOMAIN answers every dns query on conn with NXDOMAIN.
+func serveNXDOMAIN(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		// question ends after name and 4 bytes of type and class
+		end := 12
+		for end < n && buf[end] != 0 {
+			end += int(buf[end]) + 1
+		}
+		end += 5
+		if end > n {
+			continue
+		}
+		reply := append([]byte{}, buf[:end]...)
+		binary.BigEndian.PutUint16(reply[2:], 0x8183)
+		binary.BigEndian.PutUint16(reply[4:], 1)
+		binary.BigEndian.PutUint16(reply[6:], 0)
+		binary.BigEndian.PutUint16(reply[8:], 0)
+		binary.BigEndian.PutUint16(reply[10:], 0)
+		conn.WriteTo(reply, addr)
+	}
+}
+
+const dnsServerEnv = "DISKIMAGE_TEST_DNS_SERVER"
+
+// TestHelperDNSServer is the dns server of TestCheckNetworkVeth, it serves in
+// namespace of gateway until it is killed.
+func TestHelperDNSServer(t *testing.T) {
+	address := os.Getenv(dnsServerEnv)
+	if address == "" {
+		t.Skip("dns server of TestCheckNetworkVeth")
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("ready")
+	serveNXDOMAIN(conn)
+}
+
+// TestCheckNetworkVeth checks a network on one end of a veth pair, the other
+// end is in namespace of gateway, which is the dns server as well.
+func TestCheckNetworkVeth(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+	mustIP(t, "netns", "add", "gw")
+	defer exec.Command("ip", "netns", "del", "gw").Run()
+	mustIP(t, "link", "add", "veth0", "type", "veth", "peer", "name", "veth1", "netns", "gw")
+	mustIP(t, "-n", "gw", "addr", "add", "10.0.0.1/24", "dev", "veth1")
+	mustIP(t, "-n", "gw", "link", "set", "veth1", "up")
+	mustIP(t, "-n", "gw", "link", "set", "lo", "up")
+	out, err := exec.Command("ip", "-n", "gw", "-o", "link", "show", "veth1").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(string(out))
+	gatewayMAC := ""
+	for i := range fields {
+		if fields[i] == "link/ether" && i+1 < len(fields) {
+			gatewayMAC = fields[i+1]
+		}
+	}
+
+	server := exec.Command("ip", "netns", "exec", "gw", os.Args[0], "-test.run=^TestHelperDNSServer$")
+	server.Env = append(os.Environ(), dnsServerEnv+"=10.0.0.1:53")
+	stdout, err := server.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.Process.Kill()
+		server.Wait()
+	}()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatalf("dns server: %q %v", line, err)
+	}
+
+	m := NewHardWareManager(zap.NewNop())
+	address := &net.IPNet{IP: net.ParseIP("10.0.0.10").To4(), Mask: net.CIDRMask(24, 32)}
+	check := NetworkCheck{
+		Links:   []string{"veth0"},
+		Address: address,
+		Gateway: net.ParseIP("10.0.0.1").To4(),
+		DNS:     []net.IP{net.ParseIP("10.0.0.1")},
+		DNSName: "precheck.invalid",
+		Timeout: 3 * time.Second,
+	}
+	result, err := m.CheckNetwork(context.Background(), check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.OK() {
+		t.Fatalf("check failed: %v", result.Errors)
+	}
+	if result.Interface != "veth0" || result.GatewayMAC != gatewayMAC {
+		t.Errorf("result = %+v, want gateway %s on veth0", result, gatewayMAC)
+	}
+	// everything applied is torn down
+	if up, err := netlink.LinkIsUp("veth0"); err != nil || up {
+		t.Errorf("veth0 is up after check: %v", err)
+	}
+	if addrs, _ := (&net.Interface{Name: "veth0"}).Addrs(); len(addrs) != 0 {
+		t.Errorf("veth0 has addresses %v after check", addrs)
+	}
+
+	check.Gateway = net.ParseIP("10.0.0.99").To4()
+	check.DNS = []net.IP{net.ParseIP("10.0.0.98")}
+	check.Timeout = 500 * time.Millisecond
+	result, err = m.CheckNetwork(context.Background(), check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) != 2 {
+		t.Errorf("errors = %v, want gateway and dns errors", result.Errors)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	check.Timeout = time.Minute
+	start := time.Now()
+	if _, err := m.CheckNetwork(ctx, check); err != context.Canceled {
+		t.Errorf("CheckNetwork with canceled ctx = %v, want %v", err, context.Canceled)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("canceled check took %v", time.Since(start))
+	}
+}
@@ -1,13 +1,11 @@
 package installer
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
 
-	"diskimage-installer/pkg/utils"
-	diskutils "diskimage-installer/pkg/utils/disk"
-
 	"github.com/pkg/errors"
 )
 
@@ -32,13 +30,18 @@ type Partition struct {
 	Name   string
 	Size   string
 	FsType string
+	// Label is label of filesystem
+	Label string
+	// UUID is uuid of filesystem, PartUUID is uuid of GPT partition entry
+	UUID     string
+	PartUUID string
 }
 
-func listAllBlockDevice() ([]BlockDevice, error) {
-	if err := diskutils.UdevSettle(); err != nil {
+func (i *ImgaeInstaller) listAllBlockDevice(ctx context.Context) ([]BlockDevice, error) {
+	if err := i.disk.UdevSettle(ctx); err != nil {
 		return nil, fmt.Errorf("udevSettle: %v", err)
 	}
-	out, err := utils.RunCommand("lsblk", "-O", "-J")
+	out, err := i.runner.Run(ctx, "lsblk", "-O", "-J")
 	if err != nil {
 		return nil, errors.Wrapf(err, "lsblk: %v", out)
 	}
@@ -66,8 +69,8 @@ func listAllBlockDevice() ([]BlockDevice, error) {
 	return result, nil
 }
 
-func listPartitions(device BlockDevice) ([]Partition, error) {
-	out, err := utils.RunCommand("lsblk", "-O", "-J")
+func (i *ImgaeInstaller) listPartitions(ctx context.Context, device BlockDevice) ([]Partition, error) {
+	out, err := i.runner.Run(ctx, "lsblk", "-O", "-J")
 	if err != nil {
 		return nil, errors.Wrapf(err, "lsblk: %v", out)
 	}
@@ -92,8 +95,12 @@ func listPartitions(device BlockDevice) ([]Partition, error) {
 			name := kv["name"].(string)
 
 			p.Name = "/dev/" + name
-			p.Size = kv["size"].(string)
-			p.FsType = kv["fstype"].(string)
+			p.Size, _ = kv["size"].(string)
+			// fstype is null on a partition without filesystem
+			p.FsType, _ = kv["fstype"].(string)
+			p.UUID, _ = kv["uuid"].(string)
+			p.Label, _ = kv["label"].(string)
+			p.PartUUID, _ = kv["partuuid"].(string)
 			result = append(result, p)
 		}
 		return result, nil
@@ -0,0 +1,45 @@
+package installer
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/bmc"
+)
+
+// configureBMC applies ipmi of node to the local BMC when it asks to.
+func (i *ImgaeInstaller) configureBMC(ctx context.Context) error {
+	if !i.IPMI.Configure {
+		return nil
+	}
+	if err := i.IPMI.Validate(); err != nil {
+		return err
+	}
+	config := i.bmcConfig()
+	if err := bmc.Configure(ctx, i.bmc, config, i.logger); err != nil {
+		return errors.Wrap(err, "bmc.Configure")
+	}
+	i.logger.Sugar().Infof("bmc is configured as %s on channel %d", config.IPAddress, config.Channel)
+	return nil
+}
+
+func (i *ImgaeInstaller) bmcConfig() bmc.Config {
+	config := bmc.Config{
+		Channel:     i.IPMI.Channel,
+		IPAddress:   i.IPMI.Address,
+		Netmask:     i.IPMI.Netmask,
+		Gateway:     i.IPMI.Gateway,
+		UserID:      i.IPMI.UserID,
+		Username:    i.IPMI.Username,
+		Password:    i.IPMI.Password,
+		CipherSuite: int(i.IPMI.Cipher),
+	}
+	if config.Channel == 0 {
+		config.Channel = 1
+	}
+	if config.UserID == 0 {
+		config.UserID = 2
+	}
+	return config
+}
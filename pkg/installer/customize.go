@@ -0,0 +1,311 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/config"
+)
+
+// fsTypesOfRoot are filesystems root of an image may be on.
+var fsTypesOfRoot = map[string]bool{
+	"ext2":  true,
+	"ext3":  true,
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+}
+
+const (
+	fsTypeLVM     = "LVM2_member"
+	umountRetries = 5
+	// maxSymlinks bounds symlinks followed while resolving a path in root.
+	maxSymlinks = 40
+)
+
+// customize writes files of node into root filesystem of the installed
+// image.
+func (i *ImgaeInstaller) customize(ctx context.Context) (err error) {
+	if len(i.Files) == 0 {
+		return nil
+	}
+	device, err := i.rootDevice(ctx)
+	if err != nil {
+		return err
+	}
+	if err := i.disk.RescanDevice(ctx, device.Name); err != nil {
+		return errors.Wrap(err, "diskutils.RescanDevice")
+	}
+	root, unmount, err := i.mountRoot(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := unmount(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+	for _, f := range i.Files {
+		if err := writeFileInRoot(root, f); err != nil {
+			return errors.Wrapf(err, "write %s", f.Path)
+		}
+		i.logger.Sugar().Infof("wrote %s into installed root", f.Path)
+	}
+	return nil
+}
+
+// mountRoot finds root filesystem on device, including logical volumes of
+// LVM in the image, and mounts it read-write. unmount undoes everything
+// mountRoot did.
+func (i *ImgaeInstaller) mountRoot(ctx context.Context, device BlockDevice) (string, func() error, error) {
+	partitions, err := i.listPartitions(ctx, device)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "listPartitions(%s)", device.Name)
+	}
+	vgs := []string{}
+	deactivate := func() error {
+		ctx, cancel := cleanupContext()
+		defer cancel()
+		// volume groups are deactivated so that nothing holds the disk
+		for _, vg := range vgs {
+			if out, err := i.runner.Run(ctx, "vgchange", "-an", vg); err != nil {
+				return fmt.Errorf("vgchange -an %s: %v: %s", vg, err, out)
+			}
+		}
+		return nil
+	}
+	candidates := []string{}
+	for _, p := range partitions {
+		if fsTypesOfRoot[p.FsType] {
+			candidates = append(candidates, p.Name)
+			continue
+		}
+		if p.FsType != fsTypeLVM {
+			continue
+		}
+		volumes, vg, err := i.activateVolumeGroup(ctx, p.Name)
+		if vg != "" {
+			vgs = append(vgs, vg)
+		}
+		if err != nil {
+			deactivate()
+			return "", nil, err
+		}
+		candidates = append(candidates, volumes...)
+	}
+
+	dir, err := ioutil.TempDir("", "diskimage-root-")
+	if err != nil {
+		deactivate()
+		return "", nil, err
+	}
+	for _, c := range candidates {
+		if out, err := i.runner.Run(ctx, "mount", "-o", "ro", c, dir); err != nil {
+			i.logger.Sugar().Debugf("mount %s: %v: %s", c, err, out)
+			continue
+		}
+		if !isRootFilesystem(dir) {
+			if err := i.umount(ctx, dir); err != nil {
+				deactivate()
+				return "", nil, err
+			}
+			continue
+		}
+		if out, err := i.runner.Run(ctx, "mount", "-o", "remount,rw", dir); err != nil {
+			i.cleanupUmount(dir)
+			deactivate()
+			return "", nil, fmt.Errorf("remount %s read-write: %v: %s", c, err, out)
+		}
+		i.logger.Sugar().Infof("mounted root filesystem %s of installed image at %s", c, dir)
+		unmount := func() error {
+			if err := i.cleanupUmount(dir); err != nil {
+				return err
+			}
+			os.Remove(dir)
+			return deactivate()
+		}
+		return dir, unmount, nil
+	}
+	os.Remove(dir)
+	deactivate()
+	return "", nil, fmt.Errorf("no root filesystem is found among %v of %s", candidates, device.Name)
+}
+
+// activateVolumeGroup activates volume group of physical volume pv and
+// returns its logical volumes with a filesystem root may be on.
+func (i *ImgaeInstaller) activateVolumeGroup(ctx context.Context, pv string) ([]string, string, error) {
+	out, err := i.runner.Run(ctx, "pvs", "--noheadings", "-o", "vg_name", pv)
+	if err != nil {
+		return nil, "", fmt.Errorf("pvs %s: %v: %s", pv, err, out)
+	}
+	vg := strings.TrimSpace(out)
+	if vg == "" {
+		return nil, "", nil
+	}
+	if out, err := i.runner.Run(ctx, "vgchange", "-ay", vg); err != nil {
+		return nil, vg, fmt.Errorf("vgchange -ay %s: %v: %s", vg, err, out)
+	}
+	out, err = i.runner.Run(ctx, "lvs", "--noheadings", "-o", "lv_path", vg)
+	if err != nil {
+		return nil, vg, fmt.Errorf("lvs %s: %v: %s", vg, err, out)
+	}
+	volumes := []string{}
+	for _, lv := range strings.Fields(out) {
+		fstype, _ := i.runner.Run(ctx, "blkid", "-o", "value", "-s", "TYPE", lv)
+		if fsTypesOfRoot[strings.TrimSpace(fstype)] {
+			volumes = append(volumes, lv)
+		}
+	}
+	return volumes, vg, nil
+}
+
+// umount syncs and unmounts dir, it is retried since udev or a scan may
+// hold the filesystem for a moment.
+func (i *ImgaeInstaller) umount(ctx context.Context, dir string) error {
+	var out string
+	var err error
+	for n := 0; n < umountRetries; n++ {
+		i.runner.Run(ctx, "sync")
+		if out, err = i.runner.Run(ctx, "umount", dir); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("umount %s: %v: %s", dir, err, out)
+		case <-time.After(time.Second):
+		}
+	}
+	return fmt.Errorf("umount %s: %v: %s", dir, err, out)
+}
+
+// cleanupUmount unmounts dir a step mounted once the step is over, whether
+// or not its context is done.
+func (i *ImgaeInstaller) cleanupUmount(dir string) error {
+	ctx, cancel := cleanupContext()
+	defer cancel()
+	return i.umount(ctx, dir)
+}
+
+func isRootFilesystem(dir string) bool {
+	for _, f := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if _, err := os.Lstat(filepath.Join(dir, f)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileInRoot writes f into filesystem mounted at root, an existing file
+// or symlink at its path is replaced.
+func writeFileInRoot(root string, f config.FileInfo) error {
+	data, err := f.Data()
+	if err != nil {
+		return err
+	}
+	mode, err := f.FileMode()
+	if err != nil {
+		return err
+	}
+	uid, err := lookupID(filepath.Join(root, "etc", "passwd"), f.Owner)
+	if err != nil {
+		return errors.Wrap(err, "owner")
+	}
+	gid, err := lookupID(filepath.Join(root, "etc", "group"), f.Group)
+	if err != nil {
+		return errors.Wrap(err, "group")
+	}
+	dir, err := resolveInRoot(root, filepath.Dir(f.Path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	target := filepath.Join(dir, filepath.Base(f.Path))
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(f.Path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chown(tmp.Name(), uid, gid); err != nil {
+		return err
+	}
+	// chmod after chown, which clears setuid and setgid
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// resolveInRoot returns where p is in filesystem mounted at root. Symlinks
+// are followed as if root were /, so a path never leads out of root.
+func resolveInRoot(root, p string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(strings.TrimPrefix(filepath.Clean("/"+p), "/"), "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		if name == "" || name == "." {
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// a missing component is created as a directory
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		resolved = "/"
+		rest = append(strings.Split(strings.TrimPrefix(filepath.Clean(target), "/"), "/"), rest...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// lookupID returns id of name in file in the form of /etc/passwd or
+// /etc/group, 0 is returned for an empty name.
+func lookupID(file, name string) (int, error) {
+	if name == "" {
+		return 0, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) >= 3 && fields[0] == name {
+			return strconv.Atoi(fields[2])
+		}
+	}
+	return 0, fmt.Errorf("%s is not in %s", name, file)
+}
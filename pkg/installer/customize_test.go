@@ -0,0 +1,385 @@
+package installer
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils"
+)
+
+const (
+	testPasswd = "root:x:0:0:root:/root:/bin/bash\napp:x:1001:1002::/home/app:/bin/sh\n"
+	testGroup  = "root:x:0:\nwheel:x:10:\napp:x:1002:\n"
+)
+
+func TestLookupID(t *testing.T) {
+	dir := t.TempDir()
+	passwd := filepath.Join(dir, "passwd")
+	if err := ioutil.WriteFile(passwd, []byte(testPasswd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		want    int
+		wantErr bool
+	}{
+		{name: "", want: 0},
+		{name: "root", want: 0},
+		{name: "app", want: 1001},
+		{name: "2000", want: 2000},
+		{name: "nobody", wantErr: true},
+		// 1001 is uid of app, an id is taken as is
+		{name: "1002", want: 1002},
+	}
+	for _, tt := range tests {
+		got, err := lookupID(passwd, tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("lookupID(%q) = %d, %v, want %d, error %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+	if _, err := lookupID(filepath.Join(dir, "group"), "app"); err == nil {
+		t.Errorf("lookupID of missing file succeeds")
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"opt/app", "usr/lib"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		// absolute symlink is relative to root of image, not of host
+		"etc":        "/opt/app/etc",
+		"lib":        "usr/lib",
+		"escape":     "../../../../tmp",
+		"loop":       "loop2",
+		"loop2":      "loop",
+		"usr/lib/up": "..",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "/etc/hosts.d", want: "/opt/app/etc/hosts.d"},
+		{path: "/lib/modules", want: "/usr/lib/modules"},
+		{path: "/usr/lib/up/share", want: "/usr/share"},
+		{path: "/escape/x", want: "/tmp/x"},
+		{path: "/../../etc", want: "/opt/app/etc"},
+		{path: "/new/dir", want: "/new/dir"},
+		{path: "/loop/x", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := resolveInRoot(root, tt.path)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("resolveInRoot(%s) = %s, want error", tt.path, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.Join(root, tt.want) {
+			t.Errorf("resolveInRoot(%s) = %s, %v, want %s in root", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestWriteFileInRoot(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{"etc/passwd": testPasswd, "etc/group": testGroup} {
+		mustWriteFile(t, filepath.Join(root, name), content)
+	}
+	if err := os.Symlink("/etc/motd.real", filepath.Join(root, "etc", "motd")); err != nil {
+		t.Fatal(err)
+	}
+	// without root, files can only be owned by the user running test
+	owner, group := strconv.Itoa(os.Getuid()), strconv.Itoa(os.Getgid())
+	files := []config.FileInfo{
+		{Path: "/etc/app/app.conf", Content: "listen: 8080\n", Mode: "0640", Owner: owner, Group: group},
+		{Path: "/etc/motd", Content: "aGVsbG8K", Encoding: config.FileEncodingBase64, Owner: owner, Group: group},
+	}
+	for _, f := range files {
+		if err := writeFileInRoot(root, f); err != nil {
+			t.Fatalf("%s: %v", f.Path, err)
+		}
+	}
+	checkFile(t, filepath.Join(root, "etc/app/app.conf"), "listen: 8080\n", 0640, os.Getuid(), os.Getgid())
+	// symlink is replaced, not followed
+	checkFile(t, filepath.Join(root, "etc/motd"), "hello\n", 0644, os.Getuid(), os.Getgid())
+	if _, err := os.Lstat(filepath.Join(root, "etc/motd.real")); !os.IsNotExist(err) {
+		t.Errorf("target of symlink is written: %v", err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(root, "etc/app"))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("temporary files are left: %v %v", entries, err)
+	}
+
+	if err := writeFileInRoot(root, config.FileInfo{Path: "/etc/x", Owner: "nobody"}); err == nil {
+		t.Errorf("unknown owner is accepted")
+	}
+}
+
+func mustWriteFile(t *testing.T, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFile(t *testing.T, file, content string, mode os.FileMode, uid, gid int) {
+	t.Helper()
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if string(data) != content {
+		t.Errorf("%s = %q, want %q", file, data, content)
+	}
+	fi, err := os.Lstat(file)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm() != mode {
+		t.Errorf("mode of %s = %v, want %v", file, fi.Mode(), mode)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if int(st.Uid) != uid || int(st.Gid) != gid {
+		t.Errorf("owner of %s = %d:%d, want %d:%d", file, st.Uid, st.Gid, uid, gid)
+	}
+}
+
+// udevlessRunner runs commands on host which has no udev, as test sandboxes
+// often don't. Commands of udev and partitioning tools the ramdisk has are
+// taken as succeeded when they aren't installed, and lsblk, which learns
+// filesystems from udev, has them filled in by blkid.
+type udevlessRunner struct {
+	utils.ExecRunner
+}
+
+func (r udevlessRunner) Run(ctx context.Context, command string, args ...string) (string, error) {
+	switch command {
+	case "udevadm", "partprobe", "sgdisk":
+		if _, err := exec.LookPath(command); err != nil {
+			return "", nil
+		}
+	case "lsblk":
+		out, err := r.ExecRunner.Run(ctx, command, args...)
+		if err != nil {
+			return out, err
+		}
+		return r.fillFilesystems(ctx, out)
+	}
+	return r.ExecRunner.Run(ctx, command, args...)
+}
+
+func (r udevlessRunner) fillFilesystems(ctx context.Context, out string) (string, error) {
+	data := map[string][]map[string]interface{}{}
+	if err := json.Unmarshal([]byte(out), &data); err != nil {
+		return "", err
+	}
+	var fill func(devices []interface{})
+	fill = func(devices []interface{}) {
+		for _, d := range devices {
+			device := d.(map[string]interface{})
+			name, _ := device["name"].(string)
+			for key, tag := range map[string]string{"fstype": "TYPE", "label": "LABEL", "uuid": "UUID"} {
+				if v, _ := r.ExecRunner.Run(ctx, "blkid", "-o", "value", "-s", tag, "/dev/"+name); strings.TrimSpace(v) != "" {
+					device[key] = strings.TrimSpace(v)
+				}
+			}
+			if children, ok := device["children"].([]interface{}); ok {
+				fill(children)
+			}
+		}
+	}
+	for _, devices := range data {
+		list := []interface{}{}
+		for _, d := range devices {
+			list = append(list, d)
+		}
+		fill(list)
+	}
+	filled, err := json.Marshal(data)
+	return string(filled), err
+}
+
+// newLoopDisk attaches an image of one MBR partition, which is set up by
+// format, to a loop device. Test is skipped when that isn't possible.
+func newLoopDisk(t *testing.T, format func(partition string)) BlockDevice {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("loop device needs root")
+	}
+	for _, c := range []string{"losetup", "mkfs.ext4", "mount", "umount", "lsblk", "blkid"} {
+		if _, err := exec.LookPath(c); err != nil {
+			t.Skipf("%s is not installed", c)
+		}
+	}
+	image := filepath.Join(t.TempDir(), "disk.img")
+	const size = 64 << 20
+	mbr := make([]byte, 512)
+	entry := mbr[446:462]
+	entry[4] = 0x83
+	binary.LittleEndian.PutUint32(entry[8:], 2048)
+	binary.LittleEndian.PutUint32(entry[12:], size/512-2048)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if err := ioutil.WriteFile(image, mbr, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, size); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("losetup", "-P", "-f", "--show", image).CombinedOutput()
+	if err != nil {
+		t.Skipf("losetup: %v: %s", err, out)
+	}
+	device := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("losetup", "-d", device).Run() })
+	partition := device + "p1"
+	for n := 0; ; n++ {
+		if _, err := os.Stat(partition); err == nil {
+			break
+		}
+		switch n {
+		case 10:
+			// partition scan of losetup is sometimes lost, ask for it again
+			exec.Command("partx", "-a", device).Run()
+		case 50:
+			t.Skipf("%s doesn't appear", partition)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	format(partition)
+	return BlockDevice{Name: device, Kname: filepath.Base(device)}
+}
+
+func mustRun(t *testing.T, command string, args ...string) {
+	t.Helper()
+	if out, err := exec.Command(command, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s %s: %v: %s", command, strings.Join(args, " "), err, out)
+	}
+}
+
+// populateRoot makes filesystem of device look like root of an OS.
+func populateRoot(t *testing.T, device string) {
+	t.Helper()
+	mustRun(t, "mkfs.ext4", "-q", "-F", device)
+	dir := t.TempDir()
+	mustRun(t, "mount", device, dir)
+	defer mustRun(t, "umount", dir)
+	mustWriteFile(t, filepath.Join(dir, "etc/os-release"), "ID=test\n")
+	mustWriteFile(t, filepath.Join(dir, "etc/passwd"), testPasswd)
+	mustWriteFile(t, filepath.Join(dir, "etc/group"), testGroup)
+}
+
+// isMounted reports whether device is mounted anywhere.
+func isMounted(t *testing.T, device string) bool {
+	t.Helper()
+	data, err := ioutil.ReadFile("/proc/self/mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == device {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCustomizeLoopDevice(t *testing.T) {
+	tests := []struct {
+		name   string
+		format func(t *testing.T, partition string) (root string, cleanup func())
+	}{
+		{
+			name: "plain",
+			format: func(t *testing.T, partition string) (string, func()) {
+				populateRoot(t, partition)
+				return partition, func() {}
+			},
+		},
+		{
+			name: "lvm",
+			format: func(t *testing.T, partition string) (string, func()) {
+				for _, c := range []string{"pvcreate", "vgcreate", "lvcreate", "vgchange", "vgremove"} {
+					if _, err := exec.LookPath(c); err != nil {
+						t.Skipf("%s is not installed", c)
+					}
+				}
+				vg := fmt.Sprintf("diskimagetest%d", os.Getpid())
+				mustRun(t, "pvcreate", "-q", "-ff", "-y", partition)
+				mustRun(t, "vgcreate", "-q", vg, partition)
+				mustRun(t, "lvcreate", "-q", "-y", "-L", "32M", "-n", "root", vg)
+				root := "/dev/" + vg + "/root"
+				populateRoot(t, root)
+				mustRun(t, "vgchange", "-q", "-an", vg)
+				return root, func() { exec.Command("vgremove", "-q", "-f", vg).Run() }
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root string
+			device := newLoopDisk(t, func(partition string) {
+				var cleanup func()
+				root, cleanup = tt.format(t, partition)
+				t.Cleanup(cleanup)
+			})
+			node := config.Node{
+				Name: "node1",
+				Files: []config.FileInfo{
+					{Path: "/etc/app/app.conf", Content: "listen: 8080\n", Mode: "0640", Owner: "app", Group: "wheel"},
+					{Path: "/usr/local/bin/hello", Content: "IyEvYmluL3NoCmVjaG8gaGVsbG8K", Encoding: config.FileEncodingBase64, Mode: "0755"},
+				},
+			}
+			i := NewInstaller(node, zap.NewNop())
+			i.SetRunner(udevlessRunner{})
+			i.state = &State{RootDevice: &device}
+			if err := i.customize(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if isMounted(t, root) {
+				t.Fatalf("%s is still mounted", root)
+			}
+			if strings.HasPrefix(root, "/dev/diskimagetest") {
+				if _, err := os.Stat(root); err == nil {
+					t.Errorf("volume group of %s is still active", root)
+				}
+				mustRun(t, "vgchange", "-q", "-ay", filepath.Base(filepath.Dir(root)))
+				defer mustRun(t, "vgchange", "-q", "-an", filepath.Base(filepath.Dir(root)))
+			}
+
+			dir := t.TempDir()
+			mustRun(t, "mount", "-o", "ro", root, dir)
+			defer mustRun(t, "umount", dir)
+			checkFile(t, filepath.Join(dir, "etc/app/app.conf"), "listen: 8080\n", 0640, 1001, 10)
+			checkFile(t, filepath.Join(dir, "usr/local/bin/hello"), "#!/bin/sh\necho hello\n", 0755, 0, 0)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	diskutils "diskimage-installer/pkg/utils/disk"
+)
+
+const mib = 1 << 20
+
+// growRoot grows the last partition of image and its filesystem to fill root
+// disk, leaving space of config drive partition at end of disk.
+func (i *ImgaeInstaller) growRoot(ctx context.Context) error {
+	if !i.GrowRoot {
+		return nil
+	}
+	if i.isPartitionImage() {
+		// root partition of partition image fills disk already
+		return nil
+	}
+	device, err := i.rootDevice(ctx)
+	if err != nil {
+		return err
+	}
+	if err := i.disk.RescanDevice(ctx, device.Name); err != nil {
+		return errors.Wrap(err, "diskutils.RescanDevice")
+	}
+	pttype, err := i.disk.GetPartitionTableType(ctx, device.Name)
+	if err != nil {
+		return errors.Wrap(err, "diskutils.GetPartitionTableType")
+	}
+	if pttype == diskutils.GPT {
+		// backup GPT of image is in the middle of disk until it is moved
+		if err := i.disk.FixGTPPartition(ctx, device.Name); err != nil {
+			return errors.Wrap(err, "diskutils.FixGTPPartition")
+		}
+	}
+	entries, err := i.disk.ListPartitionEntries(ctx, device.Name)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("image on %s has no partition", device.Name)
+	}
+	last := entries[0]
+	for _, e := range entries {
+		if e.End > last.End {
+			last = e
+		}
+	}
+	size, err := i.disk.SizeBytes(ctx, device.Name)
+	if err != nil {
+		return errors.Wrapf(err, "size of %s", device.Name)
+	}
+	end := i.growEnd(size, pttype)
+	if end <= (last.End+1)*512-1 {
+		i.logger.Sugar().Infof("partition %d of %s fills disk already", last.Number, device.Name)
+		return nil
+	}
+	i.logger.Sugar().Infof("grow partition %d of %s to %d MiB", last.Number, device.Name, (end+1)/mib)
+	if err := i.disk.ResizePartition(ctx, device.Name, last.Number, end); err != nil {
+		return err
+	}
+	if err := i.disk.RescanDevice(ctx, device.Name); err != nil {
+		return errors.Wrap(err, "diskutils.RescanDevice")
+	}
+	return i.growFilesystem(ctx, diskutils.PartitionDevice(device.Name, last.Number))
+}
+
+// growEnd returns the last byte the last partition may end at on a disk of
+// size bytes, aligned to MiB.
+func (i *ImgaeInstaller) growEnd(size uint64, pttype diskutils.PartitionType) uint64 {
+	// the last MiB holds backup GPT and alignment slack
+	endMiB := size/mib - 1
+	reserved := uint64(0)
+	if i.needsConfigDrivePartition() {
+		reserved = uint64(diskutils.MaxConfigDriveSizeMB)
+	}
+	endMiB -= reserved
+	if pttype == diskutils.MBR {
+		// config drive of a disk beyond MBR limit is placed below the limit
+		if limit := uint64(diskutils.MaxMBRDiskSizeMB) - 1 - reserved; endMiB > limit {
+			endMiB = limit
+		}
+	}
+	return endMiB*mib - 1
+}
+
+// growFilesystem grows filesystem on partition to fill it, ext is grown
+// offline, xfs and btrfs are mounted to be grown.
+func (i *ImgaeInstaller) growFilesystem(ctx context.Context, partition string) error {
+	out, _ := i.runner.Run(ctx, "blkid", "-o", "value", "-s", "TYPE", partition)
+	fstype := strings.TrimSpace(out)
+	i.logger.Sugar().Infof("grow %s filesystem on %s", fstype, partition)
+	switch fstype {
+	case "ext2", "ext3", "ext4":
+		// exit status 1 of e2fsck means errors are corrected
+		if out, err := i.runner.Run(ctx, "e2fsck", "-f", "-p", partition); err != nil && exitCode(err) != 1 {
+			return fmt.Errorf("e2fsck %s: %v: %s", partition, err, out)
+		}
+		if out, err := i.runner.Run(ctx, "resize2fs", partition); err != nil {
+			return fmt.Errorf("resize2fs %s: %v: %s", partition, err, out)
+		}
+	case "xfs":
+		return i.growMounted(ctx, partition, "xfs_growfs")
+	case "btrfs":
+		return i.growMounted(ctx, partition, "btrfs", "filesystem", "resize", "max")
+	case fsTypeLVM:
+		if out, err := i.runner.Run(ctx, "pvresize", partition); err != nil {
+			return fmt.Errorf("pvresize %s: %v: %s", partition, err, out)
+		}
+		i.logger.Sugar().Infof("physical volume %s is grown, logical volumes are left as is", partition)
+	default:
+		i.logger.Sugar().Warnf("filesystem %q of %s isn't grown, only its partition is", fstype, partition)
+	}
+	return nil
+}
+
+// growMounted mounts partition and runs command with mount point appended.
+func (i *ImgaeInstaller) growMounted(ctx context.Context, partition string, command string, args ...string) (err error) {
+	dir, err := ioutil.TempDir("", "diskimage-grow-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+	if out, err := i.runner.Run(ctx, "mount", partition, dir); err != nil {
+		return fmt.Errorf("mount %s: %v: %s", partition, err, out)
+	}
+	defer func() {
+		if uerr := i.cleanupUmount(dir); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+	if out, err := i.runner.Run(ctx, command, append(args, dir)...); err != nil {
+		return fmt.Errorf("%s %s: %v: %s", command, partition, err, out)
+	}
+	return nil
+}
+
+// exitCode returns exit status of a command err is of, -1 if it didn't exit.
+func exitCode(err error) int {
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
@@ -0,0 +1,199 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils"
+	diskutils "diskimage-installer/pkg/utils/disk"
+)
+
+const (
+	tib = uint64(1) << 40
+	gib = uint64(1) << 30
+)
+
+func TestGrowEnd(t *testing.T) {
+	network := config.NetworkInfo{IPv4Address: "10.0.0.10", NetMask: "255.255.255.0"}
+	tests := []struct {
+		name    string
+		node    config.Node
+		size    uint64
+		pttype  diskutils.PartitionType
+		wantMiB uint64
+	}{
+		{name: "gpt with config drive", node: config.Node{Network: network}, size: 100 * gib, pttype: diskutils.GPT, wantMiB: 102400 - 1 - 64},
+		{name: "gpt without config drive", size: 100 * gib, pttype: diskutils.GPT, wantMiB: 102400 - 1},
+		{
+			name:    "ignition in oem partition needs no config drive",
+			node:    config.Node{Ignition: &config.IgnitionInfo{Placement: config.IgnitionPlacementOEM}},
+			size:    100 * gib,
+			pttype:  diskutils.GPT,
+			wantMiB: 102400 - 1,
+		},
+		{name: "gpt beyond 2TiB", node: config.Node{Network: network}, size: 4 * tib, pttype: diskutils.GPT, wantMiB: 4194304 - 1 - 64},
+		{name: "mbr with config drive", node: config.Node{Network: network}, size: 100 * gib, pttype: diskutils.MBR, wantMiB: 102400 - 1 - 64},
+		// partitions of MBR can't go beyond 2TiB, config drive is below it
+		{name: "mbr beyond 2TiB with config drive", node: config.Node{Network: network}, size: 4 * tib, pttype: diskutils.MBR, wantMiB: 2097152 - 1 - 64},
+		{name: "mbr beyond 2TiB without config drive", size: 4 * tib, pttype: diskutils.MBR, wantMiB: 2097152 - 1},
+	}
+	for _, tt := range tests {
+		i := NewInstaller(tt.node, zap.NewNop())
+		if got, want := i.growEnd(tt.size, tt.pttype), tt.wantMiB*mib-1; got != want {
+			t.Errorf("%s: growEnd = %d, want %d", tt.name, got, want)
+		}
+	}
+}
+
+var growDirPattern = regexp.MustCompile(`/tmp/diskimage-grow-[0-9]+`)
+
+// newGrowInstaller returns installer growing root of sda whose last
+// partition 2 ends at sector end.
+func newGrowInstaller(pttype, size string, end uint64, fstype string) (*ImgaeInstaller, *utils.FakeRunner) {
+	runner := utils.NewFakeRunner().
+		On("blkid /dev/sda --probe", `/dev/sda: PTUUID="0c7d0b4f" PTTYPE="`+pttype+`"`, nil).
+		On("sgdisk -v /dev/sda", "No problems found.", nil).
+		On("partx -g -o NR,START,END /dev/sda", fmt.Sprintf("    1    2048 1050623\n    2 1050624 %d\n", end), nil).
+		On("blockdev --getsize64 /dev/sda", size+"\n", nil).
+		On("blkid -o value -s TYPE /dev/sda2", fstype+"\n", nil)
+	i := NewInstaller(config.Node{Name: "node1", GrowRoot: true}, zap.NewNop())
+	i.SetRunner(runner)
+	i.state = &State{RootDevice: &BlockDevice{Name: "/dev/sda", Kname: "sda"}}
+	return i, runner
+}
+
+func TestGrowRootCommands(t *testing.T) {
+	i, runner := newGrowInstaller("gpt", "107374182400", 4194270, "ext4")
+	if err := i.growRoot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"sync",
+		"udevadm settle",
+		"partprobe /dev/sda",
+		"sgdisk -v /dev/sda",
+		"partprobe /dev/sda",
+		"blkid /dev/sda --probe",
+		// backup GPT is moved to end of disk
+		"partprobe /dev/sda",
+		"blkid /dev/sda --probe",
+		"sgdisk -v /dev/sda",
+		"partx -g -o NR,START,END /dev/sda",
+		"blockdev --getsize64 /dev/sda",
+		fmt.Sprintf("parted -s -- /dev/sda unit B resizepart 2 %dB", 102399*mib-1),
+		"sync",
+		"udevadm settle",
+		"partprobe /dev/sda",
+		"sgdisk -v /dev/sda",
+		"blkid -o value -s TYPE /dev/sda2",
+		"e2fsck -f -p /dev/sda2",
+		"resize2fs /dev/sda2",
+	}
+	if calls := runner.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls =\n%s\nwant\n%s", strings.Join(calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGrowRootMBRBeyond2TiB(t *testing.T) {
+	i, runner := newGrowInstaller("dos", fmt.Sprint(4*tib), 4194270, "ext4")
+	if err := i.growRoot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	resize := fmt.Sprintf("parted -s -- /dev/sda unit B resizepart 2 %dB", 2097151*mib-1)
+	found := false
+	for _, c := range runner.Calls() {
+		if strings.HasPrefix(c, "parted ") {
+			found = c == resize
+			if !found {
+				t.Errorf("resize = %s, want %s", c, resize)
+			}
+		}
+		if strings.HasPrefix(c, "sgdisk -e") {
+			t.Errorf("gpt is fixed on mbr: %s", c)
+		}
+	}
+	if !found {
+		t.Errorf("partition isn't resized: %v", runner.Calls())
+	}
+}
+
+func TestGrowRootFillsDiskAlready(t *testing.T) {
+	// partition 2 ends where it would be grown to on 100GiB disk
+	end := uint64(102399*mib)/512 - 1
+	i, runner := newGrowInstaller("gpt", "107374182400", end, "ext4")
+	if err := i.growRoot(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	calls := runner.Calls()
+	if last := calls[len(calls)-1]; last != "blockdev --getsize64 /dev/sda" {
+		t.Errorf("calls after size of disk: %v", calls)
+	}
+}
+
+func TestGrowFilesystem(t *testing.T) {
+	tests := []struct {
+		fstype  string
+		outputs map[string]error
+		want    []string
+		wantErr bool
+	}{
+		{
+			fstype:  "ext4",
+			outputs: map[string]error{"e2fsck": exitStatus(1)},
+			want:    []string{"e2fsck -f -p /dev/sda2", "resize2fs /dev/sda2"},
+		},
+		{
+			fstype:  "ext4",
+			outputs: map[string]error{"e2fsck": exitStatus(4)},
+			want:    []string{"e2fsck -f -p /dev/sda2"},
+			wantErr: true,
+		},
+		{
+			fstype: "xfs",
+			want:   []string{"mount /dev/sda2 $DIR", "xfs_growfs $DIR", "sync", "umount $DIR"},
+		},
+		{
+			fstype: "btrfs",
+			want:   []string{"mount /dev/sda2 $DIR", "btrfs filesystem resize max $DIR", "sync", "umount $DIR"},
+		},
+		{
+			fstype: "LVM2_member",
+			want:   []string{"pvresize /dev/sda2"},
+		},
+		{
+			fstype: "LVM2_member",
+			// pvresize failing must fail the step
+			outputs: map[string]error{"pvresize": exitStatus(5)},
+			want:    []string{"pvresize /dev/sda2"},
+			wantErr: true,
+		},
+		{
+			fstype: "swap",
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		i, runner := newGrowInstaller("gpt", "107374182400", 4194270, tt.fstype)
+		for command, err := range tt.outputs {
+			runner.On(command, "", err)
+		}
+		err := i.growFilesystem(context.Background(), "/dev/sda2")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: growFilesystem = %v, want error %v", tt.fstype, err, tt.wantErr)
+		}
+		calls := []string{}
+		for _, c := range runner.Calls()[1:] {
+			calls = append(calls, growDirPattern.ReplaceAllLiteralString(c, "$DIR"))
+		}
+		if !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("%s: calls = %v, want %v", tt.fstype, calls, tt.want)
+		}
+	}
+}
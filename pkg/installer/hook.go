@@ -0,0 +1,204 @@
+package installer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"diskimage-installer/pkg/config"
+)
+
+// hookPhaseBefore and hookPhaseAfter are hook phases run around steps,
+// pre-clean isn't bound to a step, see preCleanBefore.
+var (
+	hookPhaseBefore = map[string]string{
+		StepWriteImage: config.HookPhasePreWrite,
+	}
+	hookPhaseAfter = map[string]string{
+		StepWriteImage:           config.HookPhasePostWrite,
+		StepConfigDrivePartition: config.HookPhasePostConfigDrive,
+	}
+)
+
+// preCleanBefore reports whether pre-clean hooks run before step when no
+// step has run yet. Every step but config drive, which only generates a
+// file, changes host: network precheck configures links, bmc configures BMC
+// and raid wipes disks.
+func preCleanBefore(step string) bool {
+	return step != StepConfigDrive
+}
+
+// hookEnvPrefix prefixes environment variables passed to hooks.
+const hookEnvPrefix = "DISKIMAGE_"
+
+// HookError is the error of a hook which aborts install.
+type HookError struct {
+	Hook  string
+	Phase string
+	Err   error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s hook %s: %v", e.Phase, e.Hook, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// HookContext is written to the file of DISKIMAGE_CONTEXT for hooks, secrets
+// of node are left out by redactNode.
+type HookContext struct {
+	Phase       string       `json:"phase"`
+	Node        config.Node  `json:"node"`
+	RootDevice  *BlockDevice `json:"root_device,omitempty"`
+	Partitions  []Partition  `json:"partitions"`
+	ConfigDrive string       `json:"config_drive,omitempty"`
+}
+
+// runAfterHooks runs hooks of phase after a step unless they ran already.
+func (i *ImgaeInstaller) runAfterHooks(ctx context.Context, phase string) error {
+	if phase == "" || i.state.hooksDone(phase) {
+		return nil
+	}
+	if err := i.runHooks(ctx, phase); err != nil {
+		return err
+	}
+	i.state.completeHooks(phase)
+	return i.saveState()
+}
+
+// runHooks runs hooks of phase in order, global hooks first.
+func (i *ImgaeInstaller) runHooks(ctx context.Context, phase string) error {
+	hooks := []config.Hook{}
+	for _, h := range i.Hooks {
+		if h.Phase == phase {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+	env, cleanup, err := i.hookEnv(ctx, phase)
+	if err != nil {
+		return &HookError{Hook: hooks[0].Name, Phase: phase, Err: err}
+	}
+	defer cleanup()
+	for _, h := range hooks {
+		err := i.runHook(ctx, h, env)
+		if err == nil {
+			continue
+		}
+		if h.OnFailure == config.HookFailureContinue {
+			i.logger.Sugar().Warnf("%s hook %s failed, install continues: %v", phase, h.Name, err)
+			continue
+		}
+		return &HookError{Hook: h.Name, Phase: phase, Err: err}
+	}
+	return nil
+}
+
+func (i *ImgaeInstaller) runHook(ctx context.Context, h config.Hook, env []string) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Timeout)*time.Second)
+		defer cancel()
+	}
+	// environment is passed by env, so that hooks run through runner
+	args := append([]string{}, env...)
+	if h.Path != "" {
+		args = append(append(args, h.Path), h.Args...)
+	} else {
+		args = append(args, "/bin/sh", "-c", h.Script)
+	}
+	i.logger.Sugar().Infof("run %s hook %s", h.Phase, h.Name)
+	out, err := i.runner.Run(ctx, "env", args...)
+	if out = strings.TrimSpace(out); out != "" {
+		i.logger.Sugar().Infof("%s hook %s: %s", h.Phase, h.Name, out)
+	}
+	return err
+}
+
+// hookEnv returns environment of hooks in phase, cleanup removes the context
+// file it refers to.
+func (i *ImgaeInstaller) hookEnv(ctx context.Context, phase string) ([]string, func(), error) {
+	hookContext := HookContext{
+		Phase:       phase,
+		Node:        redactNode(i.Node),
+		RootDevice:  i.state.RootDevice,
+		Partitions:  []Partition{},
+		ConfigDrive: i.state.ConfigDrive,
+	}
+	vars := map[string]string{
+		"PHASE":        phase,
+		"NODE_NAME":    i.Name,
+		"NODE_SERIAL":  i.SerialNumber,
+		"IMAGE":        i.ImageInfo.Image,
+		"CONFIG_DRIVE": i.state.ConfigDrive,
+	}
+	if device := i.state.RootDevice; device != nil {
+		partitions, err := i.listPartitions(ctx, *device)
+		if err != nil {
+			return nil, nil, fmt.Errorf("listPartitions(%s): %v", device.Name, err)
+		}
+		hookContext.Partitions = partitions
+		names := []string{}
+		for _, p := range partitions {
+			names = append(names, p.Name)
+		}
+		vars["ROOT_DEVICE"] = device.Name
+		vars["ROOT_DEVICE_SERIAL"] = device.Serial
+		vars["ROOT_DEVICE_SIZE"] = device.Size
+		vars["PARTITIONS"] = strings.Join(names, " ")
+	}
+
+	data, err := json.MarshalIndent(hookContext, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := ioutil.TempFile(os.TempDir(), "diskimage-hook-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("create tempfile: %v", err)
+	}
+	f.Close()
+	cleanup := func() { os.Remove(f.Name()) }
+	if err := ioutil.WriteFile(f.Name(), data, 0600); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("write hook context to %s: %v", f.Name(), err)
+	}
+	vars["CONTEXT"] = f.Name()
+
+	env := []string{}
+	for _, key := range []string{"PHASE", "NODE_NAME", "NODE_SERIAL", "IMAGE", "CONFIG_DRIVE",
+		"ROOT_DEVICE", "ROOT_DEVICE_SERIAL", "ROOT_DEVICE_SIZE", "PARTITIONS", "CONTEXT"} {
+		env = append(env, hookEnvPrefix+key+"="+vars[key])
+	}
+	return env, cleanup, nil
+}
+
+// redactNode returns node without what may be secret: BMC credentials,
+// contents of files and commands of hooks, which may embed tokens. node is
+// left as is.
+func redactNode(node config.Node) config.Node {
+	node.IPMI.Username = ""
+	node.IPMI.Password = ""
+	files := make([]config.FileInfo, len(node.Files))
+	for n, f := range node.Files {
+		f.Content = ""
+		f.Encoding = ""
+		files[n] = f
+	}
+	node.Files = files
+	hooks := make([]config.Hook, len(node.Hooks))
+	for n, h := range node.Hooks {
+		h.Args = nil
+		h.Script = ""
+		hooks[n] = h
+	}
+	node.Hooks = hooks
+	return node
+}
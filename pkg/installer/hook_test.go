@@ -0,0 +1,130 @@
+package installer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils"
+)
+
+func TestHookContextHasNoSecrets(t *testing.T) {
+	node := config.Node{
+		Name:      "node1",
+		ImageInfo: &config.ImageInfo{Image: "/images/ubuntu.img"},
+		IPMI:      config.IPMIInfo{Address: "10.0.1.10", Username: "deploy", Password: "bmc-s3cr3t"},
+		Files: []config.FileInfo{
+			{Path: "/etc/app/token", Content: "api-t0ken", Mode: "0600"},
+		},
+		Hooks: []config.Hook{
+			{Name: "register", Phase: config.HookPhasePostInstall, Path: "/opt/register", Args: []string{"--token=hook-t0ken"}},
+			{Name: "notify", Phase: config.HookPhasePreClean, Script: "curl -H 'Authorization: script-t0ken' http://cmdb"},
+		},
+	}
+	i := NewInstaller(node, zap.NewNop())
+	i.SetRunner(utils.NewFakeRunner())
+	i.state = &State{}
+	env, cleanup, err := i.hookEnv(context.Background(), config.HookPhasePreClean)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	file := ""
+	for _, e := range env {
+		if strings.HasPrefix(e, hookEnvPrefix+"CONTEXT=") {
+			file = strings.TrimPrefix(e, hookEnvPrefix+"CONTEXT=")
+		}
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"deploy", "bmc-s3cr3t", "api-t0ken", "hook-t0ken", "script-t0ken"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("hook context has %s:\n%s", secret, data)
+		}
+	}
+	hookContext := HookContext{}
+	if err := json.Unmarshal(data, &hookContext); err != nil {
+		t.Fatal(err)
+	}
+	if hookContext.Node.IPMI.Address != "10.0.1.10" || hookContext.Node.Files[0].Path != "/etc/app/token" || hookContext.Node.Hooks[0].Path != "/opt/register" {
+		t.Errorf("hook context lacks what isn't secret: %+v", hookContext.Node)
+	}
+
+	// node of installer is left as is
+	if i.IPMI.Password != "bmc-s3cr3t" || i.Files[0].Content != "api-t0ken" || i.Hooks[1].Script == "" {
+		t.Errorf("node of installer is redacted: %+v", i.Node)
+	}
+}
+
+func TestPreCleanRunsBeforeHostChanges(t *testing.T) {
+	node := config.Node{
+		Name:      "node1",
+		ImageInfo: &config.ImageInfo{Image: "/images/ubuntu.img"},
+		IPMI:      config.IPMIInfo{Configure: true, Address: "10.0.1.10", Netmask: "255.255.255.0", Username: "deploy", Password: "bmc-s3cr3t"},
+		Hooks:     []config.Hook{{Name: "inventory", Phase: config.HookPhasePreClean, Script: "true"}},
+	}
+	tests := []struct {
+		name string
+		skip []string
+	}{
+		{name: "all steps"},
+		{name: "without network precheck", skip: []string{StepNetworkPrecheck}},
+	}
+	for _, tt := range tests {
+		runner := utils.NewFakeRunner()
+		i := NewInstaller(node, zap.NewNop())
+		i.SetRunner(runner)
+		i.SetSteps(nil, tt.skip)
+		// ipmitool of fake runner reads nothing back, install stops at bmc
+		if err := i.InstallOS(context.Background()); err == nil || !strings.Contains(err.Error(), "step bmc") {
+			t.Fatalf("%s: InstallOS = %v, want error of step bmc", tt.name, err)
+		}
+		calls := runner.Calls()
+		if len(calls) < 2 || !strings.HasPrefix(calls[0], "env DISKIMAGE_PHASE=pre-clean ") || !strings.HasPrefix(calls[1], "ipmitool ") {
+			t.Errorf("%s: calls = %v, want pre-clean hook before ipmitool", tt.name, calls)
+		}
+		hooks := 0
+		for _, c := range calls {
+			if strings.Contains(c, "DISKIMAGE_PHASE=pre-clean") {
+				hooks++
+			}
+		}
+		if hooks != 1 {
+			t.Errorf("%s: pre-clean hook runs %d times", tt.name, hooks)
+		}
+	}
+}
+
+func TestPlanPreClean(t *testing.T) {
+	node := config.Node{
+		Name:      "node1",
+		ImageInfo: &config.ImageInfo{Image: "/images/ubuntu.img"},
+		Hooks:     []config.Hook{{Name: "inventory", Phase: config.HookPhasePreClean, Path: "/opt/inventory"}},
+	}
+	runner := utils.NewFakeRunner().On("lsblk -O -J", lsblkBefore, nil)
+	i := NewInstaller(node, zap.NewNop())
+	i.SetRunner(runner)
+	i.RootDevice = map[string]string{"name": "/dev/sda"}
+	plan, err := i.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range plan.Steps {
+		has := false
+		for _, a := range step.Actions {
+			if strings.Contains(a, "pre-clean hook inventory") {
+				has = true
+			}
+		}
+		if has != (step.Name == StepNetworkPrecheck) {
+			t.Errorf("step %s has pre-clean hook: %v", step.Name, has)
+		}
+	}
+}
@@ -1,38 +1,81 @@
 package installer
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"diskimage-installer/pkg/bmc"
 	"diskimage-installer/pkg/config"
 	"diskimage-installer/pkg/configdrive"
 	"diskimage-installer/pkg/hardware"
 	"diskimage-installer/pkg/shell"
-	"diskimage-installer/pkg/utils/disk"
+	"diskimage-installer/pkg/utils"
 	diskutils "diskimage-installer/pkg/utils/disk"
 )
 
+// LLDP frames are sent every 30 seconds by default
+const defaultLLDPTimeout = 35 * time.Second
+
+// defaultOEMLabel is label of the OEM partition of Flatcar.
+const defaultOEMLabel = "OEM"
+
 type ImgaeInstaller struct {
 	config.Node
 	hardwareManager *hardware.HardWareManager
 	logger          *zap.Logger
+	runner          utils.Runner
+	disk            *diskutils.Disk
+	bmc             bmc.BMC
+	// networkInterfaces caches interfaces of host once they are listed.
+	networkInterfaces []hardware.NetworkInterface
+	// stateFile keeps progress of install, install isn't resumable when it
+	// is empty.
+	stateFile string
+	state     *State
+	onlySteps []string
+	skipSteps []string
 }
 
 func NewInstaller(node config.Node, logger *zap.Logger) *ImgaeInstaller {
-	return &ImgaeInstaller{
+	i := &ImgaeInstaller{
 		Node:            node,
 		logger:          logger,
 		hardwareManager: hardware.NewHardWareManager(logger),
 	}
+	i.SetRunner(utils.ExecRunner{})
+	return i
+}
+
+// SetRunner makes installer, its hardware manager and BMC run commands by
+// runner.
+func (i *ImgaeInstaller) SetRunner(runner utils.Runner) {
+	i.runner = runner
+	i.disk = diskutils.New(runner)
+	i.bmc = bmc.NewIPMITool(runner)
+	i.hardwareManager.SetRunner(runner)
+}
+
+// SetStateFile makes install resumable by keeping its progress in path.
+func (i *ImgaeInstaller) SetStateFile(path string) {
+	i.stateFile = path
+}
+
+// SetSteps limits install to steps of only, every step runs when only is
+// empty, steps of skip never run. Steps named in only run even if state file
+// says they are completed.
+func (i *ImgaeInstaller) SetSteps(only, skip []string) {
+	i.onlySteps = only
+	i.skipSteps = skip
 }
 
-func (i *ImgaeInstaller) Write(rootDevice string) error {
+func (i *ImgaeInstaller) Write(ctx context.Context, rootDevice string) error {
 	// Checksum of image
 	_ = shell.WriteImage
 	f, err := ioutil.TempFile(os.TempDir(), "diskimage-installer-")
@@ -43,64 +86,281 @@ func (i *ImgaeInstaller) Write(rootDevice string) error {
 	if err := ioutil.WriteFile(f.Name(), shell.WriteImage, 0700); err != nil {
 		return fmt.Errorf("write script to file %s: %v", f.Name(), err)
 	}
-	var out bytes.Buffer
-	cmd := exec.Command("/bin/bash", f.Name(), i.ImageInfo.Image, rootDevice)
-	cmd.Stdout = &out
-	cmd.Stderr = &out
 	i.logger.Sugar().Infof("write image %s to device %s", i.ImageInfo.Image, rootDevice)
-	if err := cmd.Run(); err != nil {
-		return errors.Wrapf(err, "write image: %s", out.String())
+	out, err := i.runner.Run(ctx, "/bin/bash", f.Name(), i.ImageInfo.Image, rootDevice)
+	if err != nil {
+		return errors.Wrapf(err, "write image: %s", out)
 	}
-	i.logger.Sugar().Infof("Write image successed\n %s", out.String())
+	i.logger.Sugar().Infof("Write image successed\n %s", out)
 	return nil
 }
 
-func (i *ImgaeInstaller) InstallOS() error {
-	configdrivefile, err := i.genConfigDrive()
+// InstallOS runs the selected install steps in order, steps completed by a
+// former attempt of the same node config are skipped.
+func (i *ImgaeInstaller) InstallOS(ctx context.Context) error {
+	if err := i.validate(); err != nil {
+		return err
+	}
+	state, err := i.loadState()
 	if err != nil {
-		return errors.Wrap(err, "ImgaeInstaller.genConfigDrive:")
+		return err
 	}
+	i.state = state
 
-	if err := i.configRaidController(); err != nil {
+	finished, cleaned := false, false
+	defer func() {
+		// without state file nothing is resumed, config drive is left
+		// for a later attempt otherwise
+		if i.stateFile == "" || finished {
+			i.clearState()
+		}
+	}()
+	for _, s := range i.steps() {
+		if s.name == StepPowerAction && len(i.onlySteps) == 0 {
+			if err := i.runAfterHooks(ctx, config.HookPhasePostInstall); err != nil {
+				return err
+			}
+		}
+		if !i.selected(s.name) {
+			i.logger.Sugar().Infof("step %s is skipped", s.name)
+			continue
+		}
+		if len(i.onlySteps) == 0 && i.state.done(s.name) {
+			i.logger.Sugar().Infof("step %s is completed already", s.name)
+		} else {
+			if !cleaned && preCleanBefore(s.name) {
+				if err := i.runHooks(ctx, config.HookPhasePreClean); err != nil {
+					return err
+				}
+				cleaned = true
+			}
+			if err := i.runHooks(ctx, hookPhaseBefore[s.name]); err != nil {
+				return err
+			}
+			if err := i.runStep(ctx, s.name, s.run); err != nil {
+				return err
+			}
+			i.state.complete(s.name)
+			// hooks after step run again once it is done again
+			i.state.forgetHooks(hookPhaseAfter[s.name])
+			if err := i.saveState(); err != nil {
+				return errors.Wrap(err, "save state")
+			}
+		}
+		if err := i.runAfterHooks(ctx, hookPhaseAfter[s.name]); err != nil {
+			return err
+		}
+	}
+	finished = len(i.onlySteps) == 0
+	return nil
+}
+
+// validate checks node config and step selection before any step runs.
+func (i *ImgaeInstaller) validate() error {
+	if i.ImageInfo == nil || i.ImageInfo.Image == "" {
+		return fmt.Errorf("image of node %s is not specified", i.Name)
+	}
+	if err := i.ImageInfo.Validate(); err != nil {
+		return err
+	}
+	if i.PartitionLayout != nil {
+		if err := i.PartitionLayout.Validate(); err != nil {
+			return err
+		}
+	}
+	if i.Ignition != nil {
+		if err := i.Ignition.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := i.ValidateStorage(); err != nil {
+		return err
+	}
+	if i.PowerAction != nil {
+		if err := i.PowerAction.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateStepTimeouts(i.StepTimeouts); err != nil {
+		return err
+	}
+	if err := i.ValidateHooks(); err != nil {
+		return err
+	}
+	if err := i.ValidateFiles(); err != nil {
 		return err
 	}
+	return ValidateStepNames(append(append([]string{}, i.onlySteps...), i.skipSteps...))
+}
 
-	rootDevice, err := i.getInstallDevice()
+func (i *ImgaeInstaller) configRaidController(ctx context.Context) error {
+	if i.RaidConfig == nil {
+		return nil
+	}
+	return i.RaidConfig.Validate()
+}
+
+func (i *ImgaeInstaller) stepConfigDrive(ctx context.Context) error {
+	configdrivefile, err := i.genConfigDrive(ctx)
 	if err != nil {
-		return fmt.Errorf("getInstallDevice: %v", err)
+		return errors.Wrap(err, "ImgaeInstaller.genConfigDrive:")
 	}
-	if err := i.Write(rootDevice.Name); err != nil {
-		return fmt.Errorf("install os: %v", err)
+	i.state.ConfigDrive = configdrivefile
+	return nil
+}
+
+func (i *ImgaeInstaller) stepRootDevice(ctx context.Context) error {
+	_, err := i.rootDevice(ctx)
+	return err
+}
+
+// rootDevice returns device image is written to, it is looked up once and
+// kept in state.
+func (i *ImgaeInstaller) rootDevice(ctx context.Context) (BlockDevice, error) {
+	if i.state.RootDevice != nil {
+		return *i.state.RootDevice, nil
+	}
+	device, err := i.getInstallDevice(ctx)
+	if err != nil {
+		return BlockDevice{}, fmt.Errorf("getInstallDevice: %v", err)
+	}
+	i.state.RootDevice = &device
+	return device, nil
+}
+
+func (i *ImgaeInstaller) stepWriteImage(ctx context.Context) error {
+	rootDevice, err := i.rootDevice(ctx)
+	if err != nil {
+		return err
 	}
-	// Write config drive
-	if err := i.CreateConfigDrivePartition(configdrivefile, rootDevice); err != nil {
-		return errors.Wrap(err, "ImgaeInstaller.WriteConfigDrive:")
+	write := i.Write
+	if i.isPartitionImage() {
+		write = i.writePartitionImage
 	}
-	// Config boot
-	uuid, err := disk.GetDiskUUID(rootDevice.Name)
+	if err := write(ctx, rootDevice.Name); err != nil {
+		if ctx.Err() != nil {
+			i.wipeDevice(rootDevice.Name)
+		}
+		return fmt.Errorf("install os: %v", err)
+	}
+	uuid, err := i.disk.GetDiskUUID(ctx, rootDevice.Name)
 	if err != nil {
-		return errors.Wrapf(err, "disk.GetDiskUUID(%s)", rootDevice.Name)
+		return errors.Wrapf(err, "i.disk.GetDiskUUID(%s)", rootDevice.Name)
 	}
 	i.logger.Sugar().Infof("root uuid: %s", uuid)
 	return nil
 }
 
-func (i ImgaeInstaller) configRaidController() error {
-	if i.RaidConfig == nil {
+func (i *ImgaeInstaller) stepConfigDrivePartition(ctx context.Context) error {
+	if i.state.ConfigDrive == "" {
+		if len(i.AllNetworks()) > 0 || i.Ignition != nil {
+			return fmt.Errorf("config drive isn't generated, step %s has to run first", StepConfigDrive)
+		}
 		return nil
 	}
+	rootDevice, err := i.rootDevice(ctx)
+	if err != nil {
+		return err
+	}
+	if i.ignitionInOEM() {
+		return i.writeIgnitionOEM(ctx, i.state.ConfigDrive, rootDevice)
+	}
+	return errors.Wrap(i.CreateConfigDrivePartition(ctx, i.state.ConfigDrive, rootDevice), "ImgaeInstaller.WriteConfigDrive:")
+}
+
+// needsConfigDrivePartition reports whether a config drive partition is
+// appended to root disk.
+func (i *ImgaeInstaller) needsConfigDrivePartition() bool {
+	return (len(i.AllNetworks()) > 0 || i.Ignition != nil) && !i.ignitionInOEM()
+}
+
+func (i *ImgaeInstaller) ignitionInOEM() bool {
+	return i.Ignition != nil && i.Ignition.Placement == config.IgnitionPlacementOEM
+}
+
+// writeIgnitionOEM copies Ignition config to config.ign of the OEM partition
+// of image, which Flatcar reads on first boot.
+func (i *ImgaeInstaller) writeIgnitionOEM(ctx context.Context, ignition string, device BlockDevice) (err error) {
+	if err := i.disk.RescanDevice(ctx, device.Name); err != nil {
+		return errors.Wrap(err, "diskutils.RescanDevice")
+	}
+	label := i.Ignition.OEMLabel
+	if label == "" {
+		label = defaultOEMLabel
+	}
+	partitions, err := i.listPartitions(ctx, device)
+	if err != nil {
+		return errors.Wrapf(err, "listPartitions(%s)", device.Name)
+	}
+	oem := ""
+	for _, p := range partitions {
+		if p.Label == label {
+			oem = p.Name
+			break
+		}
+	}
+	if oem == "" {
+		return fmt.Errorf("no partition of label %s is on %s", label, device.Name)
+	}
+	data, err := ioutil.ReadFile(ignition)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "diskimage-oem-")
+	if err != nil {
+		return err
+	}
+	if out, err := i.runner.Run(ctx, "mount", oem, dir); err != nil {
+		os.Remove(dir)
+		return fmt.Errorf("mount %s: %v: %s", oem, err, out)
+	}
+	defer func() {
+		if uerr := i.cleanupUmount(dir); uerr != nil && err == nil {
+			err = uerr
+		}
+		os.Remove(dir)
+	}()
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.ign"), data, 0600); err != nil {
+		return err
+	}
+	i.logger.Sugar().Infof("wrote ignition config to config.ign of %s", oem)
 	return nil
 }
 
-func (i *ImgaeInstaller) genConfigDrive() (string, error) {
-	if i.Network.IsEmpty() {
+func (i *ImgaeInstaller) stepPowerAction(ctx context.Context) error {
+	if i.PowerAction == nil {
+		return nil
+	}
+	rootDevice, err := i.rootDevice(ctx)
+	if err != nil {
+		return err
+	}
+	return i.powerAction(ctx, rootDevice)
+}
+
+func (i *ImgaeInstaller) genConfigDrive(ctx context.Context) (string, error) {
+	if len(i.AllNetworks()) == 0 && i.Ignition == nil {
 		return "", nil
 	}
-	networkinterfaces, err := i.hardwareManager.ListNetworkInterface()
+	networkinterfaces, err := i.listNetworkInterfaces(ctx)
 	if err != nil {
-		return "", errors.Wrap(err, "hardwareManager.ListNetworkInterface")
+		return "", err
+	}
+	if i.ignitionInOEM() {
+		ignitionPath, err := configdrive.WriteIgnition(networkinterfaces, i.Node, i.logger)
+		if err != nil {
+			return "", errors.Wrap(err, "configdrive.WriteIgnition:")
+		}
+		return ignitionPath, nil
 	}
-	configdrivePath, err := configdrive.Generate(networkinterfaces, i.Node, i.logger)
+	if i.Ignition != nil {
+		configdrivePath, err := configdrive.GenerateIgnition(ctx, networkinterfaces, i.Node, i.runner, i.logger)
+		if err != nil {
+			return "", errors.Wrap(err, "configdrive.GenerateIgnition:")
+		}
+		return configdrivePath, nil
+	}
+	configdrivePath, err := configdrive.Generate(ctx, networkinterfaces, i.Node, i.runner, i.logger)
 	if err != nil {
 		return "", errors.Wrap(err, "configdrive.Generate:")
 	}
@@ -108,8 +368,59 @@ func (i *ImgaeInstaller) genConfigDrive() (string, error) {
 	return configdrivePath, nil
 }
 
-func (i *ImgaeInstaller) getInstallDevice() (BlockDevice, error) {
-	devices, err := listAllBlockDevice()
+// listNetworkInterfaces lists interfaces of host, waiting for bond carrier and
+// discovering LLDP neighbors when node config needs them.
+func (i *ImgaeInstaller) listNetworkInterfaces(ctx context.Context) ([]hardware.NetworkInterface, error) {
+	if i.networkInterfaces != nil {
+		return i.networkInterfaces, nil
+	}
+	networkinterfaces, err := i.hardwareManager.ListNetworkInterface(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "hardwareManager.ListNetworkInterface")
+	}
+	networkinterfaces, err = i.waitForBondCarrier(ctx, networkinterfaces)
+	if err != nil {
+		return nil, errors.Wrap(err, "ImgaeInstaller.waitForBondCarrier")
+	}
+	if i.NeedsLLDP() {
+		timeout := defaultLLDPTimeout
+		if i.LLDPTimeout > 0 {
+			timeout = time.Duration(i.LLDPTimeout) * time.Second
+		}
+		networkinterfaces, err = i.hardwareManager.DiscoverLLDP(ctx, networkinterfaces, timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	i.networkInterfaces = networkinterfaces
+	return networkinterfaces, nil
+}
+
+// waitForBondCarrier gives links of bonds with carrier timeout time to finish
+// negotiation, interfaces listed at last are returned.
+func (i *ImgaeInstaller) waitForBondCarrier(ctx context.Context, networkinterfaces []hardware.NetworkInterface) ([]hardware.NetworkInterface, error) {
+	for _, network := range i.AllNetworks() {
+		bond := network.Bond
+		if bond.IsEmpty() || bond.CarrierTimeout <= 0 {
+			continue
+		}
+		interval := time.Duration(bond.CarrierPollInterval) * time.Second
+		if interval <= 0 {
+			interval = time.Second
+		}
+		var err error
+		networkinterfaces, err = i.hardwareManager.WaitForCarrier(ctx, func(n hardware.NetworkInterface) bool {
+			return configdrive.IsBondMember(n, bond)
+		}, time.Duration(bond.CarrierTimeout)*time.Second, interval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return networkinterfaces, nil
+}
+
+func (i *ImgaeInstaller) getInstallDevice(ctx context.Context) (BlockDevice, error) {
+	devices, err := i.listAllBlockDevice(ctx)
 	if err != nil {
 		i.logger.Sugar().Error("listAllBlockDevice: %v", err)
 		return BlockDevice{}, err
@@ -143,15 +454,15 @@ func (i *ImgaeInstaller) matchRootDevice(d BlockDevice, root map[string]string)
 	return false
 }
 
-func (i *ImgaeInstaller) CreateConfigDrivePartition(configdrivefile string, device BlockDevice) error {
-	if err := diskutils.RescanDevice(device.Name); err != nil {
+func (i *ImgaeInstaller) CreateConfigDrivePartition(ctx context.Context, configdrivefile string, device BlockDevice) error {
+	if err := i.disk.RescanDevice(ctx, device.Name); err != nil {
 		return errors.Wrap(err, "diskutils.RescanDevice")
 	}
 	info, err := os.Stat(configdrivefile)
 	if err != nil {
 		return err
 	}
-	partitions, err := listPartitions(device)
+	partitions, err := i.listPartitions(ctx, device)
 	if err != nil {
 		return errors.Wrapf(err, "listPartitions(%s)", device.Name)
 	}
@@ -162,28 +473,28 @@ func (i *ImgaeInstaller) CreateConfigDrivePartition(configdrivefile string, devi
 		return fmt.Errorf("config drive oversize: %s", configdrivefile)
 	}
 	i.logger.Sugar().Infof("Adding config drive partition to device %s", device.Name)
-	pttype, err := diskutils.GetPartitionTableType(device.Name)
+	pttype, err := i.disk.GetPartitionTableType(ctx, device.Name)
 	if err != nil {
 		return errors.Wrap(err, "diskutils.GetPartitionTableType:")
 	}
 	if pttype == diskutils.GPT {
-		if err := diskutils.FixGTPPartition(device.Name); err != nil {
+		if err := i.disk.FixGTPPartition(ctx, device.Name); err != nil {
 			return errors.Wrap(err, "diskutils.FixGTPPartition:")
 		}
 		option := fmt.Sprintf("0:-%dMB:0", diskutils.MaxConfigDriveSizeMB)
 		i.logger.Sugar().Info("Creating GPT Partition")
-		if err := diskutils.CreateGPTPartion(device.Name, option); err != nil {
+		if err := i.disk.CreateGPTPartion(ctx, device.Name, option); err != nil {
 			return errors.Wrap(err, "diskutils.CreateGPTPartion:")
 		}
 	} else {
 		i.logger.Sugar().Info("Creating MBR Partition")
-		if err := diskutils.CreateMBRPartitionForConfigDrive(device.Name); err != nil {
+		if err := i.disk.CreateMBRPartitionForConfigDrive(ctx, device.Name); err != nil {
 			i.logger.Sugar().Errorf("CreateMBRPartitionForConfigDrive: %v", err)
 			return err
 		}
 	}
 
-	partitions, err = listPartitions(device)
+	partitions, err = i.listPartitions(ctx, device)
 	if err != nil {
 		return errors.Wrapf(err, "listPartitions(%s)", device.Name)
 	}
@@ -197,7 +508,7 @@ func (i *ImgaeInstaller) CreateConfigDrivePartition(configdrivefile string, devi
 		configDrivePartition = p
 	}
 	i.logger.Sugar().Infof("writing configdrive to partition %s", configDrivePartition.Name)
-	if err := diskutils.DD(configdrivefile, configDrivePartition.Name); err != nil {
+	if err := i.disk.DD(ctx, configdrivefile, configDrivePartition.Name); err != nil {
 		return errors.Wrap(err, "diskutils.DD")
 	}
 	return nil
@@ -0,0 +1,274 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils"
+)
+
+// scriptRunner is a FakeRunner whose commands may have outputs in turn, the
+// last output repeats once the others are used. It makes the iso mkisofs is
+// asked for and keeps network_data.json packed in it.
+type scriptRunner struct {
+	*utils.FakeRunner
+	mu          sync.Mutex
+	outputs     map[string][]string
+	networkData string
+}
+
+func newScriptRunner() *scriptRunner {
+	return &scriptRunner{FakeRunner: utils.NewFakeRunner(), outputs: map[string][]string{}}
+}
+
+// OnEach scripts outputs of the command line in order.
+func (r *scriptRunner) OnEach(line string, outputs ...string) *scriptRunner {
+	r.outputs[line] = outputs
+	return r
+}
+
+func (r *scriptRunner) Run(ctx context.Context, command string, args ...string) (string, error) {
+	out, err := r.FakeRunner.Run(ctx, command, args...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	line := strings.Join(append([]string{command}, args...), " ")
+	if outputs, ok := r.outputs[line]; ok && len(outputs) > 0 {
+		out = outputs[0]
+		if len(outputs) > 1 {
+			r.outputs[line] = outputs[1:]
+		}
+	}
+	if command == "mkisofs" {
+		dir, iso := args[len(args)-1], args[len(args)-2]
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "openstack", "latest", "network_data.json"))
+		r.networkData = string(data)
+		if err := ioutil.WriteFile(iso, []byte("iso"), 0644); err != nil {
+			return "", err
+		}
+	}
+	return out, err
+}
+
+var tempPathPatterns = []struct {
+	pattern *regexp.Regexp
+	name    string
+}{
+	{regexp.MustCompile(`/tmp/configdrive-[0-9a-f-]+\.iso`), "$ISO"},
+	{regexp.MustCompile(`/tmp/configdriver-[0-9]+`), "$ISODIR"},
+	{regexp.MustCompile(`\S*/diskimage-installer-[0-9]+`), "$SCRIPT"},
+}
+
+// normalizedCalls returns calls of runner with temporary paths replaced by
+// their names.
+func normalizedCalls(r *scriptRunner) []string {
+	calls := r.Calls()
+	for n, c := range calls {
+		for _, p := range tempPathPatterns {
+			c = p.pattern.ReplaceAllLiteralString(c, p.name)
+		}
+		calls[n] = c
+	}
+	return calls
+}
+
+// lsblk outputs of sda before and after config drive partition is added.
+const (
+	lsblkBefore = `{"blockdevices": [
+		{"name": "sda", "kname": "sda", "type": "disk", "size": "100G", "hctl": "0:0:0:0", "rota": "1",
+		 "children": [{"name": "sda1", "kname": "sda1", "type": "part", "size": "1G", "fstype": "ext4"}]}]}`
+	lsblkAfter = `{"blockdevices": [
+		{"name": "sda", "kname": "sda", "type": "disk", "size": "100G", "hctl": "0:0:0:0", "rota": "1",
+		 "children": [{"name": "sda1", "kname": "sda1", "type": "part", "size": "1G", "fstype": "ext4"},
+		              {"name": "sda2", "kname": "sda2", "type": "part", "size": "64M"}]}]}`
+)
+
+// newFixtureInstaller returns installer of node whose host has interfaces
+// eno1 and eno2 and disk sda of partition table pttype.
+func newFixtureInstaller(t *testing.T, node config.Node, pttype string) (*ImgaeInstaller, *scriptRunner) {
+	t.Helper()
+	sysfs := t.TempDir()
+	for n, name := range []string{"eno1", "eno2"} {
+		dir := filepath.Join(sysfs, "class", "net", name)
+		device := filepath.Join(sysfs, "devices", "pci0000:00", fmt.Sprintf("0000:3b:00.%d", n))
+		for _, d := range []string{dir, device} {
+			if err := os.MkdirAll(d, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink(device, filepath.Join(dir, "device")); err != nil {
+			t.Fatal(err)
+		}
+		attrs := map[string]string{"address": fmt.Sprintf("aa:00:00:00:00:%02d", n+1), "carrier": "1", "operstate": "up"}
+		for attr, value := range attrs {
+			if err := ioutil.WriteFile(filepath.Join(dir, attr), []byte(value+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	procfs := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(procfs, "cmdline"), []byte("ro\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := newScriptRunner()
+	runner.On("blkid /dev/sda --probe", `/dev/sda: PTUUID="0c7d0b4f" PTTYPE="`+pttype+`"`, nil).
+		On("blockdev --getsize64 /dev/sda", "107374182400\n", nil).
+		On("biosdevname", "", exitStatus(4))
+	runner.OnEach("lsblk -O -J", lsblkBefore, lsblkBefore, lsblkAfter)
+	i := NewInstaller(node, zap.NewNop())
+	i.SetRunner(runner)
+	i.hardwareManager.SetSysfsRoot(sysfs)
+	i.hardwareManager.SetProcfsRoot(procfs)
+	return i, runner
+}
+
+type exitStatus int
+
+func (e exitStatus) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e exitStatus) ExitCode() int { return int(e) }
+
+func TestInstallOSCommands(t *testing.T) {
+	network := config.NetworkInfo{
+		IPv4Address: "10.0.0.10",
+		NetMask:     "255.255.255.0",
+		Gateway:     "10.0.0.1",
+		Interface:   "eno1",
+	}
+	bonded := network
+	bonded.Interface = ""
+	bonded.Bond = config.BondInfo{Mode: "802.3ad", Links: []string{"eno1", "eno2"}}
+
+	tests := []struct {
+		name        string
+		network     config.NetworkInfo
+		pttype      string
+		partition   []string
+		networkData []string
+	}{
+		{
+			name:    "gpt",
+			network: network,
+			pttype:  "gpt",
+			partition: []string{
+				"partprobe /dev/sda",
+				"blkid /dev/sda --probe",
+				"partprobe /dev/sda",
+				"blkid /dev/sda --probe",
+				"sgdisk -v /dev/sda",
+				"sgdisk -n 0:-64MB:0 /dev/sda",
+			},
+			networkData: []string{`"type": "phy"`, `"link": "aa:00:00:00:00:01"`},
+		},
+		{
+			name:    "mbr",
+			network: network,
+			pttype:  "dos",
+			partition: []string{
+				"partprobe /dev/sda",
+				"blkid /dev/sda --probe",
+				"blockdev --getsize64 /dev/sda",
+				"parted -a optimal -s -- /dev/sda mkpart primary fat32 -64MiB -0",
+				"sync",
+				"udevadm settle",
+				"partprobe /dev/sda",
+				"sgdisk -v /dev/sda",
+			},
+			networkData: []string{`"type": "phy"`},
+		},
+		{
+			name:    "gpt bonded",
+			network: bonded,
+			pttype:  "gpt",
+			partition: []string{
+				"partprobe /dev/sda",
+				"blkid /dev/sda --probe",
+				"partprobe /dev/sda",
+				"blkid /dev/sda --probe",
+				"sgdisk -v /dev/sda",
+				"sgdisk -n 0:-64MB:0 /dev/sda",
+			},
+			networkData: []string{`"type": "bond"`, `"bond_mode": "802.3ad"`, `"bond_links": [`},
+		},
+	}
+	for _, tt := range tests {
+		node := config.Node{
+			Name:       "node1",
+			ImageInfo:  &config.ImageInfo{Image: "/images/ubuntu.img"},
+			RootDevice: map[string]string{"hctl": "0:0:0:0"},
+			Network:    tt.network,
+		}
+		i, runner := newFixtureInstaller(t, node, tt.pttype)
+		if err := i.InstallOS(context.Background()); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := []string{
+			// config_drive
+			"biosdevname -i eno1",
+			"biosdevname -i eno2",
+			"mkisofs -R -V config-2 -o $ISO $ISODIR",
+			// root_device
+			"udevadm settle",
+			"lsblk -O -J",
+			// write_image
+			"/bin/bash $SCRIPT /images/ubuntu.img /dev/sda",
+			"hexdump -s 440 -n 4 -e \"0x%08x\" /dev/sda",
+			// config_drive_partition
+			"sync",
+			"udevadm settle",
+			"partprobe /dev/sda",
+			"sgdisk -v /dev/sda",
+			"lsblk -O -J",
+		}
+		want = append(want, tt.partition...)
+		want = append(want, "lsblk -O -J", "dd if=$ISO of=/dev/sda2 bs=1M oflag=sync")
+		if calls := normalizedCalls(runner); !reflect.DeepEqual(calls, want) {
+			t.Errorf("%s: calls =\n%s\nwant\n%s", tt.name, strings.Join(calls, "\n"), strings.Join(want, "\n"))
+		}
+		for _, s := range tt.networkData {
+			if !strings.Contains(runner.networkData, s) {
+				t.Errorf("%s: network_data.json has no %s:\n%s", tt.name, s, runner.networkData)
+			}
+		}
+	}
+}
+
+// cancelRunner cancels install once command runs.
+type cancelRunner struct {
+	*utils.FakeRunner
+	command string
+	cancel  context.CancelFunc
+}
+
+func (r *cancelRunner) Run(ctx context.Context, command string, args ...string) (string, error) {
+	if command == r.command {
+		r.cancel()
+	}
+	return r.FakeRunner.Run(ctx, command, args...)
+}
+
+func TestInterruptedStepUnmounts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := &cancelRunner{FakeRunner: utils.NewFakeRunner(), command: "xfs_growfs", cancel: cancel}
+	i := NewInstaller(config.Node{}, zap.NewNop())
+	i.SetRunner(runner)
+	if err := i.growMounted(ctx, "/dev/sda1", "xfs_growfs"); err != context.Canceled && !strings.Contains(fmt.Sprint(err), "context canceled") {
+		t.Errorf("growMounted = %v, want context canceled", err)
+	}
+	calls := runner.Calls()
+	if len(calls) != 4 || !strings.HasPrefix(calls[0], "mount /dev/sda1 ") || calls[2] != "sync" || !strings.HasPrefix(calls[3], "umount ") {
+		t.Errorf("calls = %v, want mount, xfs_growfs, sync and umount", calls)
+	}
+}
@@ -0,0 +1,454 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/config"
+	diskutils "diskimage-installer/pkg/utils/disk"
+)
+
+// Roles of partitions created for a partition image.
+const (
+	partitionRoleESP      = "esp"
+	partitionRoleBIOSBoot = "bios_boot"
+	partitionRoleSwap     = "swap"
+	partitionRoleRoot     = "root"
+)
+
+const (
+	defaultESPSizeMB      = 550
+	defaultBIOSBootSizeMB = 1
+)
+
+// layoutPartition is a partition created for a partition image, Start and
+// End are in MiB and End is exclusive.
+type layoutPartition struct {
+	Number int
+	Role   string
+	Start  uint64
+	End    uint64
+}
+
+func (i *ImgaeInstaller) isPartitionImage() bool {
+	return i.ImageInfo != nil && i.ImageInfo.Type == config.ImageTypePartition
+}
+
+// partitionLayout returns label and partitions created for a partition image
+// on a disk of size bytes, partitions are numbered in order.
+func (i *ImgaeInstaller) partitionLayout(size uint64) (string, []layoutPartition, error) {
+	layout := config.PartitionLayoutInfo{}
+	if i.PartitionLayout != nil {
+		layout = *i.PartitionLayout
+	}
+	label := layout.Label
+	if label == "" {
+		label = config.PartitionLabelGPT
+	}
+	pttype := diskutils.GPT
+	if label == config.PartitionLabelMSDOS {
+		pttype = diskutils.MBR
+	}
+
+	partitions := []layoutPartition{}
+	start := uint64(1)
+	add := func(role string, sizeMB uint64) {
+		partitions = append(partitions, layoutPartition{Number: len(partitions) + 1, Role: role, Start: start, End: start + sizeMB})
+		start += sizeMB
+	}
+	if i.hardwareManager.GetBootMode() == "efi" {
+		add(partitionRoleESP, uint64(orDefault(layout.ESPSizeMB, defaultESPSizeMB)))
+	} else if label == config.PartitionLabelGPT {
+		// grub of BIOS is embedded in BIOS boot partition on GPT, it is
+		// embedded after MBR on msdos
+		add(partitionRoleBIOSBoot, uint64(orDefault(layout.BIOSBootSizeMB, defaultBIOSBootSizeMB)))
+	}
+	if layout.SwapSizeMB > 0 {
+		add(partitionRoleSwap, uint64(layout.SwapSizeMB))
+	}
+	end := (i.growEnd(size, pttype) + 1) / mib
+	if end <= start {
+		return "", nil, fmt.Errorf("disk of %d MiB has no space for root partition", size/mib)
+	}
+	rootSize := uint64(layout.RootSizeMB)
+	if rootSize == 0 {
+		rootSize = end - start
+	} else if start+rootSize > end {
+		return "", nil, fmt.Errorf("root partition of %d MiB doesn't fit disk of %d MiB", rootSize, size/mib)
+	}
+	add(partitionRoleRoot, rootSize)
+	return label, partitions, nil
+}
+
+func orDefault(v, def int) int {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+func findPartition(partitions []layoutPartition, role string) (layoutPartition, bool) {
+	for _, p := range partitions {
+		if p.Role == role {
+			return p, true
+		}
+	}
+	return layoutPartition{}, false
+}
+
+// writePartitionImage creates partition layout on device and writes image
+// into its root partition, filesystem of image is grown to fill root.
+func (i *ImgaeInstaller) writePartitionImage(ctx context.Context, device string) error {
+	size, err := i.disk.SizeBytes(ctx, device)
+	if err != nil {
+		return errors.Wrapf(err, "size of %s", device)
+	}
+	label, partitions, err := i.partitionLayout(size)
+	if err != nil {
+		return err
+	}
+	if err := i.createPartitionLayout(ctx, device, label, partitions); err != nil {
+		return err
+	}
+	root, _ := findPartition(partitions, partitionRoleRoot)
+	rootDevice := diskutils.PartitionDevice(device, root.Number)
+	i.logger.Sugar().Infof("write partition image %s to %s", i.ImageInfo.Image, rootDevice)
+	if out, err := i.runner.Run(ctx, "qemu-img", "convert", "-t", "directsync", "-O", "host_device", i.ImageInfo.Image, rootDevice); err != nil {
+		return fmt.Errorf("qemu-img convert %s: %v: %s", i.ImageInfo.Image, err, out)
+	}
+	if _, err := i.runner.Run(ctx, "sync"); err != nil {
+		return err
+	}
+	return i.growFilesystem(ctx, rootDevice)
+}
+
+func (i *ImgaeInstaller) createPartitionLayout(ctx context.Context, device, label string, partitions []layoutPartition) error {
+	parted := func(args ...string) error {
+		if out, err := i.runner.Run(ctx, "parted", append([]string{"-s", "-a", "optimal", "--", device}, args...)...); err != nil {
+			return fmt.Errorf("parted %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+		return nil
+	}
+	if out, err := i.runner.Run(ctx, "wipefs", "-a", device); err != nil {
+		return fmt.Errorf("wipefs -a %s: %v: %s", device, err, out)
+	}
+	if err := parted("mklabel", label); err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		name := p.Role
+		if label == config.PartitionLabelMSDOS {
+			name = "primary"
+		}
+		args := []string{"mkpart", name}
+		switch p.Role {
+		case partitionRoleESP:
+			args = append(args, "fat32")
+		case partitionRoleSwap:
+			args = append(args, "linux-swap")
+		case partitionRoleRoot:
+			args = append(args, "ext4")
+		}
+		args = append(args, fmt.Sprintf("%dMiB", p.Start), fmt.Sprintf("%dMiB", p.End))
+		if err := parted(args...); err != nil {
+			return err
+		}
+		flag := ""
+		switch {
+		case p.Role == partitionRoleESP:
+			flag = "esp"
+		case p.Role == partitionRoleBIOSBoot:
+			flag = "bios_grub"
+		case p.Role == partitionRoleRoot && label == config.PartitionLabelMSDOS:
+			flag = "boot"
+		}
+		if flag != "" {
+			if err := parted("set", fmt.Sprint(p.Number), flag, "on"); err != nil {
+				return err
+			}
+		}
+	}
+	if err := i.disk.RescanDevice(ctx, device); err != nil {
+		return errors.Wrap(err, "diskutils.RescanDevice")
+	}
+	for _, p := range partitions {
+		partition := diskutils.PartitionDevice(device, p.Number)
+		var out string
+		var err error
+		switch p.Role {
+		case partitionRoleESP:
+			out, err = i.runner.Run(ctx, "mkfs.vfat", "-F", "32", "-n", "ESP", partition)
+		case partitionRoleSwap:
+			out, err = i.runner.Run(ctx, "mkswap", "-L", "swap", partition)
+		}
+		if err != nil {
+			return fmt.Errorf("make %s on %s: %v: %s", p.Role, partition, err, out)
+		}
+	}
+	return nil
+}
+
+// installBootloader installs grub of the installed partition image, for
+// UEFI or BIOS by boot mode of host, and adds its partitions to fstab.
+func (i *ImgaeInstaller) installBootloader(ctx context.Context) (err error) {
+	if !i.isPartitionImage() {
+		return nil
+	}
+	device, err := i.rootDevice(ctx)
+	if err != nil {
+		return err
+	}
+	size, err := i.disk.SizeBytes(ctx, device.Name)
+	if err != nil {
+		return errors.Wrapf(err, "size of %s", device.Name)
+	}
+	_, partitions, err := i.partitionLayout(size)
+	if err != nil {
+		return err
+	}
+	efi := i.hardwareManager.GetBootMode() == "efi"
+
+	dir, err := ioutil.TempDir("", "diskimage-root-")
+	if err != nil {
+		return err
+	}
+	mounted := []string{}
+	defer func() {
+		for n := len(mounted) - 1; n >= 0; n-- {
+			if uerr := i.cleanupUmount(mounted[n]); uerr != nil && err == nil {
+				err = uerr
+			}
+		}
+		if err == nil {
+			os.Remove(dir)
+		}
+	}()
+	mount := func(target string, args ...string) error {
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if out, err := i.runner.Run(ctx, "mount", append(args, target)...); err != nil {
+			return fmt.Errorf("mount %s: %v: %s", target, err, out)
+		}
+		mounted = append(mounted, target)
+		return nil
+	}
+
+	root, _ := findPartition(partitions, partitionRoleRoot)
+	if err := mount(dir, diskutils.PartitionDevice(device.Name, root.Number)); err != nil {
+		return err
+	}
+	if esp, ok := findPartition(partitions, partitionRoleESP); ok {
+		target, err := resolveInRoot(dir, "/boot/efi")
+		if err != nil {
+			return err
+		}
+		if err := mount(target, diskutils.PartitionDevice(device.Name, esp.Number)); err != nil {
+			return err
+		}
+	}
+	for _, fs := range []string{"/dev", "/proc", "/sys"} {
+		if err := mount(filepath.Join(dir, fs), "--bind", fs); err != nil {
+			return err
+		}
+	}
+	if efi {
+		if _, err := os.Stat("/sys/firmware/efi/efivars"); err == nil {
+			if err := mount(filepath.Join(dir, "sys", "firmware", "efi", "efivars"), "-t", "efivarfs", "efivarfs"); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := i.writeFstab(ctx, dir, device.Name, partitions); err != nil {
+		return errors.Wrap(err, "write fstab")
+	}
+	install, mkconfig, grubDir, err := findGrub(dir)
+	if err != nil {
+		return err
+	}
+	args := []string{dir, install}
+	if efi {
+		args = append(args, "--target="+efiTarget(), "--efi-directory=/boot/efi", "--bootloader-id="+bootloaderID(dir))
+	} else {
+		args = append(args, "--target=i386-pc", device.Name)
+	}
+	i.logger.Sugar().Infof("install bootloader: %s", strings.Join(args[1:], " "))
+	if out, err := i.runner.Run(ctx, "chroot", args...); err != nil {
+		return fmt.Errorf("%s: %v: %s", install, err, out)
+	}
+	if out, err := i.runner.Run(ctx, "chroot", dir, mkconfig, "-o", grubDir+"/grub.cfg"); err != nil {
+		return fmt.Errorf("%s: %v: %s", mkconfig, err, out)
+	}
+	return nil
+}
+
+// findGrub returns grub-install and grub-mkconfig of the image mounted at
+// root, and directory of grub config, names differ by distribution.
+func findGrub(root string) (string, string, string, error) {
+	for _, grub := range []string{"grub2", "grub"} {
+		for _, dir := range []string{"/usr/sbin", "/sbin", "/usr/bin", "/bin"} {
+			install := dir + "/" + grub + "-install"
+			p, err := resolveInRoot(root, install)
+			if err != nil {
+				continue
+			}
+			if _, err := os.Stat(p); err == nil {
+				return install, dir + "/" + grub + "-mkconfig", "/boot/" + grub, nil
+			}
+		}
+	}
+	return "", "", "", fmt.Errorf("image has neither grub2-install nor grub-install")
+}
+
+func efiTarget() string {
+	if runtime.GOARCH == "arm64" {
+		return "arm64-efi"
+	}
+	return "x86_64-efi"
+}
+
+// bootloaderID is ID of os-release of the image mounted at root.
+func bootloaderID(root string) string {
+	for _, f := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		p, err := resolveInRoot(root, f)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "ID=") {
+				if id := strings.Trim(strings.TrimPrefix(line, "ID="), `"'`); id != "" {
+					return id
+				}
+			}
+		}
+	}
+	return "linux"
+}
+
+// writeFstab adds root, ESP and swap to fstab of the image mounted at root.
+// ESP and swap entries the image has already carry UUIDs of the machine it
+// was built on, they are pointed at the new partitions instead. Root and
+// other mount points fstab has are left as is.
+func (i *ImgaeInstaller) writeFstab(ctx context.Context, root, device string, partitions []layoutPartition) error {
+	fstab, content, existing, err := readFstab(root)
+	if err != nil {
+		return err
+	}
+	original := content
+	lines := []string{}
+	for _, p := range partitions {
+		partition := diskutils.PartitionDevice(device, p.Number)
+		out, err := i.runner.Run(ctx, "blkid", "-o", "value", "-s", "UUID", partition)
+		uuid := strings.TrimSpace(out)
+		if err != nil || uuid == "" {
+			if p.Role == partitionRoleBIOSBoot {
+				continue
+			}
+			return fmt.Errorf("uuid of %s: %v: %s", partition, err, out)
+		}
+		replaced := false
+		switch p.Role {
+		case partitionRoleRoot:
+			if !existing["/"] {
+				out, _ := i.runner.Run(ctx, "blkid", "-o", "value", "-s", "TYPE", partition)
+				lines = append(lines, fmt.Sprintf("UUID=%s / %s defaults 0 1", uuid, strings.TrimSpace(out)))
+			}
+		case partitionRoleESP:
+			if content, replaced = replaceFstabSource(content, "UUID="+uuid, isESPEntry); !replaced {
+				lines = append(lines, fmt.Sprintf("UUID=%s /boot/efi vfat umask=0077 0 2", uuid))
+			}
+		case partitionRoleSwap:
+			if content, replaced = replaceFstabSource(content, "UUID="+uuid, isSwapPartitionEntry); !replaced {
+				lines = append(lines, fmt.Sprintf("UUID=%s none swap defaults 0 0", uuid))
+			}
+		}
+		if replaced {
+			i.logger.Sugar().Infof("fstab entry of %s is pointed at %s", p.Role, partition)
+		}
+	}
+	if len(lines) == 0 {
+		if content == original {
+			return nil
+		}
+		return ioutil.WriteFile(fstab, []byte(content), 0644)
+	}
+	return appendFstab(fstab, content, lines)
+}
+
+func isESPEntry(fields []string) bool {
+	return fields[1] == "/boot/efi"
+}
+
+// isSwapPartitionEntry is true for swap on a device, swap files are kept.
+func isSwapPartitionEntry(fields []string) bool {
+	return fields[2] == "swap" && (!strings.HasPrefix(fields[0], "/") || strings.HasPrefix(fields[0], "/dev/"))
+}
+
+// replaceFstabSource sets device of the first fstab entry match is true for
+// to source, further entries it is true for are commented out. It returns
+// whether any entry matched.
+func replaceFstabSource(content, source string, match func(fields []string) bool) (string, bool) {
+	lines := strings.Split(content, "\n")
+	replaced := false
+	for n, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") || !match(fields) {
+			continue
+		}
+		if replaced {
+			lines[n] = "# " + line
+			continue
+		}
+		lines[n] = strings.Replace(line, fields[0], source, 1)
+		replaced = true
+	}
+	return strings.Join(lines, "\n"), replaced
+}
+
+// readFstab reads fstab of the image mounted at root. Mount points of its
+// entries are in existing, and "swap" is when it has any swap.
+func readFstab(root string) (string, string, map[string]bool, error) {
+	fstab, err := resolveInRoot(root, "/etc/fstab")
+	if err != nil {
+		return "", "", nil, err
+	}
+	data, err := ioutil.ReadFile(fstab)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", nil, err
+	}
+	existing := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && !strings.HasPrefix(fields[0], "#") {
+			existing[fields[1]] = true
+			if fields[2] == "swap" {
+				existing["swap"] = true
+			}
+		}
+	}
+	return fstab, string(data), existing, nil
+}
+
+// appendFstab writes lines after content to fstab.
+func appendFstab(fstab, content string, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += strings.Join(lines, "\n") + "\n"
+	return ioutil.WriteFile(fstab, []byte(content), 0644)
+}
@@ -0,0 +1,81 @@
+package installer
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils"
+)
+
+func TestWriteFstab(t *testing.T) {
+	partitions := []layoutPartition{
+		{Number: 1, Role: partitionRoleESP},
+		{Number: 2, Role: partitionRoleSwap},
+		{Number: 3, Role: partitionRoleRoot},
+	}
+	tests := []struct {
+		name  string
+		fstab string
+		want  string
+	}{
+		{
+			name:  "no fstab",
+			fstab: "",
+			want: "UUID=esp-new /boot/efi vfat umask=0077 0 2\n" +
+				"UUID=swap-new none swap defaults 0 0\n" +
+				"UUID=root-new / ext4 defaults 0 1\n",
+		},
+		{
+			name: "stale esp and swap",
+			fstab: "# built on builder01\n" +
+				"LABEL=cloudimg-rootfs / ext4 defaults 0 1\n" +
+				"UUID=5A1B-2C3D\t/boot/efi\tvfat\tumask=0077\t0 1\n" +
+				"UUID=0f4e0c5e-old none swap sw 0 0\n" +
+				"/dev/vdb2 none swap sw 0 0\n" +
+				"/swapfile none swap sw 0 0\n",
+			want: "# built on builder01\n" +
+				"LABEL=cloudimg-rootfs / ext4 defaults 0 1\n" +
+				"UUID=esp-new\t/boot/efi\tvfat\tumask=0077\t0 1\n" +
+				"UUID=swap-new none swap sw 0 0\n" +
+				"# /dev/vdb2 none swap sw 0 0\n" +
+				"/swapfile none swap sw 0 0\n",
+		},
+		{
+			name:  "swap file only",
+			fstab: "UUID=root-old / ext4 defaults 0 1\n/swapfile none swap sw 0 0\n",
+			want: "UUID=root-old / ext4 defaults 0 1\n/swapfile none swap sw 0 0\n" +
+				"UUID=esp-new /boot/efi vfat umask=0077 0 2\n" +
+				"UUID=swap-new none swap defaults 0 0\n",
+		},
+	}
+	for _, tt := range tests {
+		root := t.TempDir()
+		if tt.fstab != "" {
+			mustWriteFile(t, filepath.Join(root, "etc/fstab"), tt.fstab)
+		} else {
+			mustWriteFile(t, filepath.Join(root, "etc/os-release"), "ID=test\n")
+		}
+		runner := utils.NewFakeRunner().
+			On("blkid -o value -s UUID /dev/sda1", "esp-new\n", nil).
+			On("blkid -o value -s UUID /dev/sda2", "swap-new\n", nil).
+			On("blkid -o value -s UUID /dev/sda3", "root-new\n", nil).
+			On("blkid -o value -s TYPE /dev/sda3", "ext4\n", nil)
+		i := NewInstaller(config.Node{}, zap.NewNop())
+		i.SetRunner(runner)
+		if err := i.writeFstab(context.Background(), root, "/dev/sda", partitions); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		data, err := ioutil.ReadFile(filepath.Join(root, "etc/fstab"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if string(data) != tt.want {
+			t.Errorf("%s: fstab =\n%s\nwant\n%s", tt.name, data, tt.want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/bmc"
+	"diskimage-installer/pkg/config"
+	diskutils "diskimage-installer/pkg/utils/disk"
+)
+
+// Plan is what install would do to host.
+type Plan struct {
+	Node  string
+	Steps []PlanStep
+}
+
+// PlanStep is what a step would do, Skipped tells why it doesn't run.
+type PlanStep struct {
+	Name     string
+	Skipped  string
+	Actions  []string
+	Commands []string
+}
+
+func (s *PlanStep) action(format string, args ...interface{}) {
+	s.Actions = append(s.Actions, fmt.Sprintf(format, args...))
+}
+
+func (s *PlanStep) command(args ...string) {
+	s.Commands = append(s.Commands, strings.Join(args, " "))
+}
+
+// Print writes plan in a human readable form.
+func (p *Plan) Print(w io.Writer) {
+	fmt.Fprintf(w, "plan of node %s\n", p.Node)
+	for _, s := range p.Steps {
+		if s.Skipped != "" {
+			fmt.Fprintf(w, "\n[%s] skipped: %s\n", s.Name, s.Skipped)
+			continue
+		}
+		fmt.Fprintf(w, "\n[%s]\n", s.Name)
+		if len(s.Actions) == 0 && len(s.Commands) == 0 {
+			fmt.Fprintf(w, "  nothing to do\n")
+		}
+		for _, a := range s.Actions {
+			fmt.Fprintf(w, "  - %s\n", a)
+		}
+		for _, c := range s.Commands {
+			fmt.Fprintf(w, "    $ %s\n", c)
+		}
+	}
+}
+
+// Plan resolves and validates everything install needs and returns what it
+// would do, host is only read. Config drive is generated to validate it and
+// removed afterwards.
+func (i *ImgaeInstaller) Plan(ctx context.Context) (*Plan, error) {
+	if err := i.validate(); err != nil {
+		return nil, err
+	}
+	if err := i.ValidateNetworks(); err != nil {
+		return nil, errors.Wrap(err, "invalid network config")
+	}
+	state, err := i.loadState()
+	if err != nil {
+		return nil, err
+	}
+	i.state = state
+	configDrive := ""
+	defer func() {
+		if configDrive != "" {
+			os.Remove(configDrive)
+		}
+	}()
+
+	plan := &Plan{Node: i.Name}
+	cleaned := false
+	for _, name := range Steps {
+		step := PlanStep{Name: name}
+		switch {
+		case !i.selected(name):
+			step.Skipped = "not selected"
+		case len(i.onlySteps) == 0 && i.state.done(name):
+			step.Skipped = "completed already, per state file " + i.stateFile
+		default:
+			if !cleaned && preCleanBefore(name) {
+				i.planHooks(&step, config.HookPhasePreClean)
+				cleaned = true
+			}
+			i.planHooks(&step, hookPhaseBefore[name])
+			if err := i.planStep(ctx, &step, &configDrive); err != nil {
+				return nil, &StepError{Step: name, Err: err}
+			}
+			i.planHooks(&step, hookPhaseAfter[name])
+		}
+		if name == StepPowerAction && len(i.onlySteps) == 0 {
+			post := PlanStep{}
+			i.planHooks(&post, config.HookPhasePostInstall)
+			step.Actions = append(post.Actions, step.Actions...)
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+	return plan, nil
+}
+
+func (i *ImgaeInstaller) planStep(ctx context.Context, step *PlanStep, configDrive *string) error {
+	switch step.Name {
+	case StepConfigDrive:
+		if len(i.AllNetworks()) == 0 && i.Ignition == nil {
+			return nil
+		}
+		path, err := i.genConfigDrive(ctx)
+		if err != nil {
+			return err
+		}
+		*configDrive = path
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		kind := "config drive"
+		if i.ignitionInOEM() {
+			kind = "ignition config"
+		} else if i.Ignition != nil {
+			kind = "ignition config drive"
+		}
+		step.action("generate %s of %d KiB with %d networks", kind, info.Size()/1024, len(i.AllNetworks()))
+	case StepNetworkPrecheck:
+		if i.NetworkPrecheck == nil || len(i.AllNetworks()) == 0 {
+			return nil
+		}
+		checks, err := i.precheckNetworkChecks(ctx)
+		if err != nil {
+			return err
+		}
+		for _, c := range checks {
+			on := strings.Join(c.Links, ",")
+			if c.BondMode != "" {
+				on = fmt.Sprintf("bond(%s) of %s", c.BondMode, on)
+			}
+			if c.VlanID != 0 {
+				on = fmt.Sprintf("vlan %d on %s", c.VlanID, on)
+			}
+			step.action("apply %s on %s temporarily, probe gateway %v and query dns %v for %s", c.Address, on, c.Gateway, c.DNS, c.DNSName)
+		}
+	case StepBMC:
+		if !i.IPMI.Configure {
+			return nil
+		}
+		if err := i.IPMI.Validate(); err != nil {
+			return err
+		}
+		changes, err := bmc.Plan(ctx, i.bmc, i.bmcConfig())
+		if err != nil {
+			return errors.Wrap(err, "bmc.Plan")
+		}
+		step.Actions = changes
+	case StepRaid:
+		if i.RaidConfig == nil {
+			return nil
+		}
+		if err := i.RaidConfig.Validate(); err != nil {
+			return err
+		}
+		step.action("raid config of %d logical disks is valid, raid controllers are left as is", len(i.RaidConfig.LogicalDisks))
+	case StepRootDevice:
+		device, err := i.rootDevice(ctx)
+		if err != nil {
+			return err
+		}
+		step.action("select root disk %s: model %q, serial %q, size %s", device.Name, device.Model, device.Serial, device.Size)
+	case StepWriteImage:
+		device, err := i.rootDevice(ctx)
+		if err != nil {
+			return err
+		}
+		partitions, err := i.listPartitions(ctx, device)
+		if err != nil {
+			return errors.Wrapf(err, "listPartitions(%s)", device.Name)
+		}
+		step.action("wipe %s, which destroys %d partitions", device.Name, len(partitions))
+		for _, p := range partitions {
+			step.action("destroy partition %s: %s %s", p.Name, p.FsType, p.Size)
+		}
+		if i.isPartitionImage() {
+			return i.planPartitionImage(ctx, step, device)
+		}
+		step.action("write image %s to %s", i.ImageInfo.Image, device.Name)
+		step.command("dd", "bs=512", "if=/dev/zero", "of="+device.Name, "count=33")
+		step.command("dd", "bs=512", "if=/dev/zero", "of="+device.Name, "count=33", "seek=<last 33 sectors>")
+		step.command("sgdisk", "-Z", device.Name)
+		step.command("qemu-img", "convert", "-t", "directsync", "-O", "host_device", i.ImageInfo.Image, device.Name)
+	case StepStorage:
+		if len(i.Storage) == 0 {
+			return nil
+		}
+		disks, err := i.storageDisks(ctx)
+		if err != nil {
+			return err
+		}
+		for _, d := range disks {
+			partitions, err := i.listPartitions(ctx, d.Device)
+			if err != nil {
+				return errors.Wrapf(err, "listPartitions(%s)", d.Device.Name)
+			}
+			label := d.Storage.Label
+			if label == "" {
+				label = config.PartitionLabelGPT
+			}
+			step.action("wipe %s: model %q, serial %q, size %s, which destroys %d partitions", d.Device.Name, d.Device.Model, d.Device.Serial, d.Device.Size, len(partitions))
+			step.action("create %s partition table on %s", label, d.Device.Name)
+			for n, p := range d.Storage.Partitions {
+				p = d.partition(p)
+				size := "the rest of disk"
+				if p.SizeMB > 0 {
+					size = fmt.Sprintf("%d MiB", p.SizeMB)
+				}
+				fs := p.Filesystem
+				if fs == "" {
+					fs = "no filesystem"
+				}
+				step.action("create %s of %s with %s, label %q, mountpoint %q", diskutils.PartitionDevice(d.Device.Name, n+1), size, fs, p.Label, p.Mountpoint)
+			}
+			if d.Storage.Fstab {
+				step.action("add mounts of %s to fstab of installed image", d.Device.Name)
+			}
+		}
+	case StepCustomize:
+		if len(i.Files) == 0 {
+			return nil
+		}
+		device, err := i.rootDevice(ctx)
+		if err != nil {
+			return err
+		}
+		step.action("mount root filesystem of image on %s, activating its LVM volume groups", device.Name)
+		for _, f := range i.Files {
+			data, _ := f.Data()
+			mode := f.Mode
+			if mode == "" {
+				mode = "0644"
+			}
+			step.action("write %s: %d bytes, mode %s, owner %s:%s", f.Path, len(data), mode, orRoot(f.Owner), orRoot(f.Group))
+		}
+		step.action("unmount root filesystem")
+	case StepBootloader:
+		if !i.isPartitionImage() {
+			return nil
+		}
+		device, err := i.rootDevice(ctx)
+		if err != nil {
+			return err
+		}
+		step.action("mount root partition of %s with /dev, /proc and /sys bound", device.Name)
+		step.action("add root missing in /etc/fstab, point ESP and swap entries at new partitions or add them")
+		if i.hardwareManager.GetBootMode() == "efi" {
+			step.action("install grub for UEFI into ESP mounted at /boot/efi")
+			step.command("chroot", "<root>", "grub-install", "--target="+efiTarget(), "--efi-directory=/boot/efi", "--bootloader-id=<ID of os-release>")
+		} else {
+			step.action("install grub for BIOS into %s", device.Name)
+			step.command("chroot", "<root>", "grub-install", "--target=i386-pc", device.Name)
+		}
+		step.command("chroot", "<root>", "grub-mkconfig", "-o", "/boot/grub/grub.cfg")
+		step.action("grub2-install and grub2-mkconfig are used instead when image has them")
+	case StepGrowRoot:
+		if !i.GrowRoot || i.isPartitionImage() {
+			return nil
+		}
+		device, err := i.rootDevice(ctx)
+		if err != nil {
+			return err
+		}
+		size, err := i.disk.SizeBytes(ctx, device.Name)
+		if err != nil {
+			return errors.Wrapf(err, "size of %s", device.Name)
+		}
+		// partition table is of image, which isn't known before it is written
+		step.action("grow the last partition of image on %s to end at %d MiB, MBR partitions end below 2 TiB", device.Name, (i.growEnd(size, diskutils.GPT)+1)/mib)
+		step.command("parted", "-s", "--", device.Name, "unit", "B", "resizepart", "<last partition>", fmt.Sprintf("%dB", i.growEnd(size, diskutils.GPT)))
+		step.action("grow its filesystem: resize2fs for ext, xfs_growfs for xfs, btrfs resize for btrfs, pvresize for LVM")
+	case StepConfigDrivePartition:
+		path := *configDrive
+		if path == "" {
+			path = i.state.ConfigDrive
+		}
+		if path == "" {
+			return nil
+		}
+		device, err := i.rootDevice(ctx)
+		if err != nil {
+			return err
+		}
+		if i.ignitionInOEM() {
+			label := i.Ignition.OEMLabel
+			if label == "" {
+				label = defaultOEMLabel
+			}
+			step.action("write ignition config to config.ign of partition of label %s on %s", label, device.Name)
+			return nil
+		}
+		size := diskutils.MaxConfigDriveSizeMB
+		step.action("create config drive partition of %d MiB at end of %s, by sgdisk when image is GPT, by parted when it is MBR", size, device.Name)
+		step.command("sgdisk", "-e", device.Name)
+		step.command("sgdisk", "-n", fmt.Sprintf("0:-%dMB:0", size), device.Name)
+		step.command("parted", "-a", "optimal", "-s", "--", device.Name, "mkpart", "primary", "fat32", fmt.Sprintf("-%dMiB", size), "-0")
+		step.action("write config drive to the new partition")
+		step.command("dd", "if="+path, "of=<config drive partition>", "bs=1M", "oflag=sync")
+	case StepPowerAction:
+		if i.PowerAction == nil || i.PowerAction.Action == "" || i.PowerAction.Action == config.PowerActionNone {
+			return nil
+		}
+		if i.PowerAction.BootNext {
+			step.action("set BootNext to boot entry of the installed disk")
+		}
+		if i.PowerAction.Action == config.PowerActionKexec {
+			step.action("load kernel of the installed image")
+		}
+		step.action("%s host in %d seconds", i.PowerAction.Action, i.PowerAction.Delay)
+	}
+	return nil
+}
+
+func (i *ImgaeInstaller) planPartitionImage(ctx context.Context, step *PlanStep, device BlockDevice) error {
+	size, err := i.disk.SizeBytes(ctx, device.Name)
+	if err != nil {
+		return errors.Wrapf(err, "size of %s", device.Name)
+	}
+	label, partitions, err := i.partitionLayout(size)
+	if err != nil {
+		return err
+	}
+	step.action("create %s partition table on %s", label, device.Name)
+	step.command("wipefs", "-a", device.Name)
+	step.command("parted", "-s", "-a", "optimal", "--", device.Name, "mklabel", label)
+	for _, p := range partitions {
+		step.action("create partition %d for %s from %d MiB to %d MiB", p.Number, p.Role, p.Start, p.End)
+	}
+	root, _ := findPartition(partitions, partitionRoleRoot)
+	rootDevice := diskutils.PartitionDevice(device.Name, root.Number)
+	step.action("write partition image %s to %s and grow its filesystem", i.ImageInfo.Image, rootDevice)
+	step.command("qemu-img", "convert", "-t", "directsync", "-O", "host_device", i.ImageInfo.Image, rootDevice)
+	return nil
+}
+
+func (i *ImgaeInstaller) planHooks(step *PlanStep, phase string) {
+	for _, h := range i.Hooks {
+		if phase == "" || h.Phase != phase {
+			continue
+		}
+		command := h.Path
+		if h.Script != "" {
+			command = "inline script"
+		}
+		step.action("run %s hook %s (%s), on failure %s", phase, h.Name, strings.TrimSpace(command+" "+strings.Join(h.Args, " ")), onFailure(h))
+	}
+}
+
+func onFailure(h config.Hook) string {
+	if h.OnFailure == "" {
+		return config.HookFailureAbort
+	}
+	return h.OnFailure
+}
+
+func orRoot(name string) string {
+	if name == "" {
+		return "root"
+	}
+	return name
+}
@@ -0,0 +1,166 @@
+package installer
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"diskimage-installer/pkg/config"
+)
+
+func TestPlanSteps(t *testing.T) {
+	node := config.Node{
+		Name:        "node1",
+		ImageInfo:   &config.ImageInfo{Image: "/images/ubuntu.img"},
+		RootDevice:  map[string]string{"hctl": "0:0:0:0"},
+		Network:     config.NetworkInfo{IPv4Address: "10.0.0.10", NetMask: "255.255.255.0", Gateway: "10.0.0.1", Interface: "eno1"},
+		GrowRoot:    true,
+		Files:       []config.FileInfo{{Path: "/etc/motd", Content: "welcome"}},
+		PowerAction: &config.PowerActionInfo{Action: config.PowerActionReboot},
+		Hooks: []config.Hook{
+			{Name: "verify", Phase: config.HookPhasePostWrite, Script: "true"},
+			{Name: "register", Phase: config.HookPhasePostInstall, Path: "/opt/register"},
+		},
+	}
+	configDrive := filepath.Join(t.TempDir(), "configdrive.iso")
+	mustWriteFile(t, configDrive, "iso")
+	// host is only read: interfaces for config drive, disks for root device,
+	// partitions and size of root disk
+	listInterfaces := []string{"biosdevname -i eno1", "biosdevname -i eno2", "mkisofs -R -V config-2 -o $ISO $ISODIR"}
+	listDisks := []string{"udevadm settle", "lsblk -O -J", "lsblk -O -J"}
+	diskSize := []string{"blockdev --getsize64 /dev/sda"}
+
+	tests := []struct {
+		name  string
+		only  []string
+		skip  []string
+		state *State
+		// want is steps which are planned, others are skipped with
+		// wantSkipped
+		want        []string
+		wantSkipped string
+		wantCalls   []string
+	}{
+		{
+			name:      "every step",
+			want:      Steps,
+			wantCalls: append(append(append([]string{}, listInterfaces...), listDisks...), diskSize...),
+		},
+		{
+			name:        "only",
+			only:        []string{StepWriteImage, StepGrowRoot},
+			want:        []string{StepWriteImage, StepGrowRoot},
+			wantSkipped: "not selected",
+			wantCalls:   append(append([]string{}, listDisks...), diskSize...),
+		},
+		{
+			name:        "skip",
+			skip:        []string{StepConfigDrive, StepNetworkPrecheck, StepGrowRoot, StepConfigDrivePartition},
+			want:        []string{StepBMC, StepRaid, StepRootDevice, StepWriteImage, StepStorage, StepCustomize, StepBootloader, StepPowerAction},
+			wantSkipped: "not selected",
+			wantCalls:   listDisks,
+		},
+		{
+			name:        "nothing to read",
+			only:        []string{StepBMC, StepPowerAction},
+			want:        []string{StepBMC, StepPowerAction},
+			wantSkipped: "not selected",
+			wantCalls:   []string{},
+		},
+		{
+			name: "completed steps",
+			state: &State{
+				Completed:   []string{StepConfigDrive, StepNetworkPrecheck, StepBMC, StepRaid, StepRootDevice, StepWriteImage},
+				ConfigDrive: configDrive,
+				RootDevice:  &BlockDevice{Name: "/dev/sda", Kname: "sda"},
+			},
+			want:        []string{StepStorage, StepCustomize, StepBootloader, StepGrowRoot, StepConfigDrivePartition, StepPowerAction},
+			wantSkipped: "completed already",
+			wantCalls:   diskSize,
+		},
+	}
+	for _, tt := range tests {
+		i, runner := newFixtureInstaller(t, node, "gpt")
+		i.SetSteps(tt.only, tt.skip)
+		stateFile := ""
+		if tt.state != nil {
+			stateFile = writeState(t, node, *tt.state)
+			i.SetStateFile(stateFile)
+		}
+		plan, err := i.Plan(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		names, planned := []string{}, []string{}
+		for _, s := range plan.Steps {
+			names = append(names, s.Name)
+			if s.Skipped == "" {
+				planned = append(planned, s.Name)
+			} else if !strings.HasPrefix(s.Skipped, tt.wantSkipped) {
+				t.Errorf("%s: step %s is skipped as %q, want %q", tt.name, s.Name, s.Skipped, tt.wantSkipped)
+			}
+		}
+		// every step is listed in install order, skipped or not
+		if !reflect.DeepEqual(names, Steps) {
+			t.Errorf("%s: steps = %v, want %v", tt.name, names, Steps)
+		}
+		if !reflect.DeepEqual(planned, tt.want) {
+			t.Errorf("%s: planned steps = %v, want %v", tt.name, planned, tt.want)
+		}
+		if calls := normalizedCalls(runner); !reflect.DeepEqual(calls, tt.wantCalls) {
+			t.Errorf("%s: calls =\n%s\nwant\n%s", tt.name, strings.Join(calls, "\n"), strings.Join(tt.wantCalls, "\n"))
+		}
+		if stateFile != "" {
+			// plan doesn't save state
+			data, err := ioutil.ReadFile(stateFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(data), StepStorage) {
+				t.Errorf("%s: plan saved state %s", tt.name, data)
+			}
+		}
+	}
+}
+
+func TestPlanPostInstallHooks(t *testing.T) {
+	node := config.Node{
+		Name:        "node1",
+		ImageInfo:   &config.ImageInfo{Image: "/images/ubuntu.img"},
+		RootDevice:  map[string]string{"hctl": "0:0:0:0"},
+		PowerAction: &config.PowerActionInfo{Action: config.PowerActionPowerOff},
+		Hooks:       []config.Hook{{Name: "register", Phase: config.HookPhasePostInstall, Path: "/opt/register"}},
+	}
+	tests := []struct {
+		name string
+		only []string
+		want []string
+	}{
+		{
+			name: "every step",
+			want: []string{"run post-install hook register (/opt/register), on failure abort", "poweroff host in 0 seconds"},
+		},
+		// install of some steps isn't done, post-install hooks don't run
+		{
+			name: "only power action",
+			only: []string{StepPowerAction},
+			want: []string{"poweroff host in 0 seconds"},
+		},
+	}
+	for _, tt := range tests {
+		i, _ := newFixtureInstaller(t, node, "gpt")
+		i.SetSteps(tt.only, nil)
+		plan, err := i.Plan(context.Background())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		last := plan.Steps[len(plan.Steps)-1]
+		if last.Name != StepPowerAction || !reflect.DeepEqual(last.Actions, tt.want) {
+			t.Errorf("%s: last step %s = %q, want %q", tt.name, last.Name, last.Actions, tt.want)
+		}
+	}
+}
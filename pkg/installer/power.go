@@ -0,0 +1,340 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/config"
+)
+
+// powerAction does power action of node to host, it is called only when
+// every step of install has succeeded.
+func (i *ImgaeInstaller) powerAction(ctx context.Context, rootDevice BlockDevice) error {
+	if i.PowerAction == nil {
+		return nil
+	}
+	action := i.PowerAction.Action
+	if action == "" || action == config.PowerActionNone {
+		return nil
+	}
+	if i.PowerAction.BootNext {
+		if i.hardwareManager.GetBootMode() != "efi" {
+			i.logger.Sugar().Warnf("boot_next is ignored since host boots in bios mode")
+		} else if err := i.setBootNext(ctx, rootDevice); err != nil {
+			i.logger.Sugar().Warnf("set BootNext: %v", err)
+		}
+	}
+	if action == config.PowerActionKexec {
+		if err := i.loadKexec(ctx, rootDevice); err != nil {
+			return errors.Wrap(err, "load installed kernel")
+		}
+	}
+	if i.PowerAction.Delay > 0 {
+		i.logger.Sugar().Infof("%s in %d seconds", action, i.PowerAction.Delay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(i.PowerAction.Delay) * time.Second):
+		}
+	}
+	i.logger.Sugar().Infof("%s host", action)
+	i.logger.Sync()
+	i.runner.Run(ctx, "sync")
+	var out string
+	var err error
+	switch action {
+	case config.PowerActionReboot:
+		out, err = i.runner.Run(ctx, "reboot")
+	case config.PowerActionPowerOff:
+		out, err = i.runner.Run(ctx, "poweroff")
+	case config.PowerActionKexec:
+		out, err = i.runner.Run(ctx, "kexec", "-e")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "%s: %s", action, out)
+	}
+	return nil
+}
+
+var efiBootEntry = regexp.MustCompile(`^Boot([0-9A-Fa-f]{4})\*?\s+(.*)$`)
+
+// setBootNext sets BootNext to the first boot entry whose device path is a
+// partition of root device.
+func (i *ImgaeInstaller) setBootNext(ctx context.Context, rootDevice BlockDevice) error {
+	partitions, err := i.listPartitions(ctx, rootDevice)
+	if err != nil {
+		return errors.Wrapf(err, "listPartitions(%s)", rootDevice.Name)
+	}
+	out, err := i.runner.Run(ctx, "efibootmgr", "-v")
+	if err != nil {
+		return errors.Wrapf(err, "efibootmgr -v: %s", out)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		m := efiBootEntry.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		for _, p := range partitions {
+			if p.PartUUID == "" || !strings.Contains(strings.ToLower(m[2]), strings.ToLower(p.PartUUID)) {
+				continue
+			}
+			i.logger.Sugar().Infof("set BootNext to Boot%s on %s", m[1], p.Name)
+			if out, err := i.runner.Run(ctx, "efibootmgr", "-n", m[1]); err != nil {
+				return errors.Wrapf(err, "efibootmgr -n %s: %s", m[1], out)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no boot entry is on %s", rootDevice.Name)
+}
+
+// loadKexec loads the default kernel of the installed OS for kexec, it is
+// looked for in /boot of root and at top of a separate boot partition.
+func (i *ImgaeInstaller) loadKexec(ctx context.Context, rootDevice BlockDevice) error {
+	partitions, err := i.listPartitions(ctx, rootDevice)
+	if err != nil {
+		return errors.Wrapf(err, "listPartitions(%s)", rootDevice.Name)
+	}
+	mountpoint, err := ioutil.TempDir("", "diskimage-installer-root-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mountpoint)
+
+	for _, p := range partitions {
+		if !fsTypesOfRoot[p.FsType] {
+			continue
+		}
+		if out, err := i.runner.Run(ctx, "mount", "-o", "ro", p.Name, mountpoint); err != nil {
+			i.logger.Sugar().Warnf("mount %s: %v: %s", p.Name, err, out)
+			continue
+		}
+		err := i.kexecLoad(ctx, mountpoint, p)
+		if uerr := i.cleanupUmount(mountpoint); uerr != nil {
+			return uerr
+		}
+		if err != errNoKernel {
+			return err
+		}
+	}
+	return fmt.Errorf("no kernel is found on %s", rootDevice.Name)
+}
+
+var errNoKernel = errors.New("no kernel")
+
+// kexecLoad loads kernel of partition p mounted at dir, errNoKernel is
+// returned when p has none.
+func (i *ImgaeInstaller) kexecLoad(ctx context.Context, dir string, p Partition) error {
+	boot := filepath.Join(dir, "boot")
+	kernel, initrd := findKernel(boot)
+	if kernel == "" {
+		// separate boot partition
+		boot = dir
+		if kernel, initrd = findKernel(boot); kernel == "" {
+			return errNoKernel
+		}
+	}
+	cmdline := i.PowerAction.KexecCmdline
+	if cmdline == "" {
+		var err error
+		if cmdline, err = i.kexecCmdline(dir, boot, kernel, p); err != nil {
+			return err
+		}
+	}
+	args := []string{"-l", kernel, "--command-line=" + cmdline}
+	if initrd != "" {
+		args = append(args, "--initrd="+initrd)
+	}
+	i.logger.Sugar().Infof("kexec load %s from %s with %q", strings.TrimPrefix(kernel, dir), p.Name, cmdline)
+	if out, err := i.runner.Run(ctx, "kexec", args...); err != nil {
+		return errors.Wrapf(err, "kexec %s: %s", strings.Join(args, " "), out)
+	}
+	return nil
+}
+
+// findKernel returns the default kernel in directory boot and its initrd.
+// It is the target of vmlinuz symlink when there is one, or else the newest
+// version, rescue kernels aside.
+func findKernel(boot string) (string, string) {
+	kernel := ""
+	if target, err := os.Readlink(filepath.Join(boot, "vmlinuz")); err == nil {
+		if k := filepath.Join(boot, filepath.Base(target)); isFile(k) {
+			kernel = k
+		}
+	}
+	if kernel == "" {
+		kernels, _ := filepath.Glob(filepath.Join(boot, "vmlinuz-*"))
+		for _, k := range kernels {
+			if strings.Contains(filepath.Base(k), "rescue") || !isFile(k) {
+				continue
+			}
+			if kernel == "" || compareVersions(filepath.Base(k), filepath.Base(kernel)) > 0 {
+				kernel = k
+			}
+		}
+	}
+	if kernel == "" && isFile(filepath.Join(boot, "vmlinuz")) {
+		kernel = filepath.Join(boot, "vmlinuz")
+	}
+	if kernel == "" {
+		return "", ""
+	}
+	version := strings.TrimPrefix(filepath.Base(kernel), "vmlinuz")
+	// initrd.img-<version> of debian, initramfs-<version>.img of redhat
+	for _, name := range []string{"initrd.img" + version, "initramfs" + version + ".img", "initrd" + version} {
+		initrd := filepath.Join(boot, name)
+		if isFile(initrd) {
+			return kernel, initrd
+		}
+	}
+	return kernel, ""
+}
+
+func isFile(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+var versionPart = regexp.MustCompile(`[0-9]+|[^0-9]+`)
+
+// compareVersions compares a and b like sort -V, digits are compared as
+// numbers so 4.18.0-305 is newer than 4.18.0-80 and 5.10 than 5.9.
+func compareVersions(a, b string) int {
+	pa, pb := versionPart.FindAllString(a, -1), versionPart.FindAllString(b, -1)
+	for n := 0; n < len(pa) && n < len(pb); n++ {
+		x, y := pa[n], pb[n]
+		if isDigit(x[0]) && isDigit(y[0]) {
+			x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+			if len(x) != len(y) {
+				return len(x) - len(y)
+			}
+		}
+		if c := strings.Compare(x, y); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// kexecCmdline returns command line the installed OS boots kernel with, root
+// of partition p is added when the image doesn't name one, and console of
+// ramdisk when the image has none.
+func (i *ImgaeInstaller) kexecCmdline(dir, boot, kernel string, p Partition) (string, error) {
+	args := imageCmdline(dir, boot, kernel)
+	if !hasArg(args, "root") {
+		if !isRootFilesystem(dir) {
+			return "", fmt.Errorf("root of %s isn't known, set kexec_cmdline of power_action", filepath.Base(kernel))
+		}
+		args = append([]string{"root=UUID=" + p.UUID, "ro"}, args...)
+	}
+	if !hasArg(args, "console") {
+		cmdline, err := i.hardwareManager.GetKernelCmdline()
+		if err != nil {
+			i.logger.Sugar().Warnf("console of ramdisk: %v", err)
+		}
+		for _, arg := range strings.Fields(cmdline) {
+			if strings.HasPrefix(arg, "console=") {
+				args = append(args, arg)
+			}
+		}
+	}
+	return strings.Join(args, " "), nil
+}
+
+func hasArg(args []string, name string) bool {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// imageCmdline returns arguments the image boots kernel with, from its boot
+// loader spec entry, grub.cfg, /etc/kernel/cmdline or /etc/default/grub in
+// turn. Arguments of grub variables that can't be expanded are dropped.
+func imageCmdline(root, boot, kernel string) []string {
+	name := filepath.Base(kernel)
+	grubenv := map[string]string{}
+	for _, dir := range []string{"grub2", "grub"} {
+		for k, v := range readKeyValues(filepath.Join(boot, dir, "grubenv"), "=") {
+			grubenv[k] = v
+		}
+	}
+	entries, _ := filepath.Glob(filepath.Join(boot, "loader", "entries", "*.conf"))
+	sort.Strings(entries)
+	for _, entry := range entries {
+		conf := readKeyValues(entry, " ")
+		if filepath.Base(conf["linux"]) == name && conf["options"] != "" {
+			return expandArgs(conf["options"], grubenv)
+		}
+	}
+	for _, cfg := range []string{"grub2/grub.cfg", "grub/grub.cfg"} {
+		data, err := ioutil.ReadFile(filepath.Join(boot, cfg))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || !strings.HasPrefix(fields[0], "linux") || filepath.Base(fields[1]) != name {
+				continue
+			}
+			return expandArgs(strings.Join(fields[2:], " "), grubenv)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "etc", "kernel", "cmdline")); err == nil {
+		return strings.Fields(string(data))
+	}
+	grub := readKeyValues(filepath.Join(root, "etc", "default", "grub"), "=")
+	return expandArgs(grub["GRUB_CMDLINE_LINUX"]+" "+grub["GRUB_CMDLINE_LINUX_DEFAULT"], nil)
+}
+
+// readKeyValues reads lines of key, sep and value in file, quotes around
+// value are removed.
+func readKeyValues(file, sep string) map[string]string {
+	values := map[string]string{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, sep, 2)
+		if len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+		}
+	}
+	return values
+}
+
+// expandArgs splits args, expanding $name and ${name} by vars.
+func expandArgs(args string, vars map[string]string) []string {
+	result := []string{}
+	for _, arg := range strings.Fields(args) {
+		if !strings.Contains(arg, "$") {
+			result = append(result, arg)
+			continue
+		}
+		name := strings.Trim(arg, "${}")
+		if value, ok := vars[name]; ok {
+			result = append(result, strings.Fields(value)...)
+		}
+	}
+	return result
+}
@@ -0,0 +1,322 @@
+package installer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"vmlinuz-4.18.0-305.el8.x86_64", "vmlinuz-4.18.0-80.el8.x86_64", 1},
+		{"vmlinuz-5.10.0-8-amd64", "vmlinuz-5.9.0-1-amd64", 1},
+		{"vmlinuz-5.15.0-91-generic", "vmlinuz-5.15.0-91-generic", 0},
+		{"vmlinuz-5.4.0", "vmlinuz-5.4.0-1", -1},
+		{"vmlinuz-5.04", "vmlinuz-5.4", 0},
+	}
+	for _, tt := range tests {
+		got := compareVersions(tt.a, tt.b)
+		if (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+			t.Errorf("compareVersions(%s, %s) = %d, want sign of %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// newBootDir makes files of boot, a name with -> is a symlink to the rest.
+func newBootDir(t *testing.T, files ...string) string {
+	t.Helper()
+	boot := t.TempDir()
+	for _, f := range files {
+		if parts := strings.SplitN(f, " -> ", 2); len(parts) == 2 {
+			if err := os.Symlink(parts[1], filepath.Join(boot, parts[0])); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		mustWriteFile(t, filepath.Join(boot, f), "")
+	}
+	return boot
+}
+
+func TestFindKernel(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      []string
+		wantKernel string
+		wantInitrd string
+	}{
+		{
+			name: "newest version",
+			files: []string{
+				"vmlinuz-4.18.0-80.el8.x86_64", "initramfs-4.18.0-80.el8.x86_64.img",
+				"vmlinuz-4.18.0-305.el8.x86_64", "initramfs-4.18.0-305.el8.x86_64.img",
+				"vmlinuz-0-rescue-0123456789abcdef", "initramfs-0-rescue-0123456789abcdef.img",
+			},
+			wantKernel: "vmlinuz-4.18.0-305.el8.x86_64",
+			wantInitrd: "initramfs-4.18.0-305.el8.x86_64.img",
+		},
+		{
+			name:       "5.10 is newer than 5.9",
+			files:      []string{"vmlinuz-5.9.0-1-amd64", "vmlinuz-5.10.0-8-amd64", "initrd.img-5.10.0-8-amd64"},
+			wantKernel: "vmlinuz-5.10.0-8-amd64",
+			wantInitrd: "initrd.img-5.10.0-8-amd64",
+		},
+		{
+			name: "default by symlink",
+			files: []string{
+				"vmlinuz-5.15.0-91-generic", "initrd.img-5.15.0-91-generic",
+				"vmlinuz-5.15.0-100-generic", "initrd.img-5.15.0-100-generic",
+				"vmlinuz -> vmlinuz-5.15.0-91-generic",
+			},
+			wantKernel: "vmlinuz-5.15.0-91-generic",
+			wantInitrd: "initrd.img-5.15.0-91-generic",
+		},
+		{
+			name:  "no kernel",
+			files: []string{"grub/grub.cfg"},
+		},
+	}
+	for _, tt := range tests {
+		boot := newBootDir(t, tt.files...)
+		kernel, initrd := findKernel(boot)
+		if kernel != "" {
+			kernel = filepath.Base(kernel)
+		}
+		if initrd != "" {
+			initrd = filepath.Base(initrd)
+		}
+		if kernel != tt.wantKernel || initrd != tt.wantInitrd {
+			t.Errorf("%s: findKernel = %s, %s, want %s, %s", tt.name, kernel, initrd, tt.wantKernel, tt.wantInitrd)
+		}
+	}
+}
+
+func TestKexecCmdline(t *testing.T) {
+	const kernel = "vmlinuz-4.18.0-305.el8.x86_64"
+	tests := []struct {
+		name     string
+		root     map[string]string
+		boot     map[string]string
+		separate bool
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "boot loader spec with kernelopts of grubenv",
+			boot: map[string]string{
+				"loader/entries/abc-4.18.0-80.el8.x86_64.conf":  "linux /vmlinuz-4.18.0-80.el8.x86_64\noptions root=/dev/mapper/old\n",
+				"loader/entries/abc-4.18.0-305.el8.x86_64.conf": "title Rocky\nlinux /vmlinuz-4.18.0-305.el8.x86_64\noptions $kernelopts $tuned_params\n",
+				"grub2/grubenv": "# GRUB Environment Block\nkernelopts=root=/dev/mapper/rl-root ro rd.lvm.lv=rl/root rd.lvm.lv=rl/swap console=ttyS0,115200\n",
+			},
+			separate: true,
+			want:     "root=/dev/mapper/rl-root ro rd.lvm.lv=rl/root rd.lvm.lv=rl/swap console=ttyS0,115200",
+		},
+		{
+			name: "grub.cfg",
+			boot: map[string]string{
+				"grub/grub.cfg": "menuentry 'Ubuntu' {\n\tlinux\t/boot/" + kernel + " root=UUID=1234 ro quiet splash $vt_handoff\n}\n" +
+					"menuentry 'Ubuntu, recovery' {\n\tlinux\t/boot/" + kernel + " root=UUID=1234 ro recovery nomodeset\n}\n",
+			},
+			want: "root=UUID=1234 ro quiet splash console=tty0 console=ttyS1,115200n8",
+		},
+		{
+			name: "default grub without root",
+			root: map[string]string{"etc/default/grub": "GRUB_TIMEOUT=5\nGRUB_CMDLINE_LINUX=\"crashkernel=auto rd.lvm.lv=vg/root\"\nGRUB_CMDLINE_LINUX_DEFAULT='quiet'\n"},
+			want: "root=UUID=root-uuid ro crashkernel=auto rd.lvm.lv=vg/root quiet console=tty0 console=ttyS1,115200n8",
+		},
+		{
+			name: "kernel/cmdline",
+			root: map[string]string{"etc/kernel/cmdline": "root=UUID=abcd ro console=ttyS0\n"},
+			want: "root=UUID=abcd ro console=ttyS0",
+		},
+		{
+			name:     "separate boot partition without root",
+			separate: true,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		boot := filepath.Join(dir, "boot")
+		if tt.separate {
+			boot = dir
+		} else {
+			mustWriteFile(t, filepath.Join(dir, "etc/os-release"), "ID=test\n")
+		}
+		for name, content := range tt.root {
+			mustWriteFile(t, filepath.Join(dir, name), content)
+		}
+		for name, content := range tt.boot {
+			mustWriteFile(t, filepath.Join(boot, name), content)
+		}
+		procfs := t.TempDir()
+		mustWriteFile(t, filepath.Join(procfs, "cmdline"), "BOOTIF=01-aa-00-00-00-00-01 console=tty0 console=ttyS1,115200n8\n")
+		i := NewInstaller(config.Node{PowerAction: &config.PowerActionInfo{Action: config.PowerActionKexec}}, zap.NewNop())
+		i.hardwareManager.SetProcfsRoot(procfs)
+		got, err := i.kexecCmdline(dir, boot, filepath.Join(boot, kernel), Partition{UUID: "root-uuid"})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: kexecCmdline = %q, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: kexecCmdline = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// mountRunner is a FakeRunner whose mount fills mount point with files of
+// the partition and whose umount empties it.
+type mountRunner struct {
+	*utils.FakeRunner
+	files map[string]map[string]string
+}
+
+func (r *mountRunner) Run(ctx context.Context, command string, args ...string) (string, error) {
+	switch {
+	case command == "mount" && len(args) > 1:
+		dir := args[len(args)-1]
+		for name, content := range r.files[args[len(args)-2]] {
+			path := filepath.Join(dir, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return "", err
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				return "", err
+			}
+		}
+	case command == "umount" && len(args) == 1:
+		entries, _ := ioutil.ReadDir(args[0])
+		for _, e := range entries {
+			os.RemoveAll(filepath.Join(args[0], e.Name()))
+		}
+	}
+	return r.FakeRunner.Run(ctx, command, args...)
+}
+
+var kexecRootPattern = regexp.MustCompile(`/tmp/diskimage-installer-root-[0-9]+`)
+
+// lsblkKexec has ESP, separate boot partition and LVM of sda.
+const lsblkKexec = `{"blockdevices": [
+	{"name": "sda", "kname": "sda", "type": "disk", "size": "100G",
+	 "children": [{"name": "sda1", "kname": "sda1", "type": "part", "fstype": "vfat", "partuuid": "5c2b7a1e-0000-4000-8000-000000000001"},
+	              {"name": "sda2", "kname": "sda2", "type": "part", "fstype": "xfs", "uuid": "boot-uuid"},
+	              {"name": "sda3", "kname": "sda3", "type": "part", "fstype": "LVM2_member"}]}]}`
+
+const efibootmgrOutput = `BootCurrent: 0001
+BootOrder: 0001,0003
+Boot0001* UEFI PXEv4 (MAC:aa0000000001)	PciRoot(0x0)/Pci(0x1c,0x0)/MAC(aa0000000001,1)/IPv4(0.0.0.0,0,DHCP)
+Boot0003* rocky	HD(1,GPT,5C2B7A1E-0000-4000-8000-000000000001,0x800,0x100000)/File(\EFI\rocky\shimx64.efi)
+`
+
+func TestPowerActionCommands(t *testing.T) {
+	const kernel = "vmlinuz-4.18.0-305.el8.x86_64"
+	bootFiles := map[string]string{
+		kernel:                                          "",
+		"vmlinuz-4.18.0-80.el8.x86_64":                  "",
+		"initramfs-4.18.0-305.el8.x86_64.img":           "",
+		"loader/entries/abc-4.18.0-305.el8.x86_64.conf": "linux /" + kernel + "\noptions root=/dev/mapper/rl-root ro rd.lvm.lv=rl/root\n",
+	}
+	tests := []struct {
+		name    string
+		action  config.PowerActionInfo
+		efi     bool
+		files   map[string]map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "kexec from separate boot partition",
+			action: config.PowerActionInfo{Action: config.PowerActionKexec},
+			files:  map[string]map[string]string{"/dev/sda2": bootFiles},
+			want: []string{
+				"lsblk -O -J",
+				"mount -o ro /dev/sda2 $ROOT",
+				"kexec -l $ROOT/" + kernel + " --command-line=root=/dev/mapper/rl-root ro rd.lvm.lv=rl/root console=ttyS0 --initrd=$ROOT/initramfs-4.18.0-305.el8.x86_64.img",
+				"sync",
+				"umount $ROOT",
+				"sync",
+				"kexec -e",
+			},
+		},
+		{
+			name:   "kexec with command line of power action",
+			action: config.PowerActionInfo{Action: config.PowerActionKexec, KexecCmdline: "root=/dev/sda3 single"},
+			files:  map[string]map[string]string{"/dev/sda2": bootFiles},
+			want: []string{
+				"lsblk -O -J",
+				"mount -o ro /dev/sda2 $ROOT",
+				"kexec -l $ROOT/" + kernel + " --command-line=root=/dev/sda3 single --initrd=$ROOT/initramfs-4.18.0-305.el8.x86_64.img",
+				"sync",
+				"umount $ROOT",
+				"sync",
+				"kexec -e",
+			},
+		},
+		{
+			name:   "kexec finds no kernel",
+			action: config.PowerActionInfo{Action: config.PowerActionKexec},
+			want: []string{
+				"lsblk -O -J",
+				"mount -o ro /dev/sda2 $ROOT",
+				"sync",
+				"umount $ROOT",
+			},
+			wantErr: true,
+		},
+		{
+			name:   "boot next on uefi",
+			action: config.PowerActionInfo{Action: config.PowerActionReboot, BootNext: true},
+			efi:    true,
+			want:   []string{"lsblk -O -J", "efibootmgr -v", "efibootmgr -n 0003", "sync", "reboot"},
+		},
+		{
+			name:   "boot next on bios",
+			action: config.PowerActionInfo{Action: config.PowerActionPowerOff, BootNext: true},
+			want:   []string{"sync", "poweroff"},
+		},
+	}
+	for _, tt := range tests {
+		sysfs, procfs := t.TempDir(), t.TempDir()
+		if tt.efi {
+			if err := os.MkdirAll(filepath.Join(sysfs, "firmware", "efi"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mustWriteFile(t, filepath.Join(procfs, "cmdline"), "console=ttyS0\n")
+		runner := &mountRunner{
+			FakeRunner: utils.NewFakeRunner().On("lsblk -O -J", lsblkKexec, nil).On("efibootmgr -v", efibootmgrOutput, nil),
+			files:      tt.files,
+		}
+		action := tt.action
+		i := NewInstaller(config.Node{PowerAction: &action}, zap.NewNop())
+		i.SetRunner(runner)
+		i.hardwareManager.SetSysfsRoot(sysfs)
+		i.hardwareManager.SetProcfsRoot(procfs)
+		err := i.powerAction(context.Background(), BlockDevice{Name: "/dev/sda", Kname: "sda"})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: powerAction = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		calls := runner.Calls()
+		for n, c := range calls {
+			calls[n] = kexecRootPattern.ReplaceAllLiteralString(c, "$ROOT")
+		}
+		if !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("%s: calls =\n%s\nwant\n%s", tt.name, strings.Join(calls, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
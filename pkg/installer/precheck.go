@@ -0,0 +1,152 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/configdrive"
+	"diskimage-installer/pkg/hardware"
+)
+
+const (
+	defaultPrecheckTimeout = 5 * time.Second
+	defaultPrecheckDNSName = "precheck.invalid"
+)
+
+// precheckNetwork applies every static IPv4 network of node in ramdisk and
+// checks its gateway and dns servers before anything is written to disk.
+func (i *ImgaeInstaller) precheckNetwork(ctx context.Context) error {
+	if i.NetworkPrecheck == nil || len(i.AllNetworks()) == 0 {
+		return nil
+	}
+	checks, err := i.precheckNetworkChecks(ctx)
+	if err != nil {
+		return err
+	}
+
+	failed := []string{}
+	for _, check := range checks {
+		result, err := i.hardwareManager.CheckNetwork(ctx, check)
+		if err != nil {
+			return errors.Wrapf(err, "check network %s", check.Address)
+		}
+		if result.OK() {
+			i.logger.Sugar().Infof("network %s on %s passed precheck, gateway %s is at %s",
+				result.Address, result.Interface, result.Gateway, result.GatewayMAC)
+			continue
+		}
+		for _, e := range result.Errors {
+			i.logger.Sugar().Errorf("network %s on %s: %s", result.Address, result.Interface, e)
+		}
+		failed = append(failed, result.Address)
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if i.NetworkPrecheck.IgnoreFailure {
+		i.logger.Sugar().Warnf("networks %v failed precheck, failure is ignored", failed)
+		return nil
+	}
+	return fmt.Errorf("networks %v failed precheck", failed)
+}
+
+// precheckNetworkChecks returns checks of static IPv4 networks of node.
+func (i *ImgaeInstaller) precheckNetworkChecks(ctx context.Context) ([]hardware.NetworkCheck, error) {
+	networkinterfaces, err := i.listNetworkInterfaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	networkData, err := configdrive.GetNetworkMetaData(networkinterfaces, i.Node)
+	if err != nil {
+		return nil, errors.Wrap(err, "configdrive.GetNetworkMetaData")
+	}
+	return i.networkChecks(networkData, networkinterfaces)
+}
+
+// networkChecks converts static IPv4 networks of network data into checks.
+func (i *ImgaeInstaller) networkChecks(data configdrive.NetworkMetaData, networkinterfaces []hardware.NetworkInterface) ([]hardware.NetworkCheck, error) {
+	timeout := defaultPrecheckTimeout
+	if i.NetworkPrecheck.Timeout > 0 {
+		timeout = time.Duration(i.NetworkPrecheck.Timeout) * time.Second
+	}
+	dnsName := defaultPrecheckDNSName
+	if i.NetworkPrecheck.DNSName != "" {
+		dnsName = i.NetworkPrecheck.DNSName
+	}
+	names := map[string]string{}
+	for _, n := range networkinterfaces {
+		names[strings.ToLower(n.MACAddress)] = n.Name
+	}
+	links := map[string]configdrive.Link{}
+	for _, l := range data.Links {
+		links[l.ID] = l
+	}
+	// dns servers are checked on the first static IPv4 network rendered from
+	// the network declaring them only, other networks may have no route to
+	// them
+	networks := i.AllNetworks()
+	dns := map[string][]net.IP{}
+	hasCheck := map[int]bool{}
+	for _, n := range data.Networks {
+		if n.Type != configdrive.NetworkTypeIPv4 || hasCheck[n.NetworkIndex] {
+			continue
+		}
+		hasCheck[n.NetworkIndex] = true
+		for _, server := range networks[n.NetworkIndex].DNS {
+			dns[n.ID] = append(dns[n.ID], net.ParseIP(server))
+		}
+	}
+	for idx, network := range networks {
+		if len(network.DNS) > 0 && !hasCheck[idx] {
+			i.logger.Sugar().Warnf("dns servers %v aren't prechecked, their network has no static IPv4 address", network.DNS)
+		}
+	}
+
+	checks := []hardware.NetworkCheck{}
+	for _, n := range data.Networks {
+		if n.Type != configdrive.NetworkTypeIPv4 {
+			continue
+		}
+		check := hardware.NetworkCheck{
+			Address: &net.IPNet{
+				IP:   net.ParseIP(n.IPAddress).To4(),
+				Mask: net.IPMask(net.ParseIP(n.Netmask).To4()),
+			},
+			DNS:     dns[n.ID],
+			DNSName: dnsName,
+			Timeout: timeout,
+		}
+		for _, r := range n.Routes {
+			if r.Network == "0.0.0.0" && r.Netmask == "0.0.0.0" {
+				check.Gateway = net.ParseIP(r.Gateway).To4()
+			}
+		}
+		link := links[n.Link]
+		if link.Type == configdrive.LinkTypeVlan {
+			check.VlanID = link.VlanID
+			link = links[link.VlanLink]
+		}
+		macs := []string{link.MacAddress}
+		if link.Type == configdrive.LinkTypeBond {
+			check.BondMode = link.BondMode
+			if check.BondMode == "" {
+				check.BondMode = "balance-rr"
+			}
+			macs = link.BondLinks
+		}
+		for _, mac := range macs {
+			name, ok := names[strings.ToLower(mac)]
+			if !ok {
+				return nil, fmt.Errorf("host has no interface %s", mac)
+			}
+			check.Links = append(check.Links, name)
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
@@ -0,0 +1,132 @@
+package installer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/configdrive"
+	"diskimage-installer/pkg/hardware"
+)
+
+func TestNetworkChecksDNSOfDeclaringNetwork(t *testing.T) {
+	interfaces := []hardware.NetworkInterface{
+		{Name: "eno1", MACAddress: "aa:00:00:00:00:01", HasCarrier: true},
+		{Name: "eno2", MACAddress: "aa:00:00:00:00:02", HasCarrier: true},
+	}
+	node := config.Node{
+		Name: "node1",
+		Networks: []config.NetworkInfo{
+			{
+				IPv4Address: "10.0.0.10",
+				NetMask:     "255.255.255.0",
+				Gateway:     "10.0.0.1",
+				DNS:         []string{"10.0.0.2", "8.8.8.8"},
+				Interface:   "eno1",
+			},
+			{
+				// storage network without gateway
+				IPv4Address: "192.168.0.10",
+				NetMask:     "255.255.255.0",
+				Interface:   "eno2",
+			},
+		},
+		NetworkPrecheck: &config.NetworkPrecheckInfo{},
+	}
+	data, err := configdrive.GetNetworkMetaData(interfaces, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := NewInstaller(node, zap.NewNop())
+	checks, err := i.networkChecks(data, interfaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 2 {
+		t.Fatalf("got %d checks, want 2", len(checks))
+	}
+	byAddress := map[string]hardware.NetworkCheck{}
+	for _, c := range checks {
+		byAddress[c.Address.IP.String()] = c
+	}
+	provisioning := byAddress["10.0.0.10"]
+	if want := []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("8.8.8.8")}; !reflect.DeepEqual(provisioning.DNS, want) {
+		t.Errorf("dns of 10.0.0.10 = %v, want %v", provisioning.DNS, want)
+	}
+	if !provisioning.Gateway.Equal(net.ParseIP("10.0.0.1")) || !reflect.DeepEqual(provisioning.Links, []string{"eno1"}) {
+		t.Errorf("check of 10.0.0.10 = %+v, want gateway 10.0.0.1 on eno1", provisioning)
+	}
+	storage := byAddress["192.168.0.10"]
+	if len(storage.DNS) != 0 || storage.Gateway != nil {
+		t.Errorf("check of 192.168.0.10 = %+v, want no dns and no gateway", storage)
+	}
+	if !reflect.DeepEqual(storage.Links, []string{"eno2"}) {
+		t.Errorf("links of 192.168.0.10 = %v, want [eno2]", storage.Links)
+	}
+}
+
+func TestNetworkChecksDNSOfVlanAndDHCPNetworks(t *testing.T) {
+	interfaces := []hardware.NetworkInterface{
+		{Name: "eno1", MACAddress: "aa:00:00:00:00:01", HasCarrier: true},
+		{Name: "eno2", MACAddress: "aa:00:00:00:00:02", HasCarrier: true},
+		{Name: "eno3", MACAddress: "aa:00:00:00:00:03", HasCarrier: true},
+	}
+	node := config.Node{
+		Name: "node1",
+		Networks: []config.NetworkInfo{
+			{
+				// address is on vlan only, untagged link carries nothing
+				DNS:       []string{"10.1.0.2"},
+				Interface: "eno1",
+				Vlans:     []config.VlanInfo{{ID: 100, IPv4Address: "10.1.0.10", NetMask: "255.255.255.0", Gateway: "10.1.0.1"}},
+			},
+			{
+				DHCP:      true,
+				DNS:       []string{"10.2.0.2"},
+				Interface: "eno2",
+				Vlans:     []config.VlanInfo{{ID: 200, IPv4Address: "10.2.0.10", NetMask: "255.255.255.0"}},
+			},
+			{
+				// dns of a network without static address is checked nowhere
+				DHCP:      true,
+				DNS:       []string{"10.3.0.2"},
+				Interface: "eno3",
+				VlanID:    300,
+			},
+		},
+		NetworkPrecheck: &config.NetworkPrecheckInfo{},
+	}
+	data, err := configdrive.GetNetworkMetaData(interfaces, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := NewInstaller(node, zap.NewNop())
+	checks, err := i.networkChecks(data, interfaces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address string
+		vlanID  int
+		links   []string
+		dns     []net.IP
+	}{
+		{"10.1.0.10", 100, []string{"eno1"}, []net.IP{net.ParseIP("10.1.0.2")}},
+		{"10.2.0.10", 200, []string{"eno2"}, []net.IP{net.ParseIP("10.2.0.2")}},
+	}
+	if len(checks) != len(tests) {
+		t.Fatalf("checks = %+v, want %d", checks, len(tests))
+	}
+	for n, tt := range tests {
+		c := checks[n]
+		if c.Address.IP.String() != tt.address || c.VlanID != tt.vlanID || !reflect.DeepEqual(c.Links, tt.links) {
+			t.Errorf("check %d = %+v, want %s of vlan %d on %v", n, c, tt.address, tt.vlanID, tt.links)
+		}
+		if !reflect.DeepEqual(c.DNS, tt.dns) {
+			t.Errorf("dns of %s = %v, want %v", tt.address, c.DNS, tt.dns)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package installer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/config"
+)
+
+// DefaultStateFile is where progress of install is kept, it is on tmpfs so
+// it doesn't outlive the ramdisk.
+const DefaultStateFile = "/run/diskimage-installer/state.json"
+
+// State is progress of an install, it is saved after every step so that a
+// failed install resumes from the failed step.
+type State struct {
+	// NodeHash identifies node config state belongs to, state of another
+	// node or changed config is discarded.
+	NodeHash  string   `json:"node_hash"`
+	Completed []string `json:"completed"`
+	// ConfigDrive is path of generated config drive iso.
+	ConfigDrive string       `json:"config_drive,omitempty"`
+	RootDevice  *BlockDevice `json:"root_device,omitempty"`
+	// Hooks are phases whose hooks ran after their step was done.
+	Hooks []string `json:"hooks,omitempty"`
+}
+
+func (s *State) done(step string) bool {
+	for _, c := range s.Completed {
+		if c == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) complete(step string) {
+	if !s.done(step) {
+		s.Completed = append(s.Completed, step)
+	}
+}
+
+func (s *State) forget(step string) {
+	completed := []string{}
+	for _, c := range s.Completed {
+		if c != step {
+			completed = append(completed, c)
+		}
+	}
+	s.Completed = completed
+}
+
+func (s *State) hooksDone(phase string) bool {
+	for _, h := range s.Hooks {
+		if h == phase {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) completeHooks(phase string) {
+	if !s.hooksDone(phase) {
+		s.Hooks = append(s.Hooks, phase)
+	}
+}
+
+func (s *State) forgetHooks(phase string) {
+	hooks := []string{}
+	for _, h := range s.Hooks {
+		if h != phase {
+			hooks = append(hooks, h)
+		}
+	}
+	s.Hooks = hooks
+}
+
+// nodeHash hashes what earlier steps depend on, power action and step
+// timeouts may change between attempts.
+func nodeHash(node config.Node) (string, error) {
+	node.PowerAction = nil
+	node.StepTimeouts = nil
+	data, err := json.Marshal(node)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadState reads state of node from state file, an empty state is returned
+// when there is no state file or it belongs to another node.
+func (i *ImgaeInstaller) loadState() (*State, error) {
+	hash, err := nodeHash(i.Node)
+	if err != nil {
+		return nil, errors.Wrap(err, "hash node config")
+	}
+	state := &State{NodeHash: hash}
+	if i.stateFile == "" {
+		return state, nil
+	}
+	data, err := ioutil.ReadFile(i.stateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", i.stateFile)
+	}
+	saved := &State{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		i.logger.Sugar().Warnf("discard state file %s: %v", i.stateFile, err)
+		return state, nil
+	}
+	if saved.NodeHash != hash {
+		i.logger.Sugar().Warnf("discard state file %s of another node config", i.stateFile)
+		return state, nil
+	}
+	if saved.ConfigDrive != "" {
+		if _, err := os.Stat(saved.ConfigDrive); err != nil {
+			i.logger.Sugar().Warnf("config drive %s is gone, it is generated again", saved.ConfigDrive)
+			saved.ConfigDrive = ""
+			saved.forget(StepConfigDrive)
+		}
+	}
+	i.logger.Sugar().Infof("resume install, completed steps are %v", saved.Completed)
+	return saved, nil
+}
+
+// saveState writes state to state file atomically.
+func (i *ImgaeInstaller) saveState() error {
+	if i.stateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(i.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(i.stateFile), 0700); err != nil {
+		return errors.Wrapf(err, "create directory of %s", i.stateFile)
+	}
+	tmp := i.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrapf(err, "write %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, i.stateFile), "rename %s", tmp)
+}
+
+// clearState removes state file and config drive once install is done.
+func (i *ImgaeInstaller) clearState() {
+	if i.state.ConfigDrive != "" {
+		os.Remove(i.state.ConfigDrive)
+	}
+	if i.stateFile != "" {
+		if err := os.Remove(i.stateFile); err != nil && !os.IsNotExist(err) {
+			i.logger.Sugar().Warnf("remove state file: %v", err)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package installer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils"
+)
+
+func newResumeNode() config.Node {
+	return config.Node{
+		Name:       "node1",
+		ImageInfo:  &config.ImageInfo{Image: "/images/ubuntu.img"},
+		RootDevice: map[string]string{"name": "/dev/sda"},
+		Hooks: []config.Hook{
+			{Name: "verify", Phase: config.HookPhasePostWrite, Script: "true"},
+			{Name: "register", Phase: config.HookPhasePostInstall, Script: "true"},
+		},
+	}
+}
+
+// writeState saves state of node into a state file, NodeHash of node is
+// used unless state has one.
+func writeState(t *testing.T, node config.Node, state State) string {
+	t.Helper()
+	if state.NodeHash == "" {
+		hash, err := nodeHash(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.NodeHash = hash
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "state.json")
+	mustWriteFile(t, file, string(data))
+	return file
+}
+
+func TestLoadState(t *testing.T) {
+	node := newResumeNode()
+	configDrive := filepath.Join(t.TempDir(), "configdrive.iso")
+	mustWriteFile(t, configDrive, "iso")
+	completed := []string{StepConfigDrive, StepNetworkPrecheck, StepBMC}
+
+	tests := []struct {
+		name string
+		// state is written when it isn't nil, content otherwise
+		state   *State
+		content string
+		// change changes node after state is saved
+		change        func(n *config.Node)
+		wantCompleted []string
+		wantDrive     string
+	}{
+		{name: "no state file", wantCompleted: nil},
+		{
+			name:          "state of node",
+			state:         &State{Completed: completed, ConfigDrive: configDrive},
+			wantCompleted: completed,
+			wantDrive:     configDrive,
+		},
+		{
+			name:          "state of another config",
+			state:         &State{NodeHash: "0123abcd", Completed: completed, ConfigDrive: configDrive},
+			wantCompleted: nil,
+		},
+		{
+			name:          "node changed",
+			state:         &State{Completed: completed},
+			change:        func(n *config.Node) { n.ImageInfo = &config.ImageInfo{Image: "/images/rhel.img"} },
+			wantCompleted: nil,
+		},
+		{
+			name:          "power action changed",
+			state:         &State{Completed: completed},
+			change:        func(n *config.Node) { n.PowerAction = &config.PowerActionInfo{Action: config.PowerActionReboot} },
+			wantCompleted: completed,
+		},
+		{
+			name:          "config drive is gone",
+			state:         &State{Completed: completed, ConfigDrive: filepath.Join(t.TempDir(), "gone.iso")},
+			wantCompleted: []string{StepNetworkPrecheck, StepBMC},
+		},
+		{name: "broken state file", content: `{"completed": [`, wantCompleted: nil},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(t.TempDir(), "state.json")
+		if tt.state != nil {
+			file = writeState(t, node, *tt.state)
+		} else if tt.content != "" {
+			mustWriteFile(t, file, tt.content)
+		}
+		n := newResumeNode()
+		if tt.change != nil {
+			tt.change(&n)
+		}
+		i := NewInstaller(n, zap.NewNop())
+		i.SetStateFile(file)
+		state, err := i.loadState()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		hash, _ := nodeHash(n)
+		if state.NodeHash != hash {
+			t.Errorf("%s: state is of node %s, want %s", tt.name, state.NodeHash, hash)
+		}
+		if len(state.Completed) != len(tt.wantCompleted) || (len(tt.wantCompleted) > 0 && !reflect.DeepEqual(state.Completed, tt.wantCompleted)) {
+			t.Errorf("%s: completed = %v, want %v", tt.name, state.Completed, tt.wantCompleted)
+		}
+		if state.ConfigDrive != tt.wantDrive {
+			t.Errorf("%s: config drive = %q, want %q", tt.name, state.ConfigDrive, tt.wantDrive)
+		}
+	}
+}
+
+var hookPhasePattern = regexp.MustCompile(`DISKIMAGE_PHASE=([a-z-]+) `)
+
+// resumeCalls names hook and write image commands of calls, other commands
+// are left out.
+func resumeCalls(calls []string) []string {
+	names := []string{}
+	for _, c := range calls {
+		if m := hookPhasePattern.FindStringSubmatch(c); m != nil {
+			names = append(names, "hook "+m[1])
+		} else if strings.HasPrefix(c, "/bin/bash ") {
+			names = append(names, "write image")
+		}
+	}
+	return names
+}
+
+func TestInstallOSResume(t *testing.T) {
+	written := []string{StepConfigDrive, StepNetworkPrecheck, StepBMC, StepRaid, StepRootDevice, StepWriteImage}
+	tests := []struct {
+		name  string
+		state State
+		only  []string
+		want  []string
+	}{
+		{
+			name:  "completed steps are skipped",
+			state: State{Completed: written, Hooks: []string{config.HookPhasePostWrite}},
+			want:  []string{"hook post-install"},
+		},
+		{
+			name:  "hooks of completed step which didn't run",
+			state: State{Completed: written},
+			want:  []string{"hook post-write", "hook post-install"},
+		},
+		{
+			name:  "hooks run again with their step",
+			state: State{Completed: written, Hooks: []string{config.HookPhasePostWrite}},
+			only:  []string{StepWriteImage},
+			want:  []string{"write image", "hook post-write"},
+		},
+		{
+			name:  "stale state",
+			state: State{NodeHash: "0123abcd", Completed: written, Hooks: []string{config.HookPhasePostWrite}},
+			want:  []string{"write image", "hook post-write", "hook post-install"},
+		},
+	}
+	for _, tt := range tests {
+		node := newResumeNode()
+		tt.state.RootDevice = &BlockDevice{Name: "/dev/sda", Kname: "sda"}
+		file := writeState(t, node, tt.state)
+		runner := utils.NewFakeRunner().On("lsblk -O -J", lsblkBefore, nil)
+		i := NewInstaller(node, zap.NewNop())
+		i.SetRunner(runner)
+		i.SetStateFile(file)
+		i.SetSteps(tt.only, nil)
+		if err := i.InstallOS(context.Background()); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := resumeCalls(runner.Calls()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: calls = %v, want %v", tt.name, got, tt.want)
+		}
+
+		_, err := os.Stat(file)
+		if len(tt.only) == 0 {
+			// finished install leaves nothing to resume
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: state file is left: %v", tt.name, err)
+			}
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		saved := State{}
+		if err := json.Unmarshal(data, &saved); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(saved.Completed, written) || !reflect.DeepEqual(saved.Hooks, []string{config.HookPhasePostWrite}) {
+			t.Errorf("%s: saved state = %+v", tt.name, saved)
+		}
+	}
+}
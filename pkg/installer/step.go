@@ -0,0 +1,184 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Steps of install, in the order they run. Names are used by step timeouts
+// of node config, the state file and --steps/--skip-steps.
+const (
+	StepConfigDrive          = "config_drive"
+	StepNetworkPrecheck      = "network_precheck"
+	StepBMC                  = "bmc"
+	StepRaid                 = "raid"
+	StepRootDevice           = "root_device"
+	StepWriteImage           = "write_image"
+	StepStorage              = "storage"
+	StepCustomize            = "customize"
+	StepBootloader           = "bootloader"
+	StepGrowRoot             = "grow_root"
+	StepConfigDrivePartition = "config_drive_partition"
+	StepPowerAction          = "power_action"
+)
+
+// Steps are names of every install step in order.
+var Steps = []string{
+	StepConfigDrive,
+	StepNetworkPrecheck,
+	StepBMC,
+	StepRaid,
+	StepRootDevice,
+	StepWriteImage,
+	StepStorage,
+	StepCustomize,
+	StepBootloader,
+	StepGrowRoot,
+	StepConfigDrivePartition,
+	StepPowerAction,
+}
+
+// wipeTimeout bounds cleanup of a half written disk, which runs after
+// context of install is done.
+const wipeTimeout = 30 * time.Second
+
+// cleanupTimeout bounds unmounting and deactivating what a step set up on
+// host.
+const cleanupTimeout = 2 * time.Minute
+
+// cleanupContext returns the context to undo mounts and activations of a
+// step in. It deliberately isn't derived from context of the step: a step
+// which is interrupted or times out still has to unmount what it mounted,
+// so cleanup gets its own timeout instead.
+func cleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+type step struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+func (i *ImgaeInstaller) steps() []step {
+	return []step{
+		{StepConfigDrive, i.stepConfigDrive},
+		{StepNetworkPrecheck, i.precheckNetwork},
+		{StepBMC, i.configureBMC},
+		{StepRaid, i.configRaidController},
+		{StepRootDevice, i.stepRootDevice},
+		{StepWriteImage, i.stepWriteImage},
+		{StepStorage, i.applyStorage},
+		{StepCustomize, i.customize},
+		{StepBootloader, i.installBootloader},
+		{StepGrowRoot, i.growRoot},
+		{StepConfigDrivePartition, i.stepConfigDrivePartition},
+		{StepPowerAction, i.stepPowerAction},
+	}
+}
+
+// StepError is the error of a failed install step, Interrupted is true when
+// the step was cancelled or ran out of time.
+type StepError struct {
+	Step        string
+	Interrupted bool
+	Err         error
+}
+
+func (e *StepError) Error() string {
+	if e.Interrupted {
+		return fmt.Sprintf("step %s interrupted: %v", e.Step, e.Err)
+	}
+	return fmt.Sprintf("step %s: %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateStepNames returns an error naming the first of names which is not
+// an install step.
+func ValidateStepNames(names []string) error {
+	for _, name := range names {
+		if !isStep(name) {
+			return fmt.Errorf("unknown step %s, steps are %v", name, Steps)
+		}
+	}
+	return nil
+}
+
+func isStep(name string) bool {
+	for _, step := range Steps {
+		if name == step {
+			return true
+		}
+	}
+	return false
+}
+
+func validateStepTimeouts(timeouts map[string]int) error {
+	names := make([]string, 0, len(timeouts))
+	for name := range timeouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if err := ValidateStepNames(names); err != nil {
+		return fmt.Errorf("step_timeouts: %v", err)
+	}
+	for _, name := range names {
+		if timeouts[name] < 0 {
+			return fmt.Errorf("timeout of step %s is negative", name)
+		}
+	}
+	return nil
+}
+
+// selected reports whether step is chosen by --steps and --skip-steps.
+func (i *ImgaeInstaller) selected(step string) bool {
+	for _, s := range i.skipSteps {
+		if s == step {
+			return false
+		}
+	}
+	if len(i.onlySteps) == 0 {
+		return true
+	}
+	for _, s := range i.onlySteps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
+
+// runStep runs fn under the timeout of step, an error of fn is wrapped in
+// StepError.
+func (i *ImgaeInstaller) runStep(ctx context.Context, step string, fn func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return &StepError{Step: step, Interrupted: true, Err: err}
+	}
+	if timeout := i.StepTimeouts[step]; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		defer cancel()
+	}
+	i.logger.Sugar().Infof("step %s started", step)
+	start := time.Now()
+	if err := fn(ctx); err != nil {
+		return &StepError{Step: step, Interrupted: ctx.Err() != nil, Err: err}
+	}
+	i.logger.Sugar().Infof("step %s finished in %s", step, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// wipeDevice erases signatures of device, so that a disk whose image is
+// partly written doesn't boot.
+func (i *ImgaeInstaller) wipeDevice(device string) {
+	ctx, cancel := context.WithTimeout(context.Background(), wipeTimeout)
+	defer cancel()
+	i.logger.Sugar().Warnf("wipe signatures of partly written device %s", device)
+	if out, err := i.runner.Run(ctx, "wipefs", "-a", device); err != nil {
+		i.logger.Sugar().Errorf("wipefs -a %s: %v: %s", device, err, out)
+	}
+}
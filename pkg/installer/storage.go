@@ -0,0 +1,294 @@
+package installer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"diskimage-installer/pkg/config"
+	diskutils "diskimage-installer/pkg/utils/disk"
+)
+
+// storageDisk is a disk selected by storage, Index replaces config.StorageIndex
+// in its labels and mountpoints.
+type storageDisk struct {
+	Device  BlockDevice
+	Index   int
+	Storage config.StorageInfo
+}
+
+// partition returns p with config.StorageIndex of label and mountpoint replaced.
+func (d storageDisk) partition(p config.StoragePartition) config.StoragePartition {
+	index := strconv.Itoa(d.Index)
+	p.Label = strings.Replace(p.Label, config.StorageIndex, index, -1)
+	p.Mountpoint = strings.Replace(p.Mountpoint, config.StorageIndex, index, -1)
+	return p
+}
+
+// matchStorageDevice is true when d matches every hint, hints that
+// config.StorageDeviceHints doesn't know match no disk.
+func matchStorageDevice(d BlockDevice, hints map[string]string) bool {
+	for k, v := range hints {
+		var value string
+		switch k {
+		case "name":
+			value = d.Name
+		case "hctl":
+			value = d.Hctl
+		case "uuid":
+			value = d.UUID
+		case "size":
+			value = d.Size
+		case "model":
+			value = d.Model
+		case "serial":
+			value = d.Serial
+		case "wwn":
+			value = d.WWN
+		case "vendor":
+			value = strings.TrimSpace(d.Vendor)
+		case "tran":
+			value = d.InterfaceType
+		default:
+			return false
+		}
+		if v != value {
+			return false
+		}
+	}
+	return len(hints) > 0
+}
+
+// storageDisks selects disks of storage in order of name, root disk is never
+// selected. Disks are indexed across all storages so labels and mountpoints
+// don't repeat. A storage selecting no disk, a disk selected twice and a
+// label or mountpoint of two partitions are errors.
+func (i *ImgaeInstaller) storageDisks(ctx context.Context) ([]storageDisk, error) {
+	root, err := i.rootDevice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devices, err := i.listAllBlockDevice(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "listAllBlockDevice")
+	}
+	sort.Slice(devices, func(a, b int) bool { return devices[a].Name < devices[b].Name })
+
+	result := []storageDisk{}
+	selected := map[string]int{}
+	labels := map[string]string{}
+	mountpoints := map[string]string{}
+	for idx, storage := range i.Storage {
+		n := 0
+		for _, d := range devices {
+			if d.Name == root.Name || !matchStorageDevice(d, storage.Device) {
+				continue
+			}
+			if prev, ok := selected[d.Name]; ok {
+				return nil, fmt.Errorf("%s is selected by both storage[%d] and storage[%d]", d.Name, prev, idx)
+			}
+			selected[d.Name] = idx
+			disk := storageDisk{Device: d, Index: len(result), Storage: storage}
+			for _, p := range storage.Partitions {
+				p = disk.partition(p)
+				if p.Label != "" {
+					if prev, ok := labels[p.Label]; ok {
+						return nil, fmt.Errorf("label %s is of both %s and %s", p.Label, prev, d.Name)
+					}
+					labels[p.Label] = d.Name
+				}
+				if p.Mountpoint == "" {
+					continue
+				}
+				if prev, ok := mountpoints[p.Mountpoint]; ok {
+					return nil, fmt.Errorf("mountpoint %s is of both %s and %s", p.Mountpoint, prev, d.Name)
+				}
+				mountpoints[p.Mountpoint] = d.Name
+			}
+			result = append(result, disk)
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("storage[%d] selects no disk by %v", idx, storage.Device)
+		}
+	}
+	return result, nil
+}
+
+// applyStorage partitions and formats disks of storage, and adds their
+// mounts to fstab of the installed image when storage asks for it.
+func (i *ImgaeInstaller) applyStorage(ctx context.Context) (err error) {
+	if len(i.Storage) == 0 {
+		return nil
+	}
+	disks, err := i.storageDisks(ctx)
+	if err != nil {
+		return err
+	}
+	lines := []string{}
+	mountpoints := []string{}
+	for _, d := range disks {
+		if err := i.formatStorageDisk(ctx, d); err != nil {
+			return errors.Wrapf(err, "storage of %s", d.Device.Name)
+		}
+		if !d.Storage.Fstab {
+			continue
+		}
+		for n, p := range d.Storage.Partitions {
+			p = d.partition(p)
+			if p.Filesystem == "" || (p.Mountpoint == "" && p.Filesystem != config.FilesystemSwap) {
+				continue
+			}
+			partition := diskutils.PartitionDevice(d.Device.Name, n+1)
+			out, err := i.runner.Run(ctx, "blkid", "-o", "value", "-s", "UUID", partition)
+			uuid := strings.TrimSpace(out)
+			if err != nil || uuid == "" {
+				return fmt.Errorf("uuid of %s: %v: %s", partition, err, out)
+			}
+			options := p.MountOptions
+			if options == "" {
+				options = "defaults"
+			}
+			if p.Filesystem == config.FilesystemSwap {
+				lines = append(lines, fmt.Sprintf("UUID=%s none swap %s 0 0", uuid, options))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("UUID=%s %s %s %s 0 2", uuid, p.Mountpoint, p.Filesystem, options))
+			mountpoints = append(mountpoints, p.Mountpoint)
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	device, err := i.rootDevice(ctx)
+	if err != nil {
+		return err
+	}
+	if err := i.disk.RescanDevice(ctx, device.Name); err != nil {
+		return errors.Wrap(err, "diskutils.RescanDevice")
+	}
+	root, unmount, err := i.mountRoot(ctx, device)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := unmount(); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+	for _, m := range mountpoints {
+		dir, err := resolveInRoot(root, m)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	fstab, content, existing, err := readFstab(root)
+	if err != nil {
+		return err
+	}
+	added := []string{}
+	for _, line := range lines {
+		if mountpoint := strings.Fields(line)[1]; mountpoint != "none" && existing[mountpoint] {
+			i.logger.Sugar().Warnf("fstab of image mounts %s already, %q is not added", mountpoint, line)
+			continue
+		}
+		added = append(added, line)
+	}
+	if err := appendFstab(fstab, content, added); err != nil {
+		return errors.Wrap(err, "write fstab")
+	}
+	i.logger.Sugar().Infof("added %d storage mounts to fstab of installed image", len(added))
+	return nil
+}
+
+// formatStorageDisk wipes disk and creates its partitions and filesystems.
+func (i *ImgaeInstaller) formatStorageDisk(ctx context.Context, d storageDisk) error {
+	device := d.Device.Name
+	label := d.Storage.Label
+	if label == "" {
+		label = config.PartitionLabelGPT
+	}
+	parted := func(args ...string) error {
+		if out, err := i.runner.Run(ctx, "parted", append([]string{"-s", "-a", "optimal", "--", device}, args...)...); err != nil {
+			return fmt.Errorf("parted %s: %v: %s", strings.Join(args, " "), err, out)
+		}
+		return nil
+	}
+	i.logger.Sugar().Infof("create %s partition table of %d partitions on %s", label, len(d.Storage.Partitions), device)
+	if out, err := i.runner.Run(ctx, "wipefs", "-a", device); err != nil {
+		return fmt.Errorf("wipefs -a %s: %v: %s", device, err, out)
+	}
+	if err := parted("mklabel", label); err != nil {
+		return err
+	}
+	start := 1
+	for n, p := range d.Storage.Partitions {
+		// GPT partition is named after label of its filesystem
+		name := d.partition(p).Label
+		if name == "" {
+			name = fmt.Sprintf("part%d", n+1)
+		}
+		if label == config.PartitionLabelMSDOS {
+			name = "primary"
+		}
+		end := "100%"
+		if p.SizeMB > 0 {
+			end = fmt.Sprintf("%dMiB", start+p.SizeMB)
+		}
+		args := []string{"mkpart", name}
+		switch p.Filesystem {
+		case config.FilesystemVFAT:
+			args = append(args, "fat32")
+		case config.FilesystemSwap:
+			args = append(args, "linux-swap")
+		case config.FilesystemXFS, config.FilesystemExt4:
+			args = append(args, p.Filesystem)
+		}
+		if err := parted(append(args, fmt.Sprintf("%dMiB", start), end)...); err != nil {
+			return err
+		}
+		start += p.SizeMB
+	}
+	if err := i.disk.RescanDevice(ctx, device); err != nil {
+		return errors.Wrap(err, "diskutils.RescanDevice")
+	}
+	for n, p := range d.Storage.Partitions {
+		p = d.partition(p)
+		partition := diskutils.PartitionDevice(device, n+1)
+		var args []string
+		switch p.Filesystem {
+		case "":
+			continue
+		case config.FilesystemXFS:
+			args = []string{"mkfs.xfs", "-f"}
+		case config.FilesystemExt4:
+			args = []string{"mkfs.ext4", "-F"}
+		case config.FilesystemVFAT:
+			args = []string{"mkfs.vfat"}
+		case config.FilesystemSwap:
+			args = []string{"mkswap"}
+		}
+		if p.Label != "" {
+			flag := "-L"
+			if p.Filesystem == config.FilesystemVFAT {
+				flag = "-n"
+			}
+			args = append(args, flag, p.Label)
+		}
+		args = append(args, partition)
+		if out, err := i.runner.Run(ctx, args[0], args[1:]...); err != nil {
+			return fmt.Errorf("%s: %v: %s", strings.Join(args, " "), err, out)
+		}
+		i.logger.Sugar().Infof("made %s on %s", p.Filesystem, partition)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package installer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"diskimage-installer/pkg/config"
+	"diskimage-installer/pkg/utils"
+)
+
+// lsblkStorage has root disk sda and data disks of two models, sde is
+// plugged by usb.
+const lsblkStorage = `{"blockdevices": [
+	{"name": "sda", "kname": "sda", "type": "disk", "size": "480G", "model": "MZ7LH480", "serial": "S1", "tran": "sata", "vendor": "ATA     "},
+	{"name": "sdb", "kname": "sdb", "type": "disk", "size": "8T", "model": "ST8000NM", "serial": "S2", "tran": "sas", "vendor": "SEAGATE "},
+	{"name": "sdc", "kname": "sdc", "type": "disk", "size": "8T", "model": "ST8000NM", "serial": "S3", "tran": "sas", "vendor": "SEAGATE "},
+	{"name": "sdd", "kname": "sdd", "type": "disk", "size": "1.9T", "model": "MZ7LH1T9", "serial": "S4", "tran": "sata", "vendor": "ATA     "},
+	{"name": "sde", "kname": "sde", "type": "disk", "size": "8T", "model": "ST8000NM", "serial": "S5", "tran": "usb", "vendor": "SEAGATE "}]}`
+
+func newStorageInstaller(storage ...config.StorageInfo) *ImgaeInstaller {
+	i := NewInstaller(config.Node{Name: "node1", Storage: storage}, zap.NewNop())
+	i.SetRunner(utils.NewFakeRunner().On("lsblk -O -J", lsblkStorage, nil))
+	i.state = &State{RootDevice: &BlockDevice{Name: "/dev/sda"}}
+	return i
+}
+
+func storageDiskNames(disks []storageDisk) []string {
+	names := []string{}
+	for _, d := range disks {
+		names = append(names, d.Device.Name)
+	}
+	return names
+}
+
+func TestMatchStorageDevice(t *testing.T) {
+	d := BlockDevice{Name: "/dev/sdb", Size: "8T", Model: "ST8000NM", Serial: "S2", InterfaceType: "sas", Vendor: "SEAGATE "}
+	tests := []struct {
+		hints map[string]string
+		want  bool
+	}{
+		{map[string]string{"model": "ST8000NM"}, true},
+		{map[string]string{"model": "ST8000NM", "tran": "sas", "vendor": "SEAGATE"}, true},
+		// root_device would take either, storage takes both
+		{map[string]string{"model": "ST8000NM", "tran": "usb"}, false},
+		{map[string]string{"size": "8T", "serial": "S3"}, false},
+		{map[string]string{"model": "ST8000NM", "rotational": "1"}, false},
+		{map[string]string{}, false},
+	}
+	for _, tt := range tests {
+		if got := matchStorageDevice(d, tt.hints); got != tt.want {
+			t.Errorf("matchStorageDevice(%v) = %v, want %v", tt.hints, got, tt.want)
+		}
+	}
+}
+
+func TestStorageDisks(t *testing.T) {
+	data := config.StoragePartition{Filesystem: config.FilesystemXFS}
+	tests := []struct {
+		name    string
+		storage []config.StorageInfo
+		want    []string
+		wantErr string
+	}{
+		{
+			name:    "every hint matches",
+			storage: []config.StorageInfo{{Device: map[string]string{"model": "ST8000NM", "tran": "sas"}, Partitions: []config.StoragePartition{data}}},
+			want:    []string{"/dev/sdb", "/dev/sdc"},
+		},
+		{
+			name:    "root disk is never selected",
+			storage: []config.StorageInfo{{Device: map[string]string{"tran": "sata"}, Partitions: []config.StoragePartition{data}}},
+			want:    []string{"/dev/sdd"},
+		},
+		{
+			name:    "no disk matches",
+			storage: []config.StorageInfo{{Device: map[string]string{"model": "MZ7LH1T9", "tran": "sas"}, Partitions: []config.StoragePartition{data}}},
+			wantErr: "storage[0] selects no disk",
+		},
+		{
+			name: "disk selected twice",
+			storage: []config.StorageInfo{
+				{Device: map[string]string{"model": "ST8000NM"}, Partitions: []config.StoragePartition{data}},
+				{Device: map[string]string{"tran": "usb"}, Partitions: []config.StoragePartition{data}},
+			},
+			wantErr: "/dev/sde is selected by both storage[0] and storage[1]",
+		},
+	}
+	for _, tt := range tests {
+		disks, err := newStorageInstaller(tt.storage...).storageDisks(context.Background())
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: storageDisks = %v, want error %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := storageDiskNames(disks); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: disks = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStorageDisksIndex(t *testing.T) {
+	partition := func(label, mountpoint string) []config.StoragePartition {
+		return []config.StoragePartition{{Filesystem: config.FilesystemXFS, Label: label, Mountpoint: mountpoint}}
+	}
+	hdd := map[string]string{"model": "ST8000NM", "tran": "sas"}
+	ssd := map[string]string{"model": "MZ7LH1T9"}
+
+	i := newStorageInstaller(
+		config.StorageInfo{Device: hdd, Partitions: partition("data{n}", "/data/{n}")},
+		config.StorageInfo{Device: ssd, Partitions: partition("data{n}", "/data/{n}")},
+	)
+	disks, err := i.storageDisks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, d := range disks {
+		p := d.partition(d.Storage.Partitions[0])
+		got = append(got, d.Device.Name+" "+p.Label+" "+p.Mountpoint)
+	}
+	// disks are numbered across storages, labels of sdd don't repeat sdb's
+	want := []string{"/dev/sdb data0 /data/0", "/dev/sdc data1 /data/1", "/dev/sdd data2 /data/2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("partitions = %v, want %v", got, want)
+	}
+
+	i = newStorageInstaller(config.StorageInfo{Device: hdd, Partitions: partition("data", "")})
+	if _, err := i.storageDisks(context.Background()); err == nil || !strings.Contains(err.Error(), "label data is of both /dev/sdb and /dev/sdc") {
+		t.Errorf("storageDisks = %v, want error of label repeated", err)
+	}
+}
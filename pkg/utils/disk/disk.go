@@ -1,10 +1,9 @@
 package disk
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"math/rand"
-	"os/exec"
 	"strconv"
 	"strings"
 	"time"
@@ -28,19 +27,26 @@ var NoPartition PartitionType = "NoPartition"
 var Unknown PartitionType = "Unknown"
 var PartProbeAttemps int = 5
 
-func GetPartitionTableType(device string) (PartitionType, error) {
-	if err := partProbe(device); err != nil {
+// Disk partitions and probes disks by running tools through runner.
+type Disk struct {
+	runner utils.Runner
+}
+
+func New(runner utils.Runner) *Disk {
+	return &Disk{runner: runner}
+}
+
+func (d *Disk) GetPartitionTableType(ctx context.Context, device string) (PartitionType, error) {
+	if err := d.partProbe(ctx, device); err != nil {
 		return Unknown, errors.Wrap(err, "getPartitionTableType:")
 	}
 
-	var out bytes.Buffer
-	cmd := exec.Command("blkid", device, "--probe")
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
+	out, err := d.runner.Run(ctx, "blkid", device, "--probe")
+	if err != nil {
 		return Unknown, err
 	}
 
-	data := strings.Split(out.String(), ": ")
+	data := strings.Split(strings.TrimSpace(out), ": ")
 	attr := data[len(data)-1]
 	tag := parseDeviceAttr(attr)
 	pttype, ok := tag["PTTYPE"]
@@ -55,25 +61,29 @@ func GetPartitionTableType(device string) (PartitionType, error) {
 
 func parseDeviceAttr(attr string) map[string]string {
 	result := map[string]string{}
-	for _, a := range strings.Split(attr, " ") {
-		kv := strings.Split(a, "=")
-		result[kv[0]] = kv[1]
+	for _, a := range strings.Fields(attr) {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		// blkid quotes values
+		result[kv[0]] = strings.Trim(kv[1], `"`)
 	}
 	return result
 }
 
-func partProbe(device string) error {
+func (d *Disk) partProbe(ctx context.Context, device string) error {
 	fn := func() error {
-		if out, err := utils.RunCommand("partprobe", device); err != nil {
+		if out, err := d.runner.Run(ctx, "partprobe", device); err != nil {
 			return errors.Wrapf(err, "partprobe %s: %v", device, out)
 		}
 		return nil
 	}
-	return retry(PartProbeAttemps, 1*time.Second, fn)
+	return retry(ctx, PartProbeAttemps, 1*time.Second, fn)
 }
 
-func fixGPTStructs(device string) error {
-	out, err := verifyDevice(device)
+func (d *Disk) fixGPTStructs(ctx context.Context, device string) error {
+	out, err := d.verifyDevice(ctx, device)
 	if err != nil {
 		return err
 	}
@@ -82,57 +92,51 @@ func fixGPTStructs(device string) error {
 		return nil
 	}
 	// move backup GTP structures to the end of the disk.
-	cmd := exec.Command("sgdisk", "-e", device)
-	if err := cmd.Run(); err != nil {
+	if _, err := d.runner.Run(ctx, "sgdisk", "-e", device); err != nil {
 		return errors.Wrap(err, "sgdisk -e:")
 	}
 	return nil
 }
 
-func FixGTPPartition(device string) error {
-	pttype, err := GetPartitionTableType(device)
+func (d *Disk) FixGTPPartition(ctx context.Context, device string) error {
+	pttype, err := d.GetPartitionTableType(ctx, device)
 	if err != nil {
 		return errors.Wrap(err, "getPartitionTableType")
 	}
 	if pttype == GPT {
-		return fixGPTStructs(device)
+		return d.fixGPTStructs(ctx, device)
 	}
 	return nil
 }
 
-func UdevSettle() error {
-	cmd := exec.Command("udevadm", "settle")
-	if err := cmd.Run(); err != nil {
+func (d *Disk) UdevSettle(ctx context.Context) error {
+	if _, err := d.runner.Run(ctx, "udevadm", "settle"); err != nil {
 		return fmt.Errorf("udevadm settle: %v", err)
 	}
 	return nil
 }
 
-func DD(src, dest string) error {
+func (d *Disk) DD(ctx context.Context, src, dest string) error {
 	cmd := fmt.Sprintf("dd if=%s of=%s bs=%s oflag=sync", src, dest, "1M")
 	zap.L().Sugar().Debug(cmd)
 	command := strings.Split(cmd, " ")
-	if out, err := utils.RunCommand(command[0], command[1:]...); err != nil {
+	if out, err := d.runner.Run(ctx, command[0], command[1:]...); err != nil {
 		return fmt.Errorf("RunCommand: %s: %v", out, err)
 	}
 	return nil
 }
 
-func CreateGPTPartion(device, option string) error {
-	var out bytes.Buffer
-	cmd := exec.Command("sgdisk", "-n", option, device)
-	cmd.Stderr = &out
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return errors.Wrapf(err, "sgdisk -n %s %s: %v", option, device, out.String())
+func (d *Disk) CreateGPTPartion(ctx context.Context, device, option string) error {
+	if out, err := d.runner.Run(ctx, "sgdisk", "-n", option, device); err != nil {
+		return errors.Wrapf(err, "sgdisk -n %s %s: %v", option, device, out)
 	}
 	return nil
 }
 
-func CreateMBRPartitionForConfigDrive(device string) error {
+func (d *Disk) CreateMBRPartitionForConfigDrive(ctx context.Context, device string) error {
 	startlimit := fmt.Sprintf("-%dMiB", MaxConfigDriveSizeMB)
 	endlimit := "-0"
-	toolarge, err := isDiskLargeThanMAX(device)
+	toolarge, err := d.isDiskLargeThanMAX(ctx, device)
 	if err != nil {
 		return errors.Wrap(err, "isDiskLargeThanMAX:")
 	}
@@ -140,74 +144,139 @@ func CreateMBRPartitionForConfigDrive(device string) error {
 		startlimit = strconv.Itoa(MaxMBRDiskSizeMB - MaxConfigDriveSizeMB - 1)
 		endlimit = strconv.Itoa(MaxMBRDiskSizeMB - 1)
 	}
-	out, err := utils.RunCommand("parted", "-a", "optimal", "-s", "--", device,
+	out, err := d.runner.Run(ctx, "parted", "-a", "optimal", "-s", "--", device,
 		"mkpart", "primary", "fat32", startlimit, endlimit)
 	if err != nil {
 		return errors.Wrapf(err, "parted: %v", out)
 	}
-	if err := RescanDevice(device); err != nil {
+	if err := d.RescanDevice(ctx, device); err != nil {
 		return errors.Wrapf(err, "rescanDevice(%s)", device)
 	}
 	return nil
 }
 
-func isDiskLargeThanMAX(device string) (bool, error) {
-	out, err := utils.RunCommand("blockdev", "--getsize64", device)
-	if err != nil {
-		return false, errors.Wrap(err, out)
-	}
-	sizebytes := strings.TrimSpace(out)
-	b, err := strconv.Atoi(sizebytes)
+func (d *Disk) isDiskLargeThanMAX(ctx context.Context, device string) (bool, error) {
+	b, err := d.SizeBytes(ctx, device)
 	if err != nil {
 		return false, err
 	}
 	mb := b / 1024 / 1024
-	if mb > MaxMBRDiskSizeMB {
+	if mb > uint64(MaxMBRDiskSizeMB) {
 		return true, nil
 	}
 	return false, nil
 }
 
-func RescanDevice(device string) error {
-	if _, err := utils.RunCommand("sync"); err != nil {
+// SizeBytes returns size of device in bytes.
+func (d *Disk) SizeBytes(ctx context.Context, device string) (uint64, error) {
+	out, err := d.runner.Run(ctx, "blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, errors.Wrap(err, out)
+	}
+	return strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+}
+
+// PartitionEntry is an entry of partition table, Start and End are in
+// 512-byte sectors whatever sector size of disk is.
+type PartitionEntry struct {
+	Number int
+	Start  uint64
+	End    uint64
+}
+
+// ListPartitionEntries reads partition table of device.
+func (d *Disk) ListPartitionEntries(ctx context.Context, device string) ([]PartitionEntry, error) {
+	out, err := d.runner.Run(ctx, "partx", "-g", "-o", "NR,START,END", device)
+	if err != nil {
+		return nil, errors.Wrapf(err, "partx %s: %s", device, out)
+	}
+	entries := []PartitionEntry{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse partx output %q: %v", line, err)
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse partx output %q: %v", line, err)
+		}
+		end, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse partx output %q: %v", line, err)
+		}
+		entries = append(entries, PartitionEntry{Number: number, Start: start, End: end})
+	}
+	return entries, nil
+}
+
+// ResizePartition moves end of partition number of device to byte end,
+// which is inclusive.
+func (d *Disk) ResizePartition(ctx context.Context, device string, number int, end uint64) error {
+	out, err := d.runner.Run(ctx, "parted", "-s", "--", device, "unit", "B", "resizepart", strconv.Itoa(number), fmt.Sprintf("%dB", end))
+	if err != nil {
+		return errors.Wrapf(err, "parted resizepart %d: %s", number, out)
+	}
+	return nil
+}
+
+// PartitionDevice returns device node of partition number of device, e.g.
+// /dev/sda1 or /dev/nvme0n1p1.
+func PartitionDevice(device string, number int) string {
+	if last := device[len(device)-1]; last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", device, number)
+	}
+	return fmt.Sprintf("%s%d", device, number)
+}
+
+func (d *Disk) RescanDevice(ctx context.Context, device string) error {
+	if _, err := d.runner.Run(ctx, "sync"); err != nil {
 		return err
 	}
-	if err := UdevSettle(); err != nil {
+	if err := d.UdevSettle(ctx); err != nil {
 		return err
 	}
-	if err := partProbe(device); err != nil {
+	if err := d.partProbe(ctx, device); err != nil {
 		return err
 	}
-	out, err := verifyDevice(device)
+	out, err := d.verifyDevice(ctx, device)
 	if err != nil {
 		return errors.Wrap(err, out)
 	}
 	return nil
 }
 
-func verifyDevice(device string) (string, error) {
-	out, err := utils.RunCommand("sgdisk", "-v", device)
+func (d *Disk) verifyDevice(ctx context.Context, device string) (string, error) {
+	out, err := d.runner.Run(ctx, "sgdisk", "-v", device)
 	if err != nil {
 		return out, err
 	}
 	return out, err
 }
 
-func retry(attemps int, sleep time.Duration, f func() error) error {
+// retry gives up once ctx is done.
+func retry(ctx context.Context, attemps int, sleep time.Duration, f func() error) error {
 	if err := f(); err != nil {
 		if attemps--; attemps > 0 {
 			jitter := time.Duration(rand.Int63n(int64(sleep)))
 			sleep = sleep + jitter/2
-			time.Sleep(sleep)
-			return retry(attemps, 2*sleep, f)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(sleep):
+			}
+			return retry(ctx, attemps, 2*sleep, f)
 		}
 		return err
 	}
 	return nil
 }
 
-func GetDiskUUID(device string) (string, error) {
-	out, err := utils.RunCommand("hexdump", "-s", "440", "-n", "4", "-e", "\"0x%08x\"", device)
+func (d *Disk) GetDiskUUID(ctx context.Context, device string) (string, error) {
+	out, err := d.runner.Run(ctx, "hexdump", "-s", "440", "-n", "4", "-e", "\"0x%08x\"", device)
 	if err != nil {
 		return "", fmt.Errorf("hexdump: %v", err)
 	}
@@ -0,0 +1,163 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"diskimage-installer/pkg/utils"
+)
+
+func TestGetPartitionTableType(t *testing.T) {
+	tests := []struct {
+		blkid string
+		want  PartitionType
+	}{
+		{`/dev/sda: PTUUID="0c7d0b4f-6a4e-4f0e-9d36-3a1b2f0c9e11" PTTYPE="gpt"`, GPT},
+		{`/dev/sda: PTUUID="5c2b7a1e" PTTYPE="dos"`, MBR},
+		{``, NoPartition},
+	}
+	for _, tt := range tests {
+		runner := utils.NewFakeRunner().On("blkid /dev/sda --probe", tt.blkid, nil)
+		got, err := New(runner).GetPartitionTableType(context.Background(), "/dev/sda")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("blkid %q: got %s, want %s", tt.blkid, got, tt.want)
+		}
+		want := []string{"partprobe /dev/sda", "blkid /dev/sda --probe"}
+		if calls := runner.Calls(); !reflect.DeepEqual(calls, want) {
+			t.Errorf("calls = %v, want %v", calls, want)
+		}
+	}
+}
+
+func TestFixGPTPartition(t *testing.T) {
+	misplaced := "Problem: The secondary header's self-pointer indicates that it doesn't reside\nat the end of the disk. If you've added a disk to a RAID array, use the 'e' option"
+	tests := []struct {
+		name   string
+		pttype string
+		verify string
+		want   []string
+	}{
+		{
+			name:   "backup header at end",
+			pttype: "gpt",
+			verify: "No problems found. 2014 free sectors (1007.0 KiB) available in 1\nsegments, the largest of which is 2014 (1007.0 KiB) in size.",
+			want:   []string{"partprobe /dev/sda", "blkid /dev/sda --probe", "sgdisk -v /dev/sda"},
+		},
+		{
+			name:   "backup header misplaced",
+			pttype: "gpt",
+			verify: misplaced,
+			want:   []string{"partprobe /dev/sda", "blkid /dev/sda --probe", "sgdisk -v /dev/sda", "sgdisk -e /dev/sda"},
+		},
+		{
+			name:   "mbr",
+			pttype: "dos",
+			want:   []string{"partprobe /dev/sda", "blkid /dev/sda --probe"},
+		},
+	}
+	for _, tt := range tests {
+		runner := utils.NewFakeRunner().
+			On("blkid /dev/sda --probe", `/dev/sda: PTTYPE="`+tt.pttype+`"`, nil).
+			On("sgdisk -v /dev/sda", tt.verify, nil)
+		if err := New(runner).FixGTPPartition(context.Background(), "/dev/sda"); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if calls := runner.Calls(); !reflect.DeepEqual(calls, tt.want) {
+			t.Errorf("%s: calls = %v, want %v", tt.name, calls, tt.want)
+		}
+	}
+}
+
+func TestCreateMBRPartitionForConfigDrive(t *testing.T) {
+	tests := []struct {
+		name string
+		size string
+		want string
+	}{
+		{"100G", "107374182400\n", "parted -a optimal -s -- /dev/sda mkpart primary fat32 -64MiB -0"},
+		// partitions of MBR can't go beyond 2TiB
+		{"4T", "4398046511104\n", "parted -a optimal -s -- /dev/sda mkpart primary fat32 2097087 2097151"},
+	}
+	for _, tt := range tests {
+		runner := utils.NewFakeRunner().On("blockdev --getsize64 /dev/sda", tt.size, nil)
+		if err := New(runner).CreateMBRPartitionForConfigDrive(context.Background(), "/dev/sda"); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := []string{
+			"blockdev --getsize64 /dev/sda",
+			tt.want,
+			"sync",
+			"udevadm settle",
+			"partprobe /dev/sda",
+			"sgdisk -v /dev/sda",
+		}
+		if calls := runner.Calls(); !reflect.DeepEqual(calls, want) {
+			t.Errorf("%s: calls = %v, want %v", tt.name, calls, want)
+		}
+	}
+}
+
+func TestCreateGPTPartition(t *testing.T) {
+	runner := utils.NewFakeRunner()
+	if err := New(runner).CreateGPTPartion(context.Background(), "/dev/nvme0n1", "0:-64MB:0"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"sgdisk -n 0:-64MB:0 /dev/nvme0n1"}
+	if calls := runner.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+}
+
+func TestListPartitionEntries(t *testing.T) {
+	out := `    1    2048 1050623
+    2 1050624 4194270
+`
+	runner := utils.NewFakeRunner().On("partx -g -o NR,START,END /dev/sda", out, nil)
+	got, err := New(runner).ListPartitionEntries(context.Background(), "/dev/sda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PartitionEntry{{Number: 1, Start: 2048, End: 1050623}, {Number: 2, Start: 1050624, End: 4194270}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	runner.On("partx -g -o NR,START,END /dev/sda", "    1    2048 end\n", nil)
+	if _, err := New(runner).ListPartitionEntries(context.Background(), "/dev/sda"); err == nil {
+		t.Errorf("malformed output is parsed")
+	}
+}
+
+func TestPartitionDevice(t *testing.T) {
+	tests := map[string]string{
+		"/dev/sda":     "/dev/sda3",
+		"/dev/vdb":     "/dev/vdb3",
+		"/dev/nvme0n1": "/dev/nvme0n1p3",
+		"/dev/loop0":   "/dev/loop0p3",
+		"/dev/md127":   "/dev/md127p3",
+	}
+	for device, want := range tests {
+		if got := PartitionDevice(device, 3); got != want {
+			t.Errorf("PartitionDevice(%s, 3) = %s, want %s", device, got, want)
+		}
+	}
+}
+
+func TestPartProbeCanceled(t *testing.T) {
+	runner := utils.NewFakeRunner().On("partprobe /dev/sda", "Error: Partition(s) 1 on /dev/sda have been written, but we have been unable to inform the kernel", errors.New("exit status 1"))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := New(runner).RescanDevice(ctx, "/dev/sda"); err != context.Canceled {
+		t.Errorf("RescanDevice = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("canceled retry of partprobe took %v", elapsed)
+	}
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// FakeRunner records commands instead of running them, outputs of commands
+// are scripted by On.
+type FakeRunner struct {
+	mu        sync.Mutex
+	calls     []string
+	responses []fakeResponse
+	// Missing are commands LookPath doesn't find.
+	Missing []string
+}
+
+type fakeResponse struct {
+	prefix string
+	output string
+	err    error
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{}
+}
+
+// On scripts output and error of commands whose command line starts with
+// prefix, e.g. "blkid /dev/sda". The longest matching prefix wins, commands
+// matching no prefix succeed with empty output.
+func (f *FakeRunner) On(prefix, output string, err error) *FakeRunner {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.responses = append(f.responses, fakeResponse{prefix: prefix, output: output, err: err})
+	return f
+}
+
+func (f *FakeRunner) Run(ctx context.Context, command string, args ...string) (string, error) {
+	line := strings.Join(append([]string{command}, args...), " ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, line)
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	match := fakeResponse{}
+	for _, r := range f.responses {
+		if strings.HasPrefix(line, r.prefix) && len(r.prefix) >= len(match.prefix) {
+			match = r
+		}
+	}
+	return match.output, match.err
+}
+
+func (f *FakeRunner) LookPath(command string) (string, error) {
+	for _, m := range f.Missing {
+		if m == command {
+			return "", fmt.Errorf("exec: %q: executable file not found in $PATH", command)
+		}
+	}
+	return "/usr/bin/" + command, nil
+}
+
+// Calls returns command lines run so far, in order.
+func (f *FakeRunner) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+// Reset forgets commands run so far, scripted outputs are kept.
+func (f *FakeRunner) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
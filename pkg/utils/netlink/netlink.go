@@ -0,0 +1,435 @@
+// Package netlink configures links, addresses and routes with rtnetlink
+// directly, it covers only what installer needs so that no iproute2 is
+// required in ramdisk.
+package netlink
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	iflaInfoKind = 1
+	iflaInfoData = 2
+	iflaBondMode = 1
+	iflaVlanID   = 1
+	nlaFNested   = 0x8000
+
+	// IFLA_PERM_ADDRESS is missing in syscall, it is reported since linux 5.6
+	iflaPermAddress = 54
+	iflaOperState   = 16
+)
+
+var sequence uint32
+
+type request struct {
+	header syscall.NlMsghdr
+	body   []byte
+	attrs  []byte
+}
+
+func newRequest(typ uint16, flags int, body []byte) *request {
+	return &request{
+		header: syscall.NlMsghdr{
+			Type:  typ,
+			Flags: uint16(syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags),
+			Seq:   atomic.AddUint32(&sequence, 1),
+		},
+		body: body,
+	}
+}
+
+func (r *request) addAttr(typ uint16, data []byte) {
+	r.attrs = appendAttr(r.attrs, typ, data)
+}
+
+func (r *request) serialize() []byte {
+	length := syscall.SizeofNlMsghdr + len(r.body) + len(r.attrs)
+	r.header.Len = uint32(length)
+	b := make([]byte, 0, length)
+	b = append(b, (*[syscall.SizeofNlMsghdr]byte)(unsafe.Pointer(&r.header))[:]...)
+	b = append(b, r.body...)
+	return append(b, r.attrs...)
+}
+
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	attr := syscall.RtAttr{
+		Len:  uint16(syscall.SizeofRtAttr + len(data)),
+		Type: typ,
+	}
+	b = append(b, (*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&attr))[:]...)
+	b = append(b, data...)
+	for len(b)%syscall.NLMSG_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// execute sends request to kernel and waits for its acknowledgement.
+func (r *request) execute() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink bind: %v", err)
+	}
+	if err := syscall.Sendto(fd, r.serialize(), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return fmt.Errorf("netlink send: %v", err)
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("netlink receive: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("netlink parse: %v", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != r.header.Seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return fmt.Errorf("netlink: short error message")
+				}
+				if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				return nil
+			case syscall.NLMSG_DONE:
+				return nil
+			}
+		}
+	}
+}
+
+// dump sends a dump request to kernel and returns every message received
+// until NLMSG_DONE.
+func (r *request) dump() ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink bind: %v", err)
+	}
+	if err := syscall.Sendto(fd, r.serialize(), 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink send: %v", err)
+	}
+
+	result := []syscall.NetlinkMessage{}
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, fmt.Errorf("netlink parse: %v", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != r.header.Seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return result, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+						return nil, syscall.Errno(-errno)
+					}
+				}
+				return result, nil
+			}
+			// buf is reused by next receive
+			m.Data = append([]byte{}, m.Data...)
+			result = append(result, m)
+		}
+	}
+}
+
+func ifInfomsg(index int, flags, change uint32) []byte {
+	msg := syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(index),
+		Flags:  flags,
+		Change: change,
+	}
+	return append([]byte{}, (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]...)
+}
+
+func uint32Attr(v uint32) []byte {
+	return append([]byte{}, (*[4]byte)(unsafe.Pointer(&v))[:]...)
+}
+
+func uint16Attr(v uint16) []byte {
+	return append([]byte{}, (*[2]byte)(unsafe.Pointer(&v))[:]...)
+}
+
+func stringAttr(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func linkIndex(name string) (int, error) {
+	i, err := net.InterfaceByName(name)
+	if err != nil {
+		return 0, err
+	}
+	return i.Index, nil
+}
+
+// Link is a network interface as reported by kernel.
+type Link struct {
+	Index int
+	Name  string
+	// Flags are IFF_* flags of link.
+	Flags        uint32
+	HardwareAddr net.HardwareAddr
+	// PermHardwareAddr is the permanent mac address burnt in device, it is
+	// nil for virtual links and before linux 5.6.
+	PermHardwareAddr net.HardwareAddr
+	// OperState is IF_OPER_* state of link.
+	OperState uint8
+}
+
+// LinkList returns every link of current network namespace.
+func LinkList() ([]Link, error) {
+	req := newRequest(syscall.RTM_GETLINK, syscall.NLM_F_DUMP, ifInfomsg(0, 0, 0))
+	req.header.Flags &^= syscall.NLM_F_ACK
+	msgs, err := req.dump()
+	if err != nil {
+		return nil, fmt.Errorf("list links: %w", err)
+	}
+	links := []Link{}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWLINK || len(m.Data) < syscall.SizeofIfInfomsg {
+			continue
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+		attrs := parseAttrs(m.Data[syscall.SizeofIfInfomsg:])
+		link := Link{
+			Index: int(info.Index),
+			Flags: info.Flags,
+		}
+		for _, a := range attrs {
+			switch a.Attr.Type &^ nlaFNested {
+			case syscall.IFLA_IFNAME:
+				link.Name = strings.TrimRight(string(a.Value), "\x00")
+			case syscall.IFLA_ADDRESS:
+				link.HardwareAddr = net.HardwareAddr(append([]byte{}, a.Value...))
+			case iflaPermAddress:
+				link.PermHardwareAddr = net.HardwareAddr(append([]byte{}, a.Value...))
+			case iflaOperState:
+				if len(a.Value) > 0 {
+					link.OperState = a.Value[0]
+				}
+			}
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// parseAttrs parses route attributes of b, a truncated attribute ends
+// parsing.
+func parseAttrs(b []byte) []syscall.NetlinkRouteAttr {
+	attrs := []syscall.NetlinkRouteAttr{}
+	for len(b) >= syscall.SizeofRtAttr {
+		a := *(*syscall.RtAttr)(unsafe.Pointer(&b[0]))
+		if int(a.Len) < syscall.SizeofRtAttr || int(a.Len) > len(b) {
+			break
+		}
+		attrs = append(attrs, syscall.NetlinkRouteAttr{Attr: a, Value: b[syscall.SizeofRtAttr:a.Len]})
+		aligned := (int(a.Len) + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+		if aligned >= len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs
+}
+
+// LinkSetUp brings link up.
+func LinkSetUp(name string) error {
+	return linkSetFlags(name, syscall.IFF_UP)
+}
+
+// LinkSetDown brings link down.
+func LinkSetDown(name string) error {
+	return linkSetFlags(name, 0)
+}
+
+func linkSetFlags(name string, flags uint32) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	req := newRequest(syscall.RTM_NEWLINK, 0, ifInfomsg(index, flags, syscall.IFF_UP))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("set link %s flags %#x: %w", name, flags, err)
+	}
+	return nil
+}
+
+// LinkIsUp reports whether link is administratively up.
+func LinkIsUp(name string) (bool, error) {
+	i, err := net.InterfaceByName(name)
+	if err != nil {
+		return false, err
+	}
+	return i.Flags&net.FlagUp != 0, nil
+}
+
+// LinkSetMaster enslaves link to master, link is released when master is
+// empty.
+func LinkSetMaster(name, master string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	masterIndex := 0
+	if master != "" {
+		if masterIndex, err = linkIndex(master); err != nil {
+			return err
+		}
+	}
+	req := newRequest(syscall.RTM_NEWLINK, 0, ifInfomsg(index, 0, 0))
+	req.addAttr(syscall.IFLA_MASTER, uint32Attr(uint32(masterIndex)))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("set master of %s to %q: %w", name, master, err)
+	}
+	return nil
+}
+
+// AddBond creates bond link, mode is the number of bonding mode.
+func AddBond(name string, mode uint8) error {
+	data := appendAttr(nil, iflaBondMode, []byte{mode})
+	return addLink(name, "bond", 0, data)
+}
+
+// AddVlan creates vlan link with id on top of parent.
+func AddVlan(name, parent string, id uint16) error {
+	parentIndex, err := linkIndex(parent)
+	if err != nil {
+		return err
+	}
+	data := appendAttr(nil, iflaVlanID, uint16Attr(id))
+	return addLink(name, "vlan", parentIndex, data)
+}
+
+func addLink(name, kind string, parentIndex int, data []byte) error {
+	req := newRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifInfomsg(0, 0, 0))
+	req.addAttr(syscall.IFLA_IFNAME, stringAttr(name))
+	if parentIndex > 0 {
+		req.addAttr(syscall.IFLA_LINK, uint32Attr(uint32(parentIndex)))
+	}
+	info := appendAttr(nil, iflaInfoKind, []byte(kind))
+	info = appendAttr(info, iflaInfoData|nlaFNested, data)
+	req.addAttr(syscall.IFLA_LINKINFO|nlaFNested, info)
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("add %s link %s: %w", kind, name, err)
+	}
+	return nil
+}
+
+// LinkDel deletes link.
+func LinkDel(name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	req := newRequest(syscall.RTM_DELLINK, 0, ifInfomsg(index, 0, 0))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("delete link %s: %w", name, err)
+	}
+	return nil
+}
+
+// AddrAdd adds address to link.
+func AddrAdd(name string, addr *net.IPNet) error {
+	return addrModify(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, name, addr)
+}
+
+// AddrDel removes address from link.
+func AddrDel(name string, addr *net.IPNet) error {
+	return addrModify(syscall.RTM_DELADDR, 0, name, addr)
+}
+
+func addrModify(typ uint16, flags int, name string, addr *net.IPNet) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	family, ip := ipFamily(addr.IP)
+	prefix, _ := addr.Mask.Size()
+	msg := syscall.IfAddrmsg{
+		Family:    family,
+		Prefixlen: uint8(prefix),
+		Index:     uint32(index),
+	}
+	req := newRequest(typ, flags, append([]byte{}, (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:]...))
+	req.addAttr(syscall.IFA_LOCAL, ip)
+	req.addAttr(syscall.IFA_ADDRESS, ip)
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("modify address %s of %s: %w", addr, name, err)
+	}
+	return nil
+}
+
+// RouteAdd adds route to dst via gateway on link.
+func RouteAdd(dst *net.IPNet, gateway net.IP, name string) error {
+	return routeModify(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, dst, gateway, name)
+}
+
+// RouteDel deletes route to dst via gateway on link.
+func RouteDel(dst *net.IPNet, gateway net.IP, name string) error {
+	return routeModify(syscall.RTM_DELROUTE, 0, dst, gateway, name)
+}
+
+func routeModify(typ uint16, flags int, dst *net.IPNet, gateway net.IP, name string) error {
+	index, err := linkIndex(name)
+	if err != nil {
+		return err
+	}
+	family, ip := ipFamily(dst.IP)
+	prefix, _ := dst.Mask.Size()
+	msg := syscall.RtMsg{
+		Family:   family,
+		Dst_len:  uint8(prefix),
+		Table:    syscall.RT_TABLE_MAIN,
+		Protocol: syscall.RTPROT_BOOT,
+		Scope:    syscall.RT_SCOPE_UNIVERSE,
+		Type:     syscall.RTN_UNICAST,
+	}
+	req := newRequest(typ, flags, append([]byte{}, (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:]...))
+	req.addAttr(syscall.RTA_DST, ip)
+	if gateway != nil {
+		_, gw := ipFamily(gateway)
+		req.addAttr(syscall.RTA_GATEWAY, gw)
+	}
+	req.addAttr(syscall.RTA_OIF, uint32Attr(uint32(index)))
+	if err := req.execute(); err != nil {
+		return fmt.Errorf("modify route %s via %s dev %s: %w", dst, gateway, name, err)
+	}
+	return nil
+}
+
+func ipFamily(ip net.IP) (uint8, []byte) {
+	if v4 := ip.To4(); v4 != nil {
+		return syscall.AF_INET, v4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
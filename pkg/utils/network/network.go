@@ -1,86 +1,239 @@
 package network
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
-	"syscall"
+
+	"diskimage-installer/pkg/utils"
 )
 
-func GetBIOSDevName(adapter string) (string, error) {
-	out := bytes.Buffer{}
-	cmd := exec.Command("biosdevname", "-i", adapter)
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			ws := exitError.Sys().(syscall.WaitStatus)
-			code := ws.ExitStatus()
-			switch code {
-			case 127:
-				return "", fmt.Errorf("executable 'biosdevname' not found")
-			case 2:
-				return "", fmt.Errorf("system BIOS does not provide naming information")
-			case 4:
-				return "", fmt.Errorf("the system is a virtual machine")
-			}
-		}
+// DefaultSysfsRoot is where sysfs is mounted on a live system.
+const DefaultSysfsRoot = "/sys"
+
+// Sysfs reads attributes of network interfaces under Root, which is
+// DefaultSysfsRoot on a live system and a fixture tree in tests.
+type Sysfs struct {
+	Root string
+}
+
+var defaultSysfs = Sysfs{Root: DefaultSysfsRoot}
+
+var pciAddressPattern = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`)
+
+func (s Sysfs) netPath(adapter string, elem ...string) string {
+	return filepath.Join(append([]string{s.Root, "class", "net", adapter}, elem...)...)
+}
+
+// Interfaces returns names of every interface under class/net.
+func (s Sysfs) Interfaces() ([]string, error) {
+	dir := filepath.Join(s.Root, "class", "net")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", dir, err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
 	}
-	return out.String(), nil
+	return names, nil
 }
 
-func HasCarrier(adapter string) (bool, error) {
-	data, err := getInterfaceInfo(adapter, "carrier")
+// IsDevice reports whether adapter is backed by a device, i.e. it is not a
+// virtual interface like bond, vlan or loopback.
+func (s Sysfs) IsDevice(adapter string) bool {
+	if _, err := os.Stat(s.netPath(adapter, "device") + "/"); err != nil {
+		return false
+	}
+	return true
+}
+
+func (s Sysfs) MACAddress(adapter string) (string, error) {
+	return s.readAttr(adapter, "address")
+}
+
+// PermanentMACAddress returns permanent mac address of a bond slave, which
+// is replaced by mac address of bond on its address attribute.
+func (s Sysfs) PermanentMACAddress(adapter string) (string, error) {
+	return s.readAttr(adapter, "bonding_slave", "perm_hwaddr")
+}
+
+// HasCarrier reports whether adapter has carrier, an interface which is
+// administratively down has no carrier.
+func (s Sysfs) HasCarrier(adapter string) (bool, error) {
+	data, err := s.readAttr(adapter, "carrier")
 	if err != nil {
+		if s.exists(adapter, "carrier") {
+			// reading carrier of a down link fails with EINVAL
+			return false, nil
+		}
 		return false, err
 	}
 	hascarrier, err := strconv.Atoi(data)
 	if err != nil {
 		return false, err
 	}
-	if hascarrier == 1 {
-		log.Printf("adapter %s has carrier", adapter)
-		return true, nil
-	}
-	return false, nil
+	return hascarrier == 1, nil
 }
 
-func GetMacAddr(adapter string) (string, error) {
-	data, err := getInterfaceInfo(adapter, "address")
+// OperState returns RFC 2863 operational state of adapter, e.g. up, down or
+// lowerlayerdown.
+func (s Sysfs) OperState(adapter string) (string, error) {
+	return s.readAttr(adapter, "operstate")
+}
+
+// Speed returns speed of adapter in Mb/s, -1 is returned without error when
+// speed is unknown, which is the case of links without carrier.
+func (s Sysfs) Speed(adapter string) (int, error) {
+	data, err := s.readAttr(adapter, "speed")
 	if err != nil {
-		return "", err
+		if s.exists(adapter, "speed") {
+			return -1, nil
+		}
+		return -1, err
 	}
-	return string(data), nil
+	speed, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("strconv.ParseInt %s: %v", data, err)
+	}
+	// SPEED_UNKNOWN is -1, some drivers report it as unsigned
+	if speed <= 0 || speed >= 1<<31-1 {
+		return -1, nil
+	}
+	return int(speed), nil
 }
 
-func GetSpeed(adapter string) (int, error) {
-	data, err := getInterfaceInfo(adapter, "speed")
+// Duplex returns full, half or unknown.
+func (s Sysfs) Duplex(adapter string) string {
+	data, err := s.readAttr(adapter, "duplex")
+	if err != nil || data == "" {
+		return "unknown"
+	}
+	return data
+}
+
+// PCIAddress returns PCI address of adapter, e.g. 0000:3b:00.0, device of
+// virtio adapters is a child of the PCI device.
+func (s Sysfs) PCIAddress(adapter string) (string, error) {
+	f := s.netPath(adapter, "device")
+	target, err := filepath.EvalSymlinks(f)
 	if err != nil {
-		return -1, err
+		return "", fmt.Errorf("readlink %s: %v", f, err)
 	}
-	speed, err := strconv.Atoi(string(data))
+	for dir := target; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if pciAddressPattern.MatchString(filepath.Base(dir)) {
+			return filepath.Base(dir), nil
+		}
+	}
+	return filepath.Base(target), nil
+}
+
+// Driver returns kernel driver name of adapter, e.g. ixgbe
+func (s Sysfs) Driver(adapter string) (string, error) {
+	return s.readlinkBase(s.netPath(adapter, "device", "driver"))
+}
+
+// VendorID returns PCI vendor id of adapter, e.g. 0x8086
+func (s Sysfs) VendorID(adapter string) (string, error) {
+	return s.readAttr(adapter, "device", "vendor")
+}
+
+// DeviceID returns PCI device id of adapter, e.g. 0x1572
+func (s Sysfs) DeviceID(adapter string) (string, error) {
+	return s.readAttr(adapter, "device", "device")
+}
+
+// SRIOV returns the number of virtual functions adapter supports and has
+// enabled, both are 0 for an adapter without SR-IOV.
+func (s Sysfs) SRIOV(adapter string) (total int, enabled int) {
+	if data, err := s.readAttr(adapter, "device", "sriov_totalvfs"); err == nil {
+		total, _ = strconv.Atoi(data)
+	}
+	if data, err := s.readAttr(adapter, "device", "sriov_numvfs"); err == nil {
+		enabled, _ = strconv.Atoi(data)
+	}
+	return total, enabled
+}
+
+// BIOSDevName returns the name biosdevname gives adapter, e.g. em1 or
+// p1p2, from SMBIOS and PCI IRQ routing information of system BIOS.
+func BIOSDevName(ctx context.Context, runner utils.Runner, adapter string) (string, error) {
+	if _, err := runner.LookPath("biosdevname"); err != nil {
+		return "", fmt.Errorf("executable 'biosdevname' not found")
+	}
+	out, err := runner.Run(ctx, "biosdevname", "-i", adapter)
 	if err != nil {
-		return -1, fmt.Errorf("strconv.Atoi %s: %v", string(data), err)
+		if exitError, ok := err.(interface{ ExitCode() int }); ok {
+			switch exitError.ExitCode() {
+			case 2:
+				return "", fmt.Errorf("system BIOS does not provide naming information")
+			case 4:
+				return "", fmt.Errorf("the system is a virtual machine")
+			}
+		}
+		return "", fmt.Errorf("biosdevname -i %s: %v: %s", adapter, err, strings.TrimSpace(out))
 	}
-	return speed, nil
+	return strings.TrimSpace(out), nil
 }
 
-func getInterfaceInfo(adapter, attr string) (string, error) {
-	f := fmt.Sprintf("/sys/class/net/%s/%s", adapter, attr)
+func (s Sysfs) readAttr(adapter string, elem ...string) (string, error) {
+	f := s.netPath(adapter, elem...)
 	data, err := ioutil.ReadFile(f)
 	if err != nil {
 		return "", fmt.Errorf("read %s: %v", f, err)
 	}
-	return strings.TrimSuffix(string(data), "\n"), nil
+	return strings.TrimSpace(string(data)), nil
 }
 
-func IsDevice(adaper string) bool {
-	if _, err := os.Stat(fmt.Sprintf("/sys/class/net/%s/device/", adaper)); os.IsNotExist(err) {
-		return false
+func (s Sysfs) exists(adapter string, elem ...string) bool {
+	_, err := os.Stat(s.netPath(adapter, elem...))
+	return err == nil
+}
+
+func (s Sysfs) readlinkBase(f string) (string, error) {
+	target, err := os.Readlink(f)
+	if err != nil {
+		return "", fmt.Errorf("readlink %s: %v", f, err)
 	}
-	return true
+	return filepath.Base(target), nil
+}
+
+func GetBIOSDevName(adapter string) (string, error) {
+	return BIOSDevName(context.Background(), utils.ExecRunner{}, adapter)
+}
+
+func HasCarrier(adapter string) (bool, error) {
+	hascarrier, err := defaultSysfs.HasCarrier(adapter)
+	if hascarrier {
+		log.Printf("adapter %s has carrier", adapter)
+	}
+	return hascarrier, err
+}
+
+func GetMacAddr(adapter string) (string, error) {
+	return defaultSysfs.MACAddress(adapter)
+}
+
+func GetSpeed(adapter string) (int, error) {
+	return defaultSysfs.Speed(adapter)
+}
+
+// GetPCIAddress returns PCI address of adapter, e.g. 0000:3b:00.0
+func GetPCIAddress(adapter string) (string, error) {
+	return defaultSysfs.PCIAddress(adapter)
+}
+
+// GetDriver returns kernel driver name of adapter, e.g. ixgbe
+func GetDriver(adapter string) (string, error) {
+	return defaultSysfs.Driver(adapter)
+}
+
+func IsDevice(adaper string) bool {
+	return defaultSysfs.IsDevice(adaper)
 }
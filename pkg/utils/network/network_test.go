@@ -0,0 +1,159 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"diskimage-installer/pkg/utils"
+)
+
+// exitError is an error of a command exiting with code, like
+// *exec.ExitError.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+
+func (e exitError) ExitCode() int { return int(e) }
+
+func TestBIOSDevName(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		err     error
+		missing bool
+		want    string
+		wantErr string
+	}{
+		{name: "embedded", output: "em1\n", want: "em1"},
+		{name: "slot", output: "p3p2\n", want: "p3p2"},
+		{name: "no naming information", err: exitError(2), wantErr: "system BIOS does not provide naming information"},
+		{name: "virtual machine", err: exitError(4), wantErr: "the system is a virtual machine"},
+		{name: "unknown device", output: "Unknown device\n", err: exitError(1), wantErr: "Unknown device"},
+		{name: "not installed", missing: true, wantErr: "executable 'biosdevname' not found"},
+	}
+	for _, tt := range tests {
+		runner := utils.NewFakeRunner().On("biosdevname -i eno1", tt.output, tt.err)
+		if tt.missing {
+			runner.Missing = []string{"biosdevname"}
+		}
+		got, err := BIOSDevName(context.Background(), runner, "eno1")
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: BIOSDevName = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestBIOSDevNameCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := BIOSDevName(ctx, utils.NewFakeRunner(), "eno1"); !strings.Contains(fmt.Sprint(err), context.Canceled.Error()) {
+		t.Errorf("err = %v, want context canceled", err)
+	}
+}
+
+// newSysfs returns a sysfs tree holding files, symlinks are given as
+// "-> target" relative to the root.
+func newSysfs(t *testing.T, files map[string]string) Sysfs {
+	t.Helper()
+	root := t.TempDir()
+	names := []string{}
+	for name, content := range files {
+		// symlinks of devices go first as files live under them
+		if strings.HasPrefix(content, "-> ") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for name, content := range files {
+		if !strings.HasPrefix(content, "-> ") {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		content := files[name]
+		f := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(content, "-> ") {
+			target := filepath.Join(root, strings.TrimPrefix(content, "-> "))
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(target, f); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(f, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Sysfs{Root: root}
+}
+
+func TestSysfs(t *testing.T) {
+	s := newSysfs(t, map[string]string{
+		"class/net/eno1/device":                    "-> devices/pci0000:00/0000:3b:00.0",
+		"class/net/eno1/address":                   "aa:00:00:00:00:01\n",
+		"class/net/eno1/bonding_slave/perm_hwaddr": "aa:00:00:00:00:02\n",
+		"class/net/eno1/speed":                     "4294967295\n",
+		"class/net/eno1/duplex":                    "\n",
+		"class/net/eno1/device/sriov_totalvfs":     "64\n",
+		"class/net/eno1/device/sriov_numvfs":       "8\n",
+		"class/net/eno1/device/driver":             "-> bus/pci/drivers/i40e",
+		"class/net/ens3/device":                    "-> devices/pci0000:00/0000:00:03.0/virtio0",
+		"class/net/ens3/speed":                     "1000\n",
+		"class/net/bond0/address":                  "aa:00:00:00:00:01\n",
+	})
+
+	names, err := s.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, " ") != "bond0 eno1 ens3" {
+		t.Errorf("Interfaces() = %v", names)
+	}
+	for name, want := range map[string]bool{"eno1": true, "ens3": true, "bond0": false} {
+		if got := s.IsDevice(name); got != want {
+			t.Errorf("IsDevice(%s) = %v, want %v", name, got, want)
+		}
+	}
+	if mac, err := s.PermanentMACAddress("eno1"); err != nil || mac != "aa:00:00:00:00:02" {
+		t.Errorf("PermanentMACAddress(eno1) = %q, %v", mac, err)
+	}
+	for name, want := range map[string]int{"eno1": -1, "ens3": 1000} {
+		if got, err := s.Speed(name); err != nil || got != want {
+			t.Errorf("Speed(%s) = %d, %v, want %d", name, got, err, want)
+		}
+	}
+	if got := s.Duplex("eno1"); got != "unknown" {
+		t.Errorf("Duplex(eno1) = %q, want unknown", got)
+	}
+	for name, want := range map[string]string{"eno1": "0000:3b:00.0", "ens3": "0000:00:03.0"} {
+		if got, err := s.PCIAddress(name); err != nil || got != want {
+			t.Errorf("PCIAddress(%s) = %q, %v, want %s", name, got, err, want)
+		}
+	}
+	if got, err := s.Driver("eno1"); err != nil || got != "i40e" {
+		t.Errorf("Driver(eno1) = %q, %v, want i40e", got, err)
+	}
+	if total, enabled := s.SRIOV("eno1"); total != 64 || enabled != 8 {
+		t.Errorf("SRIOV(eno1) = %d, %d, want 64, 8", total, enabled)
+	}
+	if total, enabled := s.SRIOV("ens3"); total != 0 || enabled != 0 {
+		t.Errorf("SRIOV(ens3) = %d, %d, want 0, 0", total, enabled)
+	}
+}
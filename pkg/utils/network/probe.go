@@ -0,0 +1,239 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"diskimage-installer/pkg/utils/netlink"
+)
+
+const (
+	arpRequest = 1
+	arpReply   = 2
+
+	EthPLLDP = 0x88cc
+
+	// recvPollInterval bounds each wait for a reply so that cancellation is
+	// noticed while waiting.
+	recvPollInterval = 200 * time.Millisecond
+)
+
+var errRecvTimeout = errors.New("receive timeout")
+
+var lldpMulticast = []byte{0x01, 0x80, 0xc2, 0x00, 0x00, 0x0e}
+
+// packetMreq is struct packet_mreq of linux/if_packet.h
+type packetMreq struct {
+	Ifindex int32
+	Type    uint16
+	Alen    uint16
+	Address [8]byte
+}
+
+// ARPProbe sends ARP request for target with source address on adapter and
+// returns mac address of the reply.
+func ARPProbe(ctx context.Context, adapter string, source, target net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	iface, err := net.InterfaceByName(adapter)
+	if err != nil {
+		return nil, err
+	}
+	source, target = source.To4(), target.To4()
+	if source == nil || target == nil {
+		return nil, fmt.Errorf("arp probe needs ipv4 addresses")
+	}
+	proto := htons(syscall.ETH_P_ARP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, fmt.Errorf("packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index}); err != nil {
+		return nil, fmt.Errorf("bind %s: %v", adapter, err)
+	}
+
+	packet := make([]byte, 28)
+	binary.BigEndian.PutUint16(packet[0:], 1) // ethernet
+	binary.BigEndian.PutUint16(packet[2:], syscall.ETH_P_IP)
+	packet[4], packet[5] = 6, 4
+	binary.BigEndian.PutUint16(packet[6:], arpRequest)
+	copy(packet[8:14], iface.HardwareAddr)
+	copy(packet[14:18], source)
+	copy(packet[24:28], target)
+	broadcast := &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index, Halen: 6}
+	copy(broadcast.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err := syscall.Sendto(fd, packet, 0, broadcast); err != nil {
+		return nil, fmt.Errorf("send arp request on %s: %v", adapter, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		n, err := recvfrom(ctx, fd, buf, deadline)
+		if err == errRecvTimeout {
+			return nil, fmt.Errorf("no arp reply from %s on %s in %v", target, adapter, timeout)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("receive arp reply on %s: %v", adapter, err)
+		}
+		if n < 28 || binary.BigEndian.Uint16(buf[6:]) != arpReply || !bytes.Equal(buf[14:18], target) {
+			continue
+		}
+		return net.HardwareAddr(append([]byte{}, buf[8:14]...)), nil
+	}
+}
+
+// Ping sends ICMP echo request to target from source and waits for its reply.
+func Ping(ctx context.Context, source, target net.IP, timeout time.Duration) error {
+	conn, err := net.ListenPacket("ip4:icmp", source.String())
+	if err != nil {
+		return fmt.Errorf("listen icmp: %v", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// closing conn ends the read below once ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	id := uint16(os.Getpid() & 0xffff)
+	msg := make([]byte, 16)
+	msg[0] = 8 // echo request
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	copy(msg[8:], "diskimag")
+	binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: target}); err != nil {
+		return fmt.Errorf("send icmp echo to %s: %v", target, err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("no icmp echo reply from %s: %v", target, err)
+		}
+		addr, ok := from.(*net.IPAddr)
+		if !ok || !addr.IP.Equal(target) || n < 8 {
+			continue
+		}
+		// echo reply
+		if buf[0] == 0 && binary.BigEndian.Uint16(buf[4:]) == id {
+			return nil
+		}
+	}
+}
+
+// CaptureLLDPFrame returns the first LLDP frame received on adapter, adapter
+// is brought up while listening if it is down. It gives up once ctx is done.
+func CaptureLLDPFrame(ctx context.Context, adapter string, timeout time.Duration) ([]byte, error) {
+	iface, err := net.InterfaceByName(adapter)
+	if err != nil {
+		return nil, err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		if err := netlink.LinkSetUp(adapter); err != nil {
+			return nil, err
+		}
+		defer netlink.LinkSetDown(adapter)
+	}
+
+	proto := htons(EthPLLDP)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, fmt.Errorf("packet socket: %v", err)
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: iface.Index}); err != nil {
+		return nil, fmt.Errorf("bind %s: %v", adapter, err)
+	}
+	mreq := packetMreq{
+		Ifindex: int32(iface.Index),
+		Type:    syscall.PACKET_MR_MULTICAST,
+		Alen:    uint16(len(lldpMulticast)),
+	}
+	copy(mreq.Address[:], lldpMulticast)
+	if _, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_PACKET, syscall.PACKET_ADD_MEMBERSHIP,
+		uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0); errno != 0 {
+		return nil, fmt.Errorf("join lldp multicast on %s: %v", adapter, errno)
+	}
+
+	buf := make([]byte, 9216)
+	n, err := recvfrom(ctx, fd, buf, time.Now().Add(timeout))
+	if err == errRecvTimeout {
+		return nil, fmt.Errorf("no lldp frame in %v", timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, buf[:n]...), nil
+}
+
+// recvfrom receives a frame on fd, errRecvTimeout is returned once deadline
+// passes and ctx.Err() once ctx is done.
+func recvfrom(ctx context.Context, fd int, buf []byte, deadline time.Time) (int, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, errRecvTimeout
+		}
+		if wait > recvPollInterval {
+			wait = recvPollInterval
+		}
+		tv := syscall.NsecToTimeval(wait.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return 0, err
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			continue
+		}
+		return n, err
+	}
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// htons converts v to network byte order.
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return *(*uint16)(unsafe.Pointer(&b[0]))
+}
@@ -2,16 +2,41 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"os/exec"
 )
 
-func RunCommand(command string, args ...string) (string, error) {
+// Runner runs external commands, installer gets one injected so that the
+// commands it runs can be recorded and scripted by FakeRunner.
+type Runner interface {
+	// Run runs command and returns its combined stdout and stderr, command
+	// is killed once ctx is done.
+	Run(ctx context.Context, command string, args ...string) (string, error)
+	// LookPath reports path of command, it fails if command isn't installed.
+	LookPath(command string) (string, error)
+}
+
+// ExecRunner runs commands on host.
+type ExecRunner struct{}
+
+func (ExecRunner) Run(ctx context.Context, command string, args ...string) (string, error) {
 	var out bytes.Buffer
-	cmd := exec.Command(command, args...)
+	cmd := exec.CommandContext(ctx, command, args...)
 	cmd.Stdout = &out
 	cmd.Stderr = &out
 	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return out.String(), ctx.Err()
+		}
 		return out.String(), err
 	}
 	return out.String(), nil
 }
+
+func (ExecRunner) LookPath(command string) (string, error) {
+	return exec.LookPath(command)
+}
+
+func RunCommand(command string, args ...string) (string, error) {
+	return ExecRunner{}.Run(context.Background(), command, args...)
+}